@@ -50,8 +50,13 @@ type KubeDNSConfig struct {
 	ConfigDir    string
 	ConfigPeriod time.Duration
 
-	NameServers string
-	Profiling   bool
+	NameServers       string
+	Profiling         bool
+	CacheLockMetrics  bool
+	UseEndpointSlices bool
+	// NamespaceAllowlist is the list of the namespaces whose services are
+	// served. If empty, the services of all namespaces are served.
+	NamespaceAllowlist []string
 }
 
 func NewKubeDNSConfig() *KubeDNSConfig {
@@ -189,4 +194,10 @@ func (s *KubeDNSConfig) AddFlags(fs *pflag.FlagSet) {
 	fs.DurationVar(&s.ConfigPeriod, "config-period", s.ConfigPeriod,
 		"period at which to check for updates in config-dir.")
 	fs.BoolVar(&s.Profiling, "profiling", s.Profiling, "specifies whether to enable profiling")
+	fs.BoolVar(&s.CacheLockMetrics, "cache-lock-metrics", s.CacheLockMetrics,
+		"export the time spent waiting for the lock of the record cache. Requires metrics to be enabled.")
+	fs.BoolVar(&s.UseEndpointSlices, "use-endpoint-slices", s.UseEndpointSlices,
+		"watch the discovery.k8s.io/v1 EndpointSlices of the services instead of their Endpoints.")
+	fs.StringSliceVar(&s.NamespaceAllowlist, "namespace-allowlist", s.NamespaceAllowlist,
+		"comma-separated list of the namespaces whose services are served. If empty, the services of all namespaces are served.")
 }
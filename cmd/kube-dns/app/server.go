@@ -25,6 +25,8 @@ import (
 	"strings"
 	"syscall"
 
+	miekgdns "github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/skynetservices/skydns/metrics"
 	"github.com/skynetservices/skydns/server"
 	"github.com/spf13/pflag"
@@ -83,13 +85,27 @@ func NewKubeDNSServerDefault(config *options.KubeDNSConfig) *KubeDNSServer {
 		configSync = dnsconfig.NewNopSync(&conf)
 	}
 
+	var opts []dns.Option
+	if config.UseEndpointSlices {
+		opts = append(opts, dns.WithEndpointSlices())
+	}
+	if len(config.NamespaceAllowlist) > 0 {
+		opts = append(opts, dns.WithNamespaceAllowlist(config.NamespaceAllowlist...))
+	}
+	if metrics.Port != "" {
+		opts = append(opts, dns.WithMetricsRegistry(prometheus.DefaultRegisterer))
+		if config.CacheLockMetrics {
+			opts = append(opts, dns.WithCacheLockMetrics())
+		}
+	}
+
 	return &KubeDNSServer{
 		domain:         config.ClusterDomain,
 		healthzPort:    config.HealthzPort,
 		dnsBindAddress: config.DNSBindAddress,
 		dnsPort:        config.DNSPort,
 		nameServers:    config.NameServers,
-		kd:             dns.NewKubeDNS(kubeClient, config.ClusterDomain, config.InitialSyncTimeout, configSync),
+		kd:             dns.NewKubeDNS(kubeClient, config.ClusterDomain, config.InitialSyncTimeout, configSync, opts...),
 		profiling:      config.Profiling,
 	}
 }
@@ -128,7 +144,9 @@ func (server *KubeDNSServer) Run() {
 	})
 	setupSignalHandlers()
 	server.startSkyDNSServer()
-	server.kd.Start()
+	if err := server.kd.Start(); err != nil {
+		klog.Fatalf("Error starting kube-dns: %v", err)
+	}
 	server.setupHandlers()
 	if server.profiling {
 		go server.setupProfiling()
@@ -150,13 +168,21 @@ func (server *KubeDNSServer) setupProfiling() {
 func (server *KubeDNSServer) setupHandlers() {
 	klog.V(0).Infof("Setting up Healthz Handler (/readiness)")
 	http.HandleFunc("/readiness", func(w http.ResponseWriter, req *http.Request) {
+		if !server.kd.Ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "not ready\n")
+			return
+		}
 		fmt.Fprintf(w, "ok\n")
 	})
 
 	klog.V(0).Infof("Setting up cache handler (/cache)")
 	http.HandleFunc("/cache", func(w http.ResponseWriter, req *http.Request) {
-		serializedJSON, err := server.kd.GetCacheAsJSON()
-		if err == nil {
+		serializedJSON, err := server.kd.GetCacheAsJSONBestEffort()
+		if serializedJSON != "" {
+			if err != nil {
+				klog.Warningf("Partially dumped the cache: %v", err)
+			}
 			fmt.Fprint(w, serializedJSON)
 		} else {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -198,5 +224,23 @@ func (d *KubeDNSServer) startSkyDNSServer() {
 	}
 
 	d.kd.SkyDNSConfig = skydnsConfig
-	go s.Run()
+	d.kd.UpdateStubZones = s.UpdateStubZones
+	s.UpdateStubZones()
+	// The SkyDNS server is served behind the additional domains of the
+	// configuration, which it would otherwise forward upstream.
+	serveDNS(d.kd.AdditionalDomainsHandler(s), skydnsConfig.DnsAddr)
+}
+
+// serveDNS serves the DNS queries received over TCP and UDP on the given
+// address with the given handler.
+func serveDNS(handler miekgdns.Handler, addr string) {
+	for _, network := range []string{"tcp", "udp"} {
+		network := network
+		go func() {
+			if err := miekgdns.ListenAndServe(addr, network, handler); err != nil {
+				klog.Fatalf("Failed to serve DNS on %s://%s: %v", network, addr, err)
+			}
+		}()
+		klog.V(0).Infof("Ready for queries on %s://%s", network, addr)
+	}
 }
@@ -10,6 +10,7 @@ require (
 	github.com/onsi/ginkgo v1.16.4
 	github.com/onsi/gomega v1.13.0
 	github.com/prometheus/client_golang v1.11.0
+	github.com/prometheus/client_model v0.2.0
 	github.com/skynetservices/skydns v0.0.0-20191015171621-94b2ea0d8bfa
 	github.com/spf13/pflag v1.0.5
 	github.com/stretchr/testify v1.7.0
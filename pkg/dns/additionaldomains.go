@@ -0,0 +1,113 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"k8s.io/dns/pkg/dns/util"
+)
+
+// AdditionalDomainsHandler returns a dns.Handler serving the names under the
+// additional domains of the configuration as the names of the cluster
+// domain they map to, and handing every other query to next as is. next,
+// typically the skydns server, only answers for the cluster domain and
+// forwards every other name upstream, so the additional domains are only
+// served through this handler. The names of the cluster domain in the
+// answer are rewritten back into the queried domain.
+func (kd *KubeDNS) AdditionalDomainsHandler(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if len(req.Question) == 0 {
+			next.ServeDNS(w, req)
+			return
+		}
+		name := dns.Fqdn(req.Question[0].Name)
+		path := util.ReverseArray(strings.Split(strings.ToLower(strings.TrimSuffix(name, ".")), "."))
+		if hasPathPrefix(path, kd.domainPath) {
+			next.ServeDNS(w, req)
+			return
+		}
+		domainPath := kd.additionalDomainPath(path)
+		if domainPath == nil {
+			next.ServeDNS(w, req)
+			return
+		}
+		// The labels of name before and from the additional domain, as
+		// queried.
+		labels := strings.Split(name, ".")
+		prefix := strings.Join(labels[:len(path)-len(domainPath)], ".")
+		domain := strings.Join(labels[len(path)-len(domainPath):], ".")
+		clusterDomain := dns.Fqdn(kd.domain)
+		rewritten := req.Copy()
+		rewritten.Question[0].Name = clusterDomain
+		if prefix != "" {
+			rewritten.Question[0].Name = prefix + "." + clusterDomain
+		}
+		next.ServeDNS(&additionalDomainWriter{
+			ResponseWriter: w,
+			question:       req.Question[0].Name,
+			clusterDomain:  strings.ToLower(clusterDomain),
+			domain:         domain,
+		}, rewritten)
+	})
+}
+
+// additionalDomainWriter rewrites the names of the cluster domain in the
+// responses written to the ResponseWriter into an additional domain.
+type additionalDomainWriter struct {
+	dns.ResponseWriter
+	// question is the name queried, as it was written.
+	question      string
+	clusterDomain string
+	domain        string
+}
+
+func (w *additionalDomainWriter) WriteMsg(m *dns.Msg) error {
+	for i := range m.Question {
+		m.Question[i].Name = w.question
+	}
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			rr.Header().Name = w.rewrite(rr.Header().Name)
+			switch rr := rr.(type) {
+			case *dns.SRV:
+				rr.Target = w.rewrite(rr.Target)
+			case *dns.CNAME:
+				rr.Target = w.rewrite(rr.Target)
+			case *dns.SOA:
+				rr.Ns = w.rewrite(rr.Ns)
+				rr.Mbox = w.rewrite(rr.Mbox)
+			}
+		}
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// rewrite returns the given name moved from the cluster domain into the
+// additional domain, or as is if it is not under the cluster domain.
+func (w *additionalDomainWriter) rewrite(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case lower == w.clusterDomain:
+		return w.domain
+	case strings.HasSuffix(lower, "."+w.clusterDomain):
+		return name[:len(name)-len(w.clusterDomain)] + w.domain
+	}
+	return name
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	skyserver "github.com/skynetservices/skydns/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/dns/pkg/dns/config"
+)
+
+func TestAdditionalDomainsOverlappingClusterDomain(t *testing.T) {
+	kd := newKubeDNS()
+	for _, domain := range []string{"local", "cluster.local.", "Cluster.Local", "svc.cluster.local"} {
+		_, err := kd.applyConfig(&config.Config{AdditionalDomains: []string{domain}})
+		assert.Error(t, err, domain)
+	}
+	_, err := kd.applyConfig(&config.Config{AdditionalDomains: []string{"cluster.internal"}})
+	assert.NoError(t, err)
+}
+
+func TestAdditionalDomainsLongestMatch(t *testing.T) {
+	kd := newKubeDNS()
+	kd.updateConfig(&config.Config{AdditionalDomains: []string{"example.com", "cluster.example.com"}})
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	kd.newService(s)
+
+	for _, name := range []string{
+		getServiceFQDN(kd.domain, s),
+		testService + "." + testNamespace + ".svc.example.com.",
+		testService + "." + testNamespace + ".svc.cluster.example.com.",
+	} {
+		records, err := kd.Records(name, false)
+		require.NoError(t, err, name)
+		require.Len(t, records, 1, name)
+		assert.Equal(t, "1.2.3.4", records[0].Host, name)
+	}
+}
+
+func TestAdditionalDomainsHandler(t *testing.T) {
+	kd := newKubeDNS()
+	kd.serviceController = &stoppableController{}
+	kd.endpointsController = &stoppableController{}
+	kd.updateConfig(&config.Config{AdditionalDomains: []string{"cluster.example.com"}})
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	kd.newService(s)
+
+	skydnsConfig := &skyserver.Config{Domain: testDomain, DnsAddr: "127.0.0.1:0"}
+	require.NoError(t, skyserver.SetDefaults(skydnsConfig))
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        pc,
+		Handler:           kd.AdditionalDomainsHandler(skyserver.New(kd, skydnsConfig)),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	<-started
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		resp, err := dns.Exchange(req, pc.LocalAddr().String())
+		require.NoError(t, err)
+		return resp
+	}
+
+	for _, name := range []string{
+		"testservice.default.svc.cluster.local.",
+		"testservice.default.svc.cluster.example.com.",
+		"TestService.Default.svc.Cluster.Example.com.",
+	} {
+		resp := query(name, dns.TypeA)
+		require.Equal(t, dns.RcodeSuccess, resp.Rcode, name)
+		assert.Equal(t, name, resp.Question[0].Name)
+		require.Len(t, resp.Answer, 1, name)
+		assert.Equal(t, name, resp.Answer[0].Header().Name)
+		assert.Equal(t, "1.2.3.4", resp.Answer[0].(*dns.A).A.String())
+	}
+
+	// The targets are in the queried domain.
+	resp := query("_http._tcp.testservice.default.svc.cluster.example.com.", dns.TypeSRV)
+	require.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	require.Len(t, resp.Answer, 1)
+	assert.Equal(t, "testservice.default.svc.cluster.example.com.", resp.Answer[0].(*dns.SRV).Target)
+	require.Len(t, resp.Extra, 1)
+	assert.Equal(t, "testservice.default.svc.cluster.example.com.", resp.Extra[0].Header().Name)
+
+	resp = query("missing.default.svc.cluster.example.com.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	require.NotEmpty(t, resp.Ns)
+	assert.Equal(t, "cluster.example.com.", resp.Ns[0].Header().Name)
+}
@@ -0,0 +1,39 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// WithNamespaceAllowlist makes KubeDNS only serve the records of the
+// services of the given namespaces, e.g. to bound the memory used by an
+// instance serving some tenants of a cluster. Services and endpoints are
+// still watched in all namespaces, but the ones of other namespaces are
+// ignored.
+func WithNamespaceAllowlist(namespaces ...string) Option {
+	return func(kd *KubeDNS) {
+		kd.namespaceAllowlist = sets.NewString(namespaces...)
+	}
+}
+
+// servesNamespace returns whether the records of the services of the given
+// namespace are served, i.e. whether the namespace is allowlisted if an
+// allowlist is set.
+func (kd *KubeDNS) servesNamespace(namespace string) bool {
+	return kd.namespaceAllowlist == nil || kd.namespaceAllowlist.Has(namespace)
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestNamespaceAllowlist(t *testing.T) {
+	kd := newKubeDNS()
+	WithNamespaceAllowlist("team-a", "team-b")(kd)
+
+	allowed := newService("team-a", "svc", "1.2.3.4", "http", 80)
+	other := newService("team-c", "svc", "1.2.3.5", "http", 80)
+	headless := newHeadlessService()
+	headless.Namespace = "team-b"
+	otherHeadless := newHeadlessService()
+	otherHeadless.Namespace = "team-c"
+	otherHeadless.Name = "headless"
+	for _, s := range []*v1.Service{allowed, other, headless, otherHeadless} {
+		assert.NoError(t, kd.servicesStore.Add(s))
+	}
+	endpoints := newEndpoints(headless, newSubsetWithOnePort("http", 80, "10.0.0.1"))
+	otherEndpoints := newEndpoints(otherHeadless, newSubsetWithOnePort("http", 80, "10.0.0.2"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	assert.NoError(t, kd.endpointsStore.Add(otherEndpoints))
+	for _, s := range []*v1.Service{allowed, other, headless, otherHeadless} {
+		kd.newService(s)
+	}
+	kd.handleEndpointAdd(endpoints)
+	kd.handleEndpointAdd(otherEndpoints)
+
+	assertDNSForClusterIP(t, "allowed", kd, allowed, []string{"1.2.3.4"})
+	records, err := kd.Records(getServiceFQDN(kd.domain, headless), false)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "10.0.0.1", records[0].Host)
+
+	// The services of the other namespaces are never added.
+	_, err = kd.Records(getServiceFQDN(kd.domain, other), false)
+	assert.Error(t, err)
+	_, err = kd.Records(getServiceFQDN(kd.domain, otherHeadless), false)
+	assert.Error(t, err)
+	_, err = kd.ReverseRecord("5.3.2.1.in-addr.arpa.")
+	assert.Error(t, err)
+	_, err = kd.ReverseRecord("2.0.0.10.in-addr.arpa.")
+	assert.Error(t, err)
+	assert.NotContains(t, kd.clusterIPServiceMap, "1.2.3.5")
+	assert.Empty(t, kd.reconcile(false))
+
+	// Removing a service of another namespace leaves the records alone,
+	// even if it shares a cluster IP with an allowlisted service.
+	other.Spec.ClusterIP = "1.2.3.4"
+	other.Spec.ClusterIPs = []string{"1.2.3.4"}
+	kd.removeService(other)
+	assertDNSForClusterIP(t, "allowed after removal", kd, allowed, []string{"1.2.3.4"})
+	assertReverseRecord(t, "allowed after removal", kd, allowed)
+}
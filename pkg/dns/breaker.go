@@ -0,0 +1,113 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// nodeListFailureThreshold is the number of consecutive failures to
+	// list the nodes after which the node list breaker opens.
+	nodeListFailureThreshold = 5
+	// nodeListCoolDown is how long the node list breaker stays open before
+	// letting a request through again.
+	nodeListCoolDown = 30 * time.Second
+)
+
+var nodeListBreakerOpenDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(metricsNamespace, "", "node_list_breaker_open"),
+	"Whether federation queries are failing fast because listing the nodes "+
+		"to find the cluster zone and region has been failing (1) or not (0).",
+	nil, nil)
+
+// circuitBreaker fails requests fast after a number of consecutive failures,
+// until a cool-down period has elapsed. A single request is then let
+// through: the breaker closes if it succeeds and opens again otherwise. The
+// zero value is a closed breaker.
+type circuitBreaker struct {
+	lock sync.Mutex
+	// failures is the number of consecutive failures.
+	failures int
+	// openUntil is the end of the cool-down period if the breaker is open.
+	openUntil time.Time
+}
+
+// allow returns whether a request may be made at the given time. Once the
+// cool-down period has elapsed, only one request is allowed until its result
+// is recorded.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.failures < nodeListFailureThreshold {
+		return true
+	}
+	if now.Before(b.openUntil) {
+		return false
+	}
+	// Keep failing fast the requests made while this one is in flight.
+	b.openUntil = now.Add(nodeListCoolDown)
+	return true
+}
+
+// record records the result of a request made at the given time.
+func (b *circuitBreaker) record(err error, now time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err == nil {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return
+	}
+	b.failures++
+	if b.failures >= nodeListFailureThreshold {
+		b.openUntil = now.Add(nodeListCoolDown)
+	}
+}
+
+// isOpen returns whether requests made at the given time fail fast.
+func (b *circuitBreaker) isOpen(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.failures >= nodeListFailureThreshold && now.Before(b.openUntil)
+}
+
+type nodeListBreakerCollector struct {
+	kd *KubeDNS
+}
+
+// NodeListBreakerCollector returns a prometheus.Collector exporting the
+// state of the breaker guarding the node lists made to answer federation
+// queries.
+func (kd *KubeDNS) NodeListBreakerCollector() prometheus.Collector {
+	return &nodeListBreakerCollector{kd: kd}
+}
+
+func (c *nodeListBreakerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- nodeListBreakerOpenDesc
+}
+
+func (c *nodeListBreakerCollector) Collect(ch chan<- prometheus.Metric) {
+	value := 0.0
+	if c.kd.nodeListBreaker.isOpen(c.kd.clock.Now()) {
+		value = 1
+	}
+	ch <- prometheus.MustNewConstMetric(nodeListBreakerOpenDesc, prometheus.GaugeValue, value)
+}
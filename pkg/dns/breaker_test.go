@@ -0,0 +1,112 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+)
+
+func gatherNodeListBreakerOpen(t *testing.T, registry *prometheus.Registry) float64 {
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(families))
+	require.Equal(t, "kubedns_node_list_breaker_open", families[0].GetName())
+	return families[0].GetMetric()[0].GetGauge().GetValue()
+}
+
+func TestNodeListBreaker(t *testing.T) {
+	kd := newKubeDNS()
+	fakeClock := clock.NewFakeClock(time.Now())
+	kd.clock = fakeClock
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(kd.NodeListBreakerCollector()))
+
+	client := fake.NewSimpleClientset(newNodes())
+	failing := true
+	client.PrependReactor("list", "nodes", func(action core.Action) (bool, runtime.Object, error) {
+		if failing {
+			return true, nil, errors.New("API server unavailable")
+		}
+		return false, nil, nil
+	})
+	kd.kubeClient = client
+	listCalls := func() int {
+		calls := 0
+		for _, action := range client.Actions() {
+			if action.Matches("list", "nodes") {
+				calls++
+			}
+		}
+		return calls
+	}
+
+	for i := 0; i < nodeListFailureThreshold; i++ {
+		_, _, err := kd.getClusterZoneAndRegion()
+		assert.Error(t, err)
+	}
+	assert.Equal(t, nodeListFailureThreshold, listCalls())
+	assert.Equal(t, 1.0, gatherNodeListBreakerOpen(t, registry))
+
+	// The breaker is open: the nodes are not listed anymore.
+	_, _, err := kd.getClusterZoneAndRegion()
+	assert.Error(t, err)
+	assert.Equal(t, nodeListFailureThreshold, listCalls())
+
+	// After the cool-down, a failing request opens the breaker again.
+	fakeClock.Step(nodeListCoolDown)
+	assert.Equal(t, 0.0, gatherNodeListBreakerOpen(t, registry))
+	_, _, err = kd.getClusterZoneAndRegion()
+	assert.Error(t, err)
+	assert.Equal(t, nodeListFailureThreshold+1, listCalls())
+	assert.Equal(t, 1.0, gatherNodeListBreakerOpen(t, registry))
+	_, _, err = kd.getClusterZoneAndRegion()
+	assert.Error(t, err)
+	assert.Equal(t, nodeListFailureThreshold+1, listCalls())
+
+	// Once the API server recovers, the breaker closes.
+	failing = false
+	fakeClock.Step(nodeListCoolDown)
+	zone, region, err := kd.getClusterZoneAndRegion()
+	require.NoError(t, err)
+	assert.Equal(t, "testcontinent-testreg-testzone", zone)
+	assert.Equal(t, "testcontinent-testreg", region)
+	assert.Equal(t, nodeListFailureThreshold+2, listCalls())
+	assert.Equal(t, 0.0, gatherNodeListBreakerOpen(t, registry))
+}
+
+func TestCircuitBreakerResetsOnSuccess(t *testing.T) {
+	b := circuitBreaker{}
+	now := time.Now()
+	for i := 0; i < nodeListFailureThreshold-1; i++ {
+		b.record(errors.New("failed"), now)
+	}
+	b.record(nil, now)
+	b.record(errors.New("failed"), now)
+	assert.True(t, b.allow(now))
+	assert.False(t, b.isOpen(now))
+}
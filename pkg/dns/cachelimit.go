@@ -0,0 +1,265 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	skymsg "github.com/skynetservices/skydns/msg"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// cacheLimitPeriod is how often the memory used by the records is
+	// compared with the maxCacheBytes of the configuration.
+	cacheLimitPeriod = 30 * time.Second
+
+	// recordOverheadBytes is the approximate memory used by a record
+	// besides its strings: the record itself and its entries in the
+	// cache maps.
+	recordOverheadBytes = 256
+)
+
+var (
+	cacheEstimatedBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "cache_estimated_bytes"),
+		"Approximate memory used by the records held.",
+		nil, nil)
+	cacheEvictedNamespacesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "cache_evicted_namespaces_total"),
+		"Number of times the records of a namespace were evicted to keep "+
+			"the memory used by the records under maxCacheBytes.",
+		nil, nil)
+	cacheEvictedRecordsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "cache_evicted_records_total"),
+		"Number of records evicted to keep the memory used by the records "+
+			"under maxCacheBytes.",
+		nil, nil)
+)
+
+// cacheEvictions counts the evictions of the records of namespaces. Access
+// to the counters is atomic.
+type cacheEvictions struct {
+	namespaces uint64
+	records    uint64
+}
+
+// runCacheLimiter periodically evicts records while the memory they use
+// is above the maxCacheBytes of the configuration, until stopCh is closed.
+func (kd *KubeDNS) runCacheLimiter(stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-kd.clock.After(cacheLimitPeriod):
+			kd.enforceCacheLimit()
+		}
+	}
+}
+
+// recordBytes returns the approximate memory used by the given record.
+func recordBytes(record *skymsg.Service) int64 {
+	return int64(recordOverheadBytes + len(record.Host) + len(record.Text) + len(record.Group) + len(record.Key))
+}
+
+// touchNamespace records that the records of the given namespace were
+// queried, if the memory used by the records is limited.
+func (kd *KubeDNS) touchNamespace(namespace string) {
+	if namespace == "" || namespace == "*" || kd.currentConfig().MaxCacheBytes == 0 {
+		return
+	}
+	now := kd.clock.Now()
+	kd.namespaceLastQueriedLock.Lock()
+	defer kd.namespaceLastQueriedLock.Unlock()
+	if kd.namespaceLastQueried == nil {
+		kd.namespaceLastQueried = make(map[string]time.Time)
+	}
+	kd.namespaceLastQueried[namespace] = now
+}
+
+// pathNamespace returns the namespace of the service records under the
+// given path, e.g. {"local", "cluster", "svc", "default", "mysvc"}, if any.
+func (kd *KubeDNS) pathNamespace(path []string) string {
+	if len(path) <= len(kd.domainPath)+1 || path[len(kd.domainPath)] != serviceSubdomain {
+		return ""
+	}
+	return path[len(kd.domainPath)+1]
+}
+
+// reverseRecordNamespace returns the namespace of the service or pod the
+// given reverse record points to, if any.
+func (kd *KubeDNS) reverseRecordNamespace(record *skymsg.Service) string {
+	domain := "." + dns.Fqdn(kd.domain)
+	host := dns.Fqdn(record.Host)
+	for _, subdomain := range []string{serviceSubdomain, podSubdomain} {
+		if prefix := strings.TrimSuffix(host, "."+subdomain+domain); prefix != host {
+			return prefix[strings.LastIndex(prefix, ".")+1:]
+		}
+	}
+	return ""
+}
+
+// cacheBytes returns the approximate memory used by all the records, and
+// by the records of each namespace.
+// Important: Assumes that we already have the cacheLock.
+func (kd *KubeDNS) cacheBytes() (int64, map[string]int64) {
+	var total int64
+	for _, record := range kd.cache.GetAllValues() {
+		total += recordBytes(record)
+	}
+	namespaces := map[string]int64{}
+	servicePath := append(append([]string{}, kd.domainPath...), serviceSubdomain)
+	for _, namespace := range kd.cache.GetChildKeys(servicePath...) {
+		for _, record := range kd.cache.GetAllValuesForPath(append(servicePath, namespace)...) {
+			namespaces[namespace] += recordBytes(record)
+		}
+	}
+	for _, record := range kd.reverseRecordMap {
+		total += recordBytes(record)
+		if namespace := kd.reverseRecordNamespace(record); namespace != "" {
+			namespaces[namespace] += recordBytes(record)
+		}
+	}
+	return total, namespaces
+}
+
+// enforceCacheLimit evicts the records of the least recently queried
+// namespaces, the ones never queried first, while the memory used by the
+// records is above the maxCacheBytes of the configuration.
+func (kd *KubeDNS) enforceCacheLimit() {
+	limit := kd.currentConfig().MaxCacheBytes
+	if limit == 0 {
+		return
+	}
+
+	kd.namespaceLastQueriedLock.Lock()
+	lastQueried := make(map[string]time.Time, len(kd.namespaceLastQueried))
+	for namespace, t := range kd.namespaceLastQueried {
+		lastQueried[namespace] = t
+	}
+	kd.namespaceLastQueriedLock.Unlock()
+
+	kd.cacheLock.Lock()
+	defer kd.cacheLock.Unlock()
+	total, namespaces := kd.cacheBytes()
+	if total <= limit {
+		return
+	}
+	order := make([]string, 0, len(namespaces))
+	for namespace := range namespaces {
+		order = append(order, namespace)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		ti, tj := lastQueried[order[i]], lastQueried[order[j]]
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return order[i] < order[j]
+	})
+	for _, namespace := range order {
+		if total <= limit {
+			break
+		}
+		klog.Warningf("Records use about %d bytes, more than the %d configured, evicting the records of namespace %q",
+			total, limit, namespace)
+		evicted := kd.evictNamespace(namespace)
+		total -= namespaces[namespace]
+		atomic.AddUint64(&kd.cacheEvictions.namespaces, 1)
+		atomic.AddUint64(&kd.cacheEvictions.records, uint64(evicted))
+	}
+	if total > limit {
+		klog.Warningf("Records still use about %d bytes after evicting all namespaces, more than the %d configured", total, limit)
+	}
+}
+
+// evictNamespace removes the records of the services of the given
+// namespace and the reverse records pointing to the namespace, and returns
+// the number of records removed.
+// Important: Assumes that we already have the cacheLock.
+func (kd *KubeDNS) evictNamespace(namespace string) int {
+	path := append(append([]string{}, kd.domainPath...), serviceSubdomain, namespace)
+	evicted := len(kd.cache.GetAllValuesForPath(path...))
+	kd.cache.DeletePath(path...)
+	for ip, record := range kd.shadowedReverseRecords {
+		if kd.reverseRecordNamespace(record) == namespace {
+			delete(kd.shadowedReverseRecords, ip)
+			evicted++
+		}
+	}
+	for ip, record := range kd.reverseRecordMap {
+		if kd.reverseRecordNamespace(record) == namespace {
+			if _, ok := kd.clusterIPServiceMap[ip]; ok {
+				kd.releaseClusterIP(ip)
+			} else {
+				delete(kd.reverseRecordMap, ip)
+			}
+			delete(kd.externalNameReverseIPs, ip)
+			evicted++
+		}
+	}
+	prefix := namespace + "/"
+	for key := range kd.serviceFirstSeen {
+		if strings.HasPrefix(key, prefix) {
+			delete(kd.serviceFirstSeen, key)
+		}
+	}
+	for key := range kd.endpointFirstSeen {
+		if strings.HasPrefix(key, prefix) {
+			delete(kd.endpointFirstSeen, key)
+		}
+	}
+	for key := range kd.externalNameTargets {
+		if strings.HasPrefix(key, prefix) {
+			delete(kd.externalNameTargets, key)
+		}
+	}
+	kd.recordsChanged(namespace, "")
+	return evicted
+}
+
+type cacheLimitCollector struct {
+	kd *KubeDNS
+}
+
+// CacheLimitCollector returns a prometheus.Collector exporting the
+// approximate memory used by the records held by kd, and the evictions
+// made to keep it under the maxCacheBytes of the configuration.
+func (kd *KubeDNS) CacheLimitCollector() prometheus.Collector {
+	return &cacheLimitCollector{kd: kd}
+}
+
+func (c *cacheLimitCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheEstimatedBytesDesc
+	ch <- cacheEvictedNamespacesDesc
+	ch <- cacheEvictedRecordsDesc
+}
+
+func (c *cacheLimitCollector) Collect(ch chan<- prometheus.Metric) {
+	c.kd.cacheLock.RLock()
+	total, _ := c.kd.cacheBytes()
+	c.kd.cacheLock.RUnlock()
+	namespaces := atomic.LoadUint64(&c.kd.cacheEvictions.namespaces)
+	records := atomic.LoadUint64(&c.kd.cacheEvictions.records)
+	ch <- prometheus.MustNewConstMetric(cacheEstimatedBytesDesc, prometheus.GaugeValue, float64(total))
+	ch <- prometheus.MustNewConstMetric(cacheEvictedNamespacesDesc, prometheus.CounterValue, float64(namespaces))
+	ch <- prometheus.MustNewConstMetric(cacheEvictedRecordsDesc, prometheus.CounterValue, float64(records))
+}
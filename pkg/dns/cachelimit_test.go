@@ -0,0 +1,106 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/clock"
+
+	"k8s.io/dns/pkg/dns/config"
+)
+
+func TestEnforceCacheLimit(t *testing.T) {
+	kd := newKubeDNS()
+	fakeClock := clock.NewFakeClock(time.Now())
+	kd.clock = fakeClock
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(kd.CacheLimitCollector()))
+
+	namespaces := []string{"ns-a", "ns-b", "ns-c", "ns-d"}
+	for i, namespace := range namespaces {
+		kd.newService(newService(namespace, "svc", fmt.Sprintf("10.0.0.%d", i+1), "http", 80))
+	}
+	kd.cacheLock.RLock()
+	total, sizes := kd.cacheBytes()
+	kd.cacheLock.RUnlock()
+	require.Equal(t, len(namespaces), len(sizes))
+	perNamespace := sizes["ns-a"]
+
+	query := func(namespace string) {
+		_, err := kd.Records("svc."+namespace+".svc.cluster.local.", false)
+		require.NoError(t, err)
+	}
+	// Checking the cache rather than querying leaves the order of the
+	// namespaces as is.
+	exists := func(namespace string) bool {
+		kd.cacheLock.RLock()
+		defer kd.cacheLock.RUnlock()
+		return len(kd.cache.GetAllValuesForPath("local", "cluster", "svc", namespace)) > 0
+	}
+
+	// Unlimited by default.
+	kd.enforceCacheLimit()
+	for _, namespace := range namespaces {
+		assert.True(t, exists(namespace), namespace)
+	}
+
+	// Queried namespaces are kept over the ones never queried, and the
+	// ones queried last over the others.
+	kd.config = &config.Config{MaxCacheBytes: total - perNamespace}
+	for _, namespace := range []string{"ns-d", "ns-a", "ns-c", "ns-b"} {
+		fakeClock.Step(time.Second)
+		query(namespace)
+	}
+	fakeClock.Step(time.Second)
+	query("ns-a")
+
+	kd.enforceCacheLimit()
+	assert.False(t, exists("ns-d"))
+	_, err := kd.ReverseRecord("4.0.0.10.in-addr.arpa.")
+	assert.Error(t, err)
+	for _, namespace := range []string{"ns-a", "ns-b", "ns-c"} {
+		assert.True(t, exists(namespace), namespace)
+	}
+
+	kd.config = &config.Config{MaxCacheBytes: total - 3*perNamespace}
+	kd.enforceCacheLimit()
+	assert.False(t, exists("ns-b"))
+	assert.False(t, exists("ns-c"))
+	assert.True(t, exists("ns-a"))
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	metrics := map[string]float64{}
+	for _, family := range families {
+		metric := family.GetMetric()[0]
+		if metric.GetCounter() != nil {
+			metrics[family.GetName()] = metric.GetCounter().GetValue()
+		} else {
+			metrics[family.GetName()] = metric.GetGauge().GetValue()
+		}
+	}
+	assert.Equal(t, 3.0, metrics["kubedns_cache_evicted_namespaces_total"])
+	// The A, SRV and PTR records of each service.
+	assert.Equal(t, 9.0, metrics["kubedns_cache_evicted_records_total"])
+	assert.Equal(t, float64(perNamespace), metrics["kubedns_cache_estimated_bytes"])
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/dns/pkg/dns/util"
+)
+
+// ServiceSummary describes a service KubeDNS is expected to serve records
+// for.
+type ServiceSummary struct {
+	// FQDN is the fully qualified name of the service.
+	FQDN string
+	// Type is the type of the service.
+	Type v1.ServiceType
+	// Headless is true for services without a cluster IP, whose records
+	// are generated from their endpoints.
+	Headless bool
+	// Ports lists the names of the ports of the service. Unnamed ports are
+	// omitted.
+	Ports []string
+	// Cached is true if records are currently held for the service.
+	Cached bool
+}
+
+// ListAllServices returns a summary of every service in the services store,
+// except the ones of namespaces outside of the allowlist, sorted by FQDN. As
+// the store is the authoritative source of services, the list reflects the
+// services that should be resolvable, whether or not their records have
+// been generated yet.
+func (kd *KubeDNS) ListAllServices() []ServiceSummary {
+	summaries := []ServiceSummary{}
+	for _, obj := range kd.servicesStore.List() {
+		service, ok := assertIsService(obj)
+		if !ok || !kd.servesNamespace(service.Namespace) {
+			continue
+		}
+		summary := ServiceSummary{
+			FQDN:     kd.fqdn(service),
+			Type:     service.Spec.Type,
+			Headless: service.Spec.Type != v1.ServiceTypeExternalName && !util.IsServiceIPSet(service),
+			Ports:    []string{},
+		}
+		for _, port := range service.Spec.Ports {
+			if port.Name != "" {
+				summary.Ports = append(summary.Ports, port.Name)
+			}
+		}
+		path := append(append([]string{}, kd.domainPath...), serviceSubdomain, service.Namespace, service.Name)
+		kd.cacheLock.RLock()
+		summary.Cached = len(kd.cache.GetValuesForPathWithWildcards(path...)) > 0
+		kd.cacheLock.RUnlock()
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].FQDN < summaries[j].FQDN
+	})
+	return summaries
+}
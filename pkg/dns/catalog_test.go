@@ -0,0 +1,84 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestListAllServices(t *testing.T) {
+	kd := newKubeDNS()
+
+	portal := newService(testNamespace, "portal", "1.2.3.4", "http", 80)
+	portal.Spec.Type = v1.ServiceTypeClusterIP
+	portal.Spec.Ports = append(portal.Spec.Ports, v1.ServicePort{Port: 8080, Protocol: v1.ProtocolTCP})
+	assert.NoError(t, kd.servicesStore.Add(portal))
+	kd.newService(portal)
+
+	external := newExternalNameService()
+	external.Name = "external"
+	assert.NoError(t, kd.servicesStore.Add(external))
+	kd.newService(external)
+
+	headless := newHeadlessService()
+	headless.Name = "headless"
+	headless.Spec.Ports = []v1.ServicePort{{Name: "dns", Port: 53, Protocol: v1.ProtocolUDP}}
+	assert.NoError(t, kd.servicesStore.Add(headless))
+	assert.NoError(t, kd.endpointsStore.Add(newEndpoints(headless, newSubsetWithOnePort("dns", 53, "10.0.0.1"))))
+	kd.newService(headless)
+
+	// A service that is stored but whose records have not been generated.
+	pending := newService("other", "pending", "1.2.3.5", "https", 443)
+	assert.NoError(t, kd.servicesStore.Add(pending))
+
+	summaries := kd.ListAllServices()
+	require.Equal(t, 4, len(summaries))
+	assert.Equal(t, []ServiceSummary{
+		{
+			FQDN:     "external.default.svc.cluster.local.",
+			Type:     v1.ServiceTypeExternalName,
+			Headless: false,
+			Ports:    []string{},
+			Cached:   true,
+		},
+		{
+			FQDN:     "headless.default.svc.cluster.local.",
+			Headless: true,
+			Ports:    []string{"dns"},
+			Cached:   true,
+		},
+		{
+			FQDN:   "pending.other.svc.cluster.local.",
+			Ports:  []string{"https"},
+			Cached: false,
+		},
+		{
+			FQDN:   "portal.default.svc.cluster.local.",
+			Type:   v1.ServiceTypeClusterIP,
+			Ports:  []string{"http"},
+			Cached: true,
+		},
+	}, summaries)
+
+	kd.removeService(portal)
+	assert.NoError(t, kd.servicesStore.Delete(portal))
+	assert.Equal(t, 3, len(kd.ListAllServices()))
+}
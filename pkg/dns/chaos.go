@@ -0,0 +1,91 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+	"k8s.io/dns/pkg/version"
+	"k8s.io/klog/v2"
+)
+
+// defaultChaosRecords returns the CHAOS class TXT records served unless
+// overridden by the configuration, keyed by fully qualified name.
+func defaultChaosRecords() map[string]string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return map[string]string{
+		"version.bind.":   version.VERSION,
+		"version.server.": version.VERSION,
+		"hostname.bind.":  hostname,
+		"id.server.":      hostname,
+	}
+}
+
+// ChaosRecords returns the answer to the given CHAOS class TXT question and
+// whether the queried name is one KubeDNS serves. Names are looked up in the
+// chaosRecords of the configuration first, then in the built-in records.
+func (kd *KubeDNS) ChaosRecords(q dns.Question) ([]dns.RR, bool) {
+	if q.Qclass != dns.ClassCHAOS || q.Qtype != dns.TypeTXT {
+		return nil, false
+	}
+	name := strings.ToLower(dns.Fqdn(q.Name))
+
+	value, ok := "", false
+	for configured, configuredValue := range kd.currentConfig().ChaosRecords {
+		if strings.ToLower(dns.Fqdn(configured)) == name {
+			value, ok = configuredValue, true
+			break
+		}
+	}
+	if !ok {
+		if value, ok = defaultChaosRecords()[name]; !ok {
+			return nil, false
+		}
+	}
+
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0}
+	return []dns.RR{&dns.TXT{Hdr: hdr, Txt: []string{value}}}, true
+}
+
+// ServeChaos is a dns.HandlerFunc answering the records returned by
+// ChaosRecords, so that a DNS server in front of KubeDNS can delegate the
+// CHAOS class to it. Queries of any other class are refused.
+func (kd *KubeDNS) ServeChaos(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	switch {
+	case len(req.Question) == 0:
+		m.SetRcode(req, dns.RcodeFormatError)
+	case req.Question[0].Qclass != dns.ClassCHAOS:
+		m.SetRcode(req, dns.RcodeRefused)
+	default:
+		if answer, ok := kd.ChaosRecords(req.Question[0]); ok {
+			m.Answer = answer
+		} else {
+			m.SetRcode(req, dns.RcodeNameError)
+		}
+	}
+	if err := w.WriteMsg(m); err != nil {
+		klog.Errorf("Failed to write CHAOS response: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/dns/pkg/dns/config"
+	"k8s.io/dns/pkg/version"
+)
+
+func TestChaosRecords(t *testing.T) {
+	kd := newKubeDNS()
+
+	txt := func(name string, qclass uint16) []string {
+		answer, ok := kd.ChaosRecords(dns.Question{Name: name, Qtype: dns.TypeTXT, Qclass: qclass})
+		if !ok {
+			return nil
+		}
+		require.Equal(t, 1, len(answer))
+		return answer[0].(*dns.TXT).Txt
+	}
+
+	assert.Equal(t, []string{version.VERSION}, txt("version.bind.", dns.ClassCHAOS))
+	assert.Equal(t, []string{version.VERSION}, txt("VERSION.SERVER.", dns.ClassCHAOS))
+	assert.Nil(t, txt("version.bind.", dns.ClassINET))
+	assert.Nil(t, txt("unknown.bind.", dns.ClassCHAOS))
+
+	kd.config = &config.Config{ChaosRecords: map[string]string{
+		"version.bind": "custom",
+		"extra.bind.":  "extra",
+	}}
+	assert.Equal(t, []string{"custom"}, txt("version.bind.", dns.ClassCHAOS))
+	assert.Equal(t, []string{"extra"}, txt("extra.bind.", dns.ClassCHAOS))
+	assert.Equal(t, []string{version.VERSION}, txt("version.server.", dns.ClassCHAOS))
+}
+
+func TestServeChaos(t *testing.T) {
+	kd := newKubeDNS()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        pc,
+		Handler:           dns.HandlerFunc(kd.ServeChaos),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	<-started
+
+	query := func(name string, qclass uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeTXT)
+		req.Question[0].Qclass = qclass
+		resp, err := dns.Exchange(req, pc.LocalAddr().String())
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := query("version.bind.", dns.ClassCHAOS)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	require.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, uint16(dns.ClassCHAOS), resp.Answer[0].Header().Class)
+	assert.Equal(t, []string{version.VERSION}, resp.Answer[0].(*dns.TXT).Txt)
+
+	assert.Equal(t, dns.RcodeNameError, query("unknown.bind.", dns.ClassCHAOS).Rcode)
+	assert.Equal(t, dns.RcodeRefused, query("version.bind.", dns.ClassINET).Rcode)
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// WouldCollide returns whether the records of the given service would
+// collide with records already served, along with a description of the
+// conflicting owner. The service collides if:
+//  1. its name is already occupied in the cache by records that are not
+//     owned by the same service, e.g. static records or a different
+//     Service object with the same namespace and name.
+//  2. its namespace is the name of a configured federation, as the names
+//     of its endpoints would then be interpreted as federation queries.
+//
+// Records owned by a stored service with the same UID are not considered a
+// collision, so that updates of an existing service can be validated.
+func (kd *KubeDNS) WouldCollide(service *v1.Service) (bool, string) {
+	if _, ok := kd.currentConfig().Federations[service.Namespace]; ok {
+		return true, fmt.Sprintf("federation %s", service.Namespace)
+	}
+
+	path := append(append([]string{}, kd.domainPath...), serviceSubdomain, service.Namespace, service.Name)
+	kd.cacheLock.RLock()
+	occupied := len(kd.cache.GetValuesForPathWithWildcards(path...)) > 0
+	kd.cacheLock.RUnlock()
+	if !occupied {
+		return false, ""
+	}
+
+	obj, exists, err := kd.servicesStore.GetByKey(service.Namespace + "/" + service.Name)
+	if err != nil || !exists {
+		return true, fmt.Sprintf("record %s", kd.fqdn(service))
+	}
+	existing, ok := assertIsService(obj)
+	if !ok {
+		return true, fmt.Sprintf("record %s", kd.fqdn(service))
+	}
+	if service.UID != "" && existing.UID == service.UID {
+		return false, ""
+	}
+	return true, fmt.Sprintf("Service %s/%s", existing.Namespace, existing.Name)
+}
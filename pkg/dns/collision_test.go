@@ -0,0 +1,72 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/dns/pkg/dns/config"
+	"k8s.io/dns/pkg/dns/util"
+)
+
+func TestWouldCollide(t *testing.T) {
+	kd := newKubeDNS()
+	kd.config = &config.Config{Federations: map[string]string{"myfederation": "example.com"}}
+
+	existing := newService(testNamespace, "existing", "1.2.3.4", "", 80)
+	existing.UID = "existing-uid"
+	assert.NoError(t, kd.servicesStore.Add(existing))
+	kd.newService(existing)
+
+	// A record that is not owned by any service.
+	static, _ := util.GetSkyMsg("1.2.3.5", 0)
+	kd.cache.SetEntry("static", static, "static.default.svc.cluster.local.",
+		append(kd.domainPath, serviceSubdomain, testNamespace)...)
+
+	for _, tc := range []struct {
+		name          string
+		namespace     string
+		serviceName   string
+		uid           string
+		collides      bool
+		expectedOwner string
+	}{
+		{name: "clean", namespace: testNamespace, serviceName: "clean"},
+		{name: "update of existing service", namespace: testNamespace, serviceName: "existing", uid: "existing-uid"},
+		{
+			name: "existing service", namespace: testNamespace, serviceName: "existing", uid: "other-uid",
+			collides: true, expectedOwner: "Service default/existing",
+		},
+		{
+			name: "static record", namespace: testNamespace, serviceName: "static",
+			collides: true, expectedOwner: "record static.default.svc.cluster.local.",
+		},
+		{
+			name: "federation alias", namespace: "myfederation", serviceName: "clean",
+			collides: true, expectedOwner: "federation myfederation",
+		},
+	} {
+		s := newService(tc.namespace, tc.serviceName, "1.2.3.6", "", 80)
+		s.UID = types.UID(tc.uid)
+		collides, owner := kd.WouldCollide(s)
+		assert.Equal(t, tc.collides, collides, tc.name)
+		assert.Equal(t, tc.expectedOwner, owner, tc.name)
+	}
+}
@@ -20,7 +20,9 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
 
+	v1 "k8s.io/api/core/v1"
 	types "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/validation"
 	fed "k8s.io/dns/pkg/dns/federation"
@@ -50,6 +52,334 @@ type Config struct {
 	// List of upstream nameservers to use. Overrides nameservers inherited
 	// from the node.
 	UpstreamNameservers []string `json:"upstreamNameservers"`
+
+	// If set, the TTL of the records of headless service endpoints grows
+	// with the time the endpoint has been present, so that stable endpoints
+	// are cached longer while new ones remain quickly discoverable. Services
+	// setting their TTL with the kubernetes.io/dns-ttl annotation keep it. If
+	// nil, all records are served with a flat TTL.
+	EndpointStabilityTTL *StabilityTTL `json:"endpointStabilityTTL"`
+
+	// Map of CHAOS class TXT record names, e.g. "version.bind", to the
+	// value they are answered with. Entries are added to, or override,
+	// the built-in version.bind, version.server, hostname.bind and
+	// id.server records.
+	ChaosRecords map[string]string `json:"chaosRecords"`
+
+	// List of domains this DNS server is authoritative for in addition to
+	// the cluster domain, e.g. while migrating to a new cluster domain.
+	// The records of the cluster domain are served under each of them.
+	// They can't be, contain or be under the cluster domain.
+	AdditionalDomains []string `json:"additionalDomains"`
+
+	// If true, an SRV record pointing at the service is generated under
+	// _service._<proto> for every port of a ClusterIP service, in
+	// addition to the records of the named ports.
+	ServiceSRVRecords bool `json:"serviceSRVRecords"`
+
+	// ClusterIP of the kubernetes.default service. If set, it is served
+	// as the record of kubernetes.default.svc until the service itself
+	// is synced from the apiserver, so that clients bootstrapping against
+	// the apiserver can resolve it while kube-dns starts.
+	KubernetesServiceIP string `json:"kubernetesServiceIP"`
+
+	// ClusterIP of the kube-dns service in the kube-system namespace. If
+	// set, its forward and reverse records are served until the service
+	// itself is synced, so that resolvers can always reverse lookup the
+	// IP of their nameserver.
+	DNSServiceIP string `json:"dnsServiceIP"`
+
+	// Maximum number of addresses of an endpoints object for which records
+	// are generated. Additional addresses are ignored. If 0, there is no
+	// limit.
+	MaxEndpointAddresses int `json:"maxEndpointAddresses"`
+
+	// Maximum number of records returned for a wildcard query, e.g.
+	// *.*.*.svc.cluster.local. If 0, a default limit of 1000 records is used.
+	MaxWildcardRecords int `json:"maxWildcardRecords"`
+
+	// If true, the weights of the SRV records of the endpoints of a
+	// headless service sum to 100 for each port, for clients splitting
+	// traffic by percentage. Otherwise every record has the same default
+	// weight.
+	NormalizeSRVWeights bool `json:"normalizeSRVWeights"`
+
+	// If true, the CNAME of an ExternalName service whose target is a
+	// federated service name, e.g. mysvc.myns.myfederation.svc.<domain>,
+	// points at the federation redirect of that name rather than at the
+	// name itself.
+	ResolveFederatedExternalNames bool `json:"resolveFederatedExternalNames"`
+
+	// If true, the answer to a federation query served by a local service
+	// whose record is itself a CNAME, e.g. of an ExternalName service, also
+	// holds the records of the rest of the chain, up to the same depth as
+	// RecordsFollowingCNAMEs. Otherwise only the CNAME to the local service
+	// is returned.
+	CollapseFederationCNAMEs bool `json:"collapseFederationCNAMEs"`
+
+	// If true, PTR records are also generated for the headless service
+	// endpoint addresses without a hostname that refer to a pod. They point
+	// at the pod record of the address, e.g. 10-0-0-1.default.pod.<domain>.
+	TargetRefPTRRecords bool `json:"targetRefPTRRecords"`
+
+	// If non-zero, the records of the cluster IPs of services without
+	// endpoints are served with at most this TTL, so that clients retry
+	// sooner and pick up the backends once they appear. If 0, these records
+	// are served with the usual TTL.
+	UnbackedServiceTTL uint32 `json:"unbackedServiceTTL"`
+
+	// If true, port names are lowercased in the labels of SRV records, and
+	// the ports whose name is not a valid port name once lowercased get no
+	// SRV record. Otherwise port names are used verbatim.
+	LowercasePortNames bool `json:"lowercasePortNames"`
+
+	// If true, names matching the federation query pattern are first
+	// looked up as is, and only handled as federation queries if there is
+	// no such local record. This prevents federations from shadowing the
+	// endpoints of headless services in namespaces named after them.
+	PreferLocalRecords bool `json:"preferLocalRecords"`
+
+	// If true, the records of a name are returned in a random order, so
+	// that the clients using the first record spread their load.
+	// Otherwise they are returned in the same order from one query to the
+	// next, sorted by host.
+	ShuffleRecords bool `json:"shuffleRecords"`
+
+	// Time the records of a deleted service are still served for. If the
+	// service is recreated in the meantime, e.g. by a delete and apply,
+	// its records are updated rather than removed then added again. If 0,
+	// the records are removed as soon as the service is deleted.
+	ServiceRemovalGracePeriod types.Duration `json:"serviceRemovalGracePeriod"`
+
+	// If true, a query for the protocol label of a service, e.g.
+	// _tcp.<service>.<ns>.svc.<domain>, returns the SRV records of every
+	// named port of the service with this protocol.
+	AggregateProtocolSRVRecords bool `json:"aggregateProtocolSRVRecords"`
+
+	// Interval at which the records of the cache are compared with the
+	// services and endpoints known to kube-dns, as a safety net against
+	// missed or misapplied updates. Services out of sync are logged and
+	// counted. If 0, the records are not compared.
+	ReconcileInterval types.Duration `json:"reconcileInterval"`
+
+	// If true, the records of the services found out of sync by the
+	// periodic reconciliation are regenerated, or removed.
+	ReconcileRepair bool `json:"reconcileRepair"`
+
+	// IP families, IPv4 and/or IPv6, of the addresses pod records, e.g.
+	// 1-2-3-4.<ns>.pod.<domain>, are answered for. If empty, pod records
+	// are answered for every family.
+	PodRecordIPFamilies []v1.IPFamily `json:"podRecordIPFamilies"`
+
+	// Record answered for a fixed name, independent of any service, so
+	// that external probes can verify the DNS server answers end to end.
+	HealthProbe *HealthProbeRecord `json:"healthProbe"`
+
+	// Bounds of the TTL of the records answered, enforced after every
+	// other TTL setting. If 0, the TTL has no floor, respectively no
+	// ceiling.
+	MinTTL uint32 `json:"minTTL"`
+	MaxTTL uint32 `json:"maxTTL"`
+
+	// Maximum percentage, from 0 to 100, by which the TTL of each record
+	// answered is randomly lengthened or shortened, so that the caches of
+	// clients don't expire in sync. The result is still bounded by MinTTL
+	// and MaxTTL. If 0, TTLs are answered as is.
+	TTLJitterPercent int `json:"ttlJitterPercent"`
+
+	// If true, the targets of ExternalName services are resolved, and the
+	// IPs they resolve to that have no reverse record get one pointing to
+	// the ExternalName service.
+	ExternalNameReverseRecords bool `json:"externalNameReverseRecords"`
+	// Map of namespace to the nameservers, in the format of
+	// UpstreamNameservers, the targets of the ExternalName services of the
+	// namespace are resolved with, e.g. the upstream of a tenant. The
+	// targets of the other namespaces are resolved with the nameservers of
+	// kube-dns.
+	NamespaceUpstreamNameservers map[string][]string `json:"namespaceUpstreamNameservers"`
+
+	// If true, the apex of the pod subdomain of a namespace,
+	// <ns>.pod.<domain>, exists: it is answered with no record, or with
+	// PodSubdomainApexIP if set, rather than NXDOMAIN.
+	AnswerPodSubdomainApex bool `json:"answerPodSubdomainApex"`
+	// IP address the apex of the pod subdomains is answered with, if
+	// AnswerPodSubdomainApex is set.
+	PodSubdomainApexIP string `json:"podSubdomainApexIP"`
+
+	// Zone and region of the cluster in federation CNAMEs when no node has
+	// the topology label of the zone, respectively of the region, e.g. on
+	// premises. If empty, federation queries fail in that case.
+	FallbackClusterZone   string `json:"fallbackClusterZone"`
+	FallbackClusterRegion string `json:"fallbackClusterRegion"`
+
+	// Maximum number of federation queries missing locally that are
+	// redirected at once. Queries beyond the limit are answered with a
+	// not-found rather than waiting. If 0, the number is not limited.
+	MaxConcurrentFederationFallbacks int `json:"maxConcurrentFederationFallbacks"`
+
+	// CIDRs of the cluster IPs of the services and of the IPs of the pods,
+	// e.g. "10.96.0.0/12". They are used to warn about overlaps, which
+	// make reverse lookups ambiguous: the reverse record of a service
+	// always takes precedence over the one of a pod with the same IP.
+	ServiceCIDRs []string `json:"serviceCIDRs"`
+	PodCIDRs     []string `json:"podCIDRs"`
+
+	// If true, the reverse lookups of IPs outside of the ServiceCIDRs and
+	// PodCIDRs fail with ErrReverseNotAuthoritative rather than
+	// ErrReverseNotFound, so that the server forwards them rather than
+	// denying they exist. Requires ServiceCIDRs or PodCIDRs.
+	ForwardUnknownReverseQueries bool `json:"forwardUnknownReverseQueries"`
+
+	// CIDRs the cluster IPs of the services get no reverse record in, e.g.
+	// a reserved range. The services still get their forward records.
+	ReverseRecordExcludedCIDRs []string `json:"reverseRecordExcludedCIDRs"`
+
+	// If set, the named not-ready addresses of the endpoints of headless
+	// services are served under this subdomain of the service, e.g.
+	// <hostname>.notready.<service>.<ns>.svc.<domain>, so that clients can
+	// reach warming pods explicitly. They are not part of the records of
+	// the service itself. If empty, not-ready addresses are not served.
+	NotReadySubdomain string `json:"notReadySubdomain"`
+
+	// If set, the ready addresses of the endpoints of headless services are
+	// also served under this subdomain of the service, e.g.
+	// ready.<service>.<ns>.svc.<domain>, so that clients can resolve only
+	// the ready addresses whether or not the service publishes its
+	// not-ready ones. If empty, no such name is served.
+	ReadySubdomain string `json:"readySubdomain"`
+
+	// If true, ClusterIP services with neither ports nor endpoint addresses,
+	// which are likely misconfigured, get no record until they have either.
+	// Otherwise they get the records of their cluster IPs.
+	WithholdIncompleteServices bool `json:"withholdIncompleteServices"`
+
+	// If true, the SOA record of the cluster domain is answered and
+	// exported with the zone file. Its serial is incremented every time the
+	// records change, so that zone transfer tooling can detect changes.
+	SOARecord bool `json:"soaRecord"`
+
+	// Approximate memory, in bytes, the records held may use. Above it, the
+	// records of the services of the least recently queried namespaces are
+	// evicted, along with their reverse records, until they use less. As
+	// evicted records are generated again on the next update of their
+	// services or endpoints, this is a last resort protection against
+	// runaway growth. If 0, the memory is not limited.
+	MaxCacheBytes int64 `json:"maxCacheBytes"`
+
+	// Time a service that changes between headless and ClusterIP is
+	// answered with the A records of both forms for, so that clients
+	// resolving it mid-transition reach it either way. If 0, the records
+	// of the new form replace the others at once.
+	HeadlessTransitionWindow types.Duration `json:"headlessTransitionWindow"`
+
+	// Time a name found to have no record is remembered for, so that
+	// repeated queries for it are answered NXDOMAIN without looking it
+	// up again. Any change of the records forgets the names remembered.
+	// If 0, names without records are not remembered.
+	NegativeCacheTTL types.Duration `json:"negativeCacheTTL"`
+
+	// If non-zero, the TTL of the records of services and of their
+	// endpoints is capped to the time left until they are this old, and
+	// set to 0 past it, so that caches can tell fresh records from stale
+	// ones. A record is as old as its service, or as the IP of the
+	// endpoint for the endpoints of headless services. If 0, the TTLs
+	// don't depend on the age of the records.
+	RecordMaxAge types.Duration `json:"recordMaxAge"`
+}
+
+// AnswersPodRecords returns whether pod records are answered for the
+// addresses of the given IP family.
+func (config *Config) AnswersPodRecords(family v1.IPFamily) bool {
+	if len(config.PodRecordIPFamilies) == 0 {
+		return true
+	}
+	for _, answered := range config.PodRecordIPFamilies {
+		if answered == family {
+			return true
+		}
+	}
+	return false
+}
+
+// BoundTTL returns the given TTL clamped to the MinTTL and MaxTTL bounds.
+func (config *Config) BoundTTL(ttl uint32) uint32 {
+	if ttl < config.MinTTL {
+		return config.MinTTL
+	}
+	if config.MaxTTL != 0 && ttl > config.MaxTTL {
+		return config.MaxTTL
+	}
+	return ttl
+}
+
+// ExcludesReverseRecord returns whether the given IP is in one of the
+// ReverseRecordExcludedCIDRs. Invalid CIDRs are ignored.
+func (config *Config) ExcludesReverseRecord(ip string) bool {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return false
+	}
+	for _, cidr := range config.ReverseRecordExcludedCIDRs {
+		if _, ipNet, err := net.ParseCIDR(cidr); err == nil && ipNet.Contains(parsedIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// InClusterCIDRs returns whether the given IP is in one of the
+// ServiceCIDRs or PodCIDRs. Invalid CIDRs are ignored.
+func (config *Config) InClusterCIDRs(ip string) bool {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return false
+	}
+	for _, cidr := range append(append([]string{}, config.ServiceCIDRs...), config.PodCIDRs...) {
+		if _, ipNet, err := net.ParseCIDR(cidr); err == nil && ipNet.Contains(parsedIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// OverlappingCIDRs returns the pairs of a service CIDR and a pod CIDR that
+// overlap, as "<service CIDR> and <pod CIDR>". Invalid CIDRs are ignored.
+func (config *Config) OverlappingCIDRs() []string {
+	var overlaps []string
+	for _, serviceCIDR := range config.ServiceCIDRs {
+		_, serviceNet, err := net.ParseCIDR(serviceCIDR)
+		if err != nil {
+			continue
+		}
+		for _, podCIDR := range config.PodCIDRs {
+			_, podNet, err := net.ParseCIDR(podCIDR)
+			if err != nil {
+				continue
+			}
+			// Two CIDRs overlap if and only if one contains the other.
+			if serviceNet.Contains(podNet.IP) || podNet.Contains(serviceNet.IP) {
+				overlaps = append(overlaps, serviceCIDR+" and "+podCIDR)
+			}
+		}
+	}
+	return overlaps
+}
+
+// StabilityTTL scales a record TTL linearly from MinTTL, for a newly seen
+// endpoint, to MaxTTL, for an endpoint that has been present for at least
+// RampPeriod.
+type StabilityTTL struct {
+	MinTTL     uint32         `json:"minTTL"`
+	MaxTTL     uint32         `json:"maxTTL"`
+	RampPeriod types.Duration `json:"rampPeriod"`
+}
+
+// HealthProbeRecord is an A or AAAA record answered for a probe name.
+type HealthProbeRecord struct {
+	// Fully qualified name of the record, e.g. dns-health.cluster.local.
+	Name string `json:"name"`
+	// IP address the name is answered with.
+	IP string `json:"ip"`
 }
 
 func NewDefaultConfig() *Config {
@@ -73,6 +403,118 @@ func (config *Config) Validate() error {
 		return err
 	}
 
+	if err := config.validateNamespaceUpstreamNameservers(); err != nil {
+		return err
+	}
+
+	if err := config.validateEndpointStabilityTTL(); err != nil {
+		return err
+	}
+
+	if err := config.validateChaosRecords(); err != nil {
+		return err
+	}
+
+	if err := config.validateAdditionalDomains(); err != nil {
+		return err
+	}
+
+	if err := config.validateHealthProbe(); err != nil {
+		return err
+	}
+
+	if config.KubernetesServiceIP != "" && net.ParseIP(config.KubernetesServiceIP) == nil {
+		return fmt.Errorf("invalid kubernetesServiceIP: %q", config.KubernetesServiceIP)
+	}
+
+	if config.DNSServiceIP != "" && net.ParseIP(config.DNSServiceIP) == nil {
+		return fmt.Errorf("invalid dnsServiceIP: %q", config.DNSServiceIP)
+	}
+
+	if config.MaxEndpointAddresses < 0 {
+		return fmt.Errorf("maxEndpointAddresses cannot be negative")
+	}
+
+	if config.MaxWildcardRecords < 0 {
+		return fmt.Errorf("maxWildcardRecords cannot be negative")
+	}
+
+	cidrs := append(append([]string{}, config.ServiceCIDRs...), config.PodCIDRs...)
+	for _, cidr := range append(cidrs, config.ReverseRecordExcludedCIDRs...) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid CIDR %q: %v", cidr, err)
+		}
+	}
+
+	if config.ForwardUnknownReverseQueries && len(cidrs) == 0 {
+		return fmt.Errorf("forwardUnknownReverseQueries requires serviceCIDRs or podCIDRs")
+	}
+
+	if config.NotReadySubdomain != "" && len(validation.IsDNS1123Label(config.NotReadySubdomain)) != 0 {
+		return fmt.Errorf("invalid notReadySubdomain: %q", config.NotReadySubdomain)
+	}
+
+	if config.ReadySubdomain != "" {
+		if len(validation.IsDNS1123Label(config.ReadySubdomain)) != 0 {
+			return fmt.Errorf("invalid readySubdomain: %q", config.ReadySubdomain)
+		}
+		if config.ReadySubdomain == config.NotReadySubdomain {
+			return fmt.Errorf("readySubdomain and notReadySubdomain cannot be the same: %q", config.ReadySubdomain)
+		}
+	}
+
+	if config.MaxConcurrentFederationFallbacks < 0 {
+		return fmt.Errorf("maxConcurrentFederationFallbacks cannot be negative")
+	}
+
+	if config.ServiceRemovalGracePeriod.Duration < 0 {
+		return fmt.Errorf("serviceRemovalGracePeriod cannot be negative")
+	}
+
+	if config.ReconcileInterval.Duration < 0 {
+		return fmt.Errorf("reconcileInterval cannot be negative")
+	}
+
+	if config.PodSubdomainApexIP != "" && net.ParseIP(config.PodSubdomainApexIP) == nil {
+		return fmt.Errorf("invalid podSubdomainApexIP: %q", config.PodSubdomainApexIP)
+	}
+
+	for _, label := range []string{config.FallbackClusterZone, config.FallbackClusterRegion} {
+		if label != "" && len(validation.IsDNS1123Label(label)) != 0 {
+			return fmt.Errorf("invalid fallback cluster zone or region: %q", label)
+		}
+	}
+
+	if config.HeadlessTransitionWindow.Duration < 0 {
+		return fmt.Errorf("headlessTransitionWindow cannot be negative")
+	}
+
+	if config.NegativeCacheTTL.Duration < 0 {
+		return fmt.Errorf("negativeCacheTTL cannot be negative")
+	}
+
+	if config.RecordMaxAge.Duration < 0 {
+		return fmt.Errorf("recordMaxAge cannot be negative")
+	}
+
+	if config.MaxCacheBytes < 0 {
+		return fmt.Errorf("maxCacheBytes cannot be negative")
+	}
+
+	if config.TTLJitterPercent < 0 || config.TTLJitterPercent > 100 {
+		return fmt.Errorf("ttlJitterPercent must be between 0 and 100, got %d", config.TTLJitterPercent)
+	}
+
+	if config.MaxTTL != 0 && config.MinTTL > config.MaxTTL {
+		return fmt.Errorf("minTTL (%d) cannot be greater than maxTTL (%d)", config.MinTTL, config.MaxTTL)
+	}
+
+	for _, family := range config.PodRecordIPFamilies {
+		if family != v1.IPv4Protocol && family != v1.IPv6Protocol {
+			return fmt.Errorf("invalid podRecordIPFamilies: %q", family)
+		}
+	}
+
 	return nil
 }
 
@@ -90,29 +532,39 @@ func (config *Config) validateFederations() error {
 
 func (config *Config) validateStubDomains() error {
 	for domain, nsList := range config.StubDomains {
-		if len(validation.IsDNS1123Subdomain(domain)) != 0 {
-			return fmt.Errorf("invalid domain name: %q", domain)
+		if err := ValidateStubDomain(domain, nsList); err != nil {
+			return err
 		}
+	}
 
-		for _, ns := range nsList {
-			host, port, err := net.SplitHostPort(ns)
-			// it can error if the port is missing
-			// or if there are too many colons (invalid host)
-			// so we assume that ns is passed without port
-			// and fail later in validation if the host was invalid
-			if err != nil {
-				host = ns
-			}
-			// Validate port if specified
-			if port != "" {
-				if _, err := strconv.ParseUint(port, 10, 16); err != nil {
-					return fmt.Errorf("invalid nameserver: %q", ns)
-				}
-			}
-			if len(validation.IsValidIP(host)) > 0 && len(validation.IsDNS1123Subdomain(ns)) > 0 {
+	return nil
+}
+
+// ValidateStubDomain validates the given stub domain and its nameservers,
+// which are either IPs, with an optional port, or names of nameservers.
+func ValidateStubDomain(domain string, nsList []string) error {
+	if len(validation.IsDNS1123Subdomain(domain)) != 0 {
+		return fmt.Errorf("invalid domain name: %q", domain)
+	}
+
+	for _, ns := range nsList {
+		if _, _, err := util.ValidateNameserverIpAndPort(ns); err == nil {
+			continue
+		}
+		// Not a valid IP, with an optional port: the name of a
+		// nameserver.
+		host, port, err := net.SplitHostPort(ns)
+		if err != nil {
+			host, port = ns, ""
+		}
+		if port != "" {
+			if _, err := strconv.ParseUint(port, 10, 16); err != nil {
 				return fmt.Errorf("invalid nameserver: %q", ns)
 			}
 		}
+		if net.ParseIP(host) != nil || len(validation.IsDNS1123Subdomain(host)) != 0 {
+			return fmt.Errorf("invalid nameserver: %q", ns)
+		}
 	}
 
 	return nil
@@ -130,3 +582,65 @@ func (config *Config) validateUpstreamNameserver() error {
 	}
 	return nil
 }
+
+func (config *Config) validateNamespaceUpstreamNameservers() error {
+	for namespace, nameServers := range config.NamespaceUpstreamNameservers {
+		if len(validation.IsDNS1123Label(namespace)) != 0 {
+			return fmt.Errorf("invalid namespace: %q", namespace)
+		}
+		if len(nameServers) == 0 || len(nameServers) > 3 {
+			return fmt.Errorf("namespace %q must have between one and three upstream nameservers", namespace)
+		}
+		for _, nameServer := range nameServers {
+			if _, _, err := util.ValidateNameserverIpAndPort(nameServer); err != nil {
+				return fmt.Errorf("invalid upstream nameserver of namespace %q: %v", namespace, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (config *Config) validateEndpointStabilityTTL() error {
+	if config.EndpointStabilityTTL == nil {
+		return nil
+	}
+	if config.EndpointStabilityTTL.MinTTL > config.EndpointStabilityTTL.MaxTTL {
+		return fmt.Errorf("endpointStabilityTTL minTTL (%d) cannot be greater than maxTTL (%d)",
+			config.EndpointStabilityTTL.MinTTL, config.EndpointStabilityTTL.MaxTTL)
+	}
+	if config.EndpointStabilityTTL.RampPeriod.Duration <= 0 {
+		return fmt.Errorf("endpointStabilityTTL rampPeriod must be positive")
+	}
+	return nil
+}
+
+func (config *Config) validateHealthProbe() error {
+	if config.HealthProbe == nil {
+		return nil
+	}
+	if len(validation.IsDNS1123Subdomain(strings.TrimSuffix(config.HealthProbe.Name, "."))) != 0 {
+		return fmt.Errorf("invalid healthProbe name: %q", config.HealthProbe.Name)
+	}
+	if net.ParseIP(config.HealthProbe.IP) == nil {
+		return fmt.Errorf("invalid healthProbe ip: %q", config.HealthProbe.IP)
+	}
+	return nil
+}
+
+func (config *Config) validateChaosRecords() error {
+	for name := range config.ChaosRecords {
+		if len(validation.IsDNS1123Subdomain(strings.TrimSuffix(name, "."))) != 0 {
+			return fmt.Errorf("invalid chaos record name: %q", name)
+		}
+	}
+	return nil
+}
+
+func (config *Config) validateAdditionalDomains() error {
+	for _, domain := range config.AdditionalDomains {
+		if len(validation.IsDNS1123Subdomain(strings.TrimSuffix(domain, "."))) != 0 {
+			return fmt.Errorf("invalid additional domain: %q", domain)
+		}
+	}
+	return nil
+}
@@ -18,8 +18,11 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	types "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestValidate(t *testing.T) {
@@ -31,6 +34,7 @@ func TestValidate(t *testing.T) {
 		{StubDomains: map[string][]string{"foo.com": []string{"1.2.3.4"}}},
 		{StubDomains: map[string][]string{"foo.com": []string{"1.2.3.4:32564"}}},
 		{StubDomains: map[string][]string{"foo.com": []string{"ns.foo.com"}}},
+		{StubDomains: map[string][]string{"foo.com": []string{"ns.foo.com:5353"}}},
 		{StubDomains: map[string][]string{
 			"foo.com": []string{"ns.foo.com"},
 			"bar.com": []string{"1.2.3.4"},
@@ -45,6 +49,39 @@ func TestValidate(t *testing.T) {
 		{UpstreamNameservers: []string{"1.2.3.4", "8.8.4.4", "8.8.8.8"}},
 		{UpstreamNameservers: []string{"1.2.3.4:53"}},
 		{UpstreamNameservers: []string{"[2001:db8:2:2:2::2]:10053", "2001:db8:3:3:3::3"}},
+		{EndpointStabilityTTL: &StabilityTTL{MinTTL: 5, MaxTTL: 300, RampPeriod: types.Duration{Duration: time.Hour}}},
+		{EndpointStabilityTTL: &StabilityTTL{MinTTL: 30, MaxTTL: 30, RampPeriod: types.Duration{Duration: time.Minute}}},
+		{ChaosRecords: map[string]string{"version.bind": "1.0", "hostname.bind.": "dns-1"}},
+		{AdditionalDomains: []string{"cluster.example.com", "new.local."}},
+		{KubernetesServiceIP: "10.0.0.1"},
+		{DNSServiceIP: "10.0.0.10"},
+		{MaxEndpointAddresses: 1000},
+		{MaxWildcardRecords: 100},
+		{ServiceRemovalGracePeriod: types.Duration{Duration: 30 * time.Second}},
+		{ReconcileInterval: types.Duration{Duration: 5 * time.Minute}, ReconcileRepair: true},
+		{PodRecordIPFamilies: []v1.IPFamily{v1.IPv4Protocol}},
+		{PodRecordIPFamilies: []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol}},
+		{HealthProbe: &HealthProbeRecord{Name: "dns-health.cluster.local.", IP: "127.0.0.1"}},
+		{HealthProbe: &HealthProbeRecord{Name: "dns-health.cluster.local", IP: "::1"}},
+		{MinTTL: 5},
+		{MinTTL: 5, MaxTTL: 5},
+		{MinTTL: 5, MaxTTL: 300},
+		{AnswerPodSubdomainApex: true},
+		{AnswerPodSubdomainApex: true, PodSubdomainApexIP: "127.0.0.1"},
+		{FallbackClusterZone: "onprem-a", FallbackClusterRegion: "onprem"},
+		{MaxConcurrentFederationFallbacks: 16},
+		{ServiceCIDRs: []string{"10.96.0.0/12", "fd00:10:96::/112"}, PodCIDRs: []string{"10.244.0.0/16"}},
+		{ReverseRecordExcludedCIDRs: []string{"10.96.128.0/17", "fd00:10:96::ff00/120"}},
+		{ForwardUnknownReverseQueries: true, PodCIDRs: []string{"10.244.0.0/16"}},
+		{NotReadySubdomain: "notready"},
+		{ReadySubdomain: "ready", NotReadySubdomain: "notready"},
+		{WithholdIncompleteServices: true},
+		{TTLJitterPercent: 10, MinTTL: 5, MaxTTL: 300},
+		{NamespaceUpstreamNameservers: map[string][]string{"tenant-a": {"10.1.0.10", "10.1.0.11:5353"}}},
+		{MaxCacheBytes: 64 << 20},
+		{HeadlessTransitionWindow: types.Duration{Duration: time.Minute}},
+		{NegativeCacheTTL: types.Duration{Duration: 5 * time.Second}},
+		{RecordMaxAge: types.Duration{Duration: time.Hour}},
 	} {
 		err := testCase.Validate()
 		assert.Nil(t, err, "should be valid: %+v", testCase)
@@ -57,10 +94,104 @@ func TestValidate(t *testing.T) {
 		{StubDomains: map[string][]string{"$$$$": []string{"1.2.3.4"}}},
 		{StubDomains: map[string][]string{"foo": []string{"$$$$"}}},
 		{StubDomains: map[string][]string{"foo.com": []string{"1.2.3.4:65564"}}},
+		{StubDomains: map[string][]string{"foo.com": []string{"1.2.3.4:0"}}},
+		{StubDomains: map[string][]string{"foo.com": []string{"ns.foo.com:dns"}}},
 		{UpstreamNameservers: []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "4.4.4.4"}},
 		{UpstreamNameservers: []string{"1.1.1.1:abc", "1.1.1.1:", "1.1.1.1:123456789"}},
+		{EndpointStabilityTTL: &StabilityTTL{MinTTL: 300, MaxTTL: 5, RampPeriod: types.Duration{Duration: time.Hour}}},
+		{EndpointStabilityTTL: &StabilityTTL{MinTTL: 5, MaxTTL: 300}},
+		{ChaosRecords: map[string]string{"$$$$": "1.0"}},
+		{AdditionalDomains: []string{"$$$$"}},
+		{KubernetesServiceIP: "kubernetes"},
+		{DNSServiceIP: "kube-dns"},
+		{MaxEndpointAddresses: -1},
+		{MaxWildcardRecords: -1},
+		{ServiceRemovalGracePeriod: types.Duration{Duration: -time.Second}},
+		{ReconcileInterval: types.Duration{Duration: -time.Minute}},
+		{PodRecordIPFamilies: []v1.IPFamily{"IPv5"}},
+		{HealthProbe: &HealthProbeRecord{Name: "dns_health.cluster.local.", IP: "127.0.0.1"}},
+		{HealthProbe: &HealthProbeRecord{Name: "dns-health.cluster.local."}},
+		{MinTTL: 300, MaxTTL: 5},
+		{AnswerPodSubdomainApex: true, PodSubdomainApexIP: "localhost"},
+		{FallbackClusterZone: "zone.a"},
+		{FallbackClusterRegion: "Region"},
+		{MaxConcurrentFederationFallbacks: -1},
+		{ServiceCIDRs: []string{"10.96.0.0"}},
+		{PodCIDRs: []string{"10.244.0.0/33"}},
+		{ReverseRecordExcludedCIDRs: []string{"10.96.128.0/17", "reserved"}},
+		{ForwardUnknownReverseQueries: true},
+		{NotReadySubdomain: "not.ready"},
+		{ReadySubdomain: "Ready!"},
+		{ReadySubdomain: "pods", NotReadySubdomain: "pods"},
+		{TTLJitterPercent: -1},
+		{TTLJitterPercent: 101},
+		{NamespaceUpstreamNameservers: map[string][]string{"Tenant": {"10.1.0.10"}}},
+		{NamespaceUpstreamNameservers: map[string][]string{"tenant-a": {}}},
+		{NamespaceUpstreamNameservers: map[string][]string{"tenant-a": {"ns.tenant-a.example.com"}}},
+		{NamespaceUpstreamNameservers: map[string][]string{"tenant-a": {"1.1.1.1", "2.2.2.2", "3.3.3.3", "4.4.4.4"}}},
+		{MaxCacheBytes: -1},
+		{HeadlessTransitionWindow: types.Duration{Duration: -time.Minute}},
+		{NegativeCacheTTL: types.Duration{Duration: -time.Second}},
+		{RecordMaxAge: types.Duration{Duration: -time.Second}},
 	} {
 		err := testCase.Validate()
 		assert.NotNil(t, err, "should not be valid: %+v", testCase)
 	}
 }
+
+func TestAnswersPodRecords(t *testing.T) {
+	config := &Config{}
+	assert.True(t, config.AnswersPodRecords(v1.IPv4Protocol))
+	assert.True(t, config.AnswersPodRecords(v1.IPv6Protocol))
+
+	config.PodRecordIPFamilies = []v1.IPFamily{v1.IPv4Protocol}
+	assert.True(t, config.AnswersPodRecords(v1.IPv4Protocol))
+	assert.False(t, config.AnswersPodRecords(v1.IPv6Protocol))
+}
+
+func TestBoundTTL(t *testing.T) {
+	config := &Config{}
+	assert.Equal(t, uint32(0), config.BoundTTL(0))
+	assert.Equal(t, uint32(864000), config.BoundTTL(864000))
+
+	config = &Config{MinTTL: 5, MaxTTL: 300}
+	assert.Equal(t, uint32(5), config.BoundTTL(0))
+	assert.Equal(t, uint32(30), config.BoundTTL(30))
+	assert.Equal(t, uint32(300), config.BoundTTL(864000))
+}
+
+func TestOverlappingCIDRs(t *testing.T) {
+	config := &Config{
+		ServiceCIDRs: []string{"10.96.0.0/12", "fd00:10:96::/112"},
+		PodCIDRs:     []string{"10.244.0.0/16", "fd00:10:244::/64"},
+	}
+	assert.Empty(t, config.OverlappingCIDRs())
+
+	config.PodCIDRs = []string{"10.100.0.0/16", "10.0.0.0/8", "10.112.0.0/16"}
+	assert.Equal(t, []string{"10.96.0.0/12 and 10.100.0.0/16", "10.96.0.0/12 and 10.0.0.0/8"}, config.OverlappingCIDRs())
+}
+
+func TestExcludesReverseRecord(t *testing.T) {
+	config := &Config{}
+	assert.False(t, config.ExcludesReverseRecord("10.96.200.1"))
+
+	config.ReverseRecordExcludedCIDRs = []string{"10.96.128.0/17", "fd00:10:96::ff00/120"}
+	assert.True(t, config.ExcludesReverseRecord("10.96.200.1"))
+	assert.True(t, config.ExcludesReverseRecord("fd00:10:96::ff01"))
+	assert.False(t, config.ExcludesReverseRecord("10.96.0.10"))
+	assert.False(t, config.ExcludesReverseRecord("fd00:10:96::1"))
+	assert.False(t, config.ExcludesReverseRecord("not-an-ip"))
+}
+
+func TestInClusterCIDRs(t *testing.T) {
+	config := &Config{}
+	assert.False(t, config.InClusterCIDRs("10.96.0.10"))
+
+	config.ServiceCIDRs = []string{"10.96.0.0/12"}
+	config.PodCIDRs = []string{"10.244.0.0/16", "fd00:10:244::/64"}
+	assert.True(t, config.InClusterCIDRs("10.96.0.10"))
+	assert.True(t, config.InClusterCIDRs("10.244.1.2"))
+	assert.True(t, config.InClusterCIDRs("fd00:10:244::1"))
+	assert.False(t, config.InClusterCIDRs("192.168.0.1"))
+	assert.False(t, config.InClusterCIDRs("not-an-ip"))
+}
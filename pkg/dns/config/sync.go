@@ -63,6 +63,10 @@ type kubeSync struct {
 	channel chan *Config
 
 	latestVersion string
+
+	// stubDomains are the stub domains of the latest valid configuration,
+	// whose values are kept for the stub domains that become invalid.
+	stubDomains map[string][]string
 }
 
 var _ Sync = (*kubeSync)(nil)
@@ -113,6 +117,7 @@ func (sync *kubeSync) processUpdate(result syncResult, buildUnchangedConfig bool
 
 	if result.Version == "" && len(result.Data) == 0 {
 		config = NewDefaultConfig()
+		sync.stubDomains = config.StubDomains
 		return
 	}
 
@@ -122,6 +127,138 @@ func (sync *kubeSync) processUpdate(result syncResult, buildUnchangedConfig bool
 		"federations":         updateFederations,
 		"stubDomains":         updateStubDomains,
 		"upstreamNameservers": updateUpstreamNameservers,
+		"endpointStabilityTTL": updateJSONField(func(config *Config) interface{} {
+			return &config.EndpointStabilityTTL
+		}),
+		"chaosRecords": updateJSONField(func(config *Config) interface{} {
+			return &config.ChaosRecords
+		}),
+		"additionalDomains": updateJSONField(func(config *Config) interface{} {
+			return &config.AdditionalDomains
+		}),
+		"serviceSRVRecords": updateJSONField(func(config *Config) interface{} {
+			return &config.ServiceSRVRecords
+		}),
+		"kubernetesServiceIP": updateJSONField(func(config *Config) interface{} {
+			return &config.KubernetesServiceIP
+		}),
+		"dnsServiceIP": updateJSONField(func(config *Config) interface{} {
+			return &config.DNSServiceIP
+		}),
+		"maxEndpointAddresses": updateJSONField(func(config *Config) interface{} {
+			return &config.MaxEndpointAddresses
+		}),
+		"maxWildcardRecords": updateJSONField(func(config *Config) interface{} {
+			return &config.MaxWildcardRecords
+		}),
+		"normalizeSRVWeights": updateJSONField(func(config *Config) interface{} {
+			return &config.NormalizeSRVWeights
+		}),
+		"resolveFederatedExternalNames": updateJSONField(func(config *Config) interface{} {
+			return &config.ResolveFederatedExternalNames
+		}),
+		"collapseFederationCNAMEs": updateJSONField(func(config *Config) interface{} {
+			return &config.CollapseFederationCNAMEs
+		}),
+		"targetRefPTRRecords": updateJSONField(func(config *Config) interface{} {
+			return &config.TargetRefPTRRecords
+		}),
+		"unbackedServiceTTL": updateJSONField(func(config *Config) interface{} {
+			return &config.UnbackedServiceTTL
+		}),
+		"lowercasePortNames": updateJSONField(func(config *Config) interface{} {
+			return &config.LowercasePortNames
+		}),
+		"preferLocalRecords": updateJSONField(func(config *Config) interface{} {
+			return &config.PreferLocalRecords
+		}),
+		"shuffleRecords": updateJSONField(func(config *Config) interface{} {
+			return &config.ShuffleRecords
+		}),
+		"serviceRemovalGracePeriod": updateJSONField(func(config *Config) interface{} {
+			return &config.ServiceRemovalGracePeriod
+		}),
+		"aggregateProtocolSRVRecords": updateJSONField(func(config *Config) interface{} {
+			return &config.AggregateProtocolSRVRecords
+		}),
+		"reconcileInterval": updateJSONField(func(config *Config) interface{} {
+			return &config.ReconcileInterval
+		}),
+		"reconcileRepair": updateJSONField(func(config *Config) interface{} {
+			return &config.ReconcileRepair
+		}),
+		"podRecordIPFamilies": updateJSONField(func(config *Config) interface{} {
+			return &config.PodRecordIPFamilies
+		}),
+		"healthProbe": updateJSONField(func(config *Config) interface{} {
+			return &config.HealthProbe
+		}),
+		"minTTL": updateJSONField(func(config *Config) interface{} {
+			return &config.MinTTL
+		}),
+		"maxTTL": updateJSONField(func(config *Config) interface{} {
+			return &config.MaxTTL
+		}),
+		"ttlJitterPercent": updateJSONField(func(config *Config) interface{} {
+			return &config.TTLJitterPercent
+		}),
+		"externalNameReverseRecords": updateJSONField(func(config *Config) interface{} {
+			return &config.ExternalNameReverseRecords
+		}),
+		"namespaceUpstreamNameservers": updateJSONField(func(config *Config) interface{} {
+			return &config.NamespaceUpstreamNameservers
+		}),
+		"answerPodSubdomainApex": updateJSONField(func(config *Config) interface{} {
+			return &config.AnswerPodSubdomainApex
+		}),
+		"podSubdomainApexIP": updateJSONField(func(config *Config) interface{} {
+			return &config.PodSubdomainApexIP
+		}),
+		"fallbackClusterZone": updateJSONField(func(config *Config) interface{} {
+			return &config.FallbackClusterZone
+		}),
+		"fallbackClusterRegion": updateJSONField(func(config *Config) interface{} {
+			return &config.FallbackClusterRegion
+		}),
+		"maxConcurrentFederationFallbacks": updateJSONField(func(config *Config) interface{} {
+			return &config.MaxConcurrentFederationFallbacks
+		}),
+		"serviceCIDRs": updateJSONField(func(config *Config) interface{} {
+			return &config.ServiceCIDRs
+		}),
+		"podCIDRs": updateJSONField(func(config *Config) interface{} {
+			return &config.PodCIDRs
+		}),
+		"forwardUnknownReverseQueries": updateJSONField(func(config *Config) interface{} {
+			return &config.ForwardUnknownReverseQueries
+		}),
+		"reverseRecordExcludedCIDRs": updateJSONField(func(config *Config) interface{} {
+			return &config.ReverseRecordExcludedCIDRs
+		}),
+		"notReadySubdomain": updateJSONField(func(config *Config) interface{} {
+			return &config.NotReadySubdomain
+		}),
+		"readySubdomain": updateJSONField(func(config *Config) interface{} {
+			return &config.ReadySubdomain
+		}),
+		"withholdIncompleteServices": updateJSONField(func(config *Config) interface{} {
+			return &config.WithholdIncompleteServices
+		}),
+		"soaRecord": updateJSONField(func(config *Config) interface{} {
+			return &config.SOARecord
+		}),
+		"maxCacheBytes": updateJSONField(func(config *Config) interface{} {
+			return &config.MaxCacheBytes
+		}),
+		"headlessTransitionWindow": updateJSONField(func(config *Config) interface{} {
+			return &config.HeadlessTransitionWindow
+		}),
+		"negativeCacheTTL": updateJSONField(func(config *Config) interface{} {
+			return &config.NegativeCacheTTL
+		}),
+		"recordMaxAge": updateJSONField(func(config *Config) interface{} {
+			return &config.RecordMaxAge
+		}),
 	} {
 		value, ok := result.Data[key]
 		if !ok {
@@ -135,15 +272,38 @@ func (sync *kubeSync) processUpdate(result syncResult, buildUnchangedConfig bool
 		}
 	}
 
+	sync.keepValidStubDomains(config)
+
 	if err = config.Validate(); err != nil {
 		klog.Errorf("Invalid configuration: %v (value was %+v), ignoring update", err, config)
 		config = nil
 		return
 	}
+	sync.stubDomains = config.StubDomains
 
 	return
 }
 
+// keepValidStubDomains replaces the invalid stub domains of the given
+// configuration with their value in the latest valid configuration, or
+// removes them if they had none, so that an invalid entry doesn't cause
+// the whole update to be ignored.
+func (sync *kubeSync) keepValidStubDomains(config *Config) {
+	for domain, nsList := range config.StubDomains {
+		err := ValidateStubDomain(domain, nsList)
+		if err == nil {
+			continue
+		}
+		if previous, ok := sync.stubDomains[domain]; ok {
+			klog.Errorf("Invalid stub domain %q: %v, keeping its previous nameservers %v", domain, err, previous)
+			config.StubDomains[domain] = previous
+		} else {
+			klog.Errorf("Invalid stub domain %q: %v, ignoring it", domain, err)
+			delete(config.StubDomains, domain)
+		}
+	}
+}
+
 type fieldUpdateFn func(key string, data string, config *Config) error
 
 func updateFederations(key string, value string, config *Config) error {
@@ -177,3 +337,17 @@ func updateUpstreamNameservers(key string, value string, config *Config) error {
 
 	return nil
 }
+
+// updateJSONField returns a fieldUpdateFn that unmarshals the JSON value
+// into the Config field returned by field.
+func updateJSONField(field func(config *Config) interface{}) fieldUpdateFn {
+	return func(key string, value string, config *Config) error {
+		if err := json.Unmarshal([]byte(value), field(config)); err != nil {
+			klog.Errorf("Invalid JSON %q: %v", value, err)
+			return err
+		}
+		klog.V(2).Infof("Updated %v to %v", key, value)
+
+		return nil
+	}
+}
@@ -20,3 +20,63 @@ func TestEmptyInitialSync(t *testing.T) {
 		t.Fatalf("expected default config, got %#v", config)
 	}
 }
+
+func TestStubDomainsSync(t *testing.T) {
+	s := newSync(newMockSource(syncResult{}, nil)).(*kubeSync)
+	update := func(version, stubDomains string) *Config {
+		config, _, err := s.processUpdate(syncResult{
+			Version: version,
+			Data:    map[string]string{"stubDomains": stubDomains},
+		}, false)
+		if err != nil {
+			t.Fatalf("processUpdate(%q) failed: %v", stubDomains, err)
+		}
+		return config
+	}
+	for _, testCase := range []struct {
+		stubDomains string
+		expected    map[string][]string
+	}{
+		// Add.
+		{
+			`{"acme.local": ["1.2.3.4"]}`,
+			map[string][]string{"acme.local": {"1.2.3.4"}},
+		},
+		{
+			`{"acme.local": ["1.2.3.4"], "corp.internal": ["[2001:db8::1]:5353"]}`,
+			map[string][]string{"acme.local": {"1.2.3.4"}, "corp.internal": {"[2001:db8::1]:5353"}},
+		},
+		// Update.
+		{
+			`{"acme.local": ["1.2.3.5", "1.2.3.6:5353"], "corp.internal": ["[2001:db8::1]:5353"]}`,
+			map[string][]string{"acme.local": {"1.2.3.5", "1.2.3.6:5353"}, "corp.internal": {"[2001:db8::1]:5353"}},
+		},
+		// An invalid entry keeps its previous value.
+		{
+			`{"acme.local": ["1.2.3.5:99999"], "corp.internal": ["[2001:db8::2]:5353"]}`,
+			map[string][]string{"acme.local": {"1.2.3.5", "1.2.3.6:5353"}, "corp.internal": {"[2001:db8::2]:5353"}},
+		},
+		// Or is ignored if it had none.
+		{
+			`{"acme.local": ["1.2.3.5"], "$$$$": ["1.2.3.4"]}`,
+			map[string][]string{"acme.local": {"1.2.3.5"}},
+		},
+		// Remove.
+		{
+			`{}`,
+			map[string][]string{},
+		},
+		{
+			`{"acme.local": ["1.2.3.5:99999"]}`,
+			map[string][]string{},
+		},
+	} {
+		config := update(testCase.stubDomains, testCase.stubDomains)
+		if config == nil {
+			t.Fatalf("processUpdate(%q) ignored the update", testCase.stubDomains)
+		}
+		if !reflect.DeepEqual(config.StubDomains, testCase.expected) {
+			t.Errorf("processUpdate(%q) = %v, want %v", testCase.stubDomains, config.StubDomains, testCase.expected)
+		}
+	}
+}
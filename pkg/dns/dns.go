@@ -18,8 +18,14 @@ package dns
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -29,15 +35,19 @@ import (
 	"k8s.io/apimachinery/pkg/fields"
 	clientset "k8s.io/client-go/kubernetes"
 	kcache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/validation"
-	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/dns/pkg/dns/config"
 	"k8s.io/dns/pkg/dns/treecache"
 	"k8s.io/dns/pkg/dns/util"
 
 	etcd "github.com/coreos/etcd/client"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 	skymsg "github.com/skynetservices/skydns/msg"
 	"github.com/skynetservices/skydns/server"
 	"k8s.io/klog/v2"
@@ -50,12 +60,78 @@ const (
 	// A subdomain added to the user specified domain for all pods.
 	podSubdomain = "pod"
 
+	// The name label of the SRV records generated for every port of a
+	// service, regardless of the port name, e.g.
+	// _service._tcp.mysvc.myns.svc.cluster.local.
+	serviceSRVLabel = "_service"
+
+	// Name of the service of the apiserver in the default namespace.
+	kubernetesServiceName = "kubernetes"
+
+	// Name of the service of kube-dns in the kube-system namespace.
+	dnsServiceName = "kube-dns"
+
+	// Maximum number of records returned for a wildcard query unless
+	// configured otherwise.
+	defaultMaxWildcardRecords = 1000
+
+	// Number of times the cleanup of an endpoints update is retried.
+	maxEndpointsRetries = 5
+
 	// Resync period for the kube controller loop.
 	resyncPeriod = 5 * time.Minute
+
+	// ReverseRecordHostAnnotation is the annotation of a service overriding
+	// the host the reverse records of its cluster IPs point to, e.g. a
+	// vanity name, instead of <service>.<ns>.svc.<domain>.
+	ReverseRecordHostAnnotation = "dns.kubernetes.io/reverse-record-host"
+
+	// AggregateRecordsOnlyAnnotation is the annotation of a headless
+	// service that, if "true", only serves the records of its endpoints
+	// under the name of the service, not under a name per endpoint, e.g.
+	// <hostname>.<service>.<ns>.svc.<domain>. The SRV and PTR records of
+	// the endpoints, which point to these names, are not served either.
+	AggregateRecordsOnlyAnnotation = "dns.kubernetes.io/aggregate-records-only"
+
+	// CanaryEndpointsAnnotation is the annotation of the endpoints of a
+	// headless service listing, separated by commas, the IPs or hostnames
+	// of its canary endpoints.
+	CanaryEndpointsAnnotation = "dns.kubernetes.io/canary-endpoints"
+	// CanarySRVWeightAnnotation is the annotation of a headless service
+	// setting the weight, from 0 to 65535, of the SRV records of its canary
+	// endpoints, e.g. "1" to send them a fraction of the traffic the others
+	// get. It overrides normalizeSRVWeights for these records. Canary
+	// endpoints get the same weight as the others by default.
+	CanarySRVWeightAnnotation = "dns.kubernetes.io/canary-srv-weight"
+
+	// SRVExcludedPortsAnnotation is the annotation of a service listing,
+	// separated by commas, the names of the ports no SRV record is
+	// generated for, e.g. "metrics,admin".
+	SRVExcludedPortsAnnotation = "dns.kubernetes.io/srv-excluded-ports"
+
+	// ExternalNameTargetsAnnotation is the annotation of an ExternalName
+	// service listing, separated by commas, secondary targets answered
+	// after its externalName, e.g. for failover. Each target is answered
+	// with a CNAME record of lower priority than the previous one.
+	ExternalNameTargetsAnnotation = "dns.kubernetes.io/external-name-targets"
+
+	// TTLAnnotation is the annotation of a service setting the TTL, in
+	// seconds, of its records instead of util.DefaultTTL, e.g. "300" for a
+	// service whose cluster IP never changes. The TTL is capped to
+	// maxServiceTTL, and to the maxTTL of the configuration when answered.
+	TTLAnnotation = "kubernetes.io/dns-ttl"
+
+	// Maximum TTL a service can set with the TTLAnnotation.
+	maxServiceTTL = 24 * 60 * 60
 )
 
 var (
 	defaultResolvFile = "/etc/resolv.conf"
+
+	// ErrInitialSyncTimeout is the error of StartWithContext if the initial
+	// listing of the services and endpoints doesn't complete within the
+	// initial sync timeout.
+	ErrInitialSyncTimeout = errors.New("timeout waiting for initialization")
 )
 
 type KubeDNS struct {
@@ -65,6 +141,10 @@ type KubeDNS struct {
 
 	// skydns points to the skydns server instance for configuration syncing.
 	SkyDNSConfig *server.Config
+	// UpdateStubZones, if set, makes the skydns server reload the
+	// nameservers of the stub domains, which it reads from the records of
+	// KubeDNS. It is called after every configuration update.
+	UpdateStubZones func()
 
 	// domain for which this DNS Server is authoritative.
 	domain string
@@ -75,6 +155,14 @@ type KubeDNS struct {
 
 	// endpointsStore that contains all the endpoints in the system.
 	endpointsStore kcache.Store
+	// useEndpointSlices is whether the endpoints are aggregated from the
+	// EndpointSlices of the services rather than watched.
+	useEndpointSlices bool
+	// endpointSlices maps the namespace/name key of the services to each
+	// of their converted EndpointSlices, by slice name. Access to this is
+	// coordinated using endpointSlicesLock.
+	endpointSlices     map[string]map[string]*convertedEndpointSlice
+	endpointSlicesLock sync.Mutex
 	// servicesStore that contains all the services in the system.
 	servicesStore kcache.Store
 	// nodesStore contains some subset of nodes in the system so that we
@@ -99,7 +187,7 @@ type KubeDNS struct {
 	// the cacheLock before invoking methods on cache the cache is not
 	// thread-safe, and the caller can guarantee thread safety by using
 	// the cacheLock
-	cacheLock sync.RWMutex
+	cacheLock instrumentedRWMutex
 
 	// The domain for which this DNS Server is authoritative, in array
 	// format and reversed.  e.g. if domain is "cluster.local",
@@ -110,9 +198,20 @@ type KubeDNS struct {
 	endpointsController kcache.Controller
 	// serviceController invokes registered callbacks when services change.
 	serviceController kcache.Controller
+	// endpointsRetryQueue holds the endpoints updates whose reverse
+	// records could not be cleaned up, to retry them.
+	endpointsRetryQueue workqueue.RateLimitingInterface
+	// externalNameQueue holds the keys of the ExternalName services whose
+	// target is to be resolved for their reverse records.
+	externalNameQueue workqueue.RateLimitingInterface
 
 	// config set from the dynamic configuration source.
 	config *config.Config
+	// additionalDomainPaths are the additionalDomains of config, in the
+	// same format as domainPath. Records of the cluster domain are also
+	// served under each of them. Access to this is coordinated using
+	// configLock.
+	additionalDomainPaths [][]string
 	// configLock protects the config below.
 	configLock sync.RWMutex
 	// configSync manages synchronization of the config map
@@ -120,26 +219,204 @@ type KubeDNS struct {
 
 	// Initial timeout for endpoints and services to be synced from APIServer
 	initialSyncTimeout time.Duration
+
+	// clock is used to track the age of records.
+	clock clock.Clock
+	// endpointFirstSeen maps the key of a headless service to the time
+	// each of its endpoint IPs was first seen. Access to this is
+	// coordinated using cacheLock.
+	endpointFirstSeen map[string]map[string]time.Time
+	// serviceFirstSeen maps the key of a ClusterIP or ExternalName
+	// service to the time it was first seen. Access to this is
+	// coordinated using cacheLock.
+	serviceFirstSeen map[string]time.Time
+
+	// nodeListBreaker fails federation queries fast while listing the
+	// nodes keeps failing, e.g. when the API server is degraded.
+	nodeListBreaker circuitBreaker
+
+	// federationFallbacks bounds the number of federation redirects
+	// computed at once.
+	federationFallbacks concurrencyLimiter
+
+	// hashFunc computes the labels of the records, if set with
+	// WithHashFunc. If nil, labels are derived from the FNV-32a hash of
+	// the records.
+	hashFunc util.HashFunc
+
+	// serviceRecordHook returns the extra records of a service, if set
+	// with WithServiceRecordHook.
+	serviceRecordHook ServiceRecordHook
+
+	// namespaceAllowlist is the set of namespaces whose services are
+	// served, if set with WithNamespaceAllowlist. If nil, the services of
+	// all namespaces are served.
+	namespaceAllowlist sets.String
+
+	// metricsRegistry is the registry the prometheus collectors are
+	// registered with by NewKubeDNS, set with WithMetricsRegistry. It
+	// discards them by default.
+	metricsRegistry prometheus.Registerer
+	// cacheLockMetrics is whether the cache lock metrics are enabled, set
+	// with WithCacheLockMetrics.
+	cacheLockMetrics bool
+
+	// eventRecorder records the events emitted on services whose records
+	// can't be generated, set with WithEventRecorder. It discards them by
+	// default.
+	eventRecorder record.EventRecorder
+	// eventLock protects lastEvents.
+	eventLock sync.Mutex
+	// lastEvents maps the services events were recently emitted on, and
+	// their reason, to the time of the last one.
+	lastEvents map[eventKey]time.Time
+
+	// externalServices maps the key of the services injected with
+	// UpsertExternalService to their spec.
+	externalServices map[string]ExternalServiceSpec
+	// externalServicesLock serializes the updates of external services.
+	externalServicesLock sync.Mutex
+
+	// pinnedServices maps the key of the services whose records are pinned
+	// to their endpoints when they were pinned, if any.
+	pinnedServices map[string]*v1.Endpoints
+	// pinnedServicesLock protects pinnedServices.
+	pinnedServicesLock sync.RWMutex
+
+	// random is the source of randomness of the random choices made when
+	// answering queries.
+	random lockedRand
+
+	// pendingRemovals maps the key of the deleted services whose records
+	// are kept for the removal grace period to their pending removal.
+	pendingRemovals map[string]*pendingRemoval
+	// pendingRemovalsLock protects pendingRemovals.
+	pendingRemovalsLock sync.Mutex
+
+	// reconcileDrifts is the number of services found out of sync by the
+	// periodic reconciliation. Access to this is atomic.
+	reconcileDrifts uint64
+	// queries counts the queries answered by Records and ReverseRecord.
+	queries queryCounters
+	// namespaceLastQueried maps the namespaces to the last time the records
+	// of their services were queried, while the memory used by the records
+	// is limited. Access to this is coordinated using
+	// namespaceLastQueriedLock.
+	namespaceLastQueried     map[string]time.Time
+	namespaceLastQueriedLock sync.Mutex
+	// cacheEvictions counts the records evicted to keep the memory used by
+	// the records under the limit.
+	cacheEvictions cacheEvictions
+	// serviceTransitions maps the key of the services within their
+	// transition window between headless and ClusterIP to their
+	// transition. Access to this is coordinated using
+	// serviceTransitionsLock.
+	serviceTransitions     map[string]*serviceTransition
+	serviceTransitionsLock sync.Mutex
+	// negativeCache remembers the queries of Records recently found to
+	// have no record, while the negativeCacheTTL of the configuration is
+	// not 0.
+	negativeCache negativeCache
+	// running tracks the goroutines started by StartWithContext.
+	running sync.WaitGroup
+
+	// externalNameReverseIPs maps the IPs ExternalName targets resolve to
+	// the key of the ExternalName service their reverse record was
+	// registered for. Access to this is coordinated using cacheLock.
+	externalNameReverseIPs map[string]string
+	// shadowedReverseRecords maps the endpoint IPs that are also cluster
+	// IPs to the reverse records of the endpoints, which are only served
+	// once the cluster IPs are released. Access to this is coordinated
+	// using cacheLock.
+	shadowedReverseRecords map[string]*skymsg.Service
+	// externalNameTargets maps the key of the ExternalName services with
+	// secondary targets to their records. Access to this is coordinated
+	// using cacheLock.
+	externalNameTargets map[string][]*skymsg.Service
+	// seededServices maps the key of the services seeded by seedService
+	// that are not synced yet to their seed. Access to this is coordinated
+	// using cacheLock.
+	seededServices map[string]*serviceSeed
+	// soaSerial is the serial of the SOA record of the cluster domain,
+	// incremented every time the records change. Access to this is
+	// coordinated using cacheLock.
+	soaSerial uint32
+	// lookupHost resolves the ExternalName targets outside the cluster
+	// domain. If nil, net.DefaultResolver is used.
+	lookupHost func(ctx context.Context, host string) ([]string, error)
 }
 
-func NewKubeDNS(client clientset.Interface, clusterDomain string, timeout time.Duration, configSync config.Sync) *KubeDNS {
+// serviceSeed is the records served for a service by seedService until
+// the service is synced.
+type serviceSeed struct {
+	ip            string
+	label         string
+	record        *skymsg.Service
+	reverseRecord *skymsg.Service
+}
+
+// pendingRemoval is the deferred removal of the records of a deleted
+// service.
+type pendingRemoval struct {
+	service *v1.Service
+	timer   clock.Timer
+}
+
+// Option configures the KubeDNS built by NewKubeDNS.
+type Option func(*KubeDNS)
+
+// WithHashFunc makes KubeDNS label the records with the given function
+// instead of their FNV-32a hash.
+func WithHashFunc(hashFunc util.HashFunc) Option {
+	return func(kd *KubeDNS) {
+		kd.hashFunc = hashFunc
+	}
+}
+
+// NewKubeDNS returns a KubeDNS serving the records of the given cluster
+// domain. The given options are applied before the watches are set up.
+func NewKubeDNS(client clientset.Interface, clusterDomain string, timeout time.Duration, configSync config.Sync, opts ...Option) *KubeDNS {
 	kd := &KubeDNS{
 		kubeClient:          client,
 		domain:              clusterDomain,
 		cache:               treecache.NewTreeCache(),
-		cacheLock:           sync.RWMutex{},
 		nodesStore:          kcache.NewStore(kcache.MetaNamespaceKeyFunc),
 		reverseRecordMap:    make(map[string]*skymsg.Service),
 		clusterIPServiceMap: make(map[string]*v1.Service),
 		domainPath:          util.ReverseArray(strings.Split(strings.TrimRight(clusterDomain, "."), ".")),
 		initialSyncTimeout:  timeout,
+		clock:               clock.RealClock{},
+		endpointFirstSeen:   make(map[string]map[string]time.Time),
+		serviceFirstSeen:    make(map[string]time.Time),
+		endpointsRetryQueue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "endpoints"),
+		externalNameQueue:   workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "externalnames"),
+		eventRecorder:       nopEventRecorder{},
+		metricsRegistry:     nopRegisterer{},
+		lastEvents:          make(map[eventKey]time.Time),
+		externalServices:    make(map[string]ExternalServiceSpec),
+		pendingRemovals:     make(map[string]*pendingRemoval),
+
+		externalNameReverseIPs: make(map[string]string),
+		externalNameTargets:    make(map[string][]*skymsg.Service),
+		seededServices:         make(map[string]*serviceSeed),
+		// Start from the current time so that the serial keeps
+		// increasing across restarts.
+		soaSerial: uint32(time.Now().Unix()),
 
 		configLock: sync.RWMutex{},
 		configSync: configSync,
 	}
+	for _, opt := range opts {
+		opt(kd)
+	}
 
-	kd.setEndpointsStore()
+	if kd.useEndpointSlices {
+		kd.setEndpointSlicesStore()
+	} else {
+		kd.setEndpointsStore()
+	}
 	kd.setServicesStore()
+	kd.registerMetrics()
 
 	return kd
 }
@@ -159,75 +436,336 @@ func (kd *KubeDNS) loadDefaultNameserver() []string {
 }
 
 func (kd *KubeDNS) updateConfig(nextConfig *config.Config) {
-	kd.configLock.Lock()
-	defer kd.configLock.Unlock()
+	previousConfig, err := kd.applyConfig(nextConfig)
+	if err != nil {
+		klog.Errorf("Invalid configuration %+v, not applied: %v", *nextConfig, err)
+		kd.configLock.Lock()
+		if kd.SkyDNSConfig != nil && len(kd.SkyDNSConfig.Nameservers) == 0 {
+			// Fall back to resolv.conf on initialization failure.
+			kd.SkyDNSConfig.Nameservers = kd.loadDefaultNameserver()
+		}
+		kd.configLock.Unlock()
+		return
+	}
+	if previousConfig.ServiceSRVRecords != nextConfig.ServiceSRVRecords ||
+		previousConfig.LowercasePortNames != nextConfig.LowercasePortNames ||
+		previousConfig.NotReadySubdomain != nextConfig.NotReadySubdomain ||
+		previousConfig.ReadySubdomain != nextConfig.ReadySubdomain ||
+		previousConfig.WithholdIncompleteServices != nextConfig.WithholdIncompleteServices ||
+		!sets.NewString(previousConfig.ReverseRecordExcludedCIDRs...).Equal(sets.NewString(nextConfig.ReverseRecordExcludedCIDRs...)) {
+		// The records of every service depend on these settings.
+		kd.regenerateServiceRecords()
+	}
+	if previousConfig.ExternalNameReverseRecords != nextConfig.ExternalNameReverseRecords {
+		kd.resetExternalNameReverseRecords()
+	}
+	kd.seedService(metav1.NamespaceDefault, kubernetesServiceName, nextConfig.KubernetesServiceIP)
+	kd.seedService(metav1.NamespaceSystem, dnsServiceName, nextConfig.DNSServiceIP)
+	// Names may have records, e.g. of federations, under the new
+	// configuration.
+	kd.negativeCache.clear()
+	kd.updateStubZones()
+}
 
-	if kd.SkyDNSConfig != nil {
-		var nameServers []string
-		for _, nameServer := range nextConfig.UpstreamNameservers {
-			ip, port, err := util.ValidateNameserverIpAndPort(nameServer)
-			if err != nil {
-				klog.Errorf("Invalid nameserver %q: %v", nameServer, err)
-				if len(kd.SkyDNSConfig.Nameservers) == 0 {
-					// Fall back to resolv.conf on initialization failure.
-					kd.SkyDNSConfig.Nameservers = kd.loadDefaultNameserver()
-				}
-				return
-			}
-			nameServers = append(nameServers, net.JoinHostPort(ip, port))
+// applyConfig validates nextConfig and derives the state that depends on
+// it, then makes it the configuration in effect with a single acquisition
+// of configLock, so that readers never observe a partially applied
+// configuration. It returns the configuration previously in effect, or an
+// error if nextConfig is invalid, in which case nothing is changed.
+func (kd *KubeDNS) applyConfig(nextConfig *config.Config) (*config.Config, error) {
+	if err := nextConfig.Validate(); err != nil {
+		return nil, err
+	}
+	var nameServers []string
+	for _, nameServer := range nextConfig.UpstreamNameservers {
+		ip, port, err := util.ValidateNameserverIpAndPort(nameServer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nameserver %q: %v", nameServer, err)
 		}
-		if len(nameServers) == 0 {
-			kd.SkyDNSConfig.Nameservers = kd.loadDefaultNameserver()
-		} else {
-			kd.SkyDNSConfig.Nameservers = nameServers
+		nameServers = append(nameServers, net.JoinHostPort(ip, port))
+	}
+	if len(nameServers) == 0 && kd.SkyDNSConfig != nil {
+		nameServers = kd.loadDefaultNameserver()
+	}
+	var additionalDomainPaths [][]string
+	for _, domain := range nextConfig.AdditionalDomains {
+		domainPath := util.ReverseArray(strings.Split(strings.ToLower(strings.TrimRight(domain, ".")), "."))
+		// The names of an overlapping domain would be rewritten into, or
+		// out of, the cluster domain.
+		if hasPathPrefix(domainPath, kd.domainPath) || hasPathPrefix(kd.domainPath, domainPath) {
+			return nil, fmt.Errorf("additional domain %q overlaps the cluster domain %q", domain, kd.domain)
 		}
+		additionalDomainPaths = append(additionalDomainPaths, domainPath)
+	}
+
+	for _, overlap := range nextConfig.OverlappingCIDRs() {
+		klog.Warningf("Service and pod CIDRs %s overlap, the reverse records of services take precedence over the ones of pods", overlap)
+	}
+
+	kd.configLock.Lock()
+	defer kd.configLock.Unlock()
+	previousConfig := kd.config
+	if previousConfig == nil {
+		previousConfig = config.NewDefaultConfig()
+	}
+	if kd.SkyDNSConfig != nil {
+		kd.SkyDNSConfig.Nameservers = nameServers
 	}
 	kd.config = nextConfig
+	kd.additionalDomainPaths = additionalDomainPaths
 	klog.V(2).Infof("Configuration updated: %+v", *kd.config)
+	return previousConfig, nil
+}
+
+// seedService serves the given IP as the record of the given service, and
+// the service as the reverse record of the IP, unless records already exist
+// for them. The seed is replaced when the IP changes, removed when it is
+// empty, and released once the service is synced, as the records generated
+// for the service supersede it.
+func (kd *KubeDNS) seedService(namespace, name, ip string) {
+	key := namespace + "/" + name
+	if _, exists, err := kd.servicesStore.GetByKey(key); err == nil && exists {
+		return
+	}
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+	}
+	var seed *serviceSeed
+	subCache := treecache.NewTreeCache()
+	if ip != "" {
+		recordValue, recordLabel := kd.getSkyMsg(ip, 0)
+		subCache.SetEntry(recordLabel, recordValue, kd.fqdn(service, recordLabel))
+		reverseRecord, _ := util.GetSkyMsg(kd.fqdn(service), 0)
+		seed = &serviceSeed{ip: ip, label: recordLabel, record: recordValue, reverseRecord: reverseRecord}
+	}
+
+	subCachePath := append(kd.domainPath, serviceSubdomain, service.Namespace)
+	kd.cacheLock.Lock()
+	defer kd.cacheLock.Unlock()
+	previous := kd.seededServices[key]
+	if previous == nil {
+		if seed == nil {
+			return
+		}
+		if len(kd.cache.GetValuesForPathWithWildcards(append(subCachePath, service.Name)...)) > 0 {
+			klog.V(3).Infof("Not seeding records of service %s/%s as they already exist", service.Namespace, service.Name)
+			return
+		}
+	} else {
+		if seed != nil && seed.ip == previous.ip {
+			return
+		}
+		kd.removeSeedReverseRecord(previous)
+		delete(kd.seededServices, key)
+	}
+	kd.recordsChanged(namespace, name)
+	if seed == nil {
+		klog.V(2).Infof("Removing the seeded records of service %s/%s", service.Namespace, service.Name)
+		kd.cache.DeletePath(append(subCachePath, service.Name)...)
+		return
+	}
+	klog.V(2).Infof("Seeding records of service %s/%s with %s", service.Namespace, service.Name, ip)
+	if _, ok := kd.reverseRecordMap[ip]; !ok {
+		kd.reverseRecordMap[ip] = seed.reverseRecord
+	}
+	kd.cache.SetSubCache(service.Name, subCache, subCachePath...)
+	kd.seededServices[key] = seed
+}
+
+// releaseSeed forgets the seed of the given service, once it is synced,
+// removing the records of the seed that the records of the service did not
+// replace.
+func (kd *KubeDNS) releaseSeed(service *v1.Service) {
+	key := service.Namespace + "/" + service.Name
+	kd.cacheLock.Lock()
+	defer kd.cacheLock.Unlock()
+	seed, ok := kd.seededServices[key]
+	if !ok {
+		return
+	}
+	delete(kd.seededServices, key)
+	changed := kd.removeSeedReverseRecord(seed)
+	subCachePath := append(kd.domainPath, serviceSubdomain, service.Namespace, service.Name)
+	if entry, ok := kd.cache.GetEntry(seed.label, subCachePath...); ok && entry == seed.record {
+		changed = kd.cache.DeletePath(subCachePath...) || changed
+	}
+	if changed {
+		kd.recordsChanged(service.Namespace, service.Name)
+	}
+}
+
+// removeSeedReverseRecord removes the reverse record of the given seed,
+// unless it was superseded, and returns whether it did.
+// Important: Assumes cacheLock is held.
+func (kd *KubeDNS) removeSeedReverseRecord(seed *serviceSeed) bool {
+	if kd.reverseRecordMap[seed.ip] != seed.reverseRecord {
+		return false
+	}
+	delete(kd.reverseRecordMap, seed.ip)
+	return true
+}
+
+// regenerateServiceRecords regenerates the records of every known service.
+func (kd *KubeDNS) regenerateServiceRecords() {
+	for _, obj := range kd.servicesStore.List() {
+		kd.newService(obj)
+	}
+	kd.externalServicesLock.Lock()
+	defer kd.externalServicesLock.Unlock()
+	for key, spec := range kd.externalServices {
+		if err := kd.generateExternalServiceRecords(&spec); err != nil {
+			klog.Errorf("Could not regenerate the records of external service %s: %v", key, err)
+		}
+	}
 }
 
-func (kd *KubeDNS) Start() {
+// toClusterDomain rewrites the given query path, in the same format as
+// domainPath, so that names under one of the additional domains are looked
+// up under the cluster domain the cache is keyed by. Paths under the
+// cluster domain are returned as is; otherwise the longest additional
+// domain the path is under is rewritten.
+func (kd *KubeDNS) toClusterDomain(path []string) []string {
+	if hasPathPrefix(path, kd.domainPath) {
+		return path
+	}
+	domainPath := kd.additionalDomainPath(path)
+	if domainPath == nil {
+		return path
+	}
+	return append(append([]string{}, kd.domainPath...), path[len(domainPath):]...)
+}
+
+// additionalDomainPath returns the path of the longest additional domain
+// the given query path is under, or nil.
+func (kd *KubeDNS) additionalDomainPath(path []string) []string {
+	kd.configLock.RLock()
+	defer kd.configLock.RUnlock()
+	var longest []string
+	for _, domainPath := range kd.additionalDomainPaths {
+		if len(domainPath) > len(longest) && hasPathPrefix(path, domainPath) {
+			longest = domainPath
+		}
+	}
+	return longest
+}
+
+func hasPathPrefix(path, prefix []string) bool {
+	if len(path) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if path[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// currentConfig returns the configuration currently in effect. The returned
+// object is shared and must not be modified.
+func (kd *KubeDNS) currentConfig() *config.Config {
+	kd.configLock.RLock()
+	defer kd.configLock.RUnlock()
+	if kd.config == nil {
+		return config.NewDefaultConfig()
+	}
+	return kd.config
+}
+
+// Start starts watching the services and endpoints and syncing the
+// configuration, and waits for the initial listing of the services and
+// endpoints. It runs until the process exits.
+func (kd *KubeDNS) Start() error {
+	return kd.StartWithContext(context.Background())
+}
+
+// StartWithContext is like Start, but the informers and the goroutines it
+// starts stop once ctx is cancelled. Wait waits for them to exit. It returns
+// ErrInitialSyncTimeout if the initial listing times out, and the error of
+// ctx if ctx is cancelled first; the informers keep running in either case
+// until ctx is cancelled.
+func (kd *KubeDNS) StartWithContext(ctx context.Context) error {
+	stopCh := ctx.Done()
+
 	klog.V(2).Infof("Starting endpointsController")
-	go kd.endpointsController.Run(wait.NeverStop)
+	kd.goUntilStopped(func() { kd.endpointsController.Run(stopCh) })
 
 	klog.V(2).Infof("Starting serviceController")
-	go kd.serviceController.Run(wait.NeverStop)
+	kd.goUntilStopped(func() { kd.serviceController.Run(stopCh) })
+
+	kd.goUntilStopped(kd.runEndpointsRetryWorker)
+	kd.goUntilStopped(kd.runExternalNameWorker)
+	kd.goUntilStopped(func() {
+		<-stopCh
+		kd.endpointsRetryQueue.ShutDown()
+		kd.externalNameQueue.ShutDown()
+	})
 
-	kd.startConfigMapSync()
+	kd.goUntilStopped(func() { kd.runReconciler(stopCh) })
+
+	kd.goUntilStopped(func() { kd.runCacheLimiter(stopCh) })
+
+	kd.startConfigMapSync(stopCh)
 
 	// Wait synchronously for the initial list operations to be
 	// complete of endpoints and services from APIServer.
-	kd.waitForResourceSyncedOrDie()
+	return kd.waitForResourceSynced(ctx)
+}
+
+// goUntilStopped runs f in a goroutine Wait waits for.
+func (kd *KubeDNS) goUntilStopped(f func()) {
+	kd.running.Add(1)
+	go func() {
+		defer kd.running.Done()
+		f()
+	}()
+}
+
+// Wait waits for the goroutines started by StartWithContext to exit, which
+// they do once its context is cancelled.
+func (kd *KubeDNS) Wait() {
+	kd.running.Wait()
 }
 
-func (kd *KubeDNS) waitForResourceSyncedOrDie() {
-	// Wait for both controllers have completed an initial resource listing
+// waitForResourceSynced waits for both controllers to complete an initial
+// resource listing, for at most initialSyncTimeout.
+func (kd *KubeDNS) waitForResourceSynced(ctx context.Context) error {
 	timeout := time.After(kd.initialSyncTimeout)
 	ticker := time.NewTicker(500 * time.Millisecond)
 	defer ticker.Stop()
 	for {
 		select {
+		case <-ctx.Done():
+			klog.V(0).Infof("Stopped waiting for services and endpoints to be initialized")
+			return ctx.Err()
 		case <-timeout:
-			klog.Fatalf("Timeout waiting for initialization")
+			return fmt.Errorf("%w: %v not initialized", ErrInitialSyncTimeout, kd.unsyncedResources())
 		case <-ticker.C:
-			unsyncedResources := []string{}
-			if !kd.endpointsController.HasSynced() {
-				unsyncedResources = append(unsyncedResources, "endpoints")
-			}
-			if !kd.serviceController.HasSynced() {
-				unsyncedResources = append(unsyncedResources, "services")
-			}
+			unsyncedResources := kd.unsyncedResources()
 			if len(unsyncedResources) > 0 {
 				klog.V(0).Infof("Waiting for %v to be initialized from apiserver...", unsyncedResources)
 				continue
 			}
 			klog.V(0).Infof("Initialized services and endpoints from apiserver")
-			return
+			return nil
 		}
 	}
 }
 
-func (kd *KubeDNS) startConfigMapSync() {
+// unsyncedResources returns the resources whose initial listing hasn't
+// completed.
+func (kd *KubeDNS) unsyncedResources() []string {
+	unsyncedResources := []string{}
+	if !kd.endpointsController.HasSynced() {
+		unsyncedResources = append(unsyncedResources, "endpoints")
+	}
+	if !kd.serviceController.HasSynced() {
+		unsyncedResources = append(unsyncedResources, "services")
+	}
+	return unsyncedResources
+}
+
+func (kd *KubeDNS) startConfigMapSync(stopCh <-chan struct{}) {
 	initialConfig, err := kd.configSync.Once()
 	if err != nil {
 		klog.Errorf(
@@ -237,22 +775,146 @@ func (kd *KubeDNS) startConfigMapSync() {
 		kd.updateConfig(initialConfig)
 	}
 
-	go kd.syncConfigMap(kd.configSync.Periodic())
+	syncChan := kd.configSync.Periodic()
+	kd.goUntilStopped(func() { kd.syncConfigMap(syncChan, stopCh) })
 }
 
-func (kd *KubeDNS) syncConfigMap(syncChan <-chan *config.Config) {
+func (kd *KubeDNS) syncConfigMap(syncChan <-chan *config.Config, stopCh <-chan struct{}) {
 	for {
-		nextConfig := <-syncChan
-
-		kd.updateConfig(nextConfig)
+		select {
+		case <-stopCh:
+			return
+		case nextConfig := <-syncChan:
+			kd.updateConfig(nextConfig)
+		}
 	}
 }
 
+// GetCacheAsJSON returns a JSON representation of the cache. Only a copy of
+// the cache is taken under cacheLock; it is serialized after the lock is
+// released so that large caches don't block updates for the whole export.
+// Records are dumped with the TTL they are currently served with.
 func (kd *KubeDNS) GetCacheAsJSON() (string, error) {
+	currentConfig := kd.currentConfig()
 	kd.cacheLock.RLock()
-	defer kd.cacheLock.RUnlock()
-	json, err := kd.cache.Serialize()
-	return json, err
+	snapshot := kd.cache.Copy()
+	kd.applyEffectiveTTLs(snapshot.GetAllValues(), currentConfig)
+	kd.cacheLock.RUnlock()
+	return snapshot.Serialize()
+}
+
+// GetCacheAsJSONBestEffort is like GetCacheAsJSON, except that the records
+// that cannot be serialized are skipped rather than failing the whole
+// export. The JSON representation of the rest of the cache is returned
+// along with an error reporting the skipped records, if any.
+func (kd *KubeDNS) GetCacheAsJSONBestEffort() (string, error) {
+	currentConfig := kd.currentConfig()
+	kd.cacheLock.RLock()
+	snapshot := kd.cache.Copy()
+	kd.applyEffectiveTTLs(snapshot.GetAllValues(), currentConfig)
+	kd.cacheLock.RUnlock()
+	return snapshot.SerializeBestEffort()
+}
+
+// cacheRecordJSON is the JSON representation of a record written by
+// WriteCacheJSON.
+type cacheRecordJSON struct {
+	Key string `json:"key"`
+	*skymsg.Service
+	// Ttl is always included, even if 0.
+	Ttl uint32 `json:"ttl"`
+}
+
+// WriteCacheJSON writes the records of the cache to w as newline-delimited
+// JSON, one record per line, with the TTL they are currently served with.
+// Unlike GetCacheAsJSON, the cache is exported a namespace at a time:
+// cacheLock is only held while the records of a namespace are copied, and
+// the whole export is never held in memory. As a consequence, the export
+// is not a consistent snapshot of the cache if it changes in the meantime.
+func (kd *KubeDNS) WriteCacheJSON(w io.Writer) error {
+	currentConfig := kd.currentConfig()
+	servicesPath := append(append([]string{}, kd.domainPath...), serviceSubdomain)
+	kd.cacheLock.RLock()
+	namespaces := kd.cache.GetChildKeys(servicesPath...)
+	kd.cacheLock.RUnlock()
+
+	encoder := json.NewEncoder(w)
+	for _, namespace := range namespaces {
+		kd.cacheLock.RLock()
+		records := kd.cache.GetAllValuesForPath(append(servicesPath, namespace)...)
+		for i, record := range records {
+			recordCopy := *record
+			records[i] = &recordCopy
+		}
+		kd.applyEffectiveTTLs(records, currentConfig)
+		kd.cacheLock.RUnlock()
+
+		sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+		for _, record := range records {
+			if err := encoder.Encode(cacheRecordJSON{Key: record.Key, Service: record, Ttl: record.Ttl}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyEffectiveTTLs sets the TTL of the given records to the TTL they are
+// served with, which may depend on the time of the query.
+// Important: Assumes that we already have the cacheLock.
+func (kd *KubeDNS) applyEffectiveTTLs(records []*skymsg.Service, currentConfig *config.Config) {
+	values := make([]skymsg.Service, 0, len(records))
+	for _, record := range records {
+		values = append(values, *record)
+	}
+	kd.applyEndpointStabilityTTL(values, currentConfig.EndpointStabilityTTL)
+	kd.applyUnbackedServiceTTL(values, currentConfig.UnbackedServiceTTL)
+	kd.applyRecordMaxAge(values, currentConfig.RecordMaxAge.Duration)
+	applyTTLBounds(values, currentConfig)
+	for i, record := range records {
+		record.Ttl = values[i].Ttl
+	}
+}
+
+// Compact prunes the nodes of the cache left empty by the removal of
+// services, e.g. the nodes of namespaces without services anymore, and
+// returns the number of nodes removed. Records are left untouched.
+func (kd *KubeDNS) Compact() int {
+	kd.cacheLock.Lock()
+	defer kd.cacheLock.Unlock()
+	removed := kd.cache.Compact()
+	klog.V(2).Infof("Removed %d empty nodes from the cache", removed)
+	return removed
+}
+
+// reverseRecordJSON is the JSON representation of a reverse record.
+type reverseRecordJSON struct {
+	Record *skymsg.Service `json:"record"`
+	// Service is the namespace/name of the ClusterIP service owning the
+	// record, if any.
+	Service string `json:"service,omitempty"`
+}
+
+// GetReverseRecordsAsJSON returns a JSON representation of the reverse
+// records, keyed by IP.
+func (kd *KubeDNS) GetReverseRecordsAsJSON() (string, error) {
+	records := make(map[string]reverseRecordJSON)
+	kd.cacheLock.RLock()
+	for ip, record := range kd.reverseRecordMap {
+		recordCopy := *record
+		reverseRecord := reverseRecordJSON{Record: &recordCopy}
+		if service, ok := kd.clusterIPServiceMap[ip]; ok {
+			reverseRecord.Service = service.Namespace + "/" + service.Name
+		}
+		records[ip] = reverseRecord
+	}
+	kd.cacheLock.RUnlock()
+
+	prettyJSON, err := json.MarshalIndent(records, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	return string(prettyJSON), nil
 }
 
 func (kd *KubeDNS) setServicesStore() {
@@ -267,7 +929,7 @@ func (kd *KubeDNS) setServicesStore() {
 		resyncPeriod,
 		kcache.ResourceEventHandlerFuncs{
 			AddFunc:    kd.newService,
-			DeleteFunc: kd.removeService,
+			DeleteFunc: kd.handleServiceDelete,
 			UpdateFunc: kd.updateService,
 		},
 	)
@@ -303,18 +965,39 @@ func assertIsService(obj interface{}) (*v1.Service, bool) {
 
 func (kd *KubeDNS) newService(obj interface{}) {
 	if service, ok := assertIsService(obj); ok {
+		if !kd.servesNamespace(service.Namespace) {
+			klog.V(4).Infof("Ignoring service %s/%s outside of the namespace allowlist", service.Namespace, service.Name)
+			return
+		}
 		klog.V(3).Infof("New service: %v", service.Name)
 		klog.V(4).Infof("Service details: %v", service)
+		defer kd.releaseSeed(service)
+
+		if previous := kd.cancelPendingRemoval(service); previous != nil {
+			// The service was recreated within the removal grace period:
+			// update its records in place, as for an update.
+			if (previous.Spec.Type == v1.ServiceTypeExternalName) !=
+				(service.Spec.Type == v1.ServiceTypeExternalName) {
+				kd.removeService(previous)
+			}
+			defer kd.removeStaleClusterIPs(previous, service)
+		}
+
+		if conflict := serviceSpecConflict(service); conflict != "" {
+			klog.Warningf("Service %s/%s: %s", service.Namespace, service.Name, conflict)
+		}
 
 		// ExternalName services are a special kind that return CNAME records
 		if service.Spec.Type == v1.ServiceTypeExternalName {
 			kd.newExternalNameService(service)
+			kd.updateExternalNameReverseRecords(service)
 			return
 		}
 		// if ClusterIP is not set, a DNS entry should not be created
 		if !util.IsServiceIPSet(service) {
 			if err := kd.newHeadlessService(service); err != nil {
 				klog.Errorf("Could not create new headless service %v: %v", service.Name, err)
+				kd.recordGenerationFailed(service, err)
 			}
 			return
 		}
@@ -326,8 +1009,61 @@ func (kd *KubeDNS) newService(obj interface{}) {
 	}
 }
 
+// handleServiceDelete removes the records of the given deleted service,
+// after the removal grace period if one is configured.
+func (kd *KubeDNS) handleServiceDelete(obj interface{}) {
+	gracePeriod := kd.currentConfig().ServiceRemovalGracePeriod.Duration
+	service, ok := assertIsService(obj)
+	if !ok || gracePeriod <= 0 {
+		kd.removeService(obj)
+		return
+	}
+
+	key := service.Namespace + "/" + service.Name
+	klog.V(3).Infof("Removing the records of service %s in %v", key, gracePeriod)
+	removal := &pendingRemoval{service: service}
+	kd.pendingRemovalsLock.Lock()
+	defer kd.pendingRemovalsLock.Unlock()
+	if previous, ok := kd.pendingRemovals[key]; ok {
+		previous.timer.Stop()
+	}
+	removal.timer = kd.clock.AfterFunc(gracePeriod, func() {
+		kd.pendingRemovalsLock.Lock()
+		current, ok := kd.pendingRemovals[key]
+		if ok && current == removal {
+			delete(kd.pendingRemovals, key)
+		}
+		kd.pendingRemovalsLock.Unlock()
+		// The removal was cancelled if the service was recreated.
+		if ok && current == removal {
+			kd.removeService(service)
+		}
+	})
+	kd.pendingRemovals[key] = removal
+}
+
+// cancelPendingRemoval cancels the pending removal of the records of the
+// given service, if any, and returns the deleted service whose records are
+// still served.
+func (kd *KubeDNS) cancelPendingRemoval(service *v1.Service) *v1.Service {
+	key := service.Namespace + "/" + service.Name
+	kd.pendingRemovalsLock.Lock()
+	removal, ok := kd.pendingRemovals[key]
+	delete(kd.pendingRemovals, key)
+	kd.pendingRemovalsLock.Unlock()
+	if !ok {
+		return nil
+	}
+	removal.timer.Stop()
+	klog.V(3).Infof("Service %s was recreated, cancelled the removal of its records", key)
+	return removal.service
+}
+
 func (kd *KubeDNS) removeService(obj interface{}) {
 	if s, ok := assertIsService(obj); ok {
+		if !kd.servesNamespace(s.Namespace) {
+			return
+		}
 		subCachePath := append(kd.domainPath, serviceSubdomain, s.Namespace, s.Name)
 		kd.cacheLock.Lock()
 		defer kd.cacheLock.Unlock()
@@ -335,19 +1071,83 @@ func (kd *KubeDNS) removeService(obj interface{}) {
 		success := kd.cache.DeletePath(subCachePath...)
 		klog.V(3).Infof("removeService %v at path %v. Success: %v",
 			s.Name, subCachePath, success)
-
-		// ExternalName services have no IP
-		if util.IsServiceIPSet(s) {
+		changed := success
+		delete(kd.endpointFirstSeen, s.Namespace+"/"+s.Name)
+		delete(kd.serviceFirstSeen, s.Namespace+"/"+s.Name)
+		delete(kd.externalNameTargets, s.Namespace+"/"+s.Name)
+
+		// ExternalName services have no IP, the cluster IPs they may
+		// set are ignored.
+		if s.Spec.Type == v1.ServiceTypeExternalName {
+			changed = kd.removeExternalNameReverseRecords(s) || changed
+		} else if util.IsServiceIPSet(s) {
 			for _, ip := range util.GetClusterIPs(s) {
-				delete(kd.reverseRecordMap, ip)
-				delete(kd.clusterIPServiceMap, ip)
+				changed = kd.releaseClusterIP(ip) || changed
+			}
+		} else {
+			changed = kd.removeHeadlessReverseRecords(s) || changed
+		}
+		if changed {
+			kd.recordsChanged(s.Namespace, s.Name)
+		}
+	}
+}
+
+// removeHeadlessReverseRecords removes the reverse records of the endpoints
+// of the given headless service, so that they don't outlive its records,
+// e.g. when it is converted to an ExternalName service while its endpoints
+// remain. It returns whether any reverse record was removed.
+// Important: Assumes that we already have the cacheLock.
+func (kd *KubeDNS) removeHeadlessReverseRecords(s *v1.Service) bool {
+	obj, exists, err := kd.endpointsStore.GetByKey(s.Namespace + "/" + s.Name)
+	if err != nil || !exists {
+		return false
+	}
+	e, ok := obj.(*v1.Endpoints)
+	if !ok {
+		return false
+	}
+	removed := false
+	serviceSuffix := "." + kd.fqdn(s)
+	for idx := range e.Subsets {
+		addresses := allAddresses(&e.Subsets[idx])
+		for subIdx := range addresses {
+			address := &addresses[subIdx]
+			if shadowed, ok := kd.shadowedReverseRecords[address.IP]; ok && strings.HasSuffix(shadowed.Host, serviceSuffix) {
+				delete(kd.shadowedReverseRecords, address.IP)
+			}
+			record, ok := kd.reverseRecordMap[address.IP]
+			if !ok {
+				continue
+			}
+			// Only remove the records owned by this service.
+			owned := strings.HasSuffix(record.Host, serviceSuffix)
+			if !owned && isPodAddress(address) {
+				namespace := address.TargetRef.Namespace
+				if namespace == "" {
+					namespace = e.Namespace
+				}
+				owned = record.Host == kd.podFQDN(address.IP, namespace)
+			}
+			if owned {
+				klog.V(4).Infof("Removing reverse record of endpoint IP %q of headless service %s/%s", address.IP, s.Namespace, s.Name)
+				delete(kd.reverseRecordMap, address.IP)
+				removed = true
 			}
 		}
 	}
+	return removed
 }
 
 func (kd *KubeDNS) updateService(oldObj, newObj interface{}) {
 	if new, ok := assertIsService(newObj); ok {
+		if !kd.servesNamespace(new.Namespace) {
+			return
+		}
+		if kd.isPinned(new.Namespace, new.Name) {
+			klog.V(3).Infof("Ignoring update of pinned service %s/%s", new.Namespace, new.Name)
+			return
+		}
 		if old, ok := assertIsService(oldObj); ok {
 			// Remove old cache path only if changing type to/from ExternalName.
 			// In all other cases, we'll update records in place.
@@ -355,13 +1155,21 @@ func (kd *KubeDNS) updateService(oldObj, newObj interface{}) {
 				(old.Spec.Type == v1.ServiceTypeExternalName) {
 				kd.removeService(oldObj)
 			}
+			kd.startServiceTransition(old, new)
 			kd.newService(newObj)
+			// The service may have lost cluster IPs, e.g. a dual-stack
+			// service becoming single-stack.
+			kd.removeStaleClusterIPs(old, new)
 		}
 	}
 }
 
 func (kd *KubeDNS) handleEndpointAdd(obj interface{}) {
 	if e, ok := obj.(*v1.Endpoints); ok {
+		if kd.isPinned(e.Namespace, e.Name) {
+			klog.V(3).Infof("Ignoring the endpoints of pinned service %s/%s", e.Namespace, e.Name)
+			return
+		}
 		if err := kd.addDNSUsingEndpoints(e); err != nil {
 			klog.Errorf("Error in addDNSUsingEndpoints(%v): %v", e.Name, err)
 		}
@@ -380,34 +1188,63 @@ func (kd *KubeDNS) handleEndpointUpdate(oldObj, newObj interface{}) {
 		klog.Errorf("newObj type assertion failed! Expected 'v1.Endpoints', got %T", newObj)
 		return
 	}
+	if !kd.servesNamespace(newEndpoints.Namespace) {
+		return
+	}
+	if kd.isPinned(newEndpoints.Namespace, newEndpoints.Name) {
+		klog.V(3).Infof("Ignoring update of the endpoints of pinned service %s/%s", newEndpoints.Namespace, newEndpoints.Name)
+		return
+	}
+
+	if err := kd.removeStaleReverseRecords(oldEndpoints, newEndpoints); err != nil {
+		klog.Errorf("Error removing stale reverse records of endpoints %s/%s, will retry: %v",
+			oldEndpoints.Namespace, oldEndpoints.Name, err)
+		kd.endpointsRetryQueue.AddRateLimited(endpointsUpdate{old: oldEndpoints, new: newEndpoints})
+	}
 
+	// TODO: Avoid unwanted updates.
+	kd.handleEndpointAdd(newObj)
+}
+
+// removeStaleReverseRecords removes the reverse records of the named
+// addresses of oldEndpoints that are no longer named in newEndpoints.
+func (kd *KubeDNS) removeStaleReverseRecords(oldEndpoints, newEndpoints *v1.Endpoints) error {
 	// oldAddressMap is use to hold oldEndpoints addresses that are not
 	// in newEndpoints
 	oldAddressMap := make(map[string]bool)
 
 	// svc is same for both old and new endpoints
 	svc, err := kd.getServiceFromEndpoints(oldEndpoints)
-	if svc != nil && err == nil {
+	if err != nil {
+		return err
+	}
+	if svc != nil {
 		if !util.IsServiceIPSet(svc) {
+			targetRefPTRRecords := kd.currentConfig().TargetRefPTRRecords
 			for idx := range oldEndpoints.Subsets {
-				for subIdx := range oldEndpoints.Subsets[idx].Addresses {
-					address := &oldEndpoints.Subsets[idx].Addresses[subIdx]
+				// Not-ready addresses may have been served before the
+				// service stopped publishing them.
+				addresses := allAddresses(&oldEndpoints.Subsets[idx])
+				for subIdx := range addresses {
+					address := &addresses[subIdx]
 					endpointIP := address.IP
-					if _, has := getHostname(address); has {
+					// Pod addresses may have been given a PTR record
+					// before targetRefPTRRecords was disabled.
+					if hasReverseRecord(address, true) {
 						oldAddressMap[endpointIP] = true
 					}
 				}
 			}
 
 			for idx := range newEndpoints.Subsets {
-				for subIdx := range newEndpoints.Subsets[idx].Addresses {
-					address := newEndpoints.Subsets[idx].Addresses[subIdx]
+				addresses := servedAddresses(&newEndpoints.Subsets[idx], svc)
+				for subIdx := range addresses {
+					address := &addresses[subIdx]
 					endpointIP := address.IP
 					if _, ok := oldAddressMap[endpointIP]; ok {
-						address := &newEndpoints.Subsets[idx].Addresses[subIdx]
 						// Entries are both in old and new endpoint. Remove from the `oldAddressMap`
 						// if the address is still named to the service.
-						if _, has := getHostname(address); has {
+						if hasReverseRecord(address, targetRefPTRRecords) {
 							// The service is still named in the Pod
 							delete(oldAddressMap, endpointIP)
 						}
@@ -419,16 +1256,18 @@ func (kd *KubeDNS) handleEndpointUpdate(oldObj, newObj interface{}) {
 			// in new endpoints, or
 			// the addresses that are no longer named.
 			kd.cacheLock.Lock()
+			changed := false
 			for k := range oldAddressMap {
 				klog.V(4).Infof("Removing old endpoint IP %q", k)
-				delete(kd.reverseRecordMap, k)
+				changed = kd.removeEndpointReverseRecord(k) || changed
+			}
+			if changed {
+				kd.recordsChanged(oldEndpoints.Namespace, oldEndpoints.Name)
 			}
 			kd.cacheLock.Unlock()
 		}
 	}
-
-	// TODO: Avoid unwanted updates.
-	kd.handleEndpointAdd(newObj)
+	return nil
 }
 
 func (kd *KubeDNS) handleEndpointDelete(obj interface{}) {
@@ -437,40 +1276,149 @@ func (kd *KubeDNS) handleEndpointDelete(obj interface{}) {
 		klog.Errorf("obj type assertion failed! Expected 'v1.Endpoints', got %T", obj)
 		return
 	}
+	if !kd.servesNamespace(endpoints.Namespace) {
+		return
+	}
 
+	if err := kd.removeReverseRecords(endpoints); err != nil {
+		klog.Errorf("Error removing reverse records of endpoints %s/%s, will retry: %v",
+			endpoints.Namespace, endpoints.Name, err)
+		kd.endpointsRetryQueue.AddRateLimited(endpointsUpdate{old: endpoints})
+	}
+	if svc, err := kd.getServiceFromEndpoints(endpoints); err == nil {
+		kd.refreshIncompleteService(svc)
+	}
+}
+
+// removeReverseRecords removes the reverse records of the named addresses
+// of the given endpoints.
+func (kd *KubeDNS) removeReverseRecords(endpoints *v1.Endpoints) error {
 	svc, err := kd.getServiceFromEndpoints(endpoints)
 	if err != nil {
-		klog.Errorf("Error from getServiceFromEndpoints(%v): %v", endpoints.Name, err)
-		return
+		return err
 	}
 	if svc != nil {
 		if !util.IsServiceIPSet(svc) {
 			kd.cacheLock.Lock()
 			defer kd.cacheLock.Unlock()
+			changed := false
 			// When endpoints for Named headless services deleted, delete old reverse dns records.
 			for idx := range endpoints.Subsets {
-				for subIdx := range endpoints.Subsets[idx].Addresses {
-					address := &endpoints.Subsets[idx].Addresses[subIdx]
-					endpointIP := address.IP
-					if _, has := getHostname(address); has {
-						delete(kd.reverseRecordMap, endpointIP)
+				addresses := allAddresses(&endpoints.Subsets[idx])
+				for subIdx := range addresses {
+					address := &addresses[subIdx]
+					if hasReverseRecord(address, true) {
+						changed = kd.removeEndpointReverseRecord(address.IP) || changed
 					}
 				}
 			}
+			if changed {
+				kd.recordsChanged(endpoints.Namespace, endpoints.Name)
+			}
 		}
 	}
+	return nil
+}
+
+// endpointsUpdate is an update or, if new is nil, a deletion of endpoints
+// whose reverse records could not be cleaned up and is retried.
+type endpointsUpdate struct {
+	old *v1.Endpoints
+	new *v1.Endpoints
+}
+
+// runEndpointsRetryWorker processes the endpoints updates queued for retry
+// until the queue is shut down.
+func (kd *KubeDNS) runEndpointsRetryWorker() {
+	for kd.processNextEndpointsRetry() {
+	}
+}
+
+// processNextEndpointsRetry retries the next queued endpoints update and
+// returns false if the queue was shut down.
+func (kd *KubeDNS) processNextEndpointsRetry() bool {
+	item, shutdown := kd.endpointsRetryQueue.Get()
+	if shutdown {
+		return false
+	}
+	defer kd.endpointsRetryQueue.Done(item)
+
+	update := item.(endpointsUpdate)
+	var err error
+	if update.new == nil {
+		err = kd.removeReverseRecords(update.old)
+	} else {
+		err = kd.removeStaleReverseRecords(update.old, update.new)
+	}
+	if err == nil {
+		kd.endpointsRetryQueue.Forget(item)
+		return true
+	}
+	if kd.endpointsRetryQueue.NumRequeues(item) < maxEndpointsRetries {
+		klog.Errorf("Error removing reverse records of endpoints %s/%s, will retry: %v",
+			update.old.Namespace, update.old.Name, err)
+		kd.endpointsRetryQueue.AddRateLimited(item)
+		return true
+	}
+	klog.Errorf("Error removing reverse records of endpoints %s/%s, giving up: %v",
+		update.old.Namespace, update.old.Name, err)
+	kd.endpointsRetryQueue.Forget(item)
+	return true
 }
 
 func (kd *KubeDNS) addDNSUsingEndpoints(e *v1.Endpoints) error {
+	if !kd.servesNamespace(e.Namespace) {
+		return nil
+	}
 	svc, err := kd.getServiceFromEndpoints(e)
 	if err != nil {
 		return err
 	}
+	if kd.refreshIncompleteService(svc) {
+		return nil
+	}
 	if svc == nil || util.IsServiceIPSet(svc) || svc.Spec.Type == v1.ServiceTypeExternalName {
 		// No headless service found corresponding to endpoints object.
 		return nil
 	}
-	return kd.generateRecordsForHeadlessService(e, svc)
+	if err := kd.generateRecordsForHeadlessService(e, svc); err != nil {
+		kd.recordGenerationFailed(svc, err)
+		return err
+	}
+	return nil
+}
+
+// refreshIncompleteService regenerates the records of the given service, and
+// returns true, if it is a ClusterIP service without ports whose records
+// are withheld while it has no endpoint addresses, for it to be called when
+// its endpoints change.
+func (kd *KubeDNS) refreshIncompleteService(svc *v1.Service) bool {
+	if svc == nil || !util.IsServiceIPSet(svc) || svc.Spec.Type == v1.ServiceTypeExternalName ||
+		len(svc.Spec.Ports) != 0 || !kd.currentConfig().WithholdIncompleteServices {
+		return false
+	}
+	kd.newPortalService(svc)
+	return true
+}
+
+// isIncompleteService returns whether the given ClusterIP service has
+// neither ports nor endpoint addresses.
+func (kd *KubeDNS) isIncompleteService(service *v1.Service) bool {
+	if len(service.Spec.Ports) != 0 {
+		return false
+	}
+	obj, exists, err := kd.endpointsStore.GetByKey(service.Namespace + "/" + service.Name)
+	if err != nil || !exists {
+		return true
+	}
+	if e, ok := obj.(*v1.Endpoints); ok {
+		for _, subset := range e.Subsets {
+			if len(subset.Addresses) != 0 {
+				return false
+			}
+		}
+	}
+	return true
 }
 
 func (kd *KubeDNS) getServiceFromEndpoints(e *v1.Endpoints) (*v1.Service, error) {
@@ -501,86 +1449,469 @@ func (kd *KubeDNS) fqdn(service *v1.Service, subpaths ...string) string {
 }
 
 func (kd *KubeDNS) newPortalService(service *v1.Service) {
+	currentConfig := kd.currentConfig()
+	if currentConfig.WithholdIncompleteServices && kd.isIncompleteService(service) {
+		klog.Warningf("Service %s/%s has neither ports nor endpoints, withholding its records",
+			service.Namespace, service.Name)
+		kd.removeService(service)
+		return
+	}
+
 	subCache := treecache.NewTreeCache()
 	clusterIPs := util.GetClusterIPs(service)
 
+	// The SRV records target the service name rather than a cluster IP,
+	// so a dual-stack service gets a single SRV record per port, labeled
+	// after its primary cluster IP.
+	srvLabel := ""
 	for _, ip := range clusterIPs {
-		recordValue, recordLabel := util.GetSkyMsg(ip, 0)
+		if !hasIPFamily(service, ip) {
+			continue
+		}
+		recordValue, recordLabel := kd.getServiceSkyMsg(service, ip, 0)
 		subCache.SetEntry(recordLabel, recordValue, kd.fqdn(service, recordLabel))
+		if srvLabel == "" {
+			srvLabel = recordLabel
+		}
+	}
+
+	// Generate SRV Records
+	excludedPorts := srvExcludedPorts(service)
+	for i := range service.Spec.Ports {
+		port := &service.Spec.Ports[i]
+
+		if port.Protocol == "" {
+			continue
+		}
+		if excludedPorts.Has(strings.ToLower(port.Name)) {
+			klog.V(3).Infof("Skipping SRV record for excluded port %q of service %s/%s",
+				port.Name, service.Namespace, service.Name)
+			continue
+		}
+		if !isSRVProtocol(port.Protocol) {
+			klog.V(2).Infof("Skipping SRV record for port %q of service %s/%s with unknown protocol %q",
+				port.Name, service.Namespace, service.Name, port.Protocol)
+			continue
+		}
 
-		// Generate SRV Records
-		for i := range service.Spec.Ports {
-			port := &service.Spec.Ports[i]
+		portName, ok := srvPortLabel(port.Name, port.Port, currentConfig.LowercasePortNames)
+		if !ok {
+			klog.V(2).Infof("Skipping SRV record for port %q of service %s/%s with invalid name",
+				port.Name, service.Namespace, service.Name)
+			continue
+		}
+
+		srvValue := kd.generateSRVRecordValue(service, int(port.Port))
+
+		l := []string{"_" + strings.ToLower(string(port.Protocol)), "_" + portName}
+		klog.V(3).Infof("Added SRV record %+v", srvValue)
+
+		subCache.SetEntry(srvLabel, srvValue, kd.fqdn(service, append(l, srvLabel)...), l...)
+	}
 
+	if currentConfig.ServiceSRVRecords {
+		kd.generateServiceSRVRecords(subCache, service)
+	}
+
+	kd.addTransitionRecords(subCache, service)
+	kd.addExtraRecords(subCache, service)
+
+	subCachePath := append(kd.domainPath, serviceSubdomain, service.Namespace)
+	reverseRecord, _ := util.GetSkyMsgWithTTL(kd.reverseRecordHost(service), 0, serviceTTL(service))
+
+	kd.cacheLock.Lock()
+	defer kd.cacheLock.Unlock()
+	changed := kd.cache.SetSubCache(service.Name, subCache, subCachePath...)
+	kd.updateServiceFirstSeen(service)
+
+	for _, ip := range clusterIPs {
+		if _, ok := util.IPFamily(ip); !ok {
+			continue
+		}
+		changed = kd.claimClusterIP(ip, service) || changed
+		if currentConfig.ExcludesReverseRecord(ip) {
+			klog.V(3).Infof("Not adding reverse record of cluster IP %q of service %s/%s, which is in an excluded CIDR",
+				ip, service.Namespace, service.Name)
+			changed = kd.deleteReverseRecord(ip) || changed
+			continue
+		}
+		changed = kd.setReverseRecord(ip, reverseRecord) || changed
+	}
+	if changed {
+		kd.recordsChanged(service.Namespace, service.Name)
+	}
+}
+
+// reverseRecordHost returns the host the reverse records of the cluster IPs
+// of the given service point to: the value of its
+// ReverseRecordHostAnnotation if it is a valid domain name, its FQDN
+// otherwise.
+func (kd *KubeDNS) reverseRecordHost(service *v1.Service) string {
+	host, ok := service.Annotations[ReverseRecordHostAnnotation]
+	if !ok {
+		return kd.fqdn(service)
+	}
+	if errs := validation.IsDNS1123Subdomain(strings.TrimSuffix(host, ".")); len(errs) > 0 {
+		klog.Warningf("Ignoring invalid %s annotation %q of service %s/%s: %v",
+			ReverseRecordHostAnnotation, host, service.Namespace, service.Name, errs)
+		return kd.fqdn(service)
+	}
+	return dns.Fqdn(host)
+}
+
+// aggregateRecordsOnly returns whether the given headless service only
+// serves the records of its endpoints under its own name.
+func aggregateRecordsOnly(service *v1.Service) bool {
+	return service.Annotations[AggregateRecordsOnlyAnnotation] == "true"
+}
+
+// endpointPortProtocols returns the protocol of the SRV records of each port
+// name of the given endpoints of svc. A port name should have a single
+// protocol, but a faulty controller may list it with different protocols in
+// different subsets. The protocol of the service port of the same name is
+// then chosen, or the first one in alphabetical order if the service has no
+// such port, so that a single, deterministic SRV record is generated.
+func endpointPortProtocols(e *v1.Endpoints, svc *v1.Service) map[string]v1.Protocol {
+	protocols := map[string]sets.String{}
+	for _, subset := range e.Subsets {
+		for _, port := range subset.Ports {
 			if port.Name == "" || port.Protocol == "" {
 				continue
 			}
+			if protocols[port.Name] == nil {
+				protocols[port.Name] = sets.NewString()
+			}
+			protocols[port.Name].Insert(string(port.Protocol))
+		}
+	}
+	retval := make(map[string]v1.Protocol, len(protocols))
+	for name, candidates := range protocols {
+		protocol := candidates.List()[0]
+		if candidates.Len() > 1 {
+			for _, port := range svc.Spec.Ports {
+				if port.Name == name && candidates.Has(string(port.Protocol)) {
+					protocol = string(port.Protocol)
+				}
+			}
+			klog.Warningf("Port %q of endpoints %s/%s has conflicting protocols %v, using %s",
+				name, e.Namespace, e.Name, candidates.List(), protocol)
+		}
+		retval[name] = v1.Protocol(protocol)
+	}
+	return retval
+}
 
-			srvValue := kd.generateSRVRecordValue(service, int(port.Port))
-
-			l := []string{"_" + strings.ToLower(string(port.Protocol)), "_" + port.Name}
-			klog.V(3).Infof("Added SRV record %+v", srvValue)
+// srvExcludedPorts returns the lowercased names of the ports listed in the
+// SRVExcludedPortsAnnotation of the given service.
+func srvExcludedPorts(service *v1.Service) sets.String {
+	excluded := sets.NewString()
+	for _, name := range strings.Split(service.Annotations[SRVExcludedPortsAnnotation], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			excluded.Insert(strings.ToLower(name))
+		}
+	}
+	return excluded
+}
 
-			subCache.SetEntry(recordLabel, srvValue, kd.fqdn(service, append(l, recordLabel)...), l...)
+// canaryEndpoints returns the IPs and hostnames of the canary endpoints
+// listed in the CanaryEndpointsAnnotation of the given endpoints.
+func canaryEndpoints(e *v1.Endpoints) sets.String {
+	canaries := sets.NewString()
+	for _, canary := range strings.Split(e.Annotations[CanaryEndpointsAnnotation], ",") {
+		if canary = strings.TrimSpace(canary); canary != "" {
+			canaries.Insert(canary)
 		}
 	}
+	return canaries
+}
 
-	subCachePath := append(kd.domainPath, serviceSubdomain, service.Namespace)
-	host := getServiceFQDN(kd.domain, service)
-	reverseRecord, _ := util.GetSkyMsg(host, 0)
+// canarySRVWeight returns the weight of the SRV records of the canary
+// endpoints of the given headless service set by its
+// CanarySRVWeightAnnotation, if any.
+func canarySRVWeight(service *v1.Service) (int, bool) {
+	value, ok := service.Annotations[CanarySRVWeightAnnotation]
+	if !ok {
+		return 0, false
+	}
+	weight, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		klog.Warningf("Ignoring invalid %s annotation %q of service %s/%s: %v",
+			CanarySRVWeightAnnotation, value, service.Namespace, service.Name, err)
+		return 0, false
+	}
+	return int(weight), true
+}
 
-	kd.cacheLock.Lock()
-	defer kd.cacheLock.Unlock()
-	kd.cache.SetSubCache(service.Name, subCache, subCachePath...)
+// servedAddresses returns the addresses of the given subset of the endpoints
+// of the given headless service that are served under the service name: its
+// ready addresses, followed by its not-ready ones if the service publishes
+// not-ready addresses.
+func servedAddresses(subset *v1.EndpointSubset, svc *v1.Service) []v1.EndpointAddress {
+	if !svc.Spec.PublishNotReadyAddresses || len(subset.NotReadyAddresses) == 0 {
+		return subset.Addresses
+	}
+	return allAddresses(subset)
+}
 
-	for _, ip := range clusterIPs {
-		kd.reverseRecordMap[ip] = reverseRecord
-		kd.clusterIPServiceMap[ip] = service
+// allAddresses returns the ready and not-ready addresses of the given
+// subset.
+func allAddresses(subset *v1.EndpointSubset) []v1.EndpointAddress {
+	return append(append([]v1.EndpointAddress{}, subset.Addresses...), subset.NotReadyAddresses...)
+}
+
+// serviceTTL returns the TTL of the records of the given service set by its
+// TTLAnnotation, capped to maxServiceTTL, or util.DefaultTTL.
+func serviceTTL(service *v1.Service) uint32 {
+	value, ok := service.Annotations[TTLAnnotation]
+	if !ok {
+		return util.DefaultTTL
 	}
+	ttl, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		klog.Warningf("Ignoring invalid %s annotation %q of service %s/%s: %v",
+			TTLAnnotation, value, service.Namespace, service.Name, err)
+		return util.DefaultTTL
+	}
+	if ttl > maxServiceTTL {
+		klog.Warningf("Capping the %s annotation %q of service %s/%s to %d",
+			TTLAnnotation, value, service.Namespace, service.Name, maxServiceTTL)
+		return maxServiceTTL
+	}
+	return uint32(ttl)
 }
 
+// generateRecordsForHeadlessService builds the records of the given headless
+// service in a new subcache, without holding cacheLock, and then swaps it in
+// place of the previous one with a single SetSubCache call under cacheLock.
+// Only the first maxEndpointAddresses addresses of the endpoints are served
+// if the configuration sets a limit. The service must never be
+// removed from the cache before the swap, or queries made in between would
+// observe an NXDOMAIN for a service that exists.
 func (kd *KubeDNS) generateRecordsForHeadlessService(e *v1.Endpoints, svc *v1.Service) error {
 	subCache := treecache.NewTreeCache()
 	klog.V(4).Infof("Endpoints Annotations: %v", e.Annotations)
 	generatedRecords := map[string]*skymsg.Service{}
+	currentConfig := kd.currentConfig()
+	maxAddresses := currentConfig.MaxEndpointAddresses
+	aggregateOnly := aggregateRecordsOnly(svc)
+	canaries := canaryEndpoints(e)
+	canaryWeight, hasCanaryWeight := canarySRVWeight(svc)
+	excludedPorts := srvExcludedPorts(svc)
+	portProtocols := endpointPortProtocols(e, svc)
+	endpointIPs := []string{}
+	// SRV records of the endpoints, keyed by SRV name.
+	srvRecords := map[string][]*skymsg.Service{}
+	canarySRVRecords := []*skymsg.Service{}
+subsets:
 	for idx := range e.Subsets {
-		for subIdx := range e.Subsets[idx].Addresses {
-			address := &e.Subsets[idx].Addresses[subIdx]
+		addresses := servedAddresses(&e.Subsets[idx], svc)
+		for subIdx := range addresses {
+			if maxAddresses > 0 && len(endpointIPs) >= maxAddresses {
+				klog.Warningf("Endpoints %s/%s have more than %d addresses, ignoring the others",
+					e.Namespace, e.Name, maxAddresses)
+				break subsets
+			}
+			address := &addresses[subIdx]
 			endpointIP := address.IP
-			recordValue, endpointName := util.GetSkyMsg(endpointIP, 0)
+			if !hasIPFamily(svc, endpointIP) {
+				continue
+			}
+			endpointIPs = append(endpointIPs, endpointIP)
+			recordValue, endpointName := kd.getServiceSkyMsg(svc, endpointIP, 0)
 			if hostLabel, exists := getHostname(address); exists {
 				endpointName = hostLabel
 			}
 			subCache.SetEntry(endpointName, recordValue, kd.fqdn(svc, endpointName))
+			if readySubdomain := currentConfig.ReadySubdomain; readySubdomain != "" && subIdx < len(e.Subsets[idx].Addresses) {
+				readyValue := *recordValue
+				subCache.SetEntry(endpointName, &readyValue, kd.fqdn(svc, readySubdomain, endpointName), readySubdomain)
+			}
+			if aggregateOnly {
+				continue
+			}
 			for portIdx := range e.Subsets[idx].Ports {
 				endpointPort := &e.Subsets[idx].Ports[portIdx]
-				if endpointPort.Name != "" && endpointPort.Protocol != "" {
-					srvValue := kd.generateSRVRecordValue(svc, int(endpointPort.Port), endpointName)
-					klog.V(3).Infof("Added SRV record %+v", srvValue)
-
-					l := []string{"_" + strings.ToLower(string(endpointPort.Protocol)), "_" + endpointPort.Name}
-					subCache.SetEntry(endpointName, srvValue, kd.fqdn(svc, append(l, endpointName)...), l...)
+				if endpointPort.Protocol == "" {
+					continue
+				}
+				if excludedPorts.Has(strings.ToLower(endpointPort.Name)) {
+					continue
+				}
+				if endpointPort.Name != "" && endpointPort.Protocol != portProtocols[endpointPort.Name] {
+					// The port name is listed with several protocols.
+					continue
+				}
+				if !isSRVProtocol(endpointPort.Protocol) {
+					klog.V(2).Infof("Skipping SRV record for port %q of endpoints %s/%s with unknown protocol %q",
+						endpointPort.Name, e.Namespace, e.Name, endpointPort.Protocol)
+					continue
+				}
+				portName, ok := srvPortLabel(endpointPort.Name, endpointPort.Port, currentConfig.LowercasePortNames)
+				if !ok {
+					klog.V(2).Infof("Skipping SRV record for port %q of endpoints %s/%s with invalid name",
+						endpointPort.Name, e.Namespace, e.Name)
+					continue
+				}
+				srvValue := kd.generateSRVRecordValue(svc, int(endpointPort.Port), endpointName)
+				klog.V(3).Infof("Added SRV record %+v", srvValue)
+
+				l := []string{"_" + strings.ToLower(string(endpointPort.Protocol)), "_" + portName}
+				subCache.SetEntry(endpointName, srvValue, kd.fqdn(svc, append(l, endpointName)...), l...)
+				srvName := strings.Join(l, ".")
+				srvRecords[srvName] = append(srvRecords[srvName], srvValue)
+				if canaries.Has(endpointIP) || canaries.Has(endpointName) {
+					canarySRVRecords = append(canarySRVRecords, srvValue)
 				}
 			}
 
-			// Generate PTR records only for Named Headless service.
+			// Generate PTR records only for Named Headless service, unless
+			// configured to also generate them for pod addresses.
 			if _, has := getHostname(address); has {
-				reverseRecord, _ := util.GetSkyMsg(kd.fqdn(svc, endpointName), 0)
+				reverseRecord, _ := util.GetSkyMsgWithTTL(kd.fqdn(svc, endpointName), 0, serviceTTL(svc))
+				generatedRecords[endpointIP] = reverseRecord
+			} else if currentConfig.TargetRefPTRRecords && isPodAddress(address) {
+				namespace := address.TargetRef.Namespace
+				if namespace == "" {
+					namespace = e.Namespace
+				}
+				reverseRecord, _ := util.GetSkyMsg(kd.podFQDN(endpointIP, namespace), 0)
 				generatedRecords[endpointIP] = reverseRecord
 			}
 		}
 	}
+	if notReadySubdomain := currentConfig.NotReadySubdomain; notReadySubdomain != "" {
+		// The not-ready addresses count against maxAddresses as well, unless
+		// already served above.
+		servedIPs := sets.NewString(endpointIPs...)
+	notReadySubsets:
+		for idx := range e.Subsets {
+			for subIdx := range e.Subsets[idx].NotReadyAddresses {
+				address := &e.Subsets[idx].NotReadyAddresses[subIdx]
+				hostLabel, exists := getHostname(address)
+				if !exists || !hasIPFamily(svc, address.IP) {
+					continue
+				}
+				if !servedIPs.Has(address.IP) {
+					if maxAddresses > 0 && servedIPs.Len() >= maxAddresses {
+						klog.Warningf("Endpoints %s/%s have more than %d addresses, ignoring the others",
+							e.Namespace, e.Name, maxAddresses)
+						break notReadySubsets
+					}
+					servedIPs.Insert(address.IP)
+				}
+				recordValue, _ := kd.getServiceSkyMsg(svc, address.IP, 0)
+				subCache.SetEntry(hostLabel, recordValue, kd.fqdn(svc, notReadySubdomain, hostLabel), notReadySubdomain)
+			}
+		}
+	}
+	if currentConfig.NormalizeSRVWeights {
+		for _, records := range srvRecords {
+			normalizeSRVWeights(records)
+		}
+	}
+	if hasCanaryWeight {
+		for _, record := range canarySRVRecords {
+			record.Weight = canaryWeight
+		}
+	}
+	kd.addTransitionRecords(subCache, svc)
+	kd.addExtraRecords(subCache, svc)
+
 	subCachePath := append(kd.domainPath, serviceSubdomain, svc.Namespace)
 	kd.cacheLock.Lock()
 	defer kd.cacheLock.Unlock()
+	changed := false
 	for endpointIP, reverseRecord := range generatedRecords {
-		klog.V(4).Infof("Adding endpointIP %q to reverseRecord %+v", endpointIP, reverseRecord)
-		kd.reverseRecordMap[endpointIP] = reverseRecord
+		changed = kd.setEndpointReverseRecord(endpointIP, reverseRecord) || changed
 	}
-	kd.cache.SetSubCache(svc.Name, subCache, subCachePath...)
+	changed = kd.cache.SetSubCache(svc.Name, subCache, subCachePath...) || changed
+	if changed {
+		kd.recordsChanged(svc.Namespace, svc.Name)
+	}
+	kd.updateEndpointFirstSeen(svc, endpointIPs)
 	return nil
 }
 
+// updateEndpointFirstSeen records the time the endpoint IPs of the given
+// headless service were first seen, keeping the time of the IPs that were
+// already known and forgetting the ones that are gone.
+// Important: Assumes that we already have the cacheLock.
+func (kd *KubeDNS) updateEndpointFirstSeen(svc *v1.Service, endpointIPs []string) {
+	key := svc.Namespace + "/" + svc.Name
+	now := kd.clock.Now()
+	previous := kd.endpointFirstSeen[key]
+	firstSeen := make(map[string]time.Time)
+	for _, endpointIP := range endpointIPs {
+		if seen, ok := previous[endpointIP]; ok {
+			firstSeen[endpointIP] = seen
+		} else {
+			firstSeen[endpointIP] = now
+		}
+	}
+	kd.endpointFirstSeen[key] = firstSeen
+}
+
+// normalizeSRVWeights sets the weights of the given SRV records, which share
+// the same priority, so that they sum to 100. The remainder of the division
+// goes to the records with the lowest targets, one point each. Every record
+// gets a weight of at least 1, so the weights of more than 100 records sum to
+// more than 100.
+func normalizeSRVWeights(records []*skymsg.Service) {
+	if len(records) == 0 {
+		return
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Host < records[j].Host })
+	weight, remainder := 100/len(records), 100%len(records)
+	for i, record := range records {
+		record.Weight = weight
+		if i < remainder {
+			record.Weight++
+		}
+		if record.Weight == 0 {
+			record.Weight = 1
+		}
+	}
+}
+
+// srvPortName returns the name of the given port used in the label of its
+// SRV records, lowercased if lowercase is set, and whether it is valid. Port
+// names are used verbatim otherwise.
+func srvPortName(name string, lowercase bool) (string, bool) {
+	if !lowercase {
+		return name, true
+	}
+	normalized := strings.ToLower(name)
+	if normalized != name {
+		klog.V(2).Infof("Normalized port name %q to %q", name, normalized)
+	}
+	if errs := validation.IsValidPortName(normalized); len(errs) != 0 {
+		klog.Warningf("Invalid port name %q: %v", name, errs)
+		return "", false
+	}
+	return normalized, true
+}
+
+// srvPortLabel is like srvPortName, but returns the number of the port if
+// it is unnamed. Port names contain at least a letter, so the label of an
+// unnamed port never collides with the one of a named port, nor with the
+// one of another unnamed port of the same protocol.
+func srvPortLabel(name string, number int32, lowercase bool) (string, bool) {
+	if name == "" {
+		return strconv.Itoa(int(number)), true
+	}
+	return srvPortName(name, lowercase)
+}
+
+// isSRVProtocol returns whether protocol is one for which SRV records are
+// generated.
+func isSRVProtocol(protocol v1.Protocol) bool {
+	switch protocol {
+	case v1.ProtocolTCP, v1.ProtocolUDP, v1.ProtocolSCTP:
+		return true
+	}
+	return false
+}
+
 func getHostname(address *v1.EndpointAddress) (string, bool) {
 	if len(address.Hostname) > 0 {
 		return address.Hostname, true
@@ -588,12 +1919,108 @@ func getHostname(address *v1.EndpointAddress) (string, bool) {
 	return "", false
 }
 
+// hasReverseRecord returns whether a PTR record is generated for the given
+// headless service endpoint address: if it is named, or if it refers to a pod
+// and targetRefPTRRecords is set.
+func hasReverseRecord(address *v1.EndpointAddress, targetRefPTRRecords bool) bool {
+	_, named := getHostname(address)
+	return named || targetRefPTRRecords && isPodAddress(address)
+}
+
+// isPodAddress returns whether the given endpoint address refers to a pod.
+func isPodAddress(address *v1.EndpointAddress) bool {
+	return address.TargetRef != nil && address.TargetRef.Kind == "Pod"
+}
+
+// podFQDN constructs the fqdn of the pod record of the given IP, e.g.
+// 10-0-0-1.default.pod.cluster.local.
+func (kd *KubeDNS) podFQDN(ip, namespace string) string {
+	label := strings.NewReplacer(".", "-", ":", "-").Replace(ip)
+	domainLabels := append(append([]string{}, kd.domainPath...), podSubdomain, namespace, label)
+	return dns.Fqdn(strings.Join(util.ReverseArray(domainLabels), "."))
+}
+
+// generateServiceSRVRecords adds a _service._<proto> SRV record pointing
+// at the service for each of its ports, named or not, so that clients can
+// discover the ports of a service without knowing their names.
+func (kd *KubeDNS) generateServiceSRVRecords(subCache treecache.TreeCache, service *v1.Service) {
+	excludedPorts := srvExcludedPorts(service)
+	for i := range service.Spec.Ports {
+		port := &service.Spec.Ports[i]
+		if port.Name != "" && excludedPorts.Has(strings.ToLower(port.Name)) {
+			continue
+		}
+		if !isSRVProtocol(port.Protocol) {
+			if port.Protocol != "" {
+				klog.V(2).Infof("Skipping service SRV record for port %d of service %s/%s with unknown protocol %q",
+					port.Port, service.Namespace, service.Name, port.Protocol)
+			}
+			continue
+		}
+		srvValue := kd.generateSRVRecordValue(service, int(port.Port))
+		srvLabel := kd.recordLabel(srvValue, util.HashServiceRecord(srvValue))
+
+		l := []string{"_" + strings.ToLower(string(port.Protocol)), serviceSRVLabel}
+		klog.V(3).Infof("Added service SRV record %+v", srvValue)
+
+		subCache.SetEntry(srvLabel, srvValue, kd.fqdn(service, append(l, srvLabel)...), l...)
+	}
+}
+
+// getSkyMsg behaves like util.GetSkyMsg, but labels the record with
+// hashFunc if set.
+func (kd *KubeDNS) getSkyMsg(ip string, port int) (*skymsg.Service, string) {
+	record, label := util.GetSkyMsg(ip, port)
+	return record, kd.recordLabel(record, label)
+}
+
+// hasIPFamily returns whether the given IP of the service or of its
+// endpoints has a family, and logs it if it doesn't. Such IPs get no
+// record, so that every address record answers either A or AAAA questions.
+func hasIPFamily(service *v1.Service, ip string) bool {
+	if _, ok := util.IPFamily(ip); !ok {
+		klog.Warningf("Not adding record for IP %q of service %s/%s, which is not an IPv4 or IPv6 address",
+			ip, service.Namespace, service.Name)
+		return false
+	}
+	return true
+}
+
+// getServiceSkyMsg behaves like getSkyMsg, but the record is served with
+// the TTL of the given service. The label is computed before the TTL is set,
+// so that it doesn't change with the TTL.
+func (kd *KubeDNS) getServiceSkyMsg(service *v1.Service, ip string, port int) (*skymsg.Service, string) {
+	record, label := kd.getSkyMsg(ip, port)
+	record.Ttl = serviceTTL(service)
+	return record, label
+}
+
+// recordLabel returns the label computed by hashFunc for the given record,
+// or defaultLabel if hashFunc is not set or returns a label that is not a
+// valid DNS label.
+func (kd *KubeDNS) recordLabel(record *skymsg.Service, defaultLabel string) string {
+	if kd.hashFunc == nil {
+		return defaultLabel
+	}
+	label := kd.hashFunc(record)
+	if errs := validation.IsDNS1123Label(label); len(errs) != 0 {
+		klog.Errorf("Invalid label %q computed for record %v, using %q instead: %v", label, record, defaultLabel, errs)
+		return defaultLabel
+	}
+	return label
+}
+
+// generateSRVRecordValue returns the SRV record of the given port of svc,
+// targeting the name of the service, or the name under it made of labels.
+// Targeting names rather than addresses keeps a single SRV record per port
+// for dual-stack services: the target resolves to the A and AAAA records
+// of all their cluster IPs.
 func (kd *KubeDNS) generateSRVRecordValue(svc *v1.Service, portNumber int, labels ...string) *skymsg.Service {
 	host := strings.Join([]string{svc.Name, svc.Namespace, serviceSubdomain, kd.domain}, ".")
 	for _, cNameLabel := range labels {
 		host = cNameLabel + "." + host
 	}
-	recordValue, _ := util.GetSkyMsg(host, portNumber)
+	recordValue, _ := util.GetSkyMsgWithTTL(host, portNumber, serviceTTL(svc))
 	return recordValue
 }
 
@@ -623,19 +2050,65 @@ func (kd *KubeDNS) newHeadlessService(service *v1.Service) error {
 	return nil
 }
 
+// serviceSpecConflict returns a description of the fields of the given
+// service that contradict its type, or "" if there is none: an ExternalName
+// service with a cluster IP, or a service of another type with an external
+// name. The records of a service are always generated after its declared
+// type, and the contradicting fields are ignored.
+func serviceSpecConflict(service *v1.Service) string {
+	if service.Spec.Type == v1.ServiceTypeExternalName {
+		if util.IsServiceIPSet(service) {
+			return fmt.Sprintf("ignoring cluster IPs %v of ExternalName service", util.GetClusterIPs(service))
+		}
+	} else if service.Spec.ExternalName != "" {
+		return fmt.Sprintf("ignoring external name %q of %s service", service.Spec.ExternalName, serviceType(service))
+	}
+	return ""
+}
+
+// serviceType returns the type of the given service, which defaults to
+// ClusterIP.
+func serviceType(service *v1.Service) v1.ServiceType {
+	if service.Spec.Type == "" {
+		return v1.ServiceTypeClusterIP
+	}
+	return service.Spec.Type
+}
+
 // Generates skydns records for an ExternalName service.
 func (kd *KubeDNS) newExternalNameService(service *v1.Service) {
 	// Create a CNAME record for the service's ExternalName.
-	// TODO: TTL?
-	recordValue, _ := util.GetSkyMsg(service.Spec.ExternalName, 0)
+	recordValue, _ := util.GetSkyMsgWithTTL(service.Spec.ExternalName, 0, serviceTTL(service))
+	targets := secondaryExternalNameTargets(service)
 	cachePath := append(kd.domainPath, serviceSubdomain, service.Namespace)
 	fqdn := kd.fqdn(service)
 	klog.V(3).Infof("newExternalNameService: storing key %s with value %v as %s under %v",
 		service.Name, recordValue, fqdn, cachePath)
+	key := service.Namespace + "/" + service.Name
 	kd.cacheLock.Lock()
 	defer kd.cacheLock.Unlock()
 	// Store the service name directly as the leaf key
-	kd.cache.SetEntry(service.Name, recordValue, fqdn, cachePath...)
+	changed := kd.cache.SetEntry(service.Name, recordValue, fqdn, cachePath...)
+	changed = !reflect.DeepEqual(kd.externalNameTargets[key], targets) || changed
+	if len(targets) > 0 {
+		kd.externalNameTargets[key] = targets
+	} else {
+		delete(kd.externalNameTargets, key)
+	}
+	if changed {
+		kd.recordsChanged(service.Namespace, service.Name)
+	}
+	kd.updateServiceFirstSeen(service)
+}
+
+// updateServiceFirstSeen records the time the given service was first seen,
+// if it is not already known.
+// Important: Assumes that we already have the cacheLock.
+func (kd *KubeDNS) updateServiceFirstSeen(service *v1.Service) {
+	key := service.Namespace + "/" + service.Name
+	if _, ok := kd.serviceFirstSeen[key]; !ok {
+		kd.serviceFirstSeen[key] = kd.clock.Now()
+	}
 }
 
 // HasSynced returns true if the initial sync of services and endpoints
@@ -644,31 +2117,69 @@ func (kd *KubeDNS) HasSynced() bool {
 	return kd.endpointsController.HasSynced() && kd.serviceController.HasSynced()
 }
 
+// Ready returns true if KubeDNS is ready to serve, i.e. once the initial
+// sync of services and endpoints has completed. It is meant for readiness
+// probes of embedders that don't block on StartWithContext.
+func (kd *KubeDNS) Ready() bool {
+	return kd.HasSynced()
+}
+
 // Records responds with DNS records that match the given name, in a format
 // understood by the skydns server. If "exact" is true, a single record
 // matching the given name is returned, otherwise all records stored under
-// the subtree matching the name are returned.
+// the subtree matching the name are returned. A "*" label matches any label,
+// e.g. *.myheadless.myns.svc.cluster.local matches the records of all the
+// endpoints of the headless service myheadless.
 func (kd *KubeDNS) Records(name string, exact bool) (retval []skymsg.Service, err error) {
 	klog.V(3).Infof("Query for %q, exact: %v", name, exact)
+	defer func() { kd.queries.observe(recordsQueryType(name, retval), len(retval) > 0, err) }()
+
+	if record, ok := kd.healthProbeRecord(name); ok {
+		return []skymsg.Service{*record}, nil
+	}
+	if records, ok := kd.stubDomainRecords(name); ok {
+		return records, nil
+	}
+
+	negativeTTL := kd.currentConfig().NegativeCacheTTL.Duration
+	negativeKey := negativeCacheKey{name: name, exact: exact}
+	if negativeTTL > 0 && kd.negativeCache.contains(negativeKey, kd.clock.Now()) {
+		klog.V(3).Infof("No record found for %v (negative cache)", name)
+		return nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound}
+	}
+	// Read before looking the records up, so that the miss is not
+	// remembered if the records change in the meantime.
+	negativeGeneration := kd.negativeCache.currentGeneration()
 
 	trimmed := strings.TrimRight(name, ".")
-	segments := strings.Split(trimmed, ".")
+	segments := util.ReverseArray(kd.toClusterDomain(util.ReverseArray(strings.Split(trimmed, "."))))
 	isFederationQuery := false
 	federationSegments := []string{}
 
 	if !exact && kd.isFederationQuery(segments) {
+		// The name may also be a local record, e.g. the name of an endpoint
+		// of a headless service in a namespace named after a federation.
+		if kd.currentConfig().PreferLocalRecords {
+			localPath := util.ReverseArray(append([]string{}, segments...))
+			if records, err := kd.getRecordsForPath(localPath, exact); err == nil && len(records) > 0 {
+				klog.V(3).Infof("Federation query %q matches local records, not treating it as a federation query", name)
+				return records, nil
+			}
+		}
 		klog.V(3).Infof("Received federation query, trying local service first")
 		// Try querying the non-federation (local) service first. Will try
 		// the federation one later, if this fails.
 		isFederationQuery = true
 		federationSegments = append(federationSegments, segments...)
 		// To try local service, remove federation name from segments.
-		// Federation name is 3rd in the segment (after service name and
-		// namespace).
-		segments = append(segments[:2], segments[3:]...)
+		// Federation name follows the service name and namespace, and
+		// the wildcard label of wildcard queries.
+		federationIndex := kd.federationLabelIndex(segments)
+		segments = append(segments[:federationIndex], segments[federationIndex+1:]...)
 	}
 
 	path := util.ReverseArray(segments)
+	kd.touchNamespace(kd.pathNamespace(path))
 	records, err := kd.getRecordsForPath(path, exact)
 
 	if err != nil {
@@ -678,11 +2189,25 @@ func (kd *KubeDNS) Records(name string, exact bool) (retval []skymsg.Service, er
 	if isFederationQuery {
 		return kd.recordsForFederation(records, path, exact, federationSegments)
 	} else if len(records) > 0 {
+		currentConfig := kd.currentConfig()
+		if currentConfig.ResolveFederatedExternalNames {
+			kd.resolveFederatedExternalNames(records)
+		}
+		if currentConfig.ShuffleRecords {
+			kd.shuffleRecords(records)
+		}
 		klog.V(4).Infof("Records for %v: %v", name, records)
 		return records, nil
+	} else if kd.currentConfig().AnswerPodSubdomainApex && kd.isPodSubdomainApex(path) {
+		// The apex exists, but has no record (NODATA).
+		return []skymsg.Service{}, nil
 	}
 
 	klog.V(3).Infof("No record found for %v", name)
+	if negativeTTL > 0 {
+		now := kd.clock.Now()
+		kd.negativeCache.add(negativeKey, negativeGeneration, now, now.Add(negativeTTL))
+	}
 	return nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound}
 }
 
@@ -725,7 +2250,11 @@ func (kd *KubeDNS) recordsForFederation(records []skymsg.Service, path []string,
 		}
 		klog.V(3).Infof(
 			"Federation: Returning CNAME for local service: %v", name)
-		return []skymsg.Service{{Host: name}}, nil
+		retval = []skymsg.Service{{Host: name}}
+		if kd.currentConfig().CollapseFederationCNAMEs {
+			retval = kd.followCNAMEs(strings.Join(federationSegments, "."), retval)
+		}
+		return retval, nil
 	}
 
 	// If the name query is not an exact query and does not match any
@@ -734,22 +2263,59 @@ func (kd *KubeDNS) recordsForFederation(records []skymsg.Service, path []string,
 	if !exact {
 		klog.V(3).Infof(
 			"Federation: Did not find a local service. Trying federation redirect (CNAME)")
-		return kd.federationRecords(util.ReverseArray(federationSegments))
+		if !kd.federationFallbacks.acquire(kd.currentConfig().MaxConcurrentFederationFallbacks) {
+			klog.V(3).Infof("Federation: too many concurrent redirects, not redirecting")
+			return nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound}
+		}
+		defer kd.federationFallbacks.release()
+		retval, err = kd.federationRecords(util.ReverseArray(federationSegments))
+		if err == nil {
+			kd.queries.observeFederationRedirect()
+		}
+		return retval, err
 	}
 
 	return nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound}
 }
 
+// getRecordsForPath returns the records under the given path, or the
+// record at path if exact is true. The records are sorted by host, then
+// port and key, so that e.g. the A records of the endpoints of a headless
+// service come in the same order from one query to the next. Records
+// shuffles them afterwards if ShuffleRecords is set.
 func (kd *KubeDNS) getRecordsForPath(path []string, exact bool) ([]skymsg.Service, error) {
 	if kd.isPodRecord(path) {
 		ip, err := kd.getPodIP(path)
 		if err == nil {
 			skyMsg, _ := util.GetSkyMsg(ip, 0)
-			return []skymsg.Service{*skyMsg}, nil
+			retval := []skymsg.Service{*skyMsg}
+			currentConfig := kd.currentConfig()
+			kd.applyTTLJitter(retval, currentConfig)
+			applyTTLBounds(retval, currentConfig)
+			return retval, nil
 		}
 		return nil, err
 	}
 
+	currentConfig := kd.currentConfig()
+	stabilityTTL := currentConfig.EndpointStabilityTTL
+
+	if currentConfig.AnswerPodSubdomainApex && kd.isPodSubdomainApex(path) {
+		retval := []skymsg.Service{}
+		if currentConfig.PodSubdomainApexIP != "" {
+			skyMsg, _ := util.GetSkyMsg(currentConfig.PodSubdomainApexIP, 0)
+			retval = append(retval, *skyMsg)
+		}
+		kd.applyTTLJitter(retval, currentConfig)
+		applyTTLBounds(retval, currentConfig)
+		return retval, nil
+	}
+
+	if kd.isAggregateOnlyEndpointPath(path) {
+		klog.V(3).Infof("Not serving the endpoint record %v of an aggregate-only service", path)
+		return nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound}
+	}
+
 	if exact {
 		key := path[len(path)-1]
 		if key == "" {
@@ -759,7 +2325,14 @@ func (kd *KubeDNS) getRecordsForPath(path []string, exact bool) ([]skymsg.Servic
 		defer kd.cacheLock.RUnlock()
 		if record, ok := kd.cache.GetEntry(key, path[:len(path)-1]...); ok {
 			klog.V(3).Infof("Exact match %v for %v received from cache", record, path[:len(path)-1])
-			return []skymsg.Service{*(record.(*skymsg.Service))}, nil
+			retval := []skymsg.Service{*(record.(*skymsg.Service))}
+			retval = kd.appendExternalNameTargets(path, retval)
+			kd.applyEndpointStabilityTTL(retval, stabilityTTL)
+			kd.applyUnbackedServiceTTL(retval, currentConfig.UnbackedServiceTTL)
+			kd.applyRecordMaxAge(retval, currentConfig.RecordMaxAge.Duration)
+			kd.applyTTLJitter(retval, currentConfig)
+			applyTTLBounds(retval, currentConfig)
+			return retval, nil
 		}
 
 		klog.V(3).Infof("Exact match for %v not found in cache", path)
@@ -768,28 +2341,269 @@ func (kd *KubeDNS) getRecordsForPath(path []string, exact bool) ([]skymsg.Servic
 
 	kd.cacheLock.RLock()
 	defer kd.cacheLock.RUnlock()
-	records := kd.cache.GetValuesForPathWithWildcards(path...)
+	var records []*skymsg.Service
+	if currentConfig.AggregateProtocolSRVRecords && kd.isProtocolPath(path) {
+		records = kd.protocolSRVRecords(path)
+	} else {
+		records = kd.cache.GetValuesForPathWithWildcards(path...)
+	}
+	records = kd.excludeNotReadyRecords(path, records, currentConfig.NotReadySubdomain)
+	sortRecords(records)
 	klog.V(3).Infof("Found %d records for %v in the cache", len(records), path)
+	if maxRecords := maxWildcardRecords(currentConfig); isWildcardPath(path) && len(records) > maxRecords {
+		klog.V(2).Infof("Truncating the %d records found for wildcard query %v to %d", len(records), path, maxRecords)
+		records = records[:maxRecords]
+	}
 
 	retval := []skymsg.Service{}
 	for _, val := range records {
 		retval = append(retval, *val)
 	}
+	retval = kd.appendExternalNameTargets(path, retval)
+	kd.applyEndpointStabilityTTL(retval, stabilityTTL)
+	kd.applyUnbackedServiceTTL(retval, currentConfig.UnbackedServiceTTL)
+	kd.applyRecordMaxAge(retval, currentConfig.RecordMaxAge.Duration)
+	kd.applyTTLJitter(retval, currentConfig)
+	applyTTLBounds(retval, currentConfig)
 
 	klog.V(4).Infof("getRecordsForPath retval=%+v, path=%v", retval, path)
 
 	return retval, nil
 }
 
+// sortRecords sorts the given records by host, then port and key, as the
+// cache returns them in no particular order.
+func sortRecords(records []*skymsg.Service) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Host != records[j].Host {
+			return records[i].Host < records[j].Host
+		}
+		if records[i].Port != records[j].Port {
+			return records[i].Port < records[j].Port
+		}
+		return records[i].Key < records[j].Key
+	})
+}
+
+// isAggregateOnlyEndpointPath returns whether the given path is the name of
+// an endpoint of a headless service with the AggregateRecordsOnlyAnnotation,
+// e.g. {"local", "cluster", "svc", "default", "myheadless", "myhostname"}.
+func (kd *KubeDNS) isAggregateOnlyEndpointPath(path []string) bool {
+	if len(path) != len(kd.domainPath)+4 || path[len(kd.domainPath)] != serviceSubdomain {
+		return false
+	}
+	namespace, name, label := path[len(path)-3], path[len(path)-2], path[len(path)-1]
+	if namespace == "*" || name == "*" || label == "*" {
+		return false
+	}
+	obj, exists, err := kd.servicesStore.GetByKey(namespace + "/" + name)
+	if err != nil || !exists {
+		return false
+	}
+	service, ok := obj.(*v1.Service)
+	return ok && !util.IsServiceIPSet(service) && aggregateRecordsOnly(service)
+}
+
+// excludeNotReadyRecords removes from the given records of path the records
+// of the not-ready addresses served under notReadySubdomain, if path is the
+// name of a service or a wildcard under it, e.g.
+// {"local", "cluster", "svc", "default", "myheadless", "*"}.
+// Important: Assumes that we already have the cacheLock.
+func (kd *KubeDNS) excludeNotReadyRecords(path []string, records []*skymsg.Service, notReadySubdomain string) []*skymsg.Service {
+	servicePathLen := len(kd.domainPath) + 3
+	if notReadySubdomain == "" || len(path) < servicePathLen || path[len(kd.domainPath)] != serviceSubdomain {
+		return records
+	}
+	if len(path) > servicePathLen && (len(path) != servicePathLen+1 || path[len(path)-1] != "*") {
+		return records
+	}
+	notReadyPath := append(append([]string{}, path[:servicePathLen]...), notReadySubdomain)
+	notReady := map[*skymsg.Service]bool{}
+	for _, record := range kd.cache.GetValuesForPathWithWildcards(notReadyPath...) {
+		notReady[record] = true
+	}
+	if len(notReady) == 0 {
+		return records
+	}
+	retval := []*skymsg.Service{}
+	for _, record := range records {
+		if !notReady[record] {
+			retval = append(retval, record)
+		}
+	}
+	return retval
+}
+
+// isProtocolPath returns whether the given path is the protocol level of
+// the SRV records of a service, e.g.
+// {"local", "cluster", "svc", "default", "kubernetes", "_tcp"}.
+func (kd *KubeDNS) isProtocolPath(path []string) bool {
+	if len(path) != len(kd.domainPath)+4 || path[len(kd.domainPath)] != serviceSubdomain {
+		return false
+	}
+	protocol := path[len(path)-1]
+	return strings.HasPrefix(protocol, "_") &&
+		isSRVProtocol(v1.Protocol(strings.ToUpper(strings.TrimPrefix(protocol, "_"))))
+}
+
+// protocolSRVRecords returns the SRV records of every named port of the
+// service with the protocol of the given path.
+// Important: Assumes that we already have the cacheLock.
+func (kd *KubeDNS) protocolSRVRecords(path []string) []*skymsg.Service {
+	retval := []*skymsg.Service{}
+	serviceSRVKey := "/" + serviceSRVLabel + "/"
+	for _, record := range kd.cache.GetAllValuesForPath(path...) {
+		// The _service records duplicate the records of the named ports.
+		if !strings.Contains(record.Key, serviceSRVKey) {
+			retval = append(retval, record)
+		}
+	}
+	return retval
+}
+
+// maxWildcardRecords returns the maximum number of records returned for a
+// wildcard query.
+func maxWildcardRecords(c *config.Config) int {
+	if c.MaxWildcardRecords > 0 {
+		return c.MaxWildcardRecords
+	}
+	return defaultMaxWildcardRecords
+}
+
+func isWildcardPath(path []string) bool {
+	for _, label := range path {
+		if label == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// applyEndpointStabilityTTL scales the TTL of the headless service endpoint
+// records in the given list with the time their endpoint has been present.
+// The TTL set by the TTLAnnotation of a service takes precedence, so the
+// records of annotated services are left untouched, as are all records if
+// stabilityTTL is nil.
+// Important: Assumes that we already have the cacheLock.
+func (kd *KubeDNS) applyEndpointStabilityTTL(records []skymsg.Service, stabilityTTL *config.StabilityTTL) {
+	if stabilityTTL == nil {
+		return
+	}
+	now := kd.clock.Now()
+	for i := range records {
+		namespace, name, ok := kd.serviceForRecordKey(records[i].Key)
+		if !ok {
+			continue
+		}
+		firstSeen, ok := kd.endpointFirstSeen[namespace+"/"+name][records[i].Host]
+		if !ok || kd.hasTTLAnnotation(namespace, name) {
+			continue
+		}
+		ttl := stabilityTTL.MaxTTL
+		if age := now.Sub(firstSeen); age < stabilityTTL.RampPeriod.Duration {
+			ramp := float64(stabilityTTL.MaxTTL-stabilityTTL.MinTTL) * float64(age) / float64(stabilityTTL.RampPeriod.Duration)
+			ttl = stabilityTTL.MinTTL + uint32(ramp)
+		}
+		records[i].Ttl = ttl
+	}
+}
+
+// hasTTLAnnotation returns whether the service with the given namespace and
+// name sets its TTL with the TTLAnnotation.
+func (kd *KubeDNS) hasTTLAnnotation(namespace, name string) bool {
+	obj, exists, err := kd.servicesStore.GetByKey(namespace + "/" + name)
+	if err != nil || !exists {
+		return false
+	}
+	service, ok := obj.(*v1.Service)
+	if !ok {
+		return false
+	}
+	_, ok = service.Annotations[TTLAnnotation]
+	return ok
+}
+
+// applyUnbackedServiceTTL caps to ttl the TTL of the cluster IP records in
+// the given list whose service has no endpoints. SRV records are left
+// untouched, as clients resolve their target, whose TTL is capped. Records
+// are left untouched if ttl is 0.
+// Important: Assumes that we already have the cacheLock.
+func (kd *KubeDNS) applyUnbackedServiceTTL(records []skymsg.Service, ttl uint32) {
+	if ttl == 0 {
+		return
+	}
+	for i := range records {
+		if records[i].Ttl <= ttl || kd.isHeadlessServiceRecord(&records[i]) {
+			continue
+		}
+		hasEndpoints, err := kd.serviceWithClusterIPHasEndpoints(&records[i])
+		if err != nil {
+			klog.V(3).Infof("Error finding if service of record %v has endpoints: %v", records[i], err)
+			continue
+		}
+		if !hasEndpoints {
+			records[i].Ttl = ttl
+		}
+	}
+}
+
+// applyRecordMaxAge caps the TTL of the given records to the time left
+// until they are maxAge old, or sets it to 0 past it. The records of
+// headless service endpoints are as old as the IP of the endpoint, the
+// other ones as their service. Records of unknown age, e.g. pod records, are left
+// untouched, and so are all records if maxAge is 0.
+// Important: Assumes that we already have the cacheLock.
+func (kd *KubeDNS) applyRecordMaxAge(records []skymsg.Service, maxAge time.Duration) {
+	if maxAge == 0 {
+		return
+	}
+	now := kd.clock.Now()
+	for i := range records {
+		namespace, name, ok := kd.serviceForRecordKey(records[i].Key)
+		if !ok {
+			continue
+		}
+		key := namespace + "/" + name
+		firstSeen, ok := kd.endpointFirstSeen[key][records[i].Host]
+		if !ok {
+			if firstSeen, ok = kd.serviceFirstSeen[key]; !ok {
+				continue
+			}
+		}
+		remaining := maxAge - now.Sub(firstSeen)
+		if remaining < 0 {
+			remaining = 0
+		}
+		if ttl := uint32(remaining / time.Second); ttl < records[i].Ttl {
+			records[i].Ttl = ttl
+		}
+	}
+}
+
+// applyTTLBounds clamps the TTL of the given records to the minTTL and
+// maxTTL bounds of the configuration.
+func applyTTLBounds(records []skymsg.Service, currentConfig *config.Config) {
+	for i := range records {
+		records[i].Ttl = currentConfig.BoundTTL(records[i].Ttl)
+	}
+}
+
 // Returns true if the given record corresponds to a headless service.
 // Important: Assumes that we already have the cacheLock. Callers responsibility to acquire it.
 // This is because the code will panic, if we try to acquire it again if we already have it.
 func (kd *KubeDNS) isHeadlessServiceRecord(msg *skymsg.Service) bool {
 	// If it is not a headless service, then msg.Host will be the cluster IP.
 	// So we can check if msg.host exists in our clusterIPServiceMap.
-	_, ok := kd.clusterIPServiceMap[msg.Host]
+	owner, ok := kd.clusterIPServiceMap[msg.Host]
 	// It is headless service if no record was found.
-	return !ok
+	if !ok {
+		return true
+	}
+	// The address of an endpoint of a headless service may also be a
+	// cluster IP, in which case the record is not under the name of the
+	// service owning the cluster IP.
+	namespace, name, ok := kd.serviceForRecordKey(msg.Key)
+	return ok && (namespace != owner.Namespace || name != owner.Name)
 }
 
 // Returns true if the service corresponding to the given message has endpoints.
@@ -820,8 +2634,9 @@ func (kd *KubeDNS) serviceWithClusterIPHasEndpoints(msg *skymsg.Service) (bool,
 }
 
 // ReverseRecord performs a reverse lookup for the given name.
-func (kd *KubeDNS) ReverseRecord(name string) (*skymsg.Service, error) {
+func (kd *KubeDNS) ReverseRecord(name string) (record *skymsg.Service, err error) {
 	klog.V(3).Infof("Query for ReverseRecord %q", name)
+	defer func() { kd.queries.observe(ptrQueryType, record != nil, err) }()
 
 	// if portalIP is not a valid IP, the reverseRecordMap lookup will fail
 	portalIP, ok := util.ExtractIP(name)
@@ -832,10 +2647,32 @@ func (kd *KubeDNS) ReverseRecord(name string) (*skymsg.Service, error) {
 	kd.cacheLock.RLock()
 	defer kd.cacheLock.RUnlock()
 	if reverseRecord, ok := kd.reverseRecordMap[portalIP]; ok {
+		kd.touchNamespace(kd.reverseRecordNamespace(reverseRecord))
 		return reverseRecord, nil
 	}
 
-	return nil, fmt.Errorf("must be exactly one service record")
+	if currentConfig := kd.currentConfig(); currentConfig.ForwardUnknownReverseQueries && !currentConfig.InClusterCIDRs(portalIP) {
+		return nil, &ReverseRecordError{IP: portalIP, Err: ErrReverseNotAuthoritative}
+	}
+	return nil, &ReverseRecordError{IP: portalIP, Err: ErrReverseNotFound}
+}
+
+// healthProbeRecord returns the record of the health probe name of the
+// configuration, if name is this name.
+func (kd *KubeDNS) healthProbeRecord(name string) (*skymsg.Service, bool) {
+	probe := kd.currentConfig().HealthProbe
+	if probe == nil || !strings.EqualFold(dns.Fqdn(probe.Name), dns.Fqdn(name)) {
+		return nil, false
+	}
+	record, _ := util.GetSkyMsg(probe.IP, 0)
+	return record, true
+}
+
+// isPodSubdomainApex returns whether the given path is the apex of the pod
+// subdomain of a namespace, e.g. {"local", "cluster", "pod", "default"}.
+func (kd *KubeDNS) isPodSubdomainApex(path []string) bool {
+	return len(path) == len(kd.domainPath)+2 &&
+		path[len(kd.domainPath)] == podSubdomain && path[len(path)-1] != "*"
 }
 
 // e.g {"local", "cluster", "pod", "default", "10-0-0-1"}
@@ -857,36 +2694,48 @@ func (kd *KubeDNS) isPodRecord(path []string) bool {
 func (kd *KubeDNS) getPodIP(path []string) (string, error) {
 	ipStr := path[len(path)-1]
 	ip := strings.Replace(ipStr, "-", ".", -1)
-	if parsed := net.ParseIP(ip); parsed != nil {
-		return ip, nil
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", fmt.Errorf("Invalid IP Address %v", ip)
+	}
+	family := v1.IPv4Protocol
+	if parsed.To4() == nil {
+		family = v1.IPv6Protocol
 	}
-	return "", fmt.Errorf("Invalid IP Address %v", ip)
+	if !kd.currentConfig().AnswersPodRecords(family) {
+		klog.V(4).Infof("Not answering the pod record of %s address %v", family, ip)
+		return "", etcd.Error{Code: etcd.ErrorCodeKeyNotFound}
+	}
+	return ip, nil
 }
 
 // isFederationQuery checks if the given query `path` matches the federated service query pattern.
 // The conjunction of the following conditions forms the test for the federated service query
 // pattern:
-//   1. `path` has exactly 4+len(domainPath) segments: mysvc.myns.myfederation.svc.domain.path.
-//   2. Service name component must be a valid RFC 1035 name.
-//   3. Namespace component must be a valid RFC 1123 name.
-//   4. Federation component must also be a valid RFC 1123 name.
-//   5. Fourth segment is exactly "svc"
-//   6. The remaining segments match kd.domainPath.
-//   7. And federation must be one of the listed federations in the config.
-//   Note: Because of the above conditions, this method will treat wildcard queries such as
-//   *.mysvc.myns.myfederation.svc.domain.path as non-federation queries.
-//   We can add support for wildcard queries later, if needed.
+//  1. `path` has exactly 4+len(domainPath) segments: mysvc.myns.myfederation.svc.domain.path,
+//     or 5+len(domainPath) if the first one is "*".
+//  2. Service name component must be a valid RFC 1035 name, or "*".
+//  3. Namespace component must be a valid RFC 1123 name, or "*".
+//  4. Federation component must also be a valid RFC 1123 name.
+//  5. Fourth segment is exactly "svc"
+//  6. The remaining segments match kd.domainPath.
+//  7. And federation must be one of the listed federations in the config.
+//     Wildcard queries such as *.mysvc.myns.myfederation.svc.domain.path, matching the endpoints
+//     of a headless service, or mysvc.*.myfederation.svc.domain.path are thus federation queries.
 func (kd *KubeDNS) isFederationQuery(path []string) bool {
+	if len(path) == 5+len(kd.domainPath) && path[0] == "*" {
+		path = path[1:]
+	}
 	if len(path) != 4+len(kd.domainPath) {
 		klog.V(4).Infof("Not a federation query: len(%q) != 4+len(%q)", path, kd.domainPath)
 		return false
 	}
-	if errs := validation.IsDNS1035Label(path[0]); len(errs) != 0 {
+	if errs := validation.IsDNS1035Label(path[0]); path[0] != "*" && len(errs) != 0 {
 		klog.V(4).Infof("Not a federation query: %q is not an RFC 1035 label: %q",
 			path[0], errs)
 		return false
 	}
-	if errs := validation.IsDNS1123Label(path[1]); len(errs) != 0 {
+	if errs := validation.IsDNS1123Label(path[1]); path[1] != "*" && len(errs) != 0 {
 		klog.V(4).Infof("Not a federation query: %q is not an RFC 1123 label: %q",
 			path[1], errs)
 		return false
@@ -921,6 +2770,38 @@ func (kd *KubeDNS) isFederationQuery(path []string) bool {
 	return true
 }
 
+// federationLabelIndex returns the index of the federation label in the
+// given federation query path, which ends with "svc" and the labels of the
+// domain, see isFederationQuery.
+func (kd *KubeDNS) federationLabelIndex(path []string) int {
+	return len(path) - len(kd.domainPath) - 2
+}
+
+// resolveFederatedExternalNames replaces the target of the ExternalName
+// records in the given list that are federated service names with the
+// federation CNAME they would be redirected to, so that clients don't have
+// to go through the federation query themselves.
+func (kd *KubeDNS) resolveFederatedExternalNames(records []skymsg.Service) {
+	for i := range records {
+		// ExternalName records are the only records that hold a name
+		// without a port.
+		if records[i].Port != 0 || net.ParseIP(records[i].Host) != nil {
+			continue
+		}
+		segments := strings.Split(strings.TrimSuffix(records[i].Host, "."), ".")
+		if !kd.isFederationQuery(segments) {
+			continue
+		}
+		federationRecords, err := kd.federationRecords(util.ReverseArray(segments))
+		if err != nil {
+			klog.V(3).Infof("Federation: could not resolve ExternalName target %q: %v", records[i].Host, err)
+			continue
+		}
+		klog.V(3).Infof("Federation: resolved ExternalName target %q to %q", records[i].Host, federationRecords[0].Host)
+		records[i].Host = federationRecords[0].Host
+	}
+}
+
 // federationRecords checks if the given `queryPath` is for a federated service and if it is,
 // it returns a CNAME response containing the cluster zone name and federation domain name
 // suffix.
@@ -937,6 +2818,7 @@ func (kd *KubeDNS) federationRecords(queryPath []string) ([]skymsg.Service, erro
 
 	// Now that we have already established that the query is a federation query, remove the local
 	// domain path components, i.e. kd.domainPath, from the query.
+	federation := path[kd.federationLabelIndex(path)]
 	path = path[:len(path)-len(kd.domainPath)]
 
 	// Append the zone name (zone in the cloud provider terminology, not a DNS
@@ -950,12 +2832,12 @@ func (kd *KubeDNS) federationRecords(queryPath []string) ([]skymsg.Service, erro
 	// We have already established that the map entry exists for the given federation,
 	// we just need to retrieve the domain name, validate it and append it to the path.
 	kd.configLock.RLock()
-	domain := kd.config.Federations[path[2]]
+	domain := kd.config.Federations[federation]
 	kd.configLock.RUnlock()
 
 	// We accept valid subdomains as well, so just let all the valid subdomains.
 	if len(validation.IsDNS1123Subdomain(domain)) != 0 {
-		return nil, fmt.Errorf("%s is not a valid domain name for federation %s", domain, path[2])
+		return nil, fmt.Errorf("%s is not a valid domain name for federation %s", domain, federation)
 	}
 	name := strings.Join(append(path, domain), ".")
 
@@ -977,58 +2859,123 @@ func (kd *KubeDNS) federationRecords(queryPath []string) ([]skymsg.Service, erro
 // that complexity is going to buy us. So taking a simpler approach here.
 // Also note that zone here means the zone in cloud provider terminology, not
 // the DNS zone.
+//
+// Both the GA topology labels and the deprecated failure-domain labels are
+// consulted. A node carrying both a zone and a region is preferred, but if no
+// such node exists the zone and region are assembled from different nodes.
 func (kd *KubeDNS) getClusterZoneAndRegion() (string, string, error) {
-	var node *v1.Node
+	var zone, region string
 
-	objs := kd.nodesStore.List()
-	if len(objs) > 0 {
-		var ok bool
-		if node, ok = objs[0].(*v1.Node); !ok {
-			return "", "", fmt.Errorf("expected node object, got: %T", objs[0])
+	for _, obj := range kd.nodesStore.List() {
+		node, ok := obj.(*v1.Node)
+		if !ok {
+			return "", "", fmt.Errorf("expected node object, got: %T", obj)
 		}
-	} else {
+		nodeZone, nodeRegion := getNodeZoneAndRegion(node)
+		if zone == "" {
+			zone = nodeZone
+		}
+		if region == "" {
+			region = nodeRegion
+		}
+	}
+
+	if zone == "" || region == "" {
 		// An alternative to listing nodes each time is to set a watch, but that is totally
 		// wasteful in case of non-federated independent Kubernetes clusters. So carefully
 		// proceeding here.
 		// TODO(madhusudancs): Move this to external/v1 API.
+		if !kd.nodeListBreaker.allow(kd.clock.Now()) {
+			return "", "", fmt.Errorf("failed to retrieve the cluster nodes: too many consecutive failures")
+		}
 		nodeList, err := kd.kubeClient.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
-		if err != nil || len(nodeList.Items) == 0 {
+		kd.nodeListBreaker.record(err, kd.clock.Now())
+		if err != nil {
 			return "", "", fmt.Errorf("failed to retrieve the cluster nodes: %v", err)
 		}
+		if len(nodeList.Items) == 0 {
+			return "", "", fmt.Errorf("the cluster has no nodes")
+		}
+
+		var zoneNode, regionNode *v1.Node
+		for i := range nodeList.Items {
+			node := &nodeList.Items[i]
+			nodeZone, nodeRegion := getNodeZoneAndRegion(node)
+			if nodeZone != "" && nodeRegion != "" {
+				// Select a node (arbitrarily the first node) that has
+				// both the zone and the region set.
+				zoneNode, regionNode = node, node
+				break
+			}
+			if nodeZone != "" && zoneNode == nil {
+				zoneNode = node
+			}
+			if nodeRegion != "" && regionNode == nil {
+				regionNode = node
+			}
+		}
 
-		// Select a node (arbitrarily the first node) that has
-		// `LabelZoneFailureDomain` and `LabelZoneRegion` set.
-		for _, nodeItem := range nodeList.Items {
-			_, zfound := nodeItem.Labels[v1.LabelZoneFailureDomain]
-			_, rfound := nodeItem.Labels[v1.LabelZoneRegion]
-			if !zfound || !rfound {
+		if zoneNode == nil && regionNode == nil {
+			if zone, region, ok := kd.fallbackZoneAndRegion(zone, region); ok {
+				return zone, region, nil
+			}
+			return "", "", fmt.Errorf("none of the %d cluster nodes has a zone or region label", len(nodeList.Items))
+		}
+		for _, node := range []*v1.Node{zoneNode, regionNode} {
+			if node == nil {
 				continue
 			}
-			// Make a copy of the node, don't rely on the loop variable.
-			node = &(*(&nodeItem))
 			if err := kd.nodesStore.Add(node); err != nil {
 				return "", "", fmt.Errorf("couldn't add the retrieved node to the cache: %v", err)
 			}
-			// Node is found, break out of the loop.
-			break
+		}
+		if zoneNode != nil && zone == "" {
+			zone, _ = getNodeZoneAndRegion(zoneNode)
+		}
+		if regionNode != nil && region == "" {
+			_, region = getNodeZoneAndRegion(regionNode)
 		}
 	}
 
-	if node == nil {
-		return "", "", fmt.Errorf("Could not find any nodes")
-	}
-
-	zone, ok := node.Labels[v1.LabelZoneFailureDomain]
-	if !ok || zone == "" {
+	zone, region, _ = kd.fallbackZoneAndRegion(zone, region)
+	if zone == "" {
 		return "", "", fmt.Errorf("unknown cluster zone")
 	}
-	region, ok := node.Labels[v1.LabelZoneRegion]
-	if !ok || region == "" {
+	if region == "" {
 		return "", "", fmt.Errorf("unknown cluster region")
 	}
 	return zone, region, nil
 }
 
+// fallbackZoneAndRegion completes the given cluster zone and region, found
+// on the nodes, with the fallbacks of the configuration, and returns
+// whether both are known.
+func (kd *KubeDNS) fallbackZoneAndRegion(zone, region string) (string, string, bool) {
+	currentConfig := kd.currentConfig()
+	if zone == "" {
+		zone = currentConfig.FallbackClusterZone
+	}
+	if region == "" {
+		region = currentConfig.FallbackClusterRegion
+	}
+	return zone, region, zone != "" && region != ""
+}
+
+// getNodeZoneAndRegion returns the zone and region labels of the given node,
+// preferring the GA topology labels over the deprecated failure-domain ones.
+// Either value is empty if the node carries neither label.
+func getNodeZoneAndRegion(node *v1.Node) (string, string) {
+	zone := node.Labels[v1.LabelTopologyZone]
+	if zone == "" {
+		zone = node.Labels[v1.LabelZoneFailureDomain]
+	}
+	region := node.Labels[v1.LabelTopologyRegion]
+	if region == "" {
+		region = node.Labels[v1.LabelZoneRegion]
+	}
+	return zone, region
+}
+
 func getServiceFQDN(domain string, service *v1.Service) string {
 	return strings.Join(
 		[]string{service.Name, service.Namespace, serviceSubdomain, domain}, ".")
@@ -17,12 +17,18 @@ limitations under the License.
 package dns
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
@@ -30,6 +36,7 @@ import (
 
 	etcd "github.com/coreos/etcd/client"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 	skymsg "github.com/skynetservices/skydns/msg"
 	skyserver "github.com/skynetservices/skydns/server"
 	"github.com/stretchr/testify/assert"
@@ -39,8 +46,11 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 
+	"k8s.io/apimachinery/pkg/util/clock"
 	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/dns/pkg/dns/config"
 	"k8s.io/dns/pkg/dns/treecache"
 	"k8s.io/dns/pkg/dns/util"
@@ -65,11 +75,25 @@ func newKubeDNS() *KubeDNS {
 		cache:               treecache.NewTreeCache(),
 		reverseRecordMap:    make(map[string]*skymsg.Service),
 		clusterIPServiceMap: make(map[string]*v1.Service),
-		cacheLock:           sync.RWMutex{},
 
 		config:     config.NewDefaultConfig(),
 		configLock: sync.RWMutex{},
 		configSync: config.NewNopSync(config.NewDefaultConfig()),
+
+		clock:             clock.RealClock{},
+		endpointFirstSeen: make(map[string]map[string]time.Time),
+		serviceFirstSeen:  make(map[string]time.Time),
+
+		endpointsRetryQueue: workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		externalNameQueue:   workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		eventRecorder:       nopEventRecorder{},
+		lastEvents:          make(map[eventKey]time.Time),
+		externalServices:    make(map[string]ExternalServiceSpec),
+		pendingRemovals:     make(map[string]*pendingRemoval),
+
+		externalNameReverseIPs: make(map[string]string),
+		externalNameTargets:    make(map[string][]*skymsg.Service),
+		seededServices:         make(map[string]*serviceSeed),
 	}
 }
 
@@ -142,6 +166,72 @@ func TestUnnamedSinglePortService(t *testing.T) {
 	}
 }
 
+// Unnamed ports get SRV records labeled after their number.
+func TestUnnamedPortSRVRecords(t *testing.T) {
+	srvPorts := func(kd *KubeDNS, name string) []int {
+		records, err := kd.RecordsOfType(name, dns.TypeSRV, false)
+		require.NoError(t, err, name)
+		ports := []int{}
+		for _, record := range records {
+			ports = append(ports, record.Port)
+		}
+		sort.Ints(ports)
+		return ports
+	}
+	udpSRVFQDN := func(kd *KubeDNS, s *v1.Service, portName string) string {
+		return strings.Replace(getSRVFQDN(kd, s, portName), "._tcp.", "._udp.", 1)
+	}
+
+	kd := newKubeDNS()
+	s := newService(testNamespace, testService, "1.2.3.4", "", 80)
+	kd.newService(s)
+	verifyRecord(t, "single unnamed port", getSRVFQDN(kd, s, "80"), getServiceFQDN(kd.domain, s), kd)
+	assert.Equal(t, []int{80}, srvPorts(kd, getSRVFQDN(kd, s, "80")))
+
+	// The labels of several unnamed ports don't collide, with each other
+	// nor with the ones of named ports.
+	kd = newKubeDNS()
+	s = newService(testNamespace, testService, "1.2.3.4", "", 80)
+	s.Spec.Ports = append(s.Spec.Ports,
+		v1.ServicePort{Protocol: "TCP", Port: 8080},
+		v1.ServicePort{Protocol: "UDP", Port: 80},
+		v1.ServicePort{Name: "http", Protocol: "TCP", Port: 81})
+	kd.newService(s)
+	assert.Equal(t, []int{80}, srvPorts(kd, getSRVFQDN(kd, s, "80")))
+	assert.Equal(t, []int{8080}, srvPorts(kd, getSRVFQDN(kd, s, "8080")))
+	assert.Equal(t, []int{80}, srvPorts(kd, udpSRVFQDN(kd, s, "80")))
+	assert.Equal(t, []int{81}, srvPorts(kd, getSRVFQDN(kd, s, "http")))
+
+	// A port without a protocol still gets no SRV record.
+	kd = newKubeDNS()
+	s = newService(testNamespace, testService, "1.2.3.4", "", 80)
+	s.Spec.Ports[0].Protocol = ""
+	kd.newService(s)
+	_, err := kd.Records(getSRVFQDN(kd, s, "80"), false)
+	assert.Error(t, err)
+
+	// Headless services are labeled after the ports of their endpoints.
+	kd = newKubeDNS()
+	s = newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(s))
+	e := newEndpoints(s, newSubsetWithOnePort("", 80, "10.0.0.1", "10.0.0.2"))
+	assert.NoError(t, kd.endpointsStore.Add(e))
+	kd.newService(s)
+	assert.Equal(t, []int{80, 80}, srvPorts(kd, getSRVFQDN(kd, s, "80")))
+
+	kd = newKubeDNS()
+	s = newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(s))
+	subset := newSubsetWithTwoPorts("", 80, "", 8080, "10.0.0.1")
+	subset.Ports = append(subset.Ports, v1.EndpointPort{Protocol: "UDP", Port: 80})
+	e = newEndpoints(s, subset)
+	assert.NoError(t, kd.endpointsStore.Add(e))
+	kd.newService(s)
+	assert.Equal(t, []int{80}, srvPorts(kd, getSRVFQDN(kd, s, "80")))
+	assert.Equal(t, []int{8080}, srvPorts(kd, getSRVFQDN(kd, s, "8080")))
+	assert.Equal(t, []int{80}, srvPorts(kd, udpSRVFQDN(kd, s, "80")))
+}
+
 func TestNamedSinglePortService(t *testing.T) {
 	const (
 		portName1 = "http1"
@@ -196,14 +286,14 @@ func TestNamedSinglePortService(t *testing.T) {
 		// Add the service
 		kd.newService(s)
 		assertDNSForClusterIP(t, tt.name, kd, s, tt.expectedIPs)
-		assertSRVForNamedPort(t, tt.name, kd, s, portName1, len(tt.expectedIPs))
+		assertSRVForNamedPort(t, tt.name, kd, s, portName1, 1)
 
 		newService := *s
 		// update the portName of the service
 		newService.Spec.Ports[0].Name = portName2
 		kd.updateService(s, &newService)
 		assertDNSForClusterIP(t, tt.name, kd, s, tt.expectedIPs)
-		assertSRVForNamedPort(t, tt.name, kd, s, portName2, len(tt.expectedIPs))
+		assertSRVForNamedPort(t, tt.name, kd, s, portName2, 1)
 		assertNoSRVForNamedPort(t, kd, s, portName1)
 
 		// Delete the service
@@ -214,6 +304,118 @@ func TestNamedSinglePortService(t *testing.T) {
 	}
 }
 
+func TestDualStackServiceReverseRecords(t *testing.T) {
+	kd := newKubeDNS()
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	s.Spec.ClusterIPs = []string{"1.2.3.4", "2001:db8::4"}
+	assert.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+
+	reverseHost := func(ip string) (string, error) {
+		reverseName, err := dns.ReverseAddr(ip)
+		require.NoError(t, err)
+		record, err := kd.ReverseRecord(reverseName)
+		if err != nil {
+			return "", err
+		}
+		return record.Host, nil
+	}
+	// Both cluster IPs point at the service.
+	for _, ip := range s.Spec.ClusterIPs {
+		host, err := reverseHost(ip)
+		require.NoError(t, err, ip)
+		assert.Equal(t, getServiceFQDN(kd.domain, s), host, ip)
+	}
+
+	// The reverse record of a cluster IP the service doesn't have anymore
+	// is removed.
+	updated := s.DeepCopy()
+	updated.Spec.ClusterIPs = []string{"1.2.3.4"}
+	assert.NoError(t, kd.servicesStore.Update(updated))
+	kd.updateService(s, updated)
+	host, err := reverseHost("1.2.3.4")
+	require.NoError(t, err)
+	assert.Equal(t, getServiceFQDN(kd.domain, s), host)
+	_, err = reverseHost("2001:db8::4")
+	assert.True(t, errors.Is(err, ErrReverseNotFound))
+	assert.NotContains(t, kd.clusterIPServiceMap, "2001:db8::4")
+
+	// Both are removed along with the service.
+	assert.NoError(t, kd.servicesStore.Update(s))
+	kd.updateService(updated, s)
+	_, err = reverseHost("2001:db8::4")
+	assert.NoError(t, err)
+	kd.removeService(s)
+	for _, ip := range s.Spec.ClusterIPs {
+		_, err := reverseHost(ip)
+		assert.True(t, errors.Is(err, ErrReverseNotFound), ip)
+	}
+	assert.Empty(t, kd.reverseRecordMap)
+	assert.Empty(t, kd.clusterIPServiceMap)
+}
+
+func TestDualStackServiceSRVRecords(t *testing.T) {
+	kd := newKubeDNS()
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	s.Spec.ClusterIPs = []string{"1.2.3.4", "2001:db8::4"}
+	s.Spec.Ports = append(s.Spec.Ports,
+		v1.ServicePort{Name: "https", Port: 443, Protocol: v1.ProtocolTCP},
+		v1.ServicePort{Name: "dns", Port: 53, Protocol: v1.ProtocolUDP})
+	kd.newService(s)
+
+	srvRecords := 0
+	for _, record := range kd.cache.GetAllValues() {
+		if record.Port != 0 {
+			srvRecords++
+		}
+	}
+	assert.Equal(t, len(s.Spec.Ports), srvRecords)
+	assertSRVForNamedPort(t, "http", kd, s, "http", 1)
+	assertSRVForNamedPort(t, "https", kd, s, "https", 1)
+	assertDNSForClusterIP(t, "dual-stack", kd, s, s.Spec.ClusterIPs)
+
+	// The SRV records target the service name, which resolves to the
+	// cluster IPs of both families.
+	srvs, err := kd.RecordsOfType(getSRVFQDN(kd, s, "http"), dns.TypeSRV, false)
+	require.NoError(t, err)
+	require.Len(t, srvs, 1)
+	target := srvs[0].Host
+	assert.Equal(t, getServiceFQDN(kd.domain, s), dns.Fqdn(target))
+	hosts := func(qtype uint16) []string {
+		records, err := kd.RecordsOfType(target, qtype, false)
+		require.NoError(t, err)
+		hosts := []string{}
+		for _, record := range records {
+			hosts = append(hosts, record.Host)
+		}
+		return hosts
+	}
+	assert.Equal(t, []string{"1.2.3.4"}, hosts(dns.TypeA))
+	assert.Equal(t, []string{"2001:db8::4"}, hosts(dns.TypeAAAA))
+
+	endpoints, err := kd.ResolveSRVTargets(testNamespace, testService, "http", "tcp")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []Endpoint{
+		{Target: target, IP: "1.2.3.4", Port: 80},
+		{Target: target, IP: "2001:db8::4", Port: 80},
+	}, endpoints)
+
+	// So do the wildcard lookups of the cache.
+	for _, path := range [][]string{
+		{"local", "cluster", "svc", testNamespace, testService},
+		{"local", "cluster", "svc", testNamespace, testService, "*"},
+		{"local", "cluster", "svc", "*", testService, "*"},
+	} {
+		ips := []string{}
+		for _, record := range kd.cache.GetValuesForPathWithWildcards(path...) {
+			if record.Port == 0 {
+				ips = append(ips, record.Host)
+			}
+		}
+		assert.ElementsMatch(t, s.Spec.ClusterIPs, ips, "path %v", path)
+	}
+}
+
 func assertARecordsMatchIPs(t *testing.T, records []dns.RR, ips ...string) {
 	expectedEndpoints := sets.NewString(ips...)
 	gotEndpoints := sets.NewString()
@@ -343,30 +545,1474 @@ func TestSkyNamedPortSRVLookup(t *testing.T) {
 	assertSRVRecordsMatchPort(t, rec, 8081)
 }
 
-func TestSimpleExternalService(t *testing.T) {
+func TestGetCacheAsJSONWithConcurrentUpdates(t *testing.T) {
 	kd := newKubeDNS()
-	s := newExternalNameService()
+	for i := 0; i < 100; i++ {
+		kd.newService(newService(testNamespace, fmt.Sprintf("svc-%d", i), fmt.Sprintf("1.2.3.%d", i), "", 80))
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s := newService(testNamespace, fmt.Sprintf("svc-%d", i%100), fmt.Sprintf("1.2.4.%d", i%100), "", 80)
+			kd.removeService(s)
+			kd.newService(s)
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		data, err := kd.GetCacheAsJSON()
+		require.NoError(t, err)
+		var snapshot struct {
+			ChildNodes map[string]json.RawMessage
+		}
+		require.NoError(t, json.Unmarshal([]byte(data), &snapshot))
+		assert.Contains(t, snapshot.ChildNodes, "local")
+	}
+	close(stop)
+	<-done
+}
+
+// cacheTTLs returns the TTL of the address records of the given JSON dump
+// of the cache, keyed by host. SRV records are skipped.
+func cacheTTLs(t *testing.T, data string) map[string]uint32 {
+	type node struct {
+		ChildNodes map[string]*node
+		Entries    map[string]map[string]interface{}
+	}
+	var root node
+	require.NoError(t, json.Unmarshal([]byte(data), &root))
+	ttls := map[string]uint32{}
+	var walk func(n *node)
+	walk = func(n *node) {
+		for _, entry := range n.Entries {
+			require.Contains(t, entry, "ttl")
+			if _, ok := entry["port"]; ok {
+				continue
+			}
+			ttls[entry["host"].(string)] = uint32(entry["ttl"].(float64))
+		}
+		for _, child := range n.ChildNodes {
+			walk(child)
+		}
+	}
+	walk(&root)
+	return ttls
+}
+
+func TestGetCacheAsJSONEffectiveTTL(t *testing.T) {
+	kd := newKubeDNS()
+	backed := newService(testNamespace, "backed", "1.2.3.4", "", 80)
+	assert.NoError(t, kd.endpointsStore.Add(newEndpoints(backed, newSubsetWithOnePort("", 80, "10.0.0.1"))))
+	kd.newService(backed)
+	kd.newService(newService(testNamespace, "unbacked", "1.2.3.5", "", 80))
+
+	data, err := kd.GetCacheAsJSON()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint32{"1.2.3.4": 30, "1.2.3.5": 30}, cacheTTLs(t, data))
+
+	kd.config = &config.Config{UnbackedServiceTTL: 5}
+	data, err = kd.GetCacheAsJSON()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint32{"1.2.3.4": 30, "1.2.3.5": 5}, cacheTTLs(t, data))
+	data, err = kd.GetCacheAsJSONBestEffort()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint32{"1.2.3.4": 30, "1.2.3.5": 5}, cacheTTLs(t, data))
+
+	// The TTL of the cached records is left untouched.
+	records, err := kd.Records("backed."+testNamespace+".svc."+testDomain, false)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(30), records[0].Ttl)
+	kd.config = &config.Config{}
+	records, err = kd.Records("unbacked."+testNamespace+".svc."+testDomain, false)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(30), records[0].Ttl)
+}
+
+func TestWriteCacheJSON(t *testing.T) {
+	kd := newKubeDNS()
+	kd.newService(newService(testNamespace, "portal", "1.2.3.4", "http", 80))
+	kd.newService(newService("other", "portal", "1.2.3.5", "", 80))
+	external := newExternalNameService()
+	external.Name = "external"
+	kd.newService(external)
+	kd.config = &config.Config{UnbackedServiceTTL: 5}
+
+	var buf bytes.Buffer
+	require.NoError(t, kd.WriteCacheJSON(&buf))
+
+	written := map[string]skymsg.Service{}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var record struct {
+			Key string `json:"key"`
+			skymsg.Service
+		}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record), scanner.Text())
+		written[record.Key] = record.Service
+	}
+	require.NoError(t, scanner.Err())
+
+	cached := map[string]skymsg.Service{}
+	for _, record := range kd.cache.GetAllValues() {
+		cached[record.Key] = *record
+	}
+	require.Equal(t, 5, len(cached))
+	assert.Equal(t, len(cached), len(written))
+	for key, record := range cached {
+		require.Contains(t, written, key)
+		assert.Equal(t, record.Host, written[key].Host, key)
+		assert.Equal(t, record.Port, written[key].Port, key)
+		// Records are written with the TTL they are served with.
+		expectedTTL := uint32(5)
+		if record.Port != 0 || net.ParseIP(record.Host) == nil {
+			expectedTTL = record.Ttl
+		}
+		assert.Equal(t, expectedTTL, written[key].Ttl, key)
+	}
+	// The cache is left untouched.
+	for _, record := range kd.cache.GetAllValues() {
+		assert.Equal(t, uint32(30), record.Ttl)
+	}
+}
+
+func TestServiceSRVRecords(t *testing.T) {
+	kd := newKubeDNS()
+	s := newService(testNamespace, testService, "1.2.3.4", "", 80)
+	s.Spec.Ports = append(s.Spec.Ports,
+		v1.ServicePort{Name: "dns", Port: 53, Protocol: v1.ProtocolUDP},
+		v1.ServicePort{Name: "dns-tcp", Port: 53, Protocol: v1.ProtocolTCP})
 	assert.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+
+	serviceFQDN := getServiceFQDN(kd.domain, s)
+	tcpName := "_service._tcp." + serviceFQDN
+	udpName := "_service._udp." + serviceFQDN
+
+	// Disabled by default.
+	_, err := kd.Records(tcpName, false)
+	assert.Error(t, err)
+
+	kd.updateConfig(&config.Config{ServiceSRVRecords: true})
+	records, err := kd.Records(tcpName, false)
+	require.NoError(t, err)
+	ports := sets.NewInt()
+	for _, record := range records {
+		assert.Equal(t, serviceFQDN, record.Host)
+		ports.Insert(record.Port)
+	}
+	assert.Equal(t, sets.NewInt(80, 53), ports)
+
+	records, err = kd.Records(udpName, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	assert.Equal(t, serviceFQDN, records[0].Host)
+	assert.Equal(t, 53, records[0].Port)
+
+	kd.updateConfig(&config.Config{})
+	_, err = kd.Records(tcpName, false)
+	assert.Error(t, err)
+}
 
+func TestAggregateProtocolSRVRecords(t *testing.T) {
+	kd := newKubeDNS()
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	s.Spec.Ports = append(s.Spec.Ports,
+		v1.ServicePort{Name: "https", Port: 443, Protocol: v1.ProtocolTCP},
+		v1.ServicePort{Name: "dns", Port: 53, Protocol: v1.ProtocolUDP})
+	assert.NoError(t, kd.servicesStore.Add(s))
 	kd.newService(s)
-	assertDNSForExternalService(t, kd, s)
-	kd.removeService(s)
-	assertNoDNSForExternalService(t, kd, s)
+
+	serviceFQDN := getServiceFQDN(kd.domain, s)
+	tcpName := "_tcp." + serviceFQDN
+
+	// Disabled by default.
+	_, err := kd.Records(tcpName, false)
+	assert.Error(t, err)
+
+	// The _service records, if any, are not duplicated.
+	kd.updateConfig(&config.Config{AggregateProtocolSRVRecords: true, ServiceSRVRecords: true})
+	records, err := kd.Records(tcpName, false)
+	require.NoError(t, err)
+	ports := []int{}
+	for _, record := range records {
+		assert.Equal(t, serviceFQDN, record.Host)
+		ports = append(ports, record.Port)
+	}
+	assert.ElementsMatch(t, []int{80, 443}, ports)
+
+	records, err = kd.Records("_udp."+serviceFQDN, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	assert.Equal(t, 53, records[0].Port)
+
+	// Queries for a port name are unchanged.
+	records, err = kd.Records(getSRVFQDN(kd, s, "https"), false)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	assert.Equal(t, 443, records[0].Port)
 }
 
-func TestSimpleHeadlessService(t *testing.T) {
+func TestGetReverseRecordsAsJSON(t *testing.T) {
+	kd := newKubeDNS()
+	portal := newService(testNamespace, "portal", "1.2.3.4", "", 80)
+	kd.newService(portal)
+	headless := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(headless))
+	endpoints := newEndpoints(headless, newSubsetWithOnePortWithHostname("", 80, true, "10.0.0.1"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(headless)
+
+	data, err := kd.GetReverseRecordsAsJSON()
+	require.NoError(t, err)
+	var records map[string]struct {
+		Record  skymsg.Service `json:"record"`
+		Service string         `json:"service"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(data), &records))
+
+	require.Equal(t, 2, len(records))
+	assert.Equal(t, "portal.default.svc.cluster.local.", records["1.2.3.4"].Record.Host)
+	assert.Equal(t, "default/portal", records["1.2.3.4"].Service)
+	assert.Equal(t, "ep-0.testservice.default.svc.cluster.local.", records["10.0.0.1"].Record.Host)
+	assert.Equal(t, "", records["10.0.0.1"].Service)
+}
+
+func TestWildcardQueryMaxRecords(t *testing.T) {
+	kd := newKubeDNS()
+	for i := 0; i < 20; i++ {
+		kd.newService(newService(fmt.Sprintf("ns-%d", i%4), fmt.Sprintf("svc-%d", i), fmt.Sprintf("1.2.3.%d", i), "", 80))
+	}
+
+	const query = "*.*.*.svc." + testDomain
+	records, err := kd.Records(query, false)
+	require.NoError(t, err)
+	assert.Equal(t, 20, len(records))
+
+	kd.config = &config.Config{MaxWildcardRecords: 5}
+	records, err = kd.Records(query, false)
+	require.NoError(t, err)
+	assert.Equal(t, 5, len(records))
+
+	// Non-wildcard queries are not limited.
+	kd.config = &config.Config{MaxWildcardRecords: 1}
+	s := newService(testNamespace, testService, "1.2.4.1", "", 80)
+	s.Spec.ClusterIPs = []string{"1.2.4.1", "2001:db8::1"}
+	kd.newService(s)
+	records, err = kd.Records(getServiceFQDN(kd.domain, s), false)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(records))
+}
+
+func TestUnbackedServiceTTL(t *testing.T) {
+	kd := newKubeDNS()
+	backed := newService(testNamespace, "backed", "1.2.3.4", "http", 80)
+	assert.NoError(t, kd.servicesStore.Add(backed))
+	assert.NoError(t, kd.endpointsStore.Add(newEndpoints(backed, newSubsetWithOnePort("http", 80, "10.0.0.1"))))
+	kd.newService(backed)
+	unbacked := newService(testNamespace, "unbacked", "1.2.3.5", "http", 80)
+	assert.NoError(t, kd.servicesStore.Add(unbacked))
+	kd.newService(unbacked)
+
+	ttl := func(name string) uint32 {
+		records, err := kd.Records(name, false)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(records))
+		return records[0].Ttl
+	}
+
+	// By default, both services are served with the same TTL.
+	assert.Equal(t, uint32(30), ttl(getServiceFQDN(kd.domain, backed)))
+	assert.Equal(t, uint32(30), ttl(getServiceFQDN(kd.domain, unbacked)))
+
+	kd.config = &config.Config{UnbackedServiceTTL: 5}
+	assert.Equal(t, uint32(30), ttl(getServiceFQDN(kd.domain, backed)))
+	assert.Equal(t, uint32(5), ttl(getServiceFQDN(kd.domain, unbacked)))
+	assert.Equal(t, uint32(30), ttl(getSRVFQDN(kd, unbacked, "http")))
+
+	// Once the service has endpoints, its usual TTL is restored.
+	assert.NoError(t, kd.endpointsStore.Add(newEndpoints(unbacked, newSubsetWithOnePort("http", 80, "10.0.0.2"))))
+	assert.Equal(t, uint32(30), ttl(getServiceFQDN(kd.domain, unbacked)))
+}
+
+func TestCustomHashFunc(t *testing.T) {
+	kd := newKubeDNS()
+	WithHashFunc(func(record *skymsg.Service) string {
+		return "h-" + strings.NewReplacer(".", "-", ":", "-").Replace(record.Host)
+	})(kd)
+
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	kd.newService(s)
+	verifyRecord(t, "portal", "h-1-2-3-4."+getServiceFQDN(kd.domain, s), "1.2.3.4", kd)
+	verifyRecord(t, "portal SRV", "h-1-2-3-4."+getSRVFQDN(kd, s, "http"), getServiceFQDN(kd.domain, s), kd)
+
+	headless := newHeadlessService()
+	headless.Name = "headless"
+	assert.NoError(t, kd.servicesStore.Add(headless))
+	assert.NoError(t, kd.endpointsStore.Add(newEndpoints(headless, newSubsetWithOnePort("http", 80, "10.0.0.1"))))
+	kd.newService(headless)
+	verifyRecord(t, "headless", "h-10-0-0-1."+getServiceFQDN(kd.domain, headless), "10.0.0.1", kd)
+
+	// Labels that are not valid DNS labels are replaced with the default.
+	kd.hashFunc = func(record *skymsg.Service) string { return "Not_A_Label" }
+	kd.newService(s)
+	_, defaultLabel := util.GetSkyMsg("1.2.3.4", 0)
+	verifyRecord(t, "invalid label", defaultLabel+"."+getServiceFQDN(kd.domain, s), "1.2.3.4", kd)
+}
+
+func TestLowercasePortNames(t *testing.T) {
+	kd := newKubeDNS()
+	s := newService(testNamespace, testService, "1.2.3.4", "HTTP-Alt", 8080)
+	assert.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+	headless := newHeadlessService()
+	headless.Name = "headless"
+	assert.NoError(t, kd.servicesStore.Add(headless))
+	assert.NoError(t, kd.endpointsStore.Add(newEndpoints(headless, newSubsetWithOnePort("HTTP-Alt", 8080, "10.0.0.1"))))
+	kd.newService(headless)
+
+	// By default, port names are used verbatim.
+	_, err := kd.Records(getSRVFQDN(kd, s, "http-alt"), false)
+	assert.Error(t, err)
+	verifyRecord(t, "verbatim", getSRVFQDN(kd, s, "HTTP-Alt"), getServiceFQDN(kd.domain, s), kd)
+
+	kd.updateConfig(&config.Config{LowercasePortNames: true})
+	verifyRecord(t, "portal", getSRVFQDN(kd, s, "http-alt"), getServiceFQDN(kd.domain, s), kd)
+	_, err = kd.Records(getSRVFQDN(kd, s, "HTTP-Alt"), false)
+	assert.Error(t, err)
+	records, err := kd.Records(getSRVFQDN(kd, headless, "http-alt"), false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, 8080, records[0].Port)
+}
+
+func TestCompact(t *testing.T) {
+	kd := newKubeDNS()
+	live := newService(testNamespace, "live", "1.2.3.4", "http", 80)
+	kd.newService(live)
+	for i := 0; i < 3; i++ {
+		s := newService("churn", fmt.Sprintf("svc-%d", i), fmt.Sprintf("1.2.4.%d", i), "http", 80)
+		kd.newService(s)
+		kd.removeService(s)
+	}
+	cache, err := kd.GetCacheAsJSON()
+	require.NoError(t, err)
+	assert.Contains(t, cache, `"churn"`)
+
+	assert.Equal(t, 1, kd.Compact())
+	cache, err = kd.GetCacheAsJSON()
+	require.NoError(t, err)
+	assert.NotContains(t, cache, `"churn"`)
+	assertDNSForClusterIP(t, "live", kd, live, []string{"1.2.3.4"})
+	verifyRecord(t, "SRV", getSRVFQDN(kd, live, "http"), getServiceFQDN(kd.domain, live), kd)
+	assert.Equal(t, 0, kd.Compact())
+}
+
+func TestHeadlessServiceNormalizedSRVWeights(t *testing.T) {
+	kd := newKubeDNS()
+	kd.config = &config.Config{NormalizeSRVWeights: true}
+	skydnsConfig := &skyserver.Config{Domain: testDomain, DnsAddr: "0.0.0.0:53"}
+	skyserver.SetDefaults(skydnsConfig)
+	s := skyserver.New(kd, skydnsConfig)
+
+	service := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(service))
+	endpoints := newEndpoints(service, newSubsetWithOnePortWithHostname("http", 80, true, "10.0.0.1", "10.0.0.2", "10.0.0.3"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(service)
+
+	name := getSRVFQDN(kd, service, "http")
+	records, err := kd.Records(name, false)
+	require.NoError(t, err)
+	weights := map[string]int{}
+	for _, record := range records {
+		weights[record.Host] = record.Weight
+	}
+	svcDomain := getServiceFQDN(kd.domain, service)
+	assert.Equal(t, map[string]int{
+		"ep-0." + svcDomain: 34,
+		"ep-1." + svcDomain: 33,
+		"ep-2." + svcDomain: 33,
+	}, weights)
+
+	question := dns.Question{Name: name, Qtype: dns.TypeSRV, Qclass: dns.ClassINET}
+	rec, _, err := s.SRVRecords(question, name, 512, false)
+	require.NoError(t, err)
+	sum := 0
+	for _, r := range rec {
+		sum += int(r.(*dns.SRV).Weight)
+	}
+	assert.Equal(t, 100, sum)
+}
+
+// The names util.ServiceRecordNames returns are the ones the records of a
+// service are served under.
+func TestServiceRecordNames(t *testing.T) {
+	for _, s := range []*v1.Service{
+		newService(testNamespace, "unnamed", "1.2.3.4", "", 80),
+		newService(testNamespace, "named", "1.2.3.5", "http", 80),
+		func() *v1.Service {
+			s := newService(testNamespace, "dualstack", "1.2.3.6", "http", 80)
+			s.Spec.ClusterIPs = []string{"1.2.3.6", "2001:db8::6"}
+			s.Spec.Ports = append(s.Spec.Ports,
+				v1.ServicePort{Name: "dns", Protocol: "UDP", Port: 53},
+				v1.ServicePort{Name: "sctp", Protocol: "SCTP", Port: 9999})
+			return s
+		}(),
+	} {
+		kd := newKubeDNS()
+		assert.NoError(t, kd.servicesStore.Add(s))
+		kd.newService(s)
+
+		// The names of the records are the parents of the names of the
+		// cache entries, which are labeled after their hash.
+		created := sets.NewString()
+		for _, record := range kd.cache.GetAllValues() {
+			name := skymsg.Domain(record.Key)
+			created.Insert(name[strings.Index(name, ".")+1:])
+		}
+		for ip := range kd.reverseRecordMap {
+			reverseName, _ := dns.ReverseAddr(ip)
+			created.Insert(reverseName)
+		}
+		assert.Equal(t, created.List(), sets.NewString(util.ServiceRecordNames(s, kd.domain)...).List(), s.Name)
+	}
+}
+
+func TestIncompleteService(t *testing.T) {
+	kd := newKubeDNS()
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(kd.IncompleteServicesCollector()))
+	incompleteServices := func() float64 {
+		families, err := registry.Gather()
+		require.NoError(t, err)
+		require.Equal(t, 1, len(families))
+		assert.Equal(t, "kubedns_incomplete_services", families[0].GetName())
+		return families[0].GetMetric()[0].GetGauge().GetValue()
+	}
+
+	s := newService(testNamespace, testService, "1.2.3.4", "", 0)
+	s.Spec.Ports = nil
+	assert.NoError(t, kd.servicesStore.Add(s))
+
+	// By default, the service gets its A record.
+	kd.newService(s)
+	assertDNSForClusterIP(t, "default", kd, s, []string{"1.2.3.4"})
+	assert.Equal(t, 1.0, incompleteServices())
+
+	kd.updateConfig(&config.Config{WithholdIncompleteServices: true})
+	_, err := kd.Records(getServiceFQDN(kd.domain, s), false)
+	assert.Error(t, err)
+	_, err = kd.ReverseRecord("4.3.2.1.in-addr.arpa.")
+	assert.Error(t, err)
+
+	// The record is served once the service has endpoints.
+	endpoints := newEndpoints(s, newSubsetWithOnePort("", 80, "10.0.0.1"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.handleEndpointAdd(endpoints)
+	assertDNSForClusterIP(t, "endpoints", kd, s, []string{"1.2.3.4"})
+	assert.Equal(t, 0.0, incompleteServices())
+
+	// And withheld again once they are gone.
+	assert.NoError(t, kd.endpointsStore.Delete(endpoints))
+	kd.handleEndpointDelete(endpoints)
+	_, err = kd.Records(getServiceFQDN(kd.domain, s), false)
+	assert.Error(t, err)
+	assert.Equal(t, 1.0, incompleteServices())
+}
+
+func TestSRVExcludedPorts(t *testing.T) {
+	kd := newKubeDNS()
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	s.Spec.Ports = append(s.Spec.Ports, v1.ServicePort{Port: 9090, Name: "metrics", Protocol: "TCP"})
+	s.Annotations = map[string]string{SRVExcludedPortsAnnotation: "Metrics"}
+	assert.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+
+	assertDNSForClusterIP(t, "A", kd, s, []string{"1.2.3.4"})
+	assertSRVForNamedPort(t, "http", kd, s, "http", 1)
+	assertNoSRVForNamedPort(t, kd, s, "metrics")
+
+	kd.config = &config.Config{ServiceSRVRecords: true}
+	kd.newService(s)
+	records, err := kd.Records("_service._tcp."+getServiceFQDN(kd.domain, s), false)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	assert.Equal(t, 80, records[0].Port)
+
+	// Headless services honor the annotation too.
+	headless := newHeadlessService()
+	headless.Annotations = map[string]string{SRVExcludedPortsAnnotation: "http2"}
+	assert.NoError(t, kd.servicesStore.Add(headless))
+	endpoints := newEndpoints(headless, newSubsetWithTwoPorts("http1", 80, "http2", 81, "10.0.0.1"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(headless)
+
+	assertDNSForHeadlessService(t, kd, endpoints)
+	records, err = kd.Records(getSRVFQDN(kd, headless, "http1"), false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(records))
+	_, err = kd.Records(getSRVFQDN(kd, headless, "http2"), false)
+	assert.Error(t, err)
+}
+
+func TestServiceTTLAnnotation(t *testing.T) {
+	kd := newKubeDNS()
+	assertTTLs := func(name string, ttl uint32) {
+		t.Helper()
+		records, err := kd.Records(name, false)
+		require.NoError(t, err)
+		require.NotEmpty(t, records)
+		for _, record := range records {
+			assert.Equal(t, ttl, record.Ttl, "TTL of %v answered for %s", record, name)
+		}
+	}
+
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	s.Annotations = map[string]string{TTLAnnotation: "300"}
+	assert.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+	assertTTLs(getServiceFQDN(kd.domain, s), 300)
+	assertTTLs(getSRVFQDN(kd, s, "http"), 300)
+	reverseRecord, err := kd.ReverseRecord("4.3.2.1.in-addr.arpa.")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(300), reverseRecord.Ttl)
+
+	// Invalid values fall back to the default TTL, too large ones are capped.
+	s.Annotations[TTLAnnotation] = "5m"
+	kd.newService(s)
+	assertTTLs(getServiceFQDN(kd.domain, s), util.DefaultTTL)
+	s.Annotations[TTLAnnotation] = "604800"
+	kd.newService(s)
+	assertTTLs(getServiceFQDN(kd.domain, s), maxServiceTTL)
+
+	// The records of headless services keep their labels.
+	headless := newHeadlessService()
+	headless.Name = "headless"
+	headless.Annotations = map[string]string{TTLAnnotation: "5"}
+	assert.NoError(t, kd.servicesStore.Add(headless))
+	endpoints := newEndpoints(headless, newSubsetWithOnePort("http", 80, "10.0.0.1", "10.0.0.2"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(headless)
+	assertDNSForHeadlessService(t, kd, endpoints)
+	assertTTLs(getServiceFQDN(kd.domain, headless), 5)
+	assertTTLs(getSRVFQDN(kd, headless, "http"), 5)
+	_, label := util.GetSkyMsg("10.0.0.1", 0)
+	assertTTLs(label+"."+getServiceFQDN(kd.domain, headless), 5)
+
+	externalName := newExternalNameService()
+	externalName.Name = "external"
+	externalName.Annotations = map[string]string{TTLAnnotation: "10"}
+	assert.NoError(t, kd.servicesStore.Add(externalName))
+	kd.newService(externalName)
+	assertTTLs(getServiceFQDN(kd.domain, externalName), 10)
+
+	// The TTL stays within the bounds of the configuration.
+	kd.config = &config.Config{MaxTTL: 60}
+	assertTTLs(getServiceFQDN(kd.domain, headless), 5)
+	assertTTLs(getServiceFQDN(kd.domain, s), 60)
+}
+
+func TestHeadlessServiceConflictingPortProtocols(t *testing.T) {
 	kd := newKubeDNS()
 	s := newHeadlessService()
 	assert.NoError(t, kd.servicesStore.Add(s))
-	endpoints := newEndpoints(s, newSubsetWithOnePort("", 80, "10.0.0.1", "10.0.0.2"), newSubsetWithOnePort("", 8080, "10.0.0.3", "10.0.0.4"))
+	tcp := newSubsetWithOnePort("http", 80, "10.0.0.1")
+	udp := newSubsetWithOnePort("http", 80, "10.0.0.2")
+	udp.Ports[0].Protocol = v1.ProtocolUDP
+	svcDomain := getServiceFQDN(kd.domain, s)
+
+	srvHosts := func(protocol string) []string {
+		records, err := kd.Records("_http._"+protocol+"."+svcDomain, false)
+		if err != nil {
+			return nil
+		}
+		hosts := []string{}
+		for _, record := range records {
+			hosts = append(hosts, record.Host)
+		}
+		return hosts
+	}
+
+	// Whatever the order of the subsets, the first protocol in
+	// alphabetical order is chosen.
+	for _, subsets := range [][]v1.EndpointSubset{{tcp, udp}, {udp, tcp}} {
+		endpoints := newEndpoints(s, subsets...)
+		assert.NoError(t, kd.endpointsStore.Update(endpoints))
+		kd.newService(s)
+		assertDNSForHeadlessService(t, kd, endpoints)
+		hosts := srvHosts("tcp")
+		require.Equal(t, 1, len(hosts))
+		assert.True(t, strings.HasSuffix(hosts[0], "."+svcDomain))
+		assert.Nil(t, srvHosts("udp"))
+	}
+
+	// Unless the service has a port of the same name.
+	s.Spec.Ports = []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolUDP}}
+	kd.newService(s)
+	assert.Equal(t, 1, len(srvHosts("udp")))
+	assert.Nil(t, srvHosts("tcp"))
+}
+
+func TestHeadlessServiceCanarySRVWeight(t *testing.T) {
+	kd := newKubeDNS()
+	service := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(service))
+	endpoints := newEndpoints(service, newSubsetWithOnePortWithHostname("http", 80, true, "10.0.0.1", "10.0.0.2", "10.0.0.3"))
+	endpoints.Annotations = map[string]string{CanaryEndpointsAnnotation: "ep-1, 10.0.0.3"}
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	svcDomain := getServiceFQDN(kd.domain, service)
+
+	weights := func() map[string]int {
+		kd.newService(service)
+		records, err := kd.Records(getSRVFQDN(kd, service, "http"), false)
+		require.NoError(t, err)
+		weights := map[string]int{}
+		for _, record := range records {
+			weights[record.Host] = record.Weight
+		}
+		return weights
+	}
+
+	// Canary endpoints get the same weight as the others by default.
+	assert.Equal(t, map[string]int{
+		"ep-0." + svcDomain: 10,
+		"ep-1." + svcDomain: 10,
+		"ep-2." + svcDomain: 10,
+	}, weights())
+
+	service.Annotations = map[string]string{CanarySRVWeightAnnotation: "1"}
+	assert.Equal(t, map[string]int{
+		"ep-0." + svcDomain: 10,
+		"ep-1." + svcDomain: 1,
+		"ep-2." + svcDomain: 1,
+	}, weights())
+
+	// The canary weight overrides the normalized weights.
+	kd.config = &config.Config{NormalizeSRVWeights: true}
+	assert.Equal(t, map[string]int{
+		"ep-0." + svcDomain: 34,
+		"ep-1." + svcDomain: 1,
+		"ep-2." + svcDomain: 1,
+	}, weights())
+
+	// Invalid weights are ignored.
+	service.Annotations = map[string]string{CanarySRVWeightAnnotation: "-1"}
+	assert.Equal(t, map[string]int{
+		"ep-0." + svcDomain: 34,
+		"ep-1." + svcDomain: 33,
+		"ep-2." + svcDomain: 33,
+	}, weights())
+}
+
+func TestSimpleExternalService(t *testing.T) {
+	kd := newKubeDNS()
+	s := newExternalNameService()
+	assert.NoError(t, kd.servicesStore.Add(s))
+
+	kd.newService(s)
+	assertDNSForExternalService(t, kd, s)
+	kd.removeService(s)
+	assertNoDNSForExternalService(t, kd, s)
+}
+
+func TestSimpleHeadlessService(t *testing.T) {
+	kd := newKubeDNS()
+	s := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(s))
+	endpoints := newEndpoints(s, newSubsetWithOnePort("", 80, "10.0.0.1", "10.0.0.2"), newSubsetWithOnePort("", 8080, "10.0.0.3", "10.0.0.4"))
+
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(s)
+	assertDNSForHeadlessService(t, kd, endpoints)
+	assertNoReverseDNSForHeadlessService(t, kd, endpoints)
+	kd.removeService(s)
+	assertNoDNSForHeadlessService(t, kd, s)
+	assertNoReverseDNSForHeadlessService(t, kd, endpoints)
+}
+
+func TestServiceWithExternalNameAndClusterIP(t *testing.T) {
+	kd := newKubeDNS()
+	portal := newService(testNamespace, "portal", "1.2.3.4", "http", 80)
+	kd.newService(portal)
+
+	// The declared type wins: an ExternalName service only gets a CNAME.
+	external := newExternalNameService()
+	external.Spec.ClusterIP = "1.2.3.4"
+	external.Spec.ClusterIPs = []string{"1.2.3.4"}
+	assert.Equal(t, `ignoring cluster IPs [1.2.3.4] of ExternalName service`, serviceSpecConflict(external))
+	kd.newService(external)
+	assertDNSForExternalService(t, kd, external)
+	assertReverseRecord(t, "portal", kd, portal)
+	kd.removeService(external)
+	assertNoDNSForExternalService(t, kd, external)
+	// The cluster IP it set is left to the service it belongs to.
+	assertReverseRecord(t, "portal", kd, portal)
+
+	// A ClusterIP service only gets records of its cluster IP.
+	portal.Spec.ExternalName = testExternalName
+	assert.Equal(t, `ignoring external name "foo.bar.example.com" of ClusterIP service`, serviceSpecConflict(portal))
+	kd.updateService(portal, portal)
+	assertDNSForClusterIP(t, "portal", kd, portal, []string{"1.2.3.4"})
+
+	assert.Equal(t, "", serviceSpecConflict(newExternalNameService()))
+	assert.Equal(t, "", serviceSpecConflict(newHeadlessService()))
+}
+
+func TestHeadlessServiceConvertedToExternalName(t *testing.T) {
+	kd := newKubeDNS()
+	s := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(s))
+	endpoints := newEndpoints(s, newSubsetWithOnePortWithHostname("http", 80, true, "10.0.0.1", "10.0.0.2"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(s)
+	assertReverseDNSForNamedHeadlessService(t, kd, endpoints)
+
+	// The endpoints remain while the service is converted.
+	externalName := newExternalNameService()
+	assert.NoError(t, kd.servicesStore.Update(externalName))
+	kd.updateService(s, externalName)
+	assertDNSForExternalService(t, kd, externalName)
+	assertNoReverseDNSForHeadlessService(t, kd, endpoints)
+
+	// Late endpoints events don't bring them back.
+	kd.handleEndpointAdd(endpoints)
+	assertNoReverseDNSForHeadlessService(t, kd, endpoints)
+}
+
+func TestServiceRemovalGracePeriod(t *testing.T) {
+	kd := newKubeDNS()
+	fakeClock := clock.NewFakeClock(time.Now())
+	kd.clock = fakeClock
+	kd.config = &config.Config{ServiceRemovalGracePeriod: metav1.Duration{Duration: 10 * time.Second}}
+
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	kd.newService(s)
+	name := getServiceFQDN(kd.domain, s)
+
+	// The service is recreated within the grace period, with a new IP.
+	kd.handleServiceDelete(s)
+	fakeClock.Step(5 * time.Second)
+	verifyRecord(t, "deleted", name, "1.2.3.4", kd)
+	recreated := newService(testNamespace, testService, "1.2.3.5", "http", 80)
+	kd.newService(recreated)
+	verifyRecord(t, "recreated", name, "1.2.3.5", kd)
+	_, err := kd.ReverseRecord("4.3.2.1.in-addr.arpa.")
+	assert.Error(t, err)
+
+	fakeClock.Step(10 * time.Second)
+	verifyRecord(t, "after the grace period", name, "1.2.3.5", kd)
+
+	// The records of a service that is not recreated are removed.
+	kd.handleServiceDelete(recreated)
+	fakeClock.Step(9 * time.Second)
+	verifyRecord(t, "deleted", name, "1.2.3.5", kd)
+	fakeClock.Step(time.Second)
+	_, err = kd.Records(name, false)
+	assert.Error(t, err)
+	_, err = kd.ReverseRecord("5.3.2.1.in-addr.arpa.")
+	assert.Error(t, err)
+
+	// By default, records are removed immediately.
+	kd.config = &config.Config{}
+	kd.newService(s)
+	kd.handleServiceDelete(s)
+	_, err = kd.Records(name, false)
+	assert.Error(t, err)
+}
+
+func TestHeadlessServiceEndpointStabilityTTL(t *testing.T) {
+	kd := newKubeDNS()
+	fakeClock := clock.NewFakeClock(time.Now())
+	kd.clock = fakeClock
+	s := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(s))
+	endpoints := newEndpoints(s, newSubsetWithOnePort("", 80, "10.0.0.1"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(s)
+
+	name := getEndpointsFQDN(kd, endpoints)
+	ttls := func() map[string]uint32 {
+		records, err := kd.Records(name, false)
+		require.NoError(t, err)
+		retval := map[string]uint32{}
+		for _, record := range records {
+			retval[record.Host] = record.Ttl
+		}
+		return retval
+	}
+
+	// Without a configured stability TTL, records keep the default TTL.
+	assert.Equal(t, map[string]uint32{"10.0.0.1": 30}, ttls())
+
+	kd.config = &config.Config{
+		EndpointStabilityTTL: &config.StabilityTTL{
+			MinTTL:     5,
+			MaxTTL:     305,
+			RampPeriod: metav1.Duration{Duration: 10 * time.Minute},
+		},
+	}
+	assert.Equal(t, map[string]uint32{"10.0.0.1": 5}, ttls())
+
+	fakeClock.Step(5 * time.Minute)
+	assert.Equal(t, map[string]uint32{"10.0.0.1": 155}, ttls())
+
+	// A new endpoint starts at the minimum TTL.
+	endpoints.Subsets = []v1.EndpointSubset{newSubsetWithOnePort("", 80, "10.0.0.1", "10.0.0.2")}
+	kd.handleEndpointAdd(endpoints)
+	assert.Equal(t, map[string]uint32{"10.0.0.1": 155, "10.0.0.2": 5}, ttls())
+
+	fakeClock.Step(time.Hour)
+	assert.Equal(t, map[string]uint32{"10.0.0.1": 305, "10.0.0.2": 305}, ttls())
+
+	kd.removeService(s)
+	assert.Empty(t, kd.endpointFirstSeen)
+}
+
+func TestHeadlessServiceEndpointStabilityTTLWithTTLAnnotation(t *testing.T) {
+	kd := newKubeDNS()
+	kd.clock = clock.NewFakeClock(time.Now())
+	kd.config = &config.Config{
+		EndpointStabilityTTL: &config.StabilityTTL{
+			MinTTL:     5,
+			MaxTTL:     305,
+			RampPeriod: metav1.Duration{Duration: 10 * time.Minute},
+		},
+	}
+	s := newHeadlessService()
+	s.Annotations = map[string]string{TTLAnnotation: "3600"}
+	assert.NoError(t, kd.servicesStore.Add(s))
+	endpoints := newEndpoints(s, newSubsetWithOnePort("", 80, "10.0.0.1"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(s)
+
+	// The annotation takes precedence over the stability TTL.
+	records, err := kd.Records(getEndpointsFQDN(kd, endpoints), false)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	assert.Equal(t, uint32(3600), records[0].Ttl)
+}
+
+func TestRecordMaxAge(t *testing.T) {
+	kd := newKubeDNS()
+	fakeClock := clock.NewFakeClock(time.Now())
+	kd.clock = fakeClock
+	// The services set a TTL longer than the maximum age, which the
+	// remaining time caps.
+	s := newService(testNamespace, testService, "1.2.3.4", "", 80)
+	s.Annotations = map[string]string{TTLAnnotation: "3600"}
+	kd.newService(s)
+	short := newService(testNamespace, "short", "1.2.3.5", "", 80)
+	short.Annotations = map[string]string{TTLAnnotation: "60"}
+	kd.newService(short)
+	headless := newHeadlessService()
+	headless.Name = "headless"
+	headless.Annotations = map[string]string{TTLAnnotation: "3600"}
+	assert.NoError(t, kd.servicesStore.Add(headless))
+	endpoints := newEndpoints(headless, newSubsetWithOnePort("", 80, "10.0.0.1"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(headless)
+
+	ttls := func(name string) map[string]uint32 {
+		records, err := kd.Records(name, false)
+		require.NoError(t, err)
+		retval := map[string]uint32{}
+		for _, record := range records {
+			retval[record.Host] = record.Ttl
+		}
+		return retval
+	}
+	serviceName := getServiceFQDN(kd.domain, s)
+	headlessName := getServiceFQDN(kd.domain, headless)
+
+	shortName := getServiceFQDN(kd.domain, short)
+
+	// By default, the TTL doesn't depend on the age of the records.
+	fakeClock.Step(time.Minute)
+	assert.Equal(t, map[string]uint32{"1.2.3.4": 3600}, ttls(serviceName))
+
+	kd.config = &config.Config{RecordMaxAge: metav1.Duration{Duration: 10 * time.Minute}}
+	assert.Equal(t, map[string]uint32{"1.2.3.4": 540}, ttls(serviceName))
+	assert.Equal(t, map[string]uint32{"10.0.0.1": 540}, ttls(headlessName))
+	// The TTL of the records is kept while shorter than the time left.
+	assert.Equal(t, map[string]uint32{"1.2.3.5": 60}, ttls(shortName))
+
+	// A new endpoint is younger than the other ones.
+	fakeClock.Step(5 * time.Minute)
+	endpoints.Subsets = []v1.EndpointSubset{newSubsetWithOnePort("", 80, "10.0.0.1", "10.0.0.2")}
+	kd.handleEndpointAdd(endpoints)
+	assert.Equal(t, map[string]uint32{"1.2.3.4": 240}, ttls(serviceName))
+	assert.Equal(t, map[string]uint32{"10.0.0.1": 240, "10.0.0.2": 600}, ttls(headlessName))
+
+	// Past the maximum age, the records are served with a TTL of 0.
+	fakeClock.Step(5 * time.Minute)
+	assert.Equal(t, map[string]uint32{"1.2.3.4": 0}, ttls(serviceName))
+	assert.Equal(t, map[string]uint32{"10.0.0.1": 0, "10.0.0.2": 300}, ttls(headlessName))
+	assert.Equal(t, map[string]uint32{"1.2.3.5": 0}, ttls(shortName))
+
+	// The cache is dumped with the TTLs served.
+	dump, err := kd.GetCacheAsJSON()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint32{"1.2.3.4": 0, "1.2.3.5": 0, "10.0.0.1": 0, "10.0.0.2": 300}, cacheTTLs(t, dump))
+}
+
+func TestHeadlessServiceEndpointsUpdateIsAtomic(t *testing.T) {
+	kd := newKubeDNS()
+	s := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(s))
+	endpoints := []*v1.Endpoints{
+		newEndpoints(s, newSubsetWithOnePortWithHostname("http", 80, true, "10.0.0.1", "10.0.0.2")),
+		newEndpoints(s, newSubsetWithOnePortWithHostname("http", 80, true, "10.0.0.3")),
+	}
+	assert.NoError(t, kd.endpointsStore.Add(endpoints[0]))
+	kd.newService(s)
+
+	name := getEndpointsFQDN(kd, endpoints[0])
+	srvName := getSRVFQDN(kd, s, "http")
+	stop := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for _, query := range []string{name, srvName} {
+				if records, err := kd.Records(query, false); err != nil || len(records) == 0 {
+					errs <- fmt.Errorf("query for %s returned %v, %v", query, records, err)
+					return
+				}
+			}
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		kd.handleEndpointUpdate(endpoints[i%2], endpoints[(i+1)%2])
+	}
+	close(stop)
+	assert.NoError(t, <-errs)
+}
+
+func TestSRVRecordsWithInvalidProtocol(t *testing.T) {
+	kd := newKubeDNS()
+	headless := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(headless))
+	subset := newSubsetWithOnePort("http", 80, "10.0.0.1")
+	subset.Ports = append(subset.Ports, v1.EndpointPort{Name: "bogus", Port: 81, Protocol: "garbage"})
+	endpoints := newEndpoints(headless, subset)
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(headless)
+
+	portal := newService(testNamespace, "portal", "1.2.3.4", "http", 80)
+	portal.Spec.Ports = append(portal.Spec.Ports, v1.ServicePort{Name: "bogus", Port: 81, Protocol: "garbage"})
+	kd.newService(portal)
+
+	for _, s := range []*v1.Service{headless, portal} {
+		records, err := kd.Records(getSRVFQDN(kd, s, "http"), false)
+		require.NoError(t, err)
+		assert.Equal(t, 1, len(records))
+
+		_, err = kd.Records("_bogus._garbage."+getServiceFQDN(kd.domain, s), false)
+		assert.Error(t, err)
+	}
+	for _, record := range kd.cache.GetAllValues() {
+		assert.NotContains(t, record.Key, "garbage")
+	}
+}
+
+func TestHeadlessServiceMaxEndpointAddresses(t *testing.T) {
+	kd := newKubeDNS()
+	kd.config = &config.Config{MaxEndpointAddresses: 3}
+	s := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(s))
+	endpoints := newEndpoints(s,
+		newSubsetWithOnePort("http", 80, "10.0.0.1", "10.0.0.2"),
+		newSubsetWithOnePort("http", 80, "10.0.0.3", "10.0.0.4", "10.0.0.5"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+
+	// The records are built without holding cacheLock: a writer can
+	// acquire it while each of them is labeled.
+	labeled, labeledUnlocked := 0, 0
+	WithHashFunc(func(record *skymsg.Service) string {
+		labeled++
+		acquired := make(chan struct{})
+		go func() {
+			kd.cacheLock.Lock()
+			kd.cacheLock.Unlock()
+			close(acquired)
+		}()
+		select {
+		case <-acquired:
+			labeledUnlocked++
+		case <-time.After(time.Second):
+		}
+		return util.HashServiceRecord(record)
+	})(kd)
+	kd.newService(s)
+	assert.NotZero(t, labeled)
+	assert.Equal(t, labeled, labeledUnlocked, "cacheLock held while building the records")
+	kd.hashFunc = nil
+
+	records, err := kd.Records(getEndpointsFQDN(kd, endpoints), false)
+	require.NoError(t, err)
+	hosts := sets.NewString()
+	for _, record := range records {
+		hosts.Insert(record.Host)
+	}
+	assert.Equal(t, sets.NewString("10.0.0.1", "10.0.0.2", "10.0.0.3"), hosts)
+
+	records, err = kd.Records(getSRVFQDN(kd, s, "http"), false)
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(records))
+	assert.Equal(t, 3, len(kd.endpointFirstSeen[s.Namespace+"/"+s.Name]))
+
+	kd.config = &config.Config{}
+	kd.handleEndpointAdd(endpoints)
+	records, err = kd.Records(getEndpointsFQDN(kd, endpoints), false)
+	require.NoError(t, err)
+	assert.Equal(t, 5, len(records))
+}
+
+func TestHeadlessServiceTargetRefPTRRecords(t *testing.T) {
+	kd := newKubeDNS()
+	s := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(s))
+	subset := newSubsetWithOnePort("http", 80, "10.0.0.1", "10.0.0.2")
+	subset.Addresses[0].TargetRef = &v1.ObjectReference{Kind: "Pod", Namespace: testNamespace, Name: "pod-1"}
+	endpoints := newEndpoints(s, subset)
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(s)
+
+	// By default, only addresses with a hostname get a PTR record.
+	assertNoReverseDNSForHeadlessService(t, kd, endpoints)
+
+	kd.config = &config.Config{TargetRefPTRRecords: true}
+	kd.handleEndpointAdd(endpoints)
+	record, err := kd.ReverseRecord("1.0.0.10.in-addr.arpa.")
+	require.NoError(t, err)
+	assert.Equal(t, "10-0-0-1.default.pod.cluster.local.", record.Host)
+	_, err = kd.ReverseRecord("2.0.0.10.in-addr.arpa.")
+	assert.Error(t, err)
+
+	// The PTR record resolves back to the address.
+	verifyRecord(t, "pod record", record.Host, "10.0.0.1", kd)
+
+	// The PTR record is removed along with the address.
+	updated := newEndpoints(s, newSubsetWithOnePort("http", 80, "10.0.0.2"))
+	kd.handleEndpointUpdate(endpoints, updated)
+	_, err = kd.ReverseRecord("1.0.0.10.in-addr.arpa.")
+	assert.Error(t, err)
+}
+
+func TestServiceReverseRecordTakesPrecedence(t *testing.T) {
+	kd := newKubeDNS()
+	kd.config = &config.Config{
+		TargetRefPTRRecords: true,
+		ServiceCIDRs:        []string{"10.0.0.0/24"},
+		PodCIDRs:            []string{"10.0.0.0/16"},
+	}
+	portal := newService(testNamespace, "portal", "10.0.0.1", "http", 80)
+	assert.NoError(t, kd.servicesStore.Add(portal))
+	kd.newService(portal)
+	portalFQDN := getServiceFQDN(kd.domain, portal)
+
+	// A pod shares the cluster IP of the service.
+	s := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(s))
+	subset := newSubsetWithOnePort("http", 80, "10.0.0.1", "10.0.0.2")
+	for i := range subset.Addresses {
+		subset.Addresses[i].TargetRef = &v1.ObjectReference{Kind: "Pod", Namespace: testNamespace, Name: fmt.Sprintf("pod-%d", i)}
+	}
+	endpoints := newEndpoints(s, subset)
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(s)
+
+	record, err := kd.ReverseRecord("1.0.0.10.in-addr.arpa.")
+	require.NoError(t, err)
+	assert.Equal(t, portalFQDN, record.Host)
+	record, err = kd.ReverseRecord("2.0.0.10.in-addr.arpa.")
+	require.NoError(t, err)
+	assert.Equal(t, "10-0-0-2.default.pod.cluster.local.", record.Host)
+
+	// Removing the pod doesn't remove the reverse record of the service.
+	updated := newEndpoints(s, newSubsetWithOnePort("http", 80, "10.0.0.2"))
+	kd.handleEndpointUpdate(endpoints, updated)
+	kd.handleEndpointDelete(updated)
+	record, err = kd.ReverseRecord("1.0.0.10.in-addr.arpa.")
+	require.NoError(t, err)
+	assert.Equal(t, portalFQDN, record.Host)
+
+	// Whatever the order the records are generated in.
+	kd.handleEndpointAdd(endpoints)
+	kd.newService(portal)
+	kd.handleEndpointAdd(endpoints)
+	record, err = kd.ReverseRecord("1.0.0.10.in-addr.arpa.")
+	require.NoError(t, err)
+	assert.Equal(t, portalFQDN, record.Host)
+}
+
+// An IP that is both a cluster IP and the address of an endpoint of a
+// headless service is answered with the reverse record of the cluster IP,
+// whatever the order they are seen in, and the reverse record of the
+// endpoint is served again once the cluster IP is released.
+func TestClusterIPAndEndpointIPOverlap(t *testing.T) {
+	kd := newKubeDNS()
+	s := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(s))
+	endpoints := newEndpoints(s, newSubsetWithOnePortWithHostname("http", 80, true, "10.0.0.1"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(s)
+	endpointFQDN := "ep-0." + getServiceFQDN(kd.domain, s)
+
+	portal := newService(testNamespace, "portal", "10.0.0.1", "http", 80)
+	assert.NoError(t, kd.servicesStore.Add(portal))
+	kd.newService(portal)
+	portalFQDN := getServiceFQDN(kd.domain, portal)
+
+	reverseHost := func() string {
+		record, err := kd.ReverseRecord("1.0.0.10.in-addr.arpa.")
+		if err != nil {
+			return ""
+		}
+		return record.Host
+	}
+	isHeadless := func(name string) bool {
+		records, err := kd.RecordsOfType(name, dns.TypeA, false)
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+		kd.cacheLock.RLock()
+		defer kd.cacheLock.RUnlock()
+		return kd.isHeadlessServiceRecord(&records[0])
+	}
+
+	assert.Equal(t, portalFQDN, reverseHost())
+	assert.True(t, isHeadless(endpointFQDN))
+	assert.False(t, isHeadless(portalFQDN))
+
+	// Regenerating the records of the endpoints doesn't change it.
+	kd.handleEndpointAdd(endpoints)
+	assert.Equal(t, portalFQDN, reverseHost())
+
+	// The reverse record of the endpoint is served once the cluster IP is
+	// released.
+	kd.removeService(portal)
+	assert.Equal(t, endpointFQDN, reverseHost())
+
+	// And not anymore once the endpoint is gone.
+	kd.newService(portal)
+	assert.Equal(t, portalFQDN, reverseHost())
+	kd.handleEndpointDelete(endpoints)
+	assert.Equal(t, portalFQDN, reverseHost())
+	kd.removeService(portal)
+	assert.Equal(t, "", reverseHost())
+}
+
+func TestHeadlessServiceNotReadySubdomain(t *testing.T) {
+	kd := newKubeDNS()
+	s := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(s))
+	subset := newSubsetWithOnePortWithHostname("http", 80, true, "10.0.0.1")
+	subset.NotReadyAddresses = []v1.EndpointAddress{
+		{IP: "10.0.0.2", Hostname: "warming"},
+		{IP: "10.0.0.3"},
+	}
+	endpoints := newEndpoints(s, subset)
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(s)
+	name := getServiceFQDN(kd.domain, s)
+
+	hosts := func(name string) []string {
+		records, err := kd.RecordsOfType(name, dns.TypeA, false)
+		if err != nil {
+			return nil
+		}
+		hosts := []string{}
+		for _, record := range records {
+			hosts = append(hosts, record.Host)
+		}
+		return hosts
+	}
+
+	// By default, not-ready addresses are not served.
+	assert.Equal(t, []string{"10.0.0.1"}, hosts(name))
+	assert.Nil(t, hosts("warming.notready."+name))
+
+	kd.updateConfig(&config.Config{NotReadySubdomain: "notready"})
+	assert.Equal(t, []string{"10.0.0.2"}, hosts("warming.notready."+name))
+	assert.Equal(t, []string{"10.0.0.2"}, hosts("*.notready."+name))
+	assert.Nil(t, hosts("warming."+name))
+	assert.Equal(t, []string{"10.0.0.1"}, hosts("ep-0."+name))
+	assert.Equal(t, []string{"10.0.0.1"}, hosts(name))
+	assert.Equal(t, []string{"10.0.0.1"}, hosts("*."+name))
+}
+
+func TestHeadlessServiceNotReadySubdomainMaxEndpointAddresses(t *testing.T) {
+	kd := newKubeDNS()
+	kd.config = &config.Config{NotReadySubdomain: "notready", MaxEndpointAddresses: 2}
+	s := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(s))
+	subset := newSubsetWithOnePortWithHostname("http", 80, true, "10.0.0.1")
+	subset.NotReadyAddresses = []v1.EndpointAddress{
+		{IP: "10.0.0.2", Hostname: "warming-0"},
+		{IP: "10.0.0.3", Hostname: "warming-1"},
+	}
+	endpoints := newEndpoints(s, subset)
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(s)
+	name := getServiceFQDN(kd.domain, s)
+
+	// The not-ready addresses beyond the cap are not served.
+	records, err := kd.RecordsOfType("*.notready."+name, dns.TypeA, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	assert.Equal(t, "10.0.0.2", records[0].Host)
+	records, err = kd.RecordsOfType(name, dns.TypeA, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	assert.Equal(t, "10.0.0.1", records[0].Host)
+}
+
+func TestHeadlessServiceReadySubdomain(t *testing.T) {
+	kd := newKubeDNS()
+	kd.config = &config.Config{ReadySubdomain: "ready"}
+	s := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(s))
+	subset := newSubsetWithOnePortWithHostname("http", 80, true, "10.0.0.1", "10.0.0.2")
+	subset.NotReadyAddresses = []v1.EndpointAddress{
+		{IP: "10.0.0.3", Hostname: "warming"},
+		{IP: "10.0.0.4"},
+	}
+	endpoints := newEndpoints(s, subset)
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(s)
+	name := getServiceFQDN(kd.domain, s)
+
+	hosts := func(name string) []string {
+		records, err := kd.RecordsOfType(name, dns.TypeA, false)
+		if err != nil {
+			return nil
+		}
+		hosts := []string{}
+		for _, record := range records {
+			hosts = append(hosts, record.Host)
+		}
+		sort.Strings(hosts)
+		return hosts
+	}
+
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, hosts("ready."+name))
+	assert.Equal(t, []string{"10.0.0.1"}, hosts("ep-0.ready."+name))
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, hosts(name))
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, hosts("*."+name))
+
+	// The service name serves the not-ready addresses as well once the
+	// service publishes them, the ready name still does not.
+	published := s.DeepCopy()
+	published.Spec.PublishNotReadyAddresses = true
+	assert.NoError(t, kd.servicesStore.Update(published))
+	kd.updateService(s, published)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}, hosts(name))
+	assert.Equal(t, []string{"10.0.0.3"}, hosts("warming."+name))
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, hosts("ready."+name))
+	assert.Nil(t, hosts("warming.ready."+name))
+}
+
+func TestPublishedNotReadyAddressReverseRecords(t *testing.T) {
+	kd := newKubeDNS()
+	s := newHeadlessService()
+	s.Spec.PublishNotReadyAddresses = true
+	assert.NoError(t, kd.servicesStore.Add(s))
+	subset := newSubsetWithOnePortWithHostname("http", 80, true, "10.0.0.1")
+	subset.NotReadyAddresses = []v1.EndpointAddress{{IP: "10.0.0.2", Hostname: "warming"}}
+	endpoints := newEndpoints(s, subset)
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.handleEndpointAdd(endpoints)
+	record, err := kd.ReverseRecord("2.0.0.10.in-addr.arpa.")
+	require.NoError(t, err)
+	assert.Equal(t, "warming."+getServiceFQDN(kd.domain, s), record.Host)
+
+	// The reverse record of a not-ready address is removed along with it.
+	updated := endpoints.DeepCopy()
+	updated.Subsets[0].NotReadyAddresses = nil
+	assert.NoError(t, kd.endpointsStore.Update(updated))
+	kd.handleEndpointUpdate(endpoints, updated)
+	_, err = kd.ReverseRecord("2.0.0.10.in-addr.arpa.")
+	assert.Error(t, err)
+
+	kd.handleEndpointUpdate(updated, endpoints)
+	_, err = kd.ReverseRecord("2.0.0.10.in-addr.arpa.")
+	require.NoError(t, err)
+	kd.handleEndpointDelete(endpoints)
+	_, err = kd.ReverseRecord("2.0.0.10.in-addr.arpa.")
+	assert.Error(t, err)
+}
+
+// The name of a headless service resolves to the addresses of its
+// endpoints, whether or not they have a hostname, so that single replica
+// headless services can be reached through the service name.
+func TestHeadlessServiceNameResolvesToEndpoints(t *testing.T) {
+	kd := newKubeDNS()
+	s := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(s))
+	endpoints := newEndpoints(s, newSubsetWithOnePortWithHostname("http", 80, true, "10.0.0.1"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(s)
+
+	name := getServiceFQDN(kd.domain, s)
+	records, err := kd.RecordsOfType(name, dns.TypeA, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	assert.Equal(t, "10.0.0.1", records[0].Host)
+
+	updated := newEndpoints(s,
+		newSubsetWithOnePortWithHostname("http", 80, true, "10.0.0.1"),
+		newSubsetWithOnePort("http", 80, "10.0.0.2"))
+	assert.NoError(t, kd.endpointsStore.Update(updated))
+	kd.handleEndpointUpdate(endpoints, updated)
+	assertDNSForHeadlessService(t, kd, updated)
+}
+
+func TestHeadlessServiceRecordsOrder(t *testing.T) {
+	kd := newKubeDNS()
+	s := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(s))
+	endpoints := newEndpoints(s, newSubsetWithOnePort("http", 80, "10.0.0.5", "10.0.0.3", "10.0.0.1", "10.0.0.4", "10.0.0.2"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(s)
+
+	// The records are sorted, whatever the order of the cache.
+	name := getServiceFQDN(kd.domain, s)
+	for i := 0; i < 10; i++ {
+		records, err := kd.RecordsOfType(name, dns.TypeA, false)
+		require.NoError(t, err)
+		hosts := []string{}
+		for _, record := range records {
+			hosts = append(hosts, record.Host)
+		}
+		assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"}, hosts)
+	}
+}
+
+func TestDualStackHeadlessServiceFamilies(t *testing.T) {
+	kd := newKubeDNS()
+	s := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(s))
+	// IPv4-mapped IPv6 addresses have no family and get no record.
+	endpoints := newEndpoints(s,
+		newSubsetWithOnePort("http", 80, "10.0.0.1", "10.0.0.2"),
+		newSubsetWithOnePort("http", 80, "2001:db8::1", "2001:db8::2", "::ffff:10.0.0.3"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(s)
+
+	name := getServiceFQDN(kd.domain, s)
+	hosts := func(qtype uint16) []string {
+		records, err := kd.RecordsOfType(name, qtype, false)
+		require.NoError(t, err)
+		hosts := []string{}
+		for _, record := range records {
+			hosts = append(hosts, record.Host)
+		}
+		return hosts
+	}
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, hosts(dns.TypeA))
+	assert.Equal(t, []string{"2001:db8::1", "2001:db8::2"}, hosts(dns.TypeAAAA))
+	_, err := kd.ReverseRecord("3.0.0.10.in-addr.arpa.")
+	assert.Error(t, err)
+}
+
+func TestNotReadySubdomainFamilies(t *testing.T) {
+	kd := newKubeDNS()
+	kd.config = &config.Config{NotReadySubdomain: "notready"}
+	s := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(s))
+	subset := newSubsetWithOnePortWithHostname("http", 80, true, "10.0.0.1")
+	subset.NotReadyAddresses = []v1.EndpointAddress{
+		{IP: "10.0.0.2", Hostname: "warming"},
+		{IP: "::ffff:10.0.0.3", Hostname: "mapped"},
+	}
+	endpoints := newEndpoints(s, subset)
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(s)
+
+	// Not-ready addresses without a family get no record either.
+	name := getServiceFQDN(kd.domain, s)
+	records, err := kd.Records("*.notready."+name, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	assert.Equal(t, "10.0.0.2", records[0].Host)
+	_, err = kd.Records("mapped.notready."+name, false)
+	assert.Error(t, err)
+}
+
+func TestHeadlessServiceWildcard(t *testing.T) {
+	kd := newKubeDNS()
+	s := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(s))
+	endpoints := newEndpoints(s,
+		newSubsetWithOnePortWithHostname("http", 80, true, "10.0.0.1"),
+		newSubsetWithOnePort("http", 80, "10.0.0.2", "10.0.0.3"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(s)
+
+	// A wildcard under the service matches the records of all its
+	// endpoints, whether they have a hostname or not.
+	records, err := kd.RecordsOfType("*."+getServiceFQDN(kd.domain, s), dns.TypeA, false)
+	require.NoError(t, err)
+	hosts := []string{}
+	for _, record := range records {
+		hosts = append(hosts, record.Host)
+	}
+	assert.ElementsMatch(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, hosts)
+}
+
+func TestHeadlessServiceAggregateRecordsOnly(t *testing.T) {
+	kd := newKubeDNS()
+	s := newHeadlessService()
+	s.Annotations = map[string]string{AggregateRecordsOnlyAnnotation: "true"}
+	assert.NoError(t, kd.servicesStore.Add(s))
+	endpoints := newEndpoints(s,
+		newSubsetWithOnePortWithHostname("http", 80, true, "10.0.0.1"),
+		newSubsetWithOnePort("http", 80, "10.0.0.2"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(s)
+
+	name := getServiceFQDN(kd.domain, s)
+	records, err := kd.Records(name, false)
+	require.NoError(t, err)
+	hosts := []string{}
+	for _, record := range records {
+		hosts = append(hosts, record.Host)
+	}
+	assert.ElementsMatch(t, []string{"10.0.0.1", "10.0.0.2"}, hosts)
 
-	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	// The endpoint names, their SRV records and their PTR records are not
+	// served.
+	for _, exact := range []bool{true, false} {
+		_, err = kd.Records("ep-0."+name, exact)
+		assert.Error(t, err)
+	}
+	_, err = kd.Records("_http._tcp."+name, false)
+	assert.Error(t, err)
+	_, err = kd.ReverseRecord("1.0.0.10.in-addr.arpa.")
+	assert.Error(t, err)
+
+	// Without the annotation, they are.
+	s.Annotations = nil
+	assert.NoError(t, kd.servicesStore.Update(s))
 	kd.newService(s)
-	assertDNSForHeadlessService(t, kd, endpoints)
-	assertNoReverseDNSForHeadlessService(t, kd, endpoints)
-	kd.removeService(s)
-	assertNoDNSForHeadlessService(t, kd, s)
-	assertNoReverseDNSForHeadlessService(t, kd, endpoints)
+	records, err = kd.Records("ep-0."+name, true)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	assert.Equal(t, "10.0.0.1", records[0].Host)
 }
 
 func TestHeadlessServiceWithNamedPorts(t *testing.T) {
@@ -516,6 +2162,62 @@ func TestNamedHeadlessServiceEndpointUpdate(t *testing.T) {
 	assertReverseDNSForNamedHeadlessService(t, kd, newEndpoints)
 }
 
+// failingStore is a cache.Store whose GetByKey fails a number of times
+// before delegating to the wrapped store.
+type failingStore struct {
+	cache.Store
+	failures int
+}
+
+func (s *failingStore) GetByKey(key string) (interface{}, bool, error) {
+	if s.failures > 0 {
+		s.failures--
+		return nil, false, fmt.Errorf("transient error")
+	}
+	return s.Store.GetByKey(key)
+}
+
+func TestNamedHeadlessServiceEndpointDeleteRetry(t *testing.T) {
+	kd := newKubeDNS()
+	service := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(service))
+	endpoints := newEndpoints(service, newSubsetWithOnePortWithHostname("", 80, true, "10.0.0.1", "10.0.0.2"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(service)
+	assertReverseDNSForNamedHeadlessService(t, kd, endpoints)
+
+	kd.servicesStore = &failingStore{Store: kd.servicesStore, failures: 1}
+	kd.handleEndpointDelete(endpoints)
+	// The reverse records are left in place after the transient error...
+	assertReverseDNSForNamedHeadlessService(t, kd, endpoints)
+
+	// ...and removed once the deletion is retried.
+	assert.True(t, kd.processNextEndpointsRetry())
+	assertNoReverseDNSForHeadlessService(t, kd, endpoints)
+	assert.Equal(t, 0, kd.endpointsRetryQueue.Len())
+}
+
+func TestNamedHeadlessServiceEndpointUpdateRetry(t *testing.T) {
+	kd := newKubeDNS()
+	service := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(service))
+	oldEndpoints := newEndpoints(service, newSubsetWithOnePortWithHostname("", 80, true, "10.0.0.1", "10.0.0.2"))
+	assert.NoError(t, kd.endpointsStore.Add(oldEndpoints))
+	kd.newService(service)
+
+	newEndpoints := newEndpoints(service, newSubsetWithOnePortWithHostname("", 80, true, "10.0.0.1"))
+	kd.servicesStore = &failingStore{Store: kd.servicesStore, failures: 1}
+	kd.handleEndpointUpdate(oldEndpoints, newEndpoints)
+	_, err := kd.ReverseRecord("2.0.0.10.in-addr.arpa.")
+	assert.NoError(t, err)
+
+	assert.True(t, kd.processNextEndpointsRetry())
+	_, err = kd.ReverseRecord("2.0.0.10.in-addr.arpa.")
+	assert.Error(t, err)
+	_, err = kd.ReverseRecord("1.0.0.10.in-addr.arpa.")
+	assert.NoError(t, err)
+}
+
 func TestNamedHeadlessServiceEndpointDelete(t *testing.T) {
 	kd := newKubeDNS()
 
@@ -744,6 +2446,256 @@ func TestFederationQueryWithCache(t *testing.T) {
 	testInvalidFederationQueries(t, kd)
 }
 
+func TestFederationQueryWithTopologyLabels(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes []v1.Node
+	}{
+		{
+			name: "GA topology labels",
+			nodes: []v1.Node{
+				newNode("testnode-0", nil),
+				newNode("testnode-1", map[string]string{
+					v1.LabelTopologyZone:   "testcontinent-testreg-testzone",
+					v1.LabelTopologyRegion: "testcontinent-testreg",
+				}),
+			},
+		},
+		{
+			name: "zone and region on different nodes",
+			nodes: []v1.Node{
+				newNode("testnode-0", map[string]string{
+					v1.LabelZoneRegion: "testcontinent-testreg",
+				}),
+				newNode("testnode-1", nil),
+				newNode("testnode-2", map[string]string{
+					v1.LabelTopologyZone: "testcontinent-testreg-testzone",
+				}),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		kd := newKubeDNS()
+		kd.config.Federations = map[string]string{
+			"myfederation":     "example.com",
+			"secondfederation": "second.example.com",
+		}
+		kd.kubeClient = fake.NewSimpleClientset(&v1.NodeList{Items: tt.nodes})
+
+		// Query twice so that the second query is answered from the nodes cache.
+		testValidFederationQueries(t, kd)
+		testValidFederationQueries(t, kd)
+
+		zone, region, err := kd.getClusterZoneAndRegion()
+		require.NoError(t, err, tt.name)
+		assert.Equal(t, "testcontinent-testreg-testzone", zone, tt.name)
+		assert.Equal(t, "testcontinent-testreg", region, tt.name)
+	}
+}
+
+func TestFederationQueryWithoutRegion(t *testing.T) {
+	kd := newKubeDNS()
+	kd.config.Federations = map[string]string{"myfederation": "example.com"}
+	kd.kubeClient = fake.NewSimpleClientset(&v1.NodeList{Items: []v1.Node{
+		newNode("testnode-0", map[string]string{
+			v1.LabelTopologyZone: "testcontinent-testreg-testzone",
+		}),
+	}})
+
+	_, _, err := kd.getClusterZoneAndRegion()
+	assert.EqualError(t, err, "unknown cluster region")
+}
+
+func TestFederationQueryWithoutNodes(t *testing.T) {
+	kd := newKubeDNS()
+	kd.config.Federations = map[string]string{"myfederation": "example.com"}
+	kd.config.FallbackClusterZone = "onprem-a"
+	kd.config.FallbackClusterRegion = "onprem"
+	kd.kubeClient = fake.NewSimpleClientset(&v1.NodeList{})
+
+	_, _, err := kd.getClusterZoneAndRegion()
+	assert.EqualError(t, err, "the cluster has no nodes")
+}
+
+func TestFederationQueryWithoutTopologyLabels(t *testing.T) {
+	kd := newKubeDNS()
+	kd.config.Federations = map[string]string{"myfederation": "example.com"}
+	kd.kubeClient = fake.NewSimpleClientset(&v1.NodeList{Items: []v1.Node{
+		newNode("testnode-0", nil),
+		newNode("testnode-1", map[string]string{"foo": "bar"}),
+	}})
+
+	_, _, err := kd.getClusterZoneAndRegion()
+	assert.EqualError(t, err, "none of the 2 cluster nodes has a zone or region label")
+
+	kd.config.FallbackClusterZone = "onprem-a"
+	kd.config.FallbackClusterRegion = "onprem"
+	zone, region, err := kd.getClusterZoneAndRegion()
+	require.NoError(t, err)
+	assert.Equal(t, "onprem-a", zone)
+	assert.Equal(t, "onprem", region)
+}
+
+func TestFederationQueryWithFallbackRegion(t *testing.T) {
+	kd := newKubeDNS()
+	kd.config.Federations = map[string]string{"myfederation": "example.com"}
+	kd.config.FallbackClusterZone = "onprem-a"
+	kd.config.FallbackClusterRegion = "onprem"
+	kd.kubeClient = fake.NewSimpleClientset(&v1.NodeList{Items: []v1.Node{
+		newNode("testnode-0", map[string]string{
+			v1.LabelTopologyZone: "testcontinent-testreg-testzone",
+		}),
+	}})
+
+	// Labels found on the nodes take precedence over the fallbacks.
+	zone, region, err := kd.getClusterZoneAndRegion()
+	require.NoError(t, err)
+	assert.Equal(t, "testcontinent-testreg-testzone", zone)
+	assert.Equal(t, "onprem", region)
+}
+
+func TestFederatedExternalNameService(t *testing.T) {
+	kd := newKubeDNS()
+	kd.config.Federations = map[string]string{"myfederation": "example.com"}
+	kd.kubeClient = fake.NewSimpleClientset(newNodes())
+
+	s := newExternalNameService()
+	s.Spec.ExternalName = "mysvc.myns.myfederation.svc.cluster.local"
+	assert.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+	name := getServiceFQDN(kd.domain, s)
+
+	// By default, the target is returned as is.
+	verifyRecord(t, "plain", name, s.Spec.ExternalName, kd)
+
+	kd.config.ResolveFederatedExternalNames = true
+	verifyRecord(t, "resolved", name,
+		"mysvc.myns.myfederation.svc.testcontinent-testreg-testzone.testcontinent-testreg.example.com.", kd)
+
+	// Targets that are not federated names are left alone.
+	s.Spec.ExternalName = testExternalName
+	kd.newService(s)
+	verifyRecord(t, "not federated", name, testExternalName, kd)
+}
+
+func TestFederationQueryCollapsingCNAMEs(t *testing.T) {
+	kd := newKubeDNS()
+	kd.config.Federations = map[string]string{"myfederation": "example.com"}
+	kd.kubeClient = fake.NewSimpleClientset(newNodes())
+
+	// The local service of the federation query is an ExternalName service
+	// pointing at another local service.
+	target := newService(testNamespace, "target", "1.2.3.4", "", 80)
+	assert.NoError(t, kd.servicesStore.Add(target))
+	kd.newService(target)
+	s := newExternalNameService()
+	s.Spec.ExternalName = getServiceFQDN(kd.domain, target)
+	assert.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+	name := getFederationServiceFQDN(kd, s, "myfederation")
+
+	hosts := func() []string {
+		records, err := kd.Records(name, false)
+		require.NoError(t, err)
+		hosts := []string{}
+		for _, record := range records {
+			hosts = append(hosts, record.Host)
+		}
+		return hosts
+	}
+
+	// By default, only the CNAME to the local service is returned.
+	assert.Equal(t, []string{getServiceFQDN(kd.domain, s)}, hosts())
+
+	kd.config.CollapseFederationCNAMEs = true
+	assert.Equal(t, []string{getServiceFQDN(kd.domain, s), getServiceFQDN(kd.domain, target), "1.2.3.4"}, hosts())
+
+	// The chain ends at the first target that isn't served by KubeDNS.
+	s.Spec.ExternalName = testExternalName
+	kd.newService(s)
+	assert.Equal(t, []string{getServiceFQDN(kd.domain, s), testExternalName}, hosts())
+}
+
+func TestFederationQueryOverlappingLocalRecord(t *testing.T) {
+	kd := newKubeDNS()
+	kd.config.Federations = map[string]string{"myfederation": "example.com"}
+	kd.kubeClient = fake.NewSimpleClientset(newNodes())
+
+	// The endpoint names of a headless service in a namespace named after
+	// the federation match the federation query pattern.
+	s := newHeadlessService()
+	s.Name = "mysvc"
+	s.Namespace = "myfederation"
+	assert.NoError(t, kd.servicesStore.Add(s))
+	assert.NoError(t, kd.endpointsStore.Add(newEndpoints(s, newSubsetWithOnePortWithHostname("", 80, true, "10.0.0.1"))))
+	kd.newService(s)
+	name := "ep-0.mysvc.myfederation.svc.cluster.local."
+
+	// By default, the federation shadows the local record.
+	verifyRecord(t, "federation", name,
+		"ep-0.mysvc.myfederation.svc.testcontinent-testreg-testzone.testcontinent-testreg.example.com.", kd)
+
+	kd.config.PreferLocalRecords = true
+	verifyRecord(t, "local", name, "10.0.0.1", kd)
+	// Names without a local record are still federation queries.
+	verifyRecord(t, "other federation", "other.myns.myfederation.svc.cluster.local.",
+		"other.myns.myfederation.svc.testcontinent-testreg-testzone.testcontinent-testreg.example.com.", kd)
+}
+
+func TestFederationWildcardQueries(t *testing.T) {
+	kd := newKubeDNS()
+	kd.config.Federations = map[string]string{"myfederation": "example.com"}
+	kd.kubeClient = fake.NewSimpleClientset(newNodes())
+	skydnsConfig := &skyserver.Config{Domain: testDomain, DnsAddr: "0.0.0.0:53"}
+	skyserver.SetDefaults(skydnsConfig)
+	server := skyserver.New(kd, skydnsConfig)
+
+	s := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(s))
+	assert.NoError(t, kd.endpointsStore.Add(newEndpoints(s, newSubsetWithOnePort("http", 80, "10.0.0.1"))))
+	kd.newService(s)
+
+	const redirectSuffix = ".testcontinent-testreg-testzone.testcontinent-testreg.example.com."
+	for _, tc := range []struct {
+		q string
+		a string
+	}{
+		// Wildcard queries matching local records are answered with a
+		// CNAME to the local wildcard name.
+		{"*.testservice.default.myfederation.svc.cluster.local.", "*.testservice.default.svc.cluster.local."},
+		{"testservice.*.myfederation.svc.cluster.local.", "testservice.*.svc.cluster.local."},
+		// Other ones are redirected to the federation.
+		{"*.mysvc.myns.myfederation.svc.cluster.local.", "*.mysvc.myns.myfederation.svc" + redirectSuffix},
+		{"mysvc.*.myfederation.svc.cluster.local.", "mysvc.*.myfederation.svc" + redirectSuffix},
+		{"*.*.myfederation.svc.cluster.local.", "*.*.myfederation.svc" + redirectSuffix},
+	} {
+		verifyRecord(t, tc.q, tc.q, tc.a, kd)
+	}
+
+	for _, q := range []string{
+		// Only a wildcard label may precede the service name.
+		"ep.mysvc.myns.myfederation.svc.cluster.local.",
+		"*.*.mysvc.myns.myfederation.svc.cluster.local.",
+		// The federation can't be a wildcard.
+		"*.mysvc.myns.*.svc.cluster.local.",
+	} {
+		_, err := kd.Records(q, false)
+		assert.Error(t, err, q)
+	}
+
+	// Wildcard SRV lookups of federated services are redirected too.
+	for q, target := range map[string]string{
+		"*.testservice.default.myfederation.svc.cluster.local.": "*.testservice.default.svc.cluster.local.",
+		"*.mysvc.myns.myfederation.svc.cluster.local.":          "*.mysvc.myns.myfederation.svc" + redirectSuffix,
+	} {
+		question := dns.Question{Name: q, Qtype: dns.TypeSRV, Qclass: dns.ClassINET}
+		records, _, err := server.SRVRecords(question, q, 512, false)
+		require.NoError(t, err, q)
+		assertSRVRecordsMatchTarget(t, records, target)
+	}
+}
+
 func testValidFederationQueries(t *testing.T, kd *KubeDNS) {
 	queries := []struct {
 		q string
@@ -812,8 +2764,10 @@ func TestConfigSync(t *testing.T) {
 	mockSync := config.NewMockSync(
 		&config.Config{Federations: make(map[string]string)}, nil)
 	kd.configSync = mockSync
+	stopCh := make(chan struct{})
+	defer close(stopCh)
 
-	kd.startConfigMapSync()
+	kd.startConfigMapSync(stopCh)
 
 	checkConfigEqual(t, kd, &config.Config{Federations: make(map[string]string)})
 	// update
@@ -830,11 +2784,84 @@ func TestConfigSyncInitialMap(t *testing.T) {
 	mockSync := config.NewMockSync(
 		&config.Config{Federations: map[string]string{"name3": "domain3"}}, nil)
 	kd.configSync = mockSync
+	stopCh := make(chan struct{})
+	defer close(stopCh)
 
-	kd.startConfigMapSync()
+	kd.startConfigMapSync(stopCh)
 	checkConfigEqual(t, kd, &config.Config{Federations: map[string]string{"name3": "domain3"}})
 }
 
+// stoppableController is a kcache.Controller that has synced and runs until
+// it is stopped.
+type stoppableController struct{}
+
+func (c *stoppableController) Run(stopCh <-chan struct{}) { <-stopCh }
+func (c *stoppableController) HasSynced() bool            { return true }
+func (c *stoppableController) LastSyncResourceVersion() string {
+	return ""
+}
+
+func TestStartWithContext(t *testing.T) {
+	kd := newKubeDNS()
+	kd.initialSyncTimeout = wait.ForeverTestTimeout
+	kd.serviceController = &stoppableController{}
+	kd.endpointsController = &stoppableController{}
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(t, kd.StartWithContext(ctx))
+	assert.True(t, kd.HasSynced())
+	assert.True(t, kd.Ready())
+
+	cancel()
+	stopped := make(chan struct{})
+	go func() {
+		kd.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("Timed out waiting for the goroutines to exit")
+	}
+	assert.True(t, kd.endpointsRetryQueue.ShuttingDown())
+}
+
+// unsyncedController is a kcache.Controller that never completes its initial
+// listing.
+type unsyncedController struct {
+	stoppableController
+}
+
+func (c *unsyncedController) HasSynced() bool { return false }
+
+func TestStartWithContextInitialSyncTimeout(t *testing.T) {
+	kd := newKubeDNS()
+	kd.initialSyncTimeout = 10 * time.Millisecond
+	kd.serviceController = &stoppableController{}
+	kd.endpointsController = &unsyncedController{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer kd.Wait()
+	defer cancel()
+
+	err := kd.StartWithContext(ctx)
+	assert.True(t, errors.Is(err, ErrInitialSyncTimeout), "unexpected error: %v", err)
+	assert.Contains(t, err.Error(), "endpoints")
+	assert.NotContains(t, err.Error(), "services")
+	assert.False(t, kd.Ready())
+}
+
+func TestStartWithContextCancelled(t *testing.T) {
+	kd := newKubeDNS()
+	kd.initialSyncTimeout = wait.ForeverTestTimeout
+	kd.serviceController = &unsyncedController{}
+	kd.endpointsController = &unsyncedController{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := kd.StartWithContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+	kd.Wait()
+}
+
 func TestUpdateConfig(t *testing.T) {
 	tmpdir, err := ioutil.TempDir("", "test")
 	defaultResolvFile = filepath.Join(tmpdir, "resolv.conf")
@@ -860,11 +2887,198 @@ func TestUpdateConfig(t *testing.T) {
 	assert.Equal(t, nextConfig, kd.config)
 	assert.Equal(t, []string{"192.0.2.123:10086", "192.0.2.123:53"}, kd.SkyDNSConfig.Nameservers)
 
+	nextConfig = &config.Config{UpstreamNameservers: []string{"2001:db8::1", "[2001:db8::2]:5353"}}
+	kd.updateConfig(nextConfig)
+	assert.Equal(t, []string{"[2001:db8::1]:53", "[2001:db8::2]:5353"}, kd.SkyDNSConfig.Nameservers)
+
 	nextConfig = new(config.Config)
 	kd.updateConfig(nextConfig)
 	assert.Equal(t, []string{"127.0.0.1:53"}, kd.SkyDNSConfig.Nameservers)
 }
 
+func TestApplyConfigIsAtomic(t *testing.T) {
+	kd := newKubeDNS()
+	configFor := func(i int) *config.Config {
+		return &config.Config{
+			MinTTL:            uint32(i),
+			MaxTTL:            uint32(i),
+			AdditionalDomains: []string{fmt.Sprintf("d%d.example.com", i)},
+		}
+	}
+	_, err := kd.applyConfig(configFor(0))
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				kd.configLock.RLock()
+				current, domainPaths := kd.config, kd.additionalDomainPaths
+				kd.configLock.RUnlock()
+				expected := fmt.Sprintf("d%d.example.com", current.MinTTL)
+				if current.MaxTTL != current.MinTTL || len(domainPaths) != 1 ||
+					strings.Join(util.ReverseArray(append([]string{}, domainPaths[0]...)), ".") != expected {
+					t.Errorf("Observed a torn configuration: %+v with additional domains %v", *current, domainPaths)
+					return
+				}
+			}
+		}()
+	}
+	for i := 1; i <= 1000; i++ {
+		_, err := kd.applyConfig(configFor(i))
+		require.NoError(t, err)
+	}
+	close(done)
+	wg.Wait()
+
+	// An invalid configuration is not applied.
+	_, err = kd.applyConfig(&config.Config{MinTTL: 10, MaxTTL: 5})
+	assert.Error(t, err)
+	assert.Equal(t, configFor(1000), kd.currentConfig())
+}
+
+func TestUpdateConfigAdditionalDomains(t *testing.T) {
+	kd := newKubeDNS()
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	kd.newService(s)
+
+	const (
+		clusterName = testService + "." + testNamespace + ".svc." + testDomain
+		aliasName   = testService + "." + testNamespace + ".svc.cluster.example.com."
+		aliasSRV    = "_http._tcp." + aliasName
+	)
+	_, err := kd.Records(aliasName, false)
+	assert.Error(t, err)
+
+	kd.updateConfig(&config.Config{AdditionalDomains: []string{"cluster.example.com"}})
+	for _, name := range []string{clusterName, aliasName} {
+		records, err := kd.Records(name, false)
+		require.NoError(t, err, name)
+		require.Equal(t, 1, len(records), name)
+		assert.Equal(t, "1.2.3.4", records[0].Host, name)
+	}
+	records, err := kd.Records(aliasSRV, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(records))
+
+	kd.updateConfig(&config.Config{})
+	_, err = kd.Records(aliasName, false)
+	assert.Error(t, err)
+	records, err = kd.Records(clusterName, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(records))
+}
+
+func TestAdditionalDomainsPodAndFederationRecords(t *testing.T) {
+	kd := newKubeDNS()
+	kd.kubeClient = fake.NewSimpleClientset(newNodes())
+	kd.updateConfig(&config.Config{
+		AdditionalDomains: []string{"cluster.internal"},
+		Federations:       map[string]string{"myfederation": "example.com"},
+	})
+
+	for _, domain := range []string{testDomain, "cluster.internal."} {
+		// Pod records are served under every domain.
+		records, err := kd.Records("1-2-3-4.default.pod."+domain, false)
+		require.NoError(t, err, domain)
+		require.Len(t, records, 1, domain)
+		assert.Equal(t, "1.2.3.4", records[0].Host, domain)
+
+		// So are federation redirects.
+		verifyRecord(t, domain, "mysvc.myns.myfederation.svc."+domain,
+			"mysvc.myns.myfederation.svc.testcontinent-testreg-testzone.testcontinent-testreg.example.com.", kd)
+	}
+}
+
+func TestUpdateConfigKubernetesServiceIP(t *testing.T) {
+	kd := newKubeDNS()
+	const name = "kubernetes.default.svc." + testDomain
+
+	resolve := func() []string {
+		records, err := kd.Records(name, false)
+		require.NoError(t, err)
+		hosts := []string{}
+		for _, record := range records {
+			hosts = append(hosts, record.Host)
+		}
+		return hosts
+	}
+
+	_, err := kd.Records(name, false)
+	assert.Error(t, err)
+
+	// Before the services are synced, the seed is served.
+	kd.updateConfig(&config.Config{KubernetesServiceIP: "10.0.0.1"})
+	assert.Equal(t, []string{"10.0.0.1"}, resolve())
+
+	// A new IP replaces the seed, along with its reverse record.
+	kd.updateConfig(&config.Config{KubernetesServiceIP: "10.0.0.3"})
+	assert.Equal(t, []string{"10.0.0.3"}, resolve())
+	_, err = kd.ReverseRecord("1.0.0.10.in-addr.arpa.")
+	assert.Error(t, err)
+	reverseRecord, err := kd.ReverseRecord("3.0.0.10.in-addr.arpa.")
+	require.NoError(t, err)
+	assert.Equal(t, name, reverseRecord.Host)
+
+	// No IP removes the seed.
+	kd.updateConfig(&config.Config{})
+	_, err = kd.Records(name, false)
+	assert.Error(t, err)
+	_, err = kd.ReverseRecord("3.0.0.10.in-addr.arpa.")
+	assert.Error(t, err)
+
+	kd.updateConfig(&config.Config{KubernetesServiceIP: "10.0.0.1"})
+	assert.Equal(t, []string{"10.0.0.1"}, resolve())
+
+	// The real service supersedes the seed.
+	s := newService(metav1.NamespaceDefault, "kubernetes", "10.0.0.10", "https", 443)
+	assert.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+	assert.Equal(t, []string{"10.0.0.10"}, resolve())
+	_, err = kd.ReverseRecord("1.0.0.10.in-addr.arpa.")
+	assert.Error(t, err)
+
+	// The seed does not override the real service once it is known.
+	kd.updateConfig(&config.Config{KubernetesServiceIP: "10.0.0.2"})
+	assert.Equal(t, []string{"10.0.0.10"}, resolve())
+	_, err = kd.ReverseRecord("2.0.0.10.in-addr.arpa.")
+	assert.Error(t, err)
+}
+
+func TestUpdateConfigDNSServiceIP(t *testing.T) {
+	kd := newKubeDNS()
+	// A cluster domain configured without the trailing dot.
+	kd.domain = strings.TrimSuffix(testDomain, ".")
+	const reverseName = "10.0.0.10.in-addr.arpa."
+
+	_, err := kd.ReverseRecord(reverseName)
+	assert.Error(t, err)
+
+	kd.updateConfig(&config.Config{DNSServiceIP: "10.0.0.10"})
+	reverseRecord, err := kd.ReverseRecord(reverseName)
+	require.NoError(t, err)
+	assert.Equal(t, "kube-dns.kube-system.svc.cluster.local.", reverseRecord.Host)
+	records, err := kd.Records("kube-dns.kube-system.svc.cluster.local.", false)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	assert.Equal(t, "10.0.0.10", records[0].Host)
+
+	s := newService(metav1.NamespaceSystem, "kube-dns", "10.0.0.10", "dns", 53)
+	assert.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+	reverseRecord, err = kd.ReverseRecord(reverseName)
+	require.NoError(t, err)
+	assert.Equal(t, "kube-dns.kube-system.svc.cluster.local.", reverseRecord.Host)
+}
+
 func newNodes() *v1.NodeList {
 	return &v1.NodeList{
 		Items: []v1.Node{
@@ -890,6 +3104,15 @@ func newNodes() *v1.NodeList {
 	}
 }
 
+func newNode(name string, labels map[string]string) v1.Node {
+	return v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+	}
+}
+
 func newService(namespace, serviceName, clusterIP, portName string, portNumber int32) *v1.Service {
 	service := v1.Service{
 		ObjectMeta: metav1.ObjectMeta{
@@ -1155,3 +3378,129 @@ func getPodsFQDN(kd *KubeDNS, e *v1.Endpoints, podHostName string) string {
 func getSRVFQDN(kd *KubeDNS, s *v1.Service, portName string) string {
 	return fmt.Sprintf("_%s._tcp.%s.%s.svc.%s", portName, s.Name, s.Namespace, kd.domain)
 }
+
+func TestPodRecordIPFamilies(t *testing.T) {
+	kd := newKubeDNS()
+	name := "10-0-0-1.default.pod.cluster.local."
+
+	verifyRecord(t, "all families", name, "10.0.0.1", kd)
+
+	kd.config = &config.Config{PodRecordIPFamilies: []v1.IPFamily{v1.IPv4Protocol}}
+	verifyRecord(t, "IPv4", name, "10.0.0.1", kd)
+
+	kd.config = &config.Config{PodRecordIPFamilies: []v1.IPFamily{v1.IPv6Protocol}}
+	_, err := kd.Records(name, false)
+	require.Error(t, err)
+	assert.Equal(t, etcd.ErrorCodeKeyNotFound, err.(etcd.Error).Code)
+}
+
+func TestPodSubdomainApex(t *testing.T) {
+	kd := newKubeDNS()
+	apex := "default.pod." + testDomain
+
+	_, err := kd.Records(apex, false)
+	require.Error(t, err)
+	assert.Equal(t, etcd.ErrorCodeKeyNotFound, err.(etcd.Error).Code)
+
+	// The apex exists, with no record.
+	kd.config = &config.Config{AnswerPodSubdomainApex: true}
+	records, err := kd.Records(apex, false)
+	require.NoError(t, err)
+	assert.Empty(t, records)
+
+	kd.config = &config.Config{AnswerPodSubdomainApex: true, PodSubdomainApexIP: "127.0.0.1"}
+	verifyRecord(t, "apex", apex, "127.0.0.1", kd)
+
+	// Pod records are unaffected.
+	verifyRecord(t, "pod", "10-0-0-1."+apex, "10.0.0.1", kd)
+	_, err = kd.Records("pod."+testDomain, false)
+	assert.Error(t, err)
+}
+
+func TestHealthProbeRecord(t *testing.T) {
+	kd := newKubeDNS()
+	name := "dns-health." + testDomain
+
+	_, err := kd.Records(name, false)
+	assert.Error(t, err)
+
+	kd.config = &config.Config{HealthProbe: &config.HealthProbeRecord{Name: "DNS-Health.cluster.local", IP: "127.0.0.1"}}
+	verifyRecord(t, "health probe", name, "127.0.0.1", kd)
+	_, err = kd.Records("other."+testDomain, false)
+	assert.Error(t, err)
+
+	// The probe record is answered even when it shadows a service.
+	kd.config = &config.Config{HealthProbe: &config.HealthProbeRecord{Name: "probe.default.svc.cluster.local.", IP: "127.0.0.2"}}
+	kd.newService(newService(testNamespace, "probe", "1.2.3.4", "http", 80))
+	verifyRecord(t, "shadowed service", "probe.default.svc."+testDomain, "127.0.0.2", kd)
+}
+
+func TestReverseRecordHostAnnotation(t *testing.T) {
+	kd := newKubeDNS()
+
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	s.Annotations = map[string]string{ReverseRecordHostAnnotation: "api.example.com"}
+	kd.newService(s)
+	record, err := kd.ReverseRecord("4.3.2.1.in-addr.arpa.")
+	require.NoError(t, err)
+	assert.Equal(t, "api.example.com.", record.Host)
+	// The forward records are unchanged.
+	assertDNSForClusterIP(t, "annotated", kd, s, []string{"1.2.3.4"})
+
+	// An invalid annotation falls back to the service name.
+	invalid := s.DeepCopy()
+	invalid.Annotations[ReverseRecordHostAnnotation] = "not a name"
+	kd.updateService(s, invalid)
+	assertReverseRecord(t, "invalid annotation", kd, invalid)
+}
+
+func TestReverseRecordExcludedCIDRs(t *testing.T) {
+	kd := newKubeDNS()
+	kd.config = &config.Config{ReverseRecordExcludedCIDRs: []string{"10.96.128.0/17"}}
+
+	excluded := newService(testNamespace, testService, "10.96.200.1", "http", 80)
+	kd.newService(excluded)
+	assertDNSForClusterIP(t, "excluded", kd, excluded, []string{"10.96.200.1"})
+	_, err := kd.ReverseRecord("1.200.96.10.in-addr.arpa.")
+	assert.Error(t, err)
+	assert.NotContains(t, kd.reverseRecordMap, "10.96.200.1")
+
+	included := newService(testNamespace, "included", "10.96.0.10", "http", 80)
+	kd.newService(included)
+	assertReverseRecord(t, "included", kd, included)
+
+	kd.removeService(excluded)
+	assert.NotContains(t, kd.clusterIPServiceMap, "10.96.200.1")
+}
+
+func TestTTLBounds(t *testing.T) {
+	kd := newKubeDNS()
+	s := newService(testNamespace, testService, "1.2.3.4", "", 80)
+	kd.newService(s)
+	name := getServiceFQDN(kd.domain, s)
+
+	ttl := func(name string) uint32 {
+		records, err := kd.Records(name, false)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(records))
+		return records[0].Ttl
+	}
+
+	kd.config = &config.Config{MaxTTL: 10}
+	assert.Equal(t, uint32(10), ttl(name))
+	assert.Equal(t, uint32(10), ttl("1-2-3-4.default.pod."+testDomain))
+
+	// The floor applies to the TTLs set by other settings too.
+	kd.config = &config.Config{UnbackedServiceTTL: 1, MinTTL: 5}
+	assert.Equal(t, uint32(5), ttl(name))
+
+	kd.config = &config.Config{MinTTL: 5, MaxTTL: 300}
+	assert.Equal(t, uint32(30), ttl(name))
+	data, err := kd.GetCacheAsJSON()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint32{"1.2.3.4": 30}, cacheTTLs(t, data))
+	kd.config = &config.Config{MaxTTL: 10}
+	data, err = kd.GetCacheAsJSON()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint32{"1.2.3.4": 10}, cacheTTLs(t, data))
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	kcache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// WithEndpointSlices makes KubeDNS watch the discovery.k8s.io/v1
+// EndpointSlices of the services instead of their Endpoints, which get
+// huge for large services: an update of a backend then only converts the
+// slice it belongs to. The records of the service are still regenerated
+// from the Endpoints aggregating all of its slices. The zones of the
+// endpoints are kept for RecordsWithTopology.
+func WithEndpointSlices() Option {
+	return func(kd *KubeDNS) {
+		kd.useEndpointSlices = true
+	}
+}
+
+// setEndpointSlicesStore watches the EndpointSlices of the services. The
+// slices of each service are aggregated into the Endpoints of the service,
+// which are kept in endpointsStore and handled as if they were watched.
+func (kd *KubeDNS) setEndpointSlicesStore() {
+	kd.endpointsStore = kcache.NewStore(kcache.MetaNamespaceKeyFunc)
+	kd.endpointSlices = make(map[string]map[string]*convertedEndpointSlice)
+	_, kd.endpointsController = kcache.NewInformer(
+		kcache.NewListWatchFromClient(
+			kd.kubeClient.DiscoveryV1().RESTClient(),
+			"endpointslices",
+			v1.NamespaceAll,
+			fields.Everything()),
+		&discovery.EndpointSlice{},
+		resyncPeriod,
+		kcache.ResourceEventHandlerFuncs{
+			AddFunc:    kd.handleEndpointSliceAdd,
+			UpdateFunc: kd.handleEndpointSliceUpdate,
+			DeleteFunc: kd.handleEndpointSliceDelete,
+		},
+	)
+}
+
+func (kd *KubeDNS) handleEndpointSliceAdd(obj interface{}) {
+	if slice, ok := obj.(*discovery.EndpointSlice); ok {
+		kd.updateEndpointSlice(slice, false)
+	} else {
+		klog.Errorf("obj type assertion failed! Expected 'discovery.EndpointSlice', got %T", obj)
+	}
+}
+
+func (kd *KubeDNS) handleEndpointSliceUpdate(oldObj, newObj interface{}) {
+	// The slice is converted again from scratch, the previous version is
+	// only needed if the slice moved to another service.
+	if old, ok := oldObj.(*discovery.EndpointSlice); ok {
+		if new, ok := newObj.(*discovery.EndpointSlice); ok &&
+			old.Labels[discovery.LabelServiceName] != new.Labels[discovery.LabelServiceName] {
+			kd.updateEndpointSlice(old, true)
+		}
+	}
+	kd.handleEndpointSliceAdd(newObj)
+}
+
+func (kd *KubeDNS) handleEndpointSliceDelete(obj interface{}) {
+	if tombstone, ok := obj.(kcache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if slice, ok := obj.(*discovery.EndpointSlice); ok {
+		kd.updateEndpointSlice(slice, true)
+	} else {
+		klog.Errorf("obj type assertion failed! Expected 'discovery.EndpointSlice', got %T", obj)
+	}
+}
+
+// updateEndpointSlice converts the given slice, or forgets it if deleted,
+// and hands the Endpoints aggregating the slices of its service to the
+// endpoints handlers. Slices that don't belong to a service are ignored.
+func (kd *KubeDNS) updateEndpointSlice(slice *discovery.EndpointSlice, deleted bool) {
+	serviceName := slice.Labels[discovery.LabelServiceName]
+	if serviceName == "" {
+		klog.V(4).Infof("Ignoring EndpointSlice %s/%s without service", slice.Namespace, slice.Name)
+		return
+	}
+	key := slice.Namespace + "/" + serviceName
+
+	kd.endpointSlicesLock.Lock()
+	defer kd.endpointSlicesLock.Unlock()
+	slices := kd.endpointSlices[key]
+	if deleted {
+		delete(slices, slice.Name)
+	} else {
+		if slices == nil {
+			slices = map[string]*convertedEndpointSlice{}
+			kd.endpointSlices[key] = slices
+		}
+		slices[slice.Name] = &convertedEndpointSlice{
+			subsets: endpointSliceSubsets(slice),
+			zones:   endpointSliceZones(slice),
+		}
+	}
+
+	var old *v1.Endpoints
+	if obj, exists, err := kd.endpointsStore.GetByKey(key); err == nil && exists {
+		old = obj.(*v1.Endpoints)
+	}
+	if len(slices) == 0 {
+		delete(kd.endpointSlices, key)
+		if old != nil {
+			kd.endpointsStore.Delete(old)
+			kd.handleEndpointDelete(old)
+		}
+		return
+	}
+
+	endpoints := aggregateEndpointSlices(slice.Namespace, serviceName, slices)
+	if old == nil {
+		kd.endpointsStore.Add(endpoints)
+		kd.handleEndpointAdd(endpoints)
+	} else {
+		kd.endpointsStore.Update(endpoints)
+		kd.handleEndpointUpdate(old, endpoints)
+	}
+}
+
+// endpointZone returns the zone of the endpoint of the given service with
+// the given IP, as set in its EndpointSlice.
+func (kd *KubeDNS) endpointZone(key, ip string) (string, bool) {
+	kd.endpointSlicesLock.Lock()
+	defer kd.endpointSlicesLock.Unlock()
+	for _, slice := range kd.endpointSlices[key] {
+		if zone, ok := slice.zones[ip]; ok {
+			return zone, true
+		}
+	}
+	return "", false
+}
+
+// aggregateEndpointSlices returns the Endpoints of the given service made of
+// the subsets of its slices, in the order of the slice names.
+func aggregateEndpointSlices(namespace, serviceName string, slices map[string]*convertedEndpointSlice) *v1.Endpoints {
+	names := make([]string, 0, len(slices))
+	for name := range slices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	endpoints := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: serviceName},
+	}
+	for _, name := range names {
+		endpoints.Subsets = append(endpoints.Subsets, slices[name].subsets...)
+	}
+	return endpoints
+}
+
+// convertedEndpointSlice is an EndpointSlice converted to Endpoints
+// subsets.
+type convertedEndpointSlice struct {
+	subsets []v1.EndpointSubset
+	// zones maps the IPs of the endpoints of the slice to their zone, which
+	// Endpoints addresses have no field for.
+	zones map[string]string
+}
+
+// endpointSliceSubsets converts the given slice to Endpoints subsets: a
+// single subset holding its ports and the first address of each of its
+// endpoints, ready or not. Slices of FQDNs are not converted, as Endpoints
+// only hold IPs.
+func endpointSliceSubsets(slice *discovery.EndpointSlice) []v1.EndpointSubset {
+	if slice.AddressType != discovery.AddressTypeIPv4 && slice.AddressType != discovery.AddressTypeIPv6 {
+		klog.V(4).Infof("Ignoring EndpointSlice %s/%s of address type %s", slice.Namespace, slice.Name, slice.AddressType)
+		return nil
+	}
+	subset := v1.EndpointSubset{}
+	for i := range slice.Endpoints {
+		endpoint := &slice.Endpoints[i]
+		if len(endpoint.Addresses) == 0 {
+			continue
+		}
+		// Consumers only use the first address of an endpoint.
+		address := v1.EndpointAddress{
+			IP:        endpoint.Addresses[0],
+			NodeName:  endpoint.NodeName,
+			TargetRef: endpoint.TargetRef,
+		}
+		if endpoint.Hostname != nil {
+			address.Hostname = *endpoint.Hostname
+		}
+		// A nil condition means that the endpoint is ready.
+		if endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready {
+			subset.Addresses = append(subset.Addresses, address)
+		} else {
+			subset.NotReadyAddresses = append(subset.NotReadyAddresses, address)
+		}
+	}
+	for _, port := range slice.Ports {
+		endpointPort := v1.EndpointPort{}
+		if port.Name != nil {
+			endpointPort.Name = *port.Name
+		}
+		if port.Port != nil {
+			endpointPort.Port = *port.Port
+		}
+		if port.Protocol != nil {
+			endpointPort.Protocol = *port.Protocol
+		}
+		subset.Ports = append(subset.Ports, endpointPort)
+	}
+	if len(subset.Addresses) == 0 && len(subset.NotReadyAddresses) == 0 {
+		return nil
+	}
+	return []v1.EndpointSubset{subset}
+}
+
+// endpointSliceZones returns the zones of the endpoints of the given slice
+// that have one, by the address endpointSliceSubsets converts them to.
+func endpointSliceZones(slice *discovery.EndpointSlice) map[string]string {
+	zones := map[string]string{}
+	for i := range slice.Endpoints {
+		endpoint := &slice.Endpoints[i]
+		if len(endpoint.Addresses) > 0 && endpoint.Zone != nil {
+			zones[endpoint.Addresses[0]] = *endpoint.Zone
+		}
+	}
+	return zones
+}
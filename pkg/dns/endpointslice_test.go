@@ -0,0 +1,157 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"k8s.io/dns/pkg/dns/config"
+)
+
+func newEndpointSlice(service *v1.Service, name string, endpoints ...discovery.Endpoint) *discovery.EndpointSlice {
+	portName, protocol, port := "http", v1.ProtocolTCP, int32(80)
+	return &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: service.Namespace,
+			Name:      name,
+			Labels:    map[string]string{discovery.LabelServiceName: service.Name},
+		},
+		AddressType: discovery.AddressTypeIPv4,
+		Endpoints:   endpoints,
+		Ports:       []discovery.EndpointPort{{Name: &portName, Protocol: &protocol, Port: &port}},
+	}
+}
+
+func newSliceEndpoint(ip, hostname string, ready bool) discovery.Endpoint {
+	endpoint := discovery.Endpoint{
+		Addresses:  []string{ip},
+		Conditions: discovery.EndpointConditions{Ready: &ready},
+	}
+	if hostname != "" {
+		endpoint.Hostname = &hostname
+	}
+	return endpoint
+}
+
+func TestNewKubeDNSWithEndpointSlices(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	kd := NewKubeDNS(client, testDomain, 0, config.NewNopSync(config.NewDefaultConfig()), WithEndpointSlices())
+	assert.True(t, kd.useEndpointSlices)
+	assert.NotNil(t, kd.endpointsStore)
+	assert.NotNil(t, kd.endpointsController)
+
+	kd = NewKubeDNS(client, testDomain, 0, config.NewNopSync(config.NewDefaultConfig()))
+	assert.False(t, kd.useEndpointSlices)
+}
+
+func TestHeadlessServiceEndpointSlices(t *testing.T) {
+	kd := newKubeDNS()
+	kd.endpointSlices = make(map[string]map[string]*convertedEndpointSlice)
+	s := newHeadlessService()
+	require.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+	fqdn := getServiceFQDN(kd.domain, s)
+
+	recordIPs := func(name string) []string {
+		t.Helper()
+		records, err := kd.Records(name, false)
+		require.NoError(t, err)
+		ips := []string{}
+		for _, record := range records {
+			ips = append(ips, record.Host)
+		}
+		sort.Strings(ips)
+		return ips
+	}
+
+	sliceA := newEndpointSlice(s, "headless-a", newSliceEndpoint("10.0.0.1", "ep-0", true))
+	sliceB := newEndpointSlice(s, "headless-b",
+		newSliceEndpoint("10.0.0.2", "", true),
+		newSliceEndpoint("10.0.0.3", "", false))
+	kd.handleEndpointSliceAdd(sliceA)
+	kd.handleEndpointSliceAdd(sliceB)
+
+	// Not-ready endpoints are not served.
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, recordIPs(fqdn))
+	assert.Equal(t, []string{"10.0.0.1"}, recordIPs("ep-0."+fqdn))
+	records, err := kd.Records(getSRVFQDN(kd, s, "http"), false)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(records))
+	record, err := kd.ReverseRecord("1.0.0.10.in-addr.arpa.")
+	require.NoError(t, err)
+	assert.Equal(t, "ep-0."+fqdn, record.Host)
+
+	// An update of a slice leaves the records of the others in place.
+	updatedB := newEndpointSlice(s, "headless-b", newSliceEndpoint("10.0.0.4", "", true))
+	kd.handleEndpointSliceUpdate(sliceB, updatedB)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.4"}, recordIPs(fqdn))
+
+	kd.handleEndpointSliceDelete(sliceA)
+	assert.Equal(t, []string{"10.0.0.4"}, recordIPs(fqdn))
+	_, err = kd.ReverseRecord("1.0.0.10.in-addr.arpa.")
+	assert.Error(t, err)
+
+	// Slices without service or of FQDNs are ignored.
+	orphan := newEndpointSlice(s, "orphan", newSliceEndpoint("10.0.0.5", "", true))
+	orphan.Labels = nil
+	kd.handleEndpointSliceAdd(orphan)
+	fqdns := newEndpointSlice(s, "headless-fqdn", newSliceEndpoint("db.example.com", "", true))
+	fqdns.AddressType = discovery.AddressTypeFQDN
+	kd.handleEndpointSliceAdd(fqdns)
+	assert.Equal(t, []string{"10.0.0.4"}, recordIPs(fqdn))
+
+	kd.handleEndpointSliceDelete(updatedB)
+	kd.handleEndpointSliceDelete(fqdns)
+	_, exists, err := kd.endpointsStore.GetByKey(s.Namespace + "/" + s.Name)
+	require.NoError(t, err)
+	assert.False(t, exists)
+	assert.Empty(t, kd.endpointSlices)
+}
+
+func TestRecordsWithTopologyEndpointSlices(t *testing.T) {
+	kd := newKubeDNS()
+	kd.endpointSlices = make(map[string]map[string]*convertedEndpointSlice)
+	s := newHeadlessService()
+	require.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+
+	// The zone is taken from the slice, although the node is not known.
+	nodeName, zone := "node-1", "zone-a"
+	inZone := newSliceEndpoint("10.0.0.1", "", true)
+	inZone.NodeName = &nodeName
+	inZone.Zone = &zone
+	kd.handleEndpointSliceAdd(newEndpointSlice(s, "headless-a", inZone, newSliceEndpoint("10.0.0.2", "", true)))
+
+	records, err := kd.RecordsWithTopology(getServiceFQDN(kd.domain, s), false)
+	require.NoError(t, err)
+	topologies := map[string]*EndpointTopology{}
+	for _, record := range records {
+		topologies[record.Host] = record.Topology
+	}
+	assert.Equal(t, map[string]*EndpointTopology{
+		"10.0.0.1": {NodeName: "node-1", Zone: "zone-a"},
+		"10.0.0.2": {},
+	}, topologies)
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// RecordGenerationFailedReason is the reason of the Warning events
+	// emitted on the services whose records can't be generated.
+	RecordGenerationFailedReason = "FailedToGenerateDNSRecords"
+
+	// minEventInterval is the minimum interval between two events of the
+	// same reason emitted on the same service, so that a service failing
+	// repeatedly, e.g. on every resync, doesn't flood the API server.
+	minEventInterval = 5 * time.Minute
+)
+
+// eventKey identifies the events of a reason emitted on a service.
+type eventKey struct {
+	namespace, name, reason string
+}
+
+// WithEventRecorder makes KubeDNS emit a Warning event on the services whose
+// records can't be generated, in addition to logging the error, so that it
+// is visible to cluster operators.
+func WithEventRecorder(recorder record.EventRecorder) Option {
+	return func(kd *KubeDNS) {
+		kd.eventRecorder = recorder
+	}
+}
+
+// recordGenerationFailed emits a Warning event on the given service for the
+// error of the generation of its records, unless one was emitted less than
+// minEventInterval ago.
+func (kd *KubeDNS) recordGenerationFailed(service *v1.Service, err error) {
+	key := eventKey{service.Namespace, service.Name, RecordGenerationFailedReason}
+	now := kd.clock.Now()
+
+	kd.eventLock.Lock()
+	if last, ok := kd.lastEvents[key]; ok && now.Sub(last) < minEventInterval {
+		kd.eventLock.Unlock()
+		return
+	}
+	for k, last := range kd.lastEvents {
+		if now.Sub(last) >= minEventInterval {
+			delete(kd.lastEvents, k)
+		}
+	}
+	kd.lastEvents[key] = now
+	kd.eventLock.Unlock()
+
+	kd.eventRecorder.Eventf(service, v1.EventTypeWarning, RecordGenerationFailedReason,
+		"Error generating DNS records: %v", err)
+}
+
+// nopEventRecorder is a record.EventRecorder discarding the events.
+type nopEventRecorder struct{}
+
+func (nopEventRecorder) Event(runtime.Object, string, string, string) {}
+
+func (nopEventRecorder) Eventf(runtime.Object, string, string, string, ...interface{}) {}
+
+func (nopEventRecorder) AnnotatedEventf(runtime.Object, map[string]string, string, string, string, ...interface{}) {
+}
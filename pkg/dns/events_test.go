@@ -0,0 +1,62 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestRecordGenerationFailedEvent(t *testing.T) {
+	kd := newKubeDNS()
+	recorder := record.NewFakeRecorder(10)
+	WithEventRecorder(recorder)(kd)
+	fakeClock := clock.NewFakeClock(time.Now())
+	kd.clock = fakeClock
+	kd.endpointsStore = &failingStore{Store: kd.endpointsStore, failures: 10}
+
+	s := newHeadlessService()
+	kd.newService(s)
+	select {
+	case event := <-recorder.Events:
+		assert.Contains(t, event, "Warning "+RecordGenerationFailedReason)
+		assert.Contains(t, event, "transient error")
+	default:
+		t.Fatal("Expected an event")
+	}
+
+	// The events of a failing service are rate limited.
+	kd.newService(s)
+	fakeClock.Step(minEventInterval - time.Second)
+	kd.newService(s)
+	assert.Empty(t, recorder.Events)
+
+	// Other services are not.
+	other := newHeadlessService()
+	other.Name = "other"
+	kd.newService(other)
+	assert.Len(t, recorder.Events, 1)
+	<-recorder.Events
+
+	fakeClock.Step(time.Second)
+	kd.newService(s)
+	assert.Len(t, recorder.Events, 1)
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/dns/pkg/dns/util"
+	"k8s.io/klog/v2"
+)
+
+// ExternalServiceSpec describes a service whose records are injected by an
+// external controller rather than generated from a core v1 Service, e.g. a
+// service-like custom resource.
+type ExternalServiceSpec struct {
+	Namespace string
+	Name      string
+	// Type is either ClusterIP, the default, or ExternalName.
+	Type v1.ServiceType
+	// IPs are the cluster IPs of a ClusterIP service, or the endpoint
+	// addresses of a headless one.
+	IPs []string
+	// Headless is true if the service has no cluster IP.
+	Headless bool
+	Ports    []v1.ServicePort
+	// ExternalName is the target of an ExternalName service.
+	ExternalName string
+}
+
+// Key returns the namespace/name key of the service.
+func (spec *ExternalServiceSpec) Key() string {
+	return spec.Namespace + "/" + spec.Name
+}
+
+func (spec *ExternalServiceSpec) validate() error {
+	if errs := validation.IsDNS1123Label(spec.Namespace); len(errs) != 0 {
+		return fmt.Errorf("invalid namespace %q: %s", spec.Namespace, strings.Join(errs, ", "))
+	}
+	if errs := validation.IsDNS1035Label(spec.Name); len(errs) != 0 {
+		return fmt.Errorf("invalid name %q: %s", spec.Name, strings.Join(errs, ", "))
+	}
+	switch spec.Type {
+	case "", v1.ServiceTypeClusterIP:
+		if !spec.Headless && len(spec.IPs) == 0 {
+			return fmt.Errorf("no cluster IP for service %s", spec.Key())
+		}
+		for _, ip := range spec.IPs {
+			if net.ParseIP(ip) == nil {
+				return fmt.Errorf("invalid IP %q for service %s", ip, spec.Key())
+			}
+		}
+	case v1.ServiceTypeExternalName:
+		if errs := validation.IsDNS1123Subdomain(spec.ExternalName); len(errs) != 0 {
+			return fmt.Errorf("invalid external name %q: %s", spec.ExternalName, strings.Join(errs, ", "))
+		}
+	default:
+		return fmt.Errorf("unsupported type %q for service %s", spec.Type, spec.Key())
+	}
+	return nil
+}
+
+// service returns the Service the records of the spec are generated from,
+// along with the Endpoints of a headless service.
+func (spec *ExternalServiceSpec) service() (*v1.Service, *v1.Endpoints) {
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: spec.Namespace, Name: spec.Name},
+		Spec: v1.ServiceSpec{
+			Type:         spec.Type,
+			Ports:        spec.Ports,
+			ExternalName: spec.ExternalName,
+		},
+	}
+	switch {
+	case spec.Type == v1.ServiceTypeExternalName:
+		return service, nil
+	case !spec.Headless:
+		service.Spec.ClusterIP = spec.IPs[0]
+		service.Spec.ClusterIPs = spec.IPs
+		return service, nil
+	}
+
+	service.Spec.ClusterIP = v1.ClusterIPNone
+	subset := v1.EndpointSubset{}
+	for _, ip := range spec.IPs {
+		subset.Addresses = append(subset.Addresses, v1.EndpointAddress{IP: ip})
+	}
+	for _, port := range spec.Ports {
+		subset.Ports = append(subset.Ports, v1.EndpointPort{Name: port.Name, Port: port.Port, Protocol: port.Protocol})
+	}
+	endpoints := &v1.Endpoints{ObjectMeta: service.ObjectMeta, Subsets: []v1.EndpointSubset{subset}}
+	return service, endpoints
+}
+
+// UpsertExternalService generates the records of the given service, or
+// replaces them if the service was already injected. The records are
+// generated as for a core v1 Service of the same shape. A service cannot be
+// injected under the name of a Service synced from the apiserver.
+func (kd *KubeDNS) UpsertExternalService(spec ExternalServiceSpec) error {
+	if err := spec.validate(); err != nil {
+		return err
+	}
+	key := spec.Key()
+	_, exists, err := kd.servicesStore.GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("service %s is already defined by a Service object", key)
+	}
+	service, _ := spec.service()
+
+	kd.externalServicesLock.Lock()
+	defer kd.externalServicesLock.Unlock()
+	previous, exists := kd.externalServices[key]
+	var previousService *v1.Service
+	if exists {
+		previousService, _ = previous.service()
+		// Records of different shapes can't be updated in place.
+		if previousService.Spec.Type != service.Spec.Type || previous.Headless != spec.Headless {
+			kd.removeService(previousService)
+		}
+	}
+	if err := kd.generateExternalServiceRecords(&spec); err != nil {
+		return err
+	}
+	if exists {
+		kd.removeStaleClusterIPs(previousService, service)
+	}
+	kd.externalServices[key] = spec
+	klog.V(3).Infof("Upserted external service %s", key)
+	return nil
+}
+
+// generateExternalServiceRecords generates the records of the given
+// external service.
+func (kd *KubeDNS) generateExternalServiceRecords(spec *ExternalServiceSpec) error {
+	service, endpoints := spec.service()
+	if endpoints != nil {
+		return kd.generateRecordsForHeadlessService(endpoints, service)
+	}
+	kd.newService(service)
+	return nil
+}
+
+// DeleteExternalService removes the records of the service with the given
+// namespace/name key injected with UpsertExternalService.
+func (kd *KubeDNS) DeleteExternalService(key string) error {
+	kd.externalServicesLock.Lock()
+	defer kd.externalServicesLock.Unlock()
+	spec, ok := kd.externalServices[key]
+	if !ok {
+		return fmt.Errorf("no external service %s", key)
+	}
+	service, _ := spec.service()
+	kd.removeService(service)
+	delete(kd.externalServices, key)
+	klog.V(3).Infof("Deleted external service %s", key)
+	return nil
+}
+
+// removeStaleClusterIPs removes the reverse records of the cluster IPs of
+// previous that next doesn't have anymore, unless another service owns them
+// by now.
+func (kd *KubeDNS) removeStaleClusterIPs(previous, next *v1.Service) {
+	if !util.IsServiceIPSet(previous) {
+		return
+	}
+	current := map[string]bool{}
+	if util.IsServiceIPSet(next) {
+		for _, ip := range util.GetClusterIPs(next) {
+			current[ip] = true
+		}
+	}
+	kd.cacheLock.Lock()
+	defer kd.cacheLock.Unlock()
+	changed := false
+	for _, ip := range util.GetClusterIPs(previous) {
+		if current[ip] {
+			continue
+		}
+		if owner, ok := kd.clusterIPServiceMap[ip]; ok && (owner.Namespace != previous.Namespace || owner.Name != previous.Name) {
+			continue
+		}
+		changed = kd.releaseClusterIP(ip) || changed
+	}
+	if changed {
+		kd.recordsChanged(previous.Namespace, previous.Name)
+	}
+}
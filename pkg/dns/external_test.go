@@ -0,0 +1,115 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestUpsertExternalService(t *testing.T) {
+	kd := newKubeDNS()
+	name := "crd." + testNamespace + ".svc." + testDomain
+	ports := []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}}
+
+	require.NoError(t, kd.UpsertExternalService(ExternalServiceSpec{
+		Namespace: testNamespace,
+		Name:      "crd",
+		IPs:       []string{"1.2.3.4"},
+		Ports:     ports,
+	}))
+	verifyRecord(t, "ClusterIP", name, "1.2.3.4", kd)
+	verifyRecord(t, "SRV", "_http._tcp."+name, name, kd)
+	record, err := kd.ReverseRecord("4.3.2.1.in-addr.arpa.")
+	require.NoError(t, err)
+	assert.Equal(t, name, record.Host)
+
+	// Updating the IPs removes the reverse records of the old ones.
+	require.NoError(t, kd.UpsertExternalService(ExternalServiceSpec{
+		Namespace: testNamespace,
+		Name:      "crd",
+		IPs:       []string{"1.2.3.5"},
+		Ports:     ports,
+	}))
+	verifyRecord(t, "updated ClusterIP", name, "1.2.3.5", kd)
+	_, err = kd.ReverseRecord("4.3.2.1.in-addr.arpa.")
+	assert.Error(t, err)
+
+	require.NoError(t, kd.UpsertExternalService(ExternalServiceSpec{
+		Namespace: testNamespace,
+		Name:      "crd",
+		IPs:       []string{"10.0.0.1", "10.0.0.2"},
+		Headless:  true,
+		Ports:     ports,
+	}))
+	records, err := kd.Records(name, false)
+	require.NoError(t, err)
+	hosts := sets.NewString()
+	for _, record := range records {
+		hosts.Insert(record.Host)
+	}
+	assert.Equal(t, sets.NewString("10.0.0.1", "10.0.0.2"), hosts)
+	records, err = kd.Records("_http._tcp."+name, false)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(records))
+	_, err = kd.ReverseRecord("5.3.2.1.in-addr.arpa.")
+	assert.Error(t, err)
+
+	require.NoError(t, kd.UpsertExternalService(ExternalServiceSpec{
+		Namespace:    testNamespace,
+		Name:         "crd",
+		Type:         v1.ServiceTypeExternalName,
+		ExternalName: testExternalName,
+	}))
+	verifyRecord(t, "ExternalName", name, testExternalName, kd)
+
+	require.NoError(t, kd.DeleteExternalService(testNamespace+"/crd"))
+	_, err = kd.Records(name, false)
+	assert.Error(t, err)
+	assert.Error(t, kd.DeleteExternalService(testNamespace+"/crd"))
+}
+
+func TestUpsertExternalServiceErrors(t *testing.T) {
+	kd := newKubeDNS()
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	assert.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+
+	for _, tc := range []struct {
+		name string
+		spec ExternalServiceSpec
+	}{
+		{name: "existing Service", spec: ExternalServiceSpec{Namespace: testNamespace, Name: testService, IPs: []string{"1.2.3.5"}}},
+		{name: "invalid name", spec: ExternalServiceSpec{Namespace: testNamespace, Name: "Invalid_Name", IPs: []string{"1.2.3.5"}}},
+		{name: "invalid IP", spec: ExternalServiceSpec{Namespace: testNamespace, Name: "crd", IPs: []string{"1.2.3"}}},
+		{name: "no IP", spec: ExternalServiceSpec{Namespace: testNamespace, Name: "crd"}},
+		{name: "unsupported type", spec: ExternalServiceSpec{Namespace: testNamespace, Name: "crd", Type: v1.ServiceTypeNodePort, IPs: []string{"1.2.3.5"}}},
+		{name: "invalid external name", spec: ExternalServiceSpec{Namespace: testNamespace, Name: "crd", Type: v1.ServiceTypeExternalName}},
+	} {
+		assert.Error(t, kd.UpsertExternalService(tc.spec), tc.name)
+	}
+	verifyRecord(t, "Service", getServiceFQDN(kd.domain, s), "1.2.3.4", kd)
+
+	// Errors of the services store are returned as is.
+	kd.servicesStore = &failingStore{Store: kd.servicesStore, failures: 1}
+	err := kd.UpsertExternalService(ExternalServiceSpec{Namespace: testNamespace, Name: "crd", IPs: []string{"1.2.3.5"}})
+	assert.EqualError(t, err, "transient error")
+}
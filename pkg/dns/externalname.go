@@ -0,0 +1,297 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	skymsg "github.com/skynetservices/skydns/msg"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	kcache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"k8s.io/dns/pkg/dns/util"
+)
+
+const (
+	// externalNameResolveTimeout bounds the resolution of the target of an
+	// ExternalName service outside the cluster domain.
+	externalNameResolveTimeout = 5 * time.Second
+
+	// Number of times the resolution of the target of an ExternalName
+	// service is retried before its reverse records are removed.
+	maxExternalNameRetries = 5
+)
+
+// updateExternalNameReverseRecords queues the given ExternalName service
+// for the resolution of its target, if the configuration enables reverse
+// records for ExternalName services. Services are queued every time they
+// are updated, including on resyncs, which is how changes of the IPs of
+// the target are picked up.
+func (kd *KubeDNS) updateExternalNameReverseRecords(service *v1.Service) {
+	if !kd.currentConfig().ExternalNameReverseRecords {
+		return
+	}
+	kd.externalNameQueue.Add(service.Namespace + "/" + service.Name)
+}
+
+// resetExternalNameReverseRecords queues every ExternalName service for
+// the resolution of its target if the configuration enables reverse records
+// for ExternalName services, and removes all of their reverse records
+// otherwise.
+func (kd *KubeDNS) resetExternalNameReverseRecords() {
+	if kd.currentConfig().ExternalNameReverseRecords {
+		for _, obj := range kd.servicesStore.List() {
+			if service, ok := assertIsService(obj); ok && service.Spec.Type == v1.ServiceTypeExternalName {
+				kd.updateExternalNameReverseRecords(service)
+			}
+		}
+		return
+	}
+	kd.cacheLock.Lock()
+	defer kd.cacheLock.Unlock()
+	for ip, key := range kd.externalNameReverseIPs {
+		delete(kd.externalNameReverseIPs, ip)
+		namespace, name, _ := kcache.SplitMetaNamespaceKey(key)
+		fqdn := kd.fqdn(&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}})
+		if record, ok := kd.reverseRecordMap[ip]; ok && record.Host == fqdn {
+			delete(kd.reverseRecordMap, ip)
+			kd.recordsChanged(namespace, name)
+		}
+	}
+}
+
+// runExternalNameWorker resolves the targets of the queued ExternalName
+// services until the queue is shut down.
+func (kd *KubeDNS) runExternalNameWorker() {
+	for kd.processNextExternalName() {
+	}
+}
+
+// processNextExternalName resolves the target of the next queued
+// ExternalName service and updates its reverse records, and returns false
+// if the queue was shut down. Failed resolutions are retried before the
+// reverse records of the service are removed.
+func (kd *KubeDNS) processNextExternalName() bool {
+	item, shutdown := kd.externalNameQueue.Get()
+	if shutdown {
+		return false
+	}
+	defer kd.externalNameQueue.Done(item)
+
+	key := item.(string)
+	obj, exists, err := kd.servicesStore.GetByKey(key)
+	if err != nil || !exists {
+		kd.externalNameQueue.Forget(item)
+		return true
+	}
+	service, ok := assertIsService(obj)
+	if !ok || service.Spec.Type != v1.ServiceTypeExternalName {
+		kd.externalNameQueue.Forget(item)
+		return true
+	}
+	ips, err := kd.resolveExternalName(service.Namespace, service.Spec.ExternalName)
+	if err != nil {
+		if kd.externalNameQueue.NumRequeues(item) < maxExternalNameRetries {
+			klog.V(3).Infof("Could not resolve the target of ExternalName service %s, will retry: %v", key, err)
+			kd.externalNameQueue.AddRateLimited(item)
+			return true
+		}
+		klog.V(3).Infof("Could not resolve the target of ExternalName service %s, giving up: %v", key, err)
+	}
+	kd.externalNameQueue.Forget(item)
+	kd.setExternalNameReverseRecords(service, ips)
+	return true
+}
+
+// setExternalNameReverseRecords registers reverse records pointing to the
+// given ExternalName service for the given IPs its target resolves to, and
+// removes the ones registered for IPs the target no longer resolves to.
+// Nothing is changed if the service was updated or removed since its
+// target was resolved, or if the configuration no longer enables it. IPs
+// that already have a reverse record, e.g. cluster IPs, are left untouched.
+func (kd *KubeDNS) setExternalNameReverseRecords(service *v1.Service, ips []string) {
+	key := service.Namespace + "/" + service.Name
+	fqdn := kd.fqdn(service)
+	reverseRecord, _ := util.GetSkyMsg(fqdn, 0)
+
+	kd.cacheLock.Lock()
+	defer kd.cacheLock.Unlock()
+	if !kd.currentConfig().ExternalNameReverseRecords {
+		return
+	}
+	if obj, exists, err := kd.servicesStore.GetByKey(key); err != nil || !exists {
+		return
+	} else if current, ok := assertIsService(obj); !ok ||
+		current.Spec.Type != v1.ServiceTypeExternalName ||
+		current.Spec.ExternalName != service.Spec.ExternalName {
+		return
+	}
+	changed := kd.removeExternalNameReverseRecords(service, ips...)
+	for _, ip := range ips {
+		if record, ok := kd.reverseRecordMap[ip]; ok && record.Host != fqdn {
+			klog.V(4).Infof("Not registering a reverse record of %s for %q, it already has one", key, ip)
+			continue
+		}
+		changed = kd.setReverseRecord(ip, reverseRecord) || changed
+		kd.externalNameReverseIPs[ip] = key
+	}
+	if changed {
+		kd.recordsChanged(service.Namespace, service.Name)
+	}
+}
+
+// removeExternalNameReverseRecords removes the reverse records registered
+// for the given ExternalName service, except the ones of the IPs to keep,
+// and returns whether any was removed.
+// Important: Assumes that we already have the cacheLock.
+func (kd *KubeDNS) removeExternalNameReverseRecords(service *v1.Service, keep ...string) bool {
+	key := service.Namespace + "/" + service.Name
+	fqdn := kd.fqdn(service)
+	kept := map[string]bool{}
+	for _, ip := range keep {
+		kept[ip] = true
+	}
+	removed := false
+	for ip, owner := range kd.externalNameReverseIPs {
+		if owner != key || kept[ip] {
+			continue
+		}
+		delete(kd.externalNameReverseIPs, ip)
+		// The IP may have been assigned to a service since.
+		if record, ok := kd.reverseRecordMap[ip]; ok && record.Host == fqdn {
+			delete(kd.reverseRecordMap, ip)
+			removed = true
+		}
+	}
+	return removed
+}
+
+// resolveExternalName returns the IPs the given ExternalName target of a
+// service of the given namespace resolves to: from the cache for names in
+// the cluster domain, with the upstream nameservers of the namespace if the
+// configuration sets some, and with the resolver of kube-dns otherwise.
+func (kd *KubeDNS) resolveExternalName(namespace, target string) ([]string, error) {
+	if ip := net.ParseIP(target); ip != nil {
+		return []string{ip.String()}, nil
+	}
+	name := strings.ToLower(dns.Fqdn(target))
+	if strings.HasSuffix(name, "."+dns.Fqdn(kd.domain)) {
+		// Other ExternalName targets are not followed, so that cycles
+		// can't loop.
+		path := util.ReverseArray(strings.Split(strings.TrimSuffix(name, "."), "."))
+		records, err := kd.getRecordsForPath(path, false)
+		if err != nil {
+			return nil, err
+		}
+		ips := []string{}
+		for _, record := range records {
+			if record.Port == 0 && net.ParseIP(record.Host) != nil {
+				ips = append(ips, record.Host)
+			}
+		}
+		return ips, nil
+	}
+
+	lookupHost := kd.lookupHost
+	if nameServers := kd.currentConfig().NamespaceUpstreamNameservers[namespace]; len(nameServers) > 0 {
+		lookupHost = upstreamResolver(nameServers).LookupHost
+	} else if lookupHost == nil {
+		lookupHost = net.DefaultResolver.LookupHost
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), externalNameResolveTimeout)
+	defer cancel()
+	return lookupHost(ctx, name)
+}
+
+// upstreamResolver returns a resolver sending its queries to the given
+// nameservers, which are validated by the configuration. Successive
+// attempts go to successive nameservers, so that an unresponsive one is
+// retried with the next.
+func upstreamResolver(nameServers []string) *net.Resolver {
+	addresses := make([]string, 0, len(nameServers))
+	for _, nameServer := range nameServers {
+		ip, port, err := util.ValidateNameserverIpAndPort(nameServer)
+		if err != nil {
+			klog.Errorf("Ignoring invalid upstream nameserver %q: %v", nameServer, err)
+			continue
+		}
+		addresses = append(addresses, net.JoinHostPort(ip, port))
+	}
+	var attempts uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			if len(addresses) == 0 {
+				return nil, errors.New("no valid upstream nameserver")
+			}
+			address := addresses[int(atomic.AddUint32(&attempts, 1)-1)%len(addresses)]
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// secondaryExternalNameTargets returns the records of the valid targets
+// listed in the ExternalNameTargetsAnnotation of the given ExternalName
+// service, in order of decreasing priority.
+func secondaryExternalNameTargets(service *v1.Service) []*skymsg.Service {
+	value, ok := service.Annotations[ExternalNameTargetsAnnotation]
+	if !ok {
+		return nil
+	}
+	var targets []*skymsg.Service
+	for _, target := range strings.Split(value, ",") {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			continue
+		}
+		if errs := validation.IsDNS1123Subdomain(strings.TrimSuffix(target, ".")); len(errs) > 0 {
+			klog.Warningf("Ignoring invalid target %q in the %s annotation of service %s/%s: %v",
+				target, ExternalNameTargetsAnnotation, service.Namespace, service.Name, errs)
+			continue
+		}
+		record, _ := util.GetSkyMsgWithTTL(target, 0, serviceTTL(service))
+		// The priority of the externalName is the default one, the lower
+		// the value the higher the priority.
+		record.Priority += len(targets) + 1
+		targets = append(targets, record)
+	}
+	return targets
+}
+
+// appendExternalNameTargets appends to the given records of path the
+// records of the secondary targets of the ExternalName service path is the
+// name of, if any.
+// Important: Assumes that we already have the cacheLock.
+func (kd *KubeDNS) appendExternalNameTargets(path []string, records []skymsg.Service) []skymsg.Service {
+	if len(path) != len(kd.domainPath)+3 || path[len(kd.domainPath)] != serviceSubdomain {
+		return records
+	}
+	for _, target := range kd.externalNameTargets[path[len(path)-2]+"/"+path[len(path)-1]] {
+		records = append(records, *target)
+	}
+	return records
+}
@@ -0,0 +1,274 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/dns/pkg/dns/config"
+)
+
+func TestExternalNameReverseRecords(t *testing.T) {
+	kd := newKubeDNS()
+	hosts := map[string][]string{"db.example.com.": {"203.0.113.10"}}
+	kd.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		if ips, ok := hosts[host]; ok {
+			return ips, nil
+		}
+		return nil, fmt.Errorf("no such host %q", host)
+	}
+
+	s := newExternalNameService()
+	s.Spec.ExternalName = "db.example.com"
+	assert.NoError(t, kd.servicesStore.Add(s))
+	fqdn := getServiceFQDN(kd.domain, s)
+
+	// Disabled by default: the target is not even resolved.
+	kd.newService(s)
+	assert.Equal(t, 0, kd.externalNameQueue.Len())
+	_, err := kd.ReverseRecord("10.113.0.203.in-addr.arpa.")
+	assert.Error(t, err)
+
+	// Enabling it resolves the targets of the known services.
+	kd.updateConfig(&config.Config{ExternalNameReverseRecords: true})
+	assert.True(t, kd.processNextExternalName())
+	record, err := kd.ReverseRecord("10.113.0.203.in-addr.arpa.")
+	require.NoError(t, err)
+	assert.Equal(t, fqdn, record.Host)
+
+	// The target now resolves to another IP.
+	hosts["db.example.com."] = []string{"203.0.113.11"}
+	kd.updateService(s, s)
+	assert.True(t, kd.processNextExternalName())
+	_, err = kd.ReverseRecord("10.113.0.203.in-addr.arpa.")
+	assert.Error(t, err)
+	record, err = kd.ReverseRecord("11.113.0.203.in-addr.arpa.")
+	require.NoError(t, err)
+	assert.Equal(t, fqdn, record.Host)
+
+	// Failed resolutions are retried before the records are removed.
+	delete(hosts, "db.example.com.")
+	kd.updateService(s, s)
+	for i := 0; i < maxExternalNameRetries; i++ {
+		assert.True(t, kd.processNextExternalName())
+		_, err = kd.ReverseRecord("11.113.0.203.in-addr.arpa.")
+		assert.NoError(t, err)
+	}
+	assert.True(t, kd.processNextExternalName())
+	_, err = kd.ReverseRecord("11.113.0.203.in-addr.arpa.")
+	assert.Error(t, err)
+
+	hosts["db.example.com."] = []string{"203.0.113.11"}
+	kd.updateService(s, s)
+	assert.True(t, kd.processNextExternalName())
+	_, err = kd.ReverseRecord("11.113.0.203.in-addr.arpa.")
+	assert.NoError(t, err)
+	kd.removeService(s)
+	_, err = kd.ReverseRecord("11.113.0.203.in-addr.arpa.")
+	assert.Error(t, err)
+
+	// Disabling it removes the records.
+	assert.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+	assert.True(t, kd.processNextExternalName())
+	_, err = kd.ReverseRecord("11.113.0.203.in-addr.arpa.")
+	assert.NoError(t, err)
+	kd.updateConfig(&config.Config{})
+	_, err = kd.ReverseRecord("11.113.0.203.in-addr.arpa.")
+	assert.Error(t, err)
+	assert.Empty(t, kd.externalNameReverseIPs)
+}
+
+func TestExternalNameReverseRecordsOfUpdatedService(t *testing.T) {
+	kd := newKubeDNS()
+	kd.config = &config.Config{ExternalNameReverseRecords: true}
+	kd.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		return []string{"203.0.113.10"}, nil
+	}
+
+	// The service is removed while its target is resolved.
+	s := newExternalNameService()
+	assert.NoError(t, kd.servicesStore.Add(s))
+	kd.setExternalNameReverseRecords(s, []string{"203.0.113.10"})
+	assert.NoError(t, kd.servicesStore.Delete(s))
+	kd.setExternalNameReverseRecords(s, []string{"203.0.113.11"})
+	_, err := kd.ReverseRecord("11.113.0.203.in-addr.arpa.")
+	assert.Error(t, err)
+
+	// The target of the service changes while it is resolved.
+	updated := newExternalNameService()
+	updated.Spec.ExternalName = "other.example.com"
+	assert.NoError(t, kd.servicesStore.Add(updated))
+	kd.setExternalNameReverseRecords(s, []string{"203.0.113.11"})
+	_, err = kd.ReverseRecord("11.113.0.203.in-addr.arpa.")
+	assert.Error(t, err)
+}
+
+func TestExternalNameReverseRecordsInCluster(t *testing.T) {
+	kd := newKubeDNS()
+	kd.config = &config.Config{ExternalNameReverseRecords: true}
+
+	headless := newHeadlessService()
+	headless.Name = "headless"
+	assert.NoError(t, kd.servicesStore.Add(headless))
+	assert.NoError(t, kd.endpointsStore.Add(newEndpoints(headless, newSubsetWithOnePort("http", 80, "10.0.0.1"))))
+	kd.newService(headless)
+	portal := newService(testNamespace, "portal", "1.2.3.4", "http", 80)
+	kd.newService(portal)
+
+	toHeadless := newExternalNameService()
+	toHeadless.Name = "to-headless"
+	toHeadless.Spec.ExternalName = "headless." + testNamespace + ".svc." + testDomain
+	assert.NoError(t, kd.servicesStore.Add(toHeadless))
+	kd.newService(toHeadless)
+	assert.True(t, kd.processNextExternalName())
+	record, err := kd.ReverseRecord("1.0.0.10.in-addr.arpa.")
+	require.NoError(t, err)
+	assert.Equal(t, getServiceFQDN(kd.domain, toHeadless), record.Host)
+
+	// Existing reverse records are not overridden.
+	toPortal := newExternalNameService()
+	toPortal.Name = "to-portal"
+	toPortal.Spec.ExternalName = "portal." + testNamespace + ".svc." + testDomain
+	assert.NoError(t, kd.servicesStore.Add(toPortal))
+	kd.newService(toPortal)
+	assert.True(t, kd.processNextExternalName())
+	assertReverseRecord(t, "cluster IP", kd, portal)
+	kd.removeService(toPortal)
+	assertReverseRecord(t, "cluster IP", kd, portal)
+}
+
+func TestExternalNameReverseRecordsInClusterDomainWithoutDot(t *testing.T) {
+	kd := newKubeDNS()
+	kd.domain = strings.TrimSuffix(testDomain, ".")
+	kd.config = &config.Config{ExternalNameReverseRecords: true}
+	kd.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		return nil, fmt.Errorf("no such host %q", host)
+	}
+
+	headless := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(headless))
+	assert.NoError(t, kd.endpointsStore.Add(newEndpoints(headless, newSubsetWithOnePort("http", 80, "10.0.0.1"))))
+	kd.newService(headless)
+
+	// The target is resolved from the cache rather than upstream.
+	s := newExternalNameService()
+	s.Name = "to-headless"
+	s.Spec.ExternalName = testService + "." + testNamespace + ".svc." + testDomain
+	assert.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+	assert.True(t, kd.processNextExternalName())
+	record, err := kd.ReverseRecord("1.0.0.10.in-addr.arpa.")
+	require.NoError(t, err)
+	assert.Equal(t, "to-headless."+testNamespace+".svc."+testDomain, record.Host)
+}
+
+func TestExternalNameSecondaryTargets(t *testing.T) {
+	kd := newKubeDNS()
+	s := newExternalNameService()
+	s.Annotations = map[string]string{
+		ExternalNameTargetsAnnotation: "secondary.example.com, not_valid, tertiary.example.com.",
+	}
+	assert.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+	fqdn := getServiceFQDN(kd.domain, s)
+
+	for _, exact := range []bool{true, false} {
+		records, err := kd.Records(fqdn, exact)
+		require.NoError(t, err)
+		hosts := []string{}
+		priorities := []int{}
+		for _, record := range records {
+			hosts = append(hosts, record.Host)
+			priorities = append(priorities, record.Priority)
+		}
+		assert.Equal(t, []string{testExternalName, "secondary.example.com", "tertiary.example.com."}, hosts)
+		assert.Equal(t, []int{10, 11, 12}, priorities)
+	}
+
+	// Removing the annotation removes the secondary targets.
+	s.Annotations = nil
+	kd.updateService(s, s)
+	assertDNSForExternalService(t, kd, s)
+
+	s.Annotations = map[string]string{ExternalNameTargetsAnnotation: "secondary.example.com"}
+	kd.updateService(s, s)
+	kd.removeService(s)
+	assert.Empty(t, kd.externalNameTargets)
+}
+
+func TestExternalNameNamespaceUpstreamNameservers(t *testing.T) {
+	// The upstream of the tenant answers its own IP for every name.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			if req.Question[0].Qtype == dns.TypeA {
+				resp.Answer = append(resp.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30},
+					A:   net.ParseIP("203.0.113.20"),
+				})
+			}
+			w.WriteMsg(resp)
+		}),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	<-started
+
+	kd := newKubeDNS()
+	kd.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		return []string{"203.0.113.10"}, nil
+	}
+	kd.config = &config.Config{
+		ExternalNameReverseRecords:   true,
+		NamespaceUpstreamNameservers: map[string][]string{"tenant": {pc.LocalAddr().String()}},
+	}
+
+	tenant := newExternalNameService()
+	tenant.Namespace = "tenant"
+	tenant.Spec.ExternalName = "db.example.com"
+	assert.NoError(t, kd.servicesStore.Add(tenant))
+	kd.newService(tenant)
+	assert.True(t, kd.processNextExternalName())
+	record, err := kd.ReverseRecord("20.113.0.203.in-addr.arpa.")
+	require.NoError(t, err)
+	assert.Equal(t, getServiceFQDN(kd.domain, tenant), record.Host)
+
+	// Other namespaces use the resolver of kube-dns.
+	s := newExternalNameService()
+	s.Spec.ExternalName = "db.example.com"
+	assert.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+	assert.True(t, kd.processNextExternalName())
+	record, err = kd.ReverseRecord("10.113.0.203.in-addr.arpa.")
+	require.NoError(t, err)
+	assert.Equal(t, getServiceFQDN(kd.domain, s), record.Host)
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"strings"
+
+	skymsg "github.com/skynetservices/skydns/msg"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+
+	"k8s.io/dns/pkg/dns/treecache"
+	"k8s.io/dns/pkg/dns/util"
+)
+
+// ExtraRecord is a record added under the name of a service by a
+// ServiceRecordHook, e.g. a TXT record with the identity of the service in
+// a service mesh.
+type ExtraRecord struct {
+	// Label is the label the record is served under below the name of the
+	// service, e.g. "_mesh" for _mesh.mysvc.myns.svc.cluster.local. It
+	// starts with "_", so that the record doesn't answer for the name of
+	// the service nor collide with the names of its endpoints, and cannot
+	// be the label of the SRV records of a protocol, e.g. "_tcp".
+	Label string
+	// Record is the record, e.g. with Text set for a TXT record. If its
+	// TTL is 0, it is served with the TTL of the service.
+	Record skymsg.Service
+}
+
+// ServiceRecordHook returns the extra records of the given service.
+type ServiceRecordHook func(service *v1.Service) []ExtraRecord
+
+// WithServiceRecordHook makes KubeDNS add the records returned by hook for
+// each ClusterIP and headless service under the name of the service, so
+// that e.g. a service mesh can serve metadata derived from the annotations
+// of the services.
+func WithServiceRecordHook(hook ServiceRecordHook) Option {
+	return func(kd *KubeDNS) {
+		kd.serviceRecordHook = hook
+	}
+}
+
+// addExtraRecords adds to the given subcache of a service the records
+// returned by the ServiceRecordHook for it, if any. Records with an invalid
+// label are skipped.
+func (kd *KubeDNS) addExtraRecords(subCache treecache.TreeCache, service *v1.Service) {
+	if kd.serviceRecordHook == nil {
+		return
+	}
+	for _, extra := range kd.serviceRecordHook(service) {
+		if !isExtraRecordLabel(extra.Label) {
+			klog.Errorf("Skipping extra record %v of service %s/%s with invalid label %q",
+				extra.Record, service.Namespace, service.Name, extra.Label)
+			continue
+		}
+		record := extra.Record
+		if record.Ttl == 0 {
+			record.Ttl = serviceTTL(service)
+		}
+		recordLabel := kd.recordLabel(&record, util.HashServiceRecord(&record))
+		subCache.SetEntry(recordLabel, &record, kd.fqdn(service, extra.Label, recordLabel), extra.Label)
+	}
+}
+
+// isExtraRecordLabel returns whether the given label is a valid Label of
+// an ExtraRecord.
+func isExtraRecordLabel(label string) bool {
+	name := strings.TrimPrefix(label, "_")
+	if name == label || len(validation.IsDNS1123Label(name)) != 0 {
+		return false
+	}
+	return !isSRVProtocol(v1.Protocol(strings.ToUpper(name)))
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+
+	skymsg "github.com/skynetservices/skydns/msg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+)
+
+const meshIdentityAnnotation = "mesh.example.com/identity"
+
+func TestServiceRecordHook(t *testing.T) {
+	kd := newKubeDNS()
+	WithServiceRecordHook(func(service *v1.Service) []ExtraRecord {
+		identity, ok := service.Annotations[meshIdentityAnnotation]
+		if !ok {
+			return nil
+		}
+		return []ExtraRecord{
+			{Label: "_mesh", Record: skymsg.Service{Text: identity}},
+			// Invalid labels are skipped.
+			{Label: "mesh", Record: skymsg.Service{Text: identity}},
+			{Label: "_tcp", Record: skymsg.Service{Text: identity}},
+		}
+	})(kd)
+
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	s.Annotations = map[string]string{meshIdentityAnnotation: "spiffe://cluster.local/ns/default/sa/testservice"}
+	kd.newService(s)
+	headless := newHeadlessService()
+	headless.Name = "headless"
+	headless.Annotations = map[string]string{meshIdentityAnnotation: "spiffe://cluster.local/ns/default/sa/headless"}
+	assert.NoError(t, kd.servicesStore.Add(headless))
+	assert.NoError(t, kd.endpointsStore.Add(newEndpoints(headless, newSubsetWithOnePort("http", 80, "10.0.0.1"))))
+	kd.newService(headless)
+
+	for _, tc := range []struct {
+		service  *v1.Service
+		identity string
+		hosts    []string
+	}{
+		{service: s, identity: "spiffe://cluster.local/ns/default/sa/testservice", hosts: []string{"1.2.3.4"}},
+		{service: headless, identity: "spiffe://cluster.local/ns/default/sa/headless", hosts: []string{"10.0.0.1"}},
+	} {
+		name := getServiceFQDN(kd.domain, tc.service)
+		records, err := kd.Records("_mesh."+name, false)
+		require.NoError(t, err, tc.service.Name)
+		require.Len(t, records, 1, tc.service.Name)
+		assert.Equal(t, tc.identity, records[0].Text, tc.service.Name)
+		assert.Equal(t, uint32(30), records[0].Ttl, tc.service.Name)
+
+		// The records of the service name are left alone.
+		records, err = kd.Records(name, false)
+		require.NoError(t, err, tc.service.Name)
+		hosts := []string{}
+		for _, record := range records {
+			hosts = append(hosts, record.Host)
+		}
+		assert.Equal(t, tc.hosts, hosts, tc.service.Name)
+		_, err = kd.Records("mesh."+name, false)
+		assert.Error(t, err, tc.service.Name)
+	}
+
+	// The SRV records are left alone.
+	records, err := kd.Records(getSRVFQDN(kd, s, "http"), false)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, 80, records[0].Port)
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var federationFallbacksShedDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(metricsNamespace, "", "federation_fallbacks_shed_total"),
+	"Number of federation queries answered with a not-found because too many "+
+		"federation redirects were being computed at once.",
+	nil, nil)
+
+// concurrencyLimiter is a semaphore that doesn't block: requests beyond the
+// limit are shed. The limit is given at each request so that it can change
+// with the configuration. The zero value is a limiter with no request in
+// flight.
+type concurrencyLimiter struct {
+	// inFlight is the number of requests in flight. Access to this is
+	// atomic.
+	inFlight int64
+	// shed is the number of requests shed. Access to this is atomic.
+	shed uint64
+}
+
+// acquire returns whether a request may proceed while fewer than limit
+// requests are in flight, or whatever the number in flight if limit is 0.
+// A request allowed to proceed must call release once done.
+func (l *concurrencyLimiter) acquire(limit int) bool {
+	if inFlight := atomic.AddInt64(&l.inFlight, 1); limit > 0 && inFlight > int64(limit) {
+		atomic.AddInt64(&l.inFlight, -1)
+		atomic.AddUint64(&l.shed, 1)
+		return false
+	}
+	return true
+}
+
+// release records the end of a request allowed by acquire.
+func (l *concurrencyLimiter) release() {
+	atomic.AddInt64(&l.inFlight, -1)
+}
+
+type federationFallbackCollector struct {
+	kd *KubeDNS
+}
+
+// FederationFallbackCollector returns a prometheus.Collector exporting the
+// number of federation queries shed by the maxConcurrentFederationFallbacks
+// limit of the configuration.
+func (kd *KubeDNS) FederationFallbackCollector() prometheus.Collector {
+	return &federationFallbackCollector{kd: kd}
+}
+
+func (c *federationFallbackCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- federationFallbacksShedDesc
+}
+
+func (c *federationFallbackCollector) Collect(ch chan<- prometheus.Metric) {
+	shed := atomic.LoadUint64(&c.kd.federationFallbacks.shed)
+	ch <- prometheus.MustNewConstMetric(federationFallbacksShedDesc, prometheus.CounterValue, float64(shed))
+}
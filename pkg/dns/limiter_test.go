@@ -0,0 +1,97 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+)
+
+func TestFederationFallbackLimit(t *testing.T) {
+	const limit = 2
+	kd := newKubeDNS()
+	kd.config.Federations = map[string]string{"myfederation": "example.com"}
+	kd.config.MaxConcurrentFederationFallbacks = limit
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(kd.FederationFallbackCollector()))
+
+	// Listing the nodes blocks until unblocked, so that the fallbacks
+	// started pile up.
+	client := fake.NewSimpleClientset(newNodes())
+	unblock := make(chan struct{})
+	client.PrependReactor("list", "nodes", func(action core.Action) (bool, runtime.Object, error) {
+		<-unblock
+		return false, nil, nil
+	})
+	kd.kubeClient = client
+
+	name := "testservice.default.myfederation.svc.cluster.local."
+	var wg sync.WaitGroup
+	for i := 0; i < limit; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			records, err := kd.Records(name, false)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, len(records))
+		}()
+	}
+	require.NoError(t, wait.PollImmediate(time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return atomic.LoadInt64(&kd.federationFallbacks.inFlight) == limit, nil
+	}))
+
+	// The limit is reached: further fallbacks are shed.
+	_, err := kd.Records(name, false)
+	require.Error(t, err)
+	assert.Equal(t, etcd.ErrorCodeKeyNotFound, err.(etcd.Error).Code)
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(families))
+	assert.Equal(t, "kubedns_federation_fallbacks_shed_total", families[0].GetName())
+	assert.Equal(t, 1.0, families[0].GetMetric()[0].GetCounter().GetValue())
+
+	close(unblock)
+	wg.Wait()
+	assert.Equal(t, int64(0), atomic.LoadInt64(&kd.federationFallbacks.inFlight))
+
+	// Fallbacks proceed again once the ones in flight are done.
+	records, err := kd.Records(name, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(records))
+}
+
+func TestConcurrencyLimiterWithoutLimit(t *testing.T) {
+	var l concurrencyLimiter
+	for i := 0; i < 100; i++ {
+		assert.True(t, l.acquire(0))
+	}
+	assert.False(t, l.acquire(100))
+	assert.Equal(t, uint64(1), l.shed)
+}
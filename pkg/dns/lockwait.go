@@ -0,0 +1,91 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Lock modes of the cache lock wait histogram.
+	readLockMode  = "read"
+	writeLockMode = "write"
+)
+
+// lockWaitBuckets range from 1 microsecond to about 4 seconds.
+var lockWaitBuckets = prometheus.ExponentialBuckets(1e-6, 4, 12)
+
+// instrumentedRWMutex is a sync.RWMutex which, once enabled, observes the
+// time spent waiting to acquire it. When disabled, the overhead is a single
+// atomic load per lock.
+type instrumentedRWMutex struct {
+	sync.RWMutex
+	// wait holds the *prometheus.HistogramVec observing the waits, by
+	// lock mode, once enabled.
+	wait atomic.Value
+}
+
+// enable starts observing the waits for m, and returns the histogram they
+// are observed in. Subsequent calls return the same histogram.
+func (m *instrumentedRWMutex) enable(name, help string) *prometheus.HistogramVec {
+	if wait, ok := m.wait.Load().(*prometheus.HistogramVec); ok {
+		return wait
+	}
+	wait := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      name,
+		Help:      help,
+		Buckets:   lockWaitBuckets,
+	}, []string{"mode"})
+	m.wait.Store(wait)
+	return wait
+}
+
+func (m *instrumentedRWMutex) Lock() {
+	wait, ok := m.wait.Load().(*prometheus.HistogramVec)
+	if !ok {
+		m.RWMutex.Lock()
+		return
+	}
+	start := time.Now()
+	m.RWMutex.Lock()
+	wait.WithLabelValues(writeLockMode).Observe(time.Since(start).Seconds())
+}
+
+func (m *instrumentedRWMutex) RLock() {
+	wait, ok := m.wait.Load().(*prometheus.HistogramVec)
+	if !ok {
+		m.RWMutex.RLock()
+		return
+	}
+	start := time.Now()
+	m.RWMutex.RLock()
+	wait.WithLabelValues(readLockMode).Observe(time.Since(start).Seconds())
+}
+
+// EnableCacheLockMetrics starts observing the time spent waiting to acquire
+// the lock of the cache, for reads and writes, and returns the
+// prometheus.Collector exporting it. It is meant to quantify the
+// contention on the lock, and is off unless called.
+func (kd *KubeDNS) EnableCacheLockMetrics() prometheus.Collector {
+	return kd.cacheLock.enable("cache_lock_wait_seconds",
+		"Time spent waiting to acquire the lock of the record cache, by lock mode (read or write).")
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheLockMetrics(t *testing.T) {
+	kd := newKubeDNS()
+	registry := prometheus.NewRegistry()
+
+	// Waits are not observed until enabled.
+	kd.cacheLock.Lock()
+	kd.cacheLock.Unlock()
+	require.NoError(t, registry.Register(kd.EnableCacheLockMetrics()))
+	assert.Equal(t, kd.EnableCacheLockMetrics(), kd.EnableCacheLockMetrics())
+
+	kd.cacheLock.Lock()
+	done := make(chan struct{})
+	go func() {
+		kd.cacheLock.RLock()
+		kd.cacheLock.RUnlock()
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	kd.cacheLock.Unlock()
+	<-done
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(families))
+	histograms := map[string]*dto.Histogram{}
+	for _, metric := range families[0].GetMetric() {
+		histograms[metric.GetLabel()[0].GetValue()] = metric.GetHistogram()
+	}
+	require.Contains(t, histograms, readLockMode)
+	require.Contains(t, histograms, writeLockMode)
+	assert.Equal(t, uint64(1), histograms[writeLockMode].GetSampleCount())
+	assert.Equal(t, uint64(1), histograms[readLockMode].GetSampleCount())
+	assert.True(t, histograms[readLockMode].GetSampleSum() >= 0.01,
+		"the read lock waited %vs", histograms[readLockMode].GetSampleSum())
+}
@@ -0,0 +1,472 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	skymsg "github.com/skynetservices/skydns/msg"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/dns/pkg/dns/util"
+)
+
+const (
+	// maxAnyRecords is the maximum number of records in the answer to an
+	// ANY question.
+	maxAnyRecords = 32
+
+	// maxCNAMEChain is the maximum number of CNAME records followed by
+	// RecordsFollowingCNAMEs, as in skydns.
+	maxCNAMEChain = 8
+)
+
+// SyntheticObjectKind is the Kind of the ObjectRef attached to records that
+// are synthesized at query time rather than generated from a Kubernetes
+// object, e.g. pod records and federation redirects.
+const SyntheticObjectKind = "Synthetic"
+
+var (
+	// ErrReverseNotFound is the error of a reverse lookup of an IP that
+	// has no reverse record.
+	ErrReverseNotFound = errors.New("no reverse record")
+	// ErrAmbiguousReverseRecord is the error of a reverse lookup of an IP
+	// that has several reverse records when a single one is expected. An
+	// IP has at most one reverse record for now.
+	ErrAmbiguousReverseRecord = errors.New("more than one reverse record")
+	// ErrReverseNotAuthoritative is the error of a reverse lookup of an IP
+	// outside of the ranges of the cluster, if the ForwardUnknownReverseQueries
+	// of the configuration is set: KubeDNS can't tell whether it has a
+	// reverse record, so the lookup is to be forwarded.
+	ErrReverseNotAuthoritative = errors.New("not authoritative for reverse lookup")
+)
+
+// ReverseRecordError is the error of the reverse lookup of an IP. As skydns
+// forwards the reverse lookups that fail, whatever the error, it is meant
+// for the other users of ReverseRecord to tell a miss from an ambiguity,
+// or from an IP KubeDNS is not authoritative for.
+type ReverseRecordError struct {
+	// IP is the IP looked up.
+	IP string
+	// Err is ErrReverseNotFound, ErrAmbiguousReverseRecord or
+	// ErrReverseNotAuthoritative.
+	Err error
+}
+
+func (e *ReverseRecordError) Error() string {
+	return fmt.Sprintf("%v for %s", e.Err, e.IP)
+}
+
+func (e *ReverseRecordError) Unwrap() error {
+	return e.Err
+}
+
+// ObjectRef identifies the Kubernetes object a record was generated from.
+type ObjectRef struct {
+	Kind      string
+	Namespace string
+	Name      string
+	UID       types.UID
+}
+
+// RecordWithSource is a record along with a reference to the Kubernetes
+// object that produced it.
+type RecordWithSource struct {
+	skymsg.Service
+	Source ObjectRef
+}
+
+// RecordsWithSource behaves like Records, but also returns a reference to
+// the object each record was generated from: the Service for ClusterIP and
+// ExternalName services and the Endpoints for headless services.
+func (kd *KubeDNS) RecordsWithSource(name string, exact bool) ([]RecordWithSource, error) {
+	records, err := kd.Records(name, exact)
+	if err != nil {
+		return nil, err
+	}
+	retval := make([]RecordWithSource, 0, len(records))
+	for _, record := range records {
+		retval = append(retval, RecordWithSource{
+			Service: record,
+			Source:  kd.recordSource(&record),
+		})
+	}
+	return retval, nil
+}
+
+// RecordsOfType behaves like Records, but only returns the records that can
+// answer a question of the given type: IPv4 and IPv6 addresses for A and
+// AAAA, records with a port for SRV and hostnames for CNAME. Every record is
+// returned for other types. An empty list with no error is returned if the
+// name exists but has no record of the given type.
+func (kd *KubeDNS) RecordsOfType(name string, qtype uint16, exact bool) ([]skymsg.Service, error) {
+	records, err := kd.Records(name, exact)
+	if err != nil {
+		return nil, err
+	}
+	retval := []skymsg.Service{}
+	for _, record := range records {
+		if recordIsOfType(&record, qtype) {
+			retval = append(retval, record)
+		}
+	}
+	return retval, nil
+}
+
+// RecordsForAny returns the answer to an ANY question for exactly the given
+// name: the PTR record of a reverse name, or the A, AAAA, SRV and CNAME
+// records of the name. Duplicate records are answered once, and at most
+// maxAnyRecords records are answered, so that ANY questions cannot cause
+// huge responses.
+func (kd *KubeDNS) RecordsForAny(name string) ([]dns.RR, error) {
+	name = dns.Fqdn(name)
+	if lower := strings.ToLower(name); strings.HasSuffix(lower, util.ArpaSuffix) || strings.HasSuffix(lower, util.ArpaSuffixV6) {
+		record, err := kd.ReverseRecord(strings.ToLower(name))
+		if err != nil {
+			return nil, err
+		}
+		hdr := dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: record.Ttl}
+		return []dns.RR{&dns.PTR{Hdr: hdr, Ptr: dns.Fqdn(record.Host)}}, nil
+	}
+
+	records, err := kd.Records(name, false)
+	if err != nil {
+		return nil, err
+	}
+	answer := []dns.RR{}
+	answered := map[string]bool{}
+	for i := range records {
+		rr := anyRecord(name, &records[i])
+		if answered[rr.String()] {
+			continue
+		}
+		answered[rr.String()] = true
+		answer = append(answer, rr)
+	}
+	sort.Slice(answer, func(i, j int) bool {
+		if answer[i].Header().Rrtype != answer[j].Header().Rrtype {
+			return answer[i].Header().Rrtype < answer[j].Header().Rrtype
+		}
+		return answer[i].String() < answer[j].String()
+	})
+	if len(answer) > maxAnyRecords {
+		answer = answer[:maxAnyRecords]
+	}
+	return answer, nil
+}
+
+// anyRecord converts the given record of name to the resource record it
+// answers: an SRV record if it has a port, an A or AAAA record if it holds
+// an address and a CNAME record otherwise.
+func anyRecord(name string, record *skymsg.Service) dns.RR {
+	hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: record.Ttl}
+	ip := net.ParseIP(record.Host)
+	switch {
+	case record.Port != 0:
+		hdr.Rrtype = dns.TypeSRV
+		return &dns.SRV{
+			Hdr:      hdr,
+			Priority: uint16(record.Priority),
+			Weight:   uint16(record.Weight),
+			Port:     uint16(record.Port),
+			Target:   dns.Fqdn(record.Host),
+		}
+	case ip != nil && ip.To4() != nil:
+		hdr.Rrtype = dns.TypeA
+		return &dns.A{Hdr: hdr, A: ip.To4()}
+	case ip != nil:
+		hdr.Rrtype = dns.TypeAAAA
+		return &dns.AAAA{Hdr: hdr, AAAA: ip}
+	default:
+		hdr.Rrtype = dns.TypeCNAME
+		return &dns.CNAME{Hdr: hdr, Target: dns.Fqdn(record.Host)}
+	}
+}
+
+// RecordsFollowingCNAMEs behaves like Records, but follows the CNAME
+// records, e.g. of ExternalName services, whose target is served by
+// KubeDNS. The CNAME records are returned along with the records of the
+// end of the chain. No record is returned with a TTL greater than the TTL
+// of a CNAME record before it in the chain, so that clients don't cache
+// the records of a target longer than the redirect to it. The chain ends
+// at the first target that isn't served by KubeDNS, which clients resolve
+// themselves.
+func (kd *KubeDNS) RecordsFollowingCNAMEs(name string, exact bool) ([]skymsg.Service, error) {
+	records, err := kd.Records(name, exact)
+	if err != nil {
+		return nil, err
+	}
+	return kd.followCNAMEs(name, records), nil
+}
+
+// followCNAMEs returns the given records of name followed, if they are a
+// single CNAME record, by the records of the rest of its chain, as
+// RecordsFollowingCNAMEs does. A CNAME record without a TTL, e.g. a
+// federation answer, doesn't cap the TTL of the records after it.
+func (kd *KubeDNS) followCNAMEs(name string, records []skymsg.Service) []skymsg.Service {
+	var err error
+	retval := []skymsg.Service{}
+	visited := map[string]bool{strings.ToLower(dns.Fqdn(name)): true}
+	capped, ttlCap := false, uint32(0)
+	for chain := 0; ; chain++ {
+		for _, record := range records {
+			if capped && record.Ttl > ttlCap {
+				record.Ttl = ttlCap
+			}
+			retval = append(retval, record)
+		}
+		if chain == maxCNAMEChain || len(records) != 1 ||
+			records[0].Port != 0 || !recordIsOfType(&records[0], dns.TypeCNAME) {
+			return retval
+		}
+		cname := retval[len(retval)-1]
+		if cname.Ttl > 0 {
+			capped, ttlCap = true, cname.Ttl
+		}
+		target := strings.ToLower(dns.Fqdn(cname.Host))
+		if visited[target] {
+			return retval
+		}
+		visited[target] = true
+		if records, err = kd.Records(target, false); err != nil || len(records) == 0 {
+			return retval
+		}
+	}
+}
+
+// CanonicalServiceFQDN returns the FQDN of the service the given name is
+// the name of under the cluster domain, e.g. mysvc.myns.svc.cluster.local.
+// for mysvc.myns.svc.cluster.example.com. if cluster.example.com is one of
+// the additionalDomains of the configuration, and whether the name is the
+// name of a service KubeDNS serves under the cluster domain or one of the
+// additional domains.
+func (kd *KubeDNS) CanonicalServiceFQDN(anyDomainFQDN string) (string, bool) {
+	name := strings.TrimSuffix(strings.ToLower(dns.Fqdn(anyDomainFQDN)), ".")
+	path := kd.toClusterDomain(util.ReverseArray(strings.Split(name, ".")))
+	if len(path) != len(kd.domainPath)+3 || !hasPathPrefix(path, kd.domainPath) ||
+		path[len(kd.domainPath)] != serviceSubdomain {
+		return "", false
+	}
+	namespacePath, service := path[:len(path)-1], path[len(path)-1]
+
+	kd.cacheLock.RLock()
+	defer kd.cacheLock.RUnlock()
+	// The records of ExternalName services are entries, the ones of other
+	// services are under a child node.
+	_, exists := kd.cache.GetEntry(service, namespacePath...)
+	if !exists {
+		keys := kd.cache.GetChildKeys(namespacePath...)
+		i := sort.SearchStrings(keys, service)
+		exists = i < len(keys) && keys[i] == service
+	}
+	if !exists {
+		return "", false
+	}
+	return dns.Fqdn(strings.Join(util.ReverseArray(append([]string{}, path...)), ".")), true
+}
+
+// EndpointTopology is the location of the endpoint a record points at.
+type EndpointTopology struct {
+	// NodeName is the node hosting the endpoint, if known.
+	NodeName string
+	// Zone is the zone of the node hosting the endpoint, if known.
+	Zone string
+}
+
+// RecordWithTopology is a record along with the topology of the endpoint
+// it points at.
+type RecordWithTopology struct {
+	skymsg.Service
+	// Topology is nil for records that do not point at the address of a
+	// headless service endpoint.
+	Topology *EndpointTopology
+}
+
+// RecordsWithTopology behaves like Records, but also returns the topology
+// of the headless service endpoints the records point at, so that clients
+// can prefer the endpoints close to them. The node of an endpoint is taken
+// from its address. Its zone is taken from its EndpointSlice when they are
+// watched, and otherwise only known if the node is in the nodes store,
+// which is populated lazily for federation queries.
+func (kd *KubeDNS) RecordsWithTopology(name string, exact bool) ([]RecordWithTopology, error) {
+	records, err := kd.Records(name, exact)
+	if err != nil {
+		return nil, err
+	}
+	retval := make([]RecordWithTopology, 0, len(records))
+	for _, record := range records {
+		retval = append(retval, RecordWithTopology{
+			Service:  record,
+			Topology: kd.recordTopology(&record),
+		})
+	}
+	return retval, nil
+}
+
+// recordTopology returns the topology of the headless service endpoint
+// whose address the given record holds, or nil.
+func (kd *KubeDNS) recordTopology(record *skymsg.Service) *EndpointTopology {
+	if net.ParseIP(record.Host) == nil {
+		return nil
+	}
+	namespace, name, ok := kd.serviceForRecordKey(record.Key)
+	if !ok {
+		return nil
+	}
+	obj, exists, err := kd.endpointsStore.GetByKey(namespace + "/" + name)
+	if err != nil || !exists {
+		return nil
+	}
+	e, ok := obj.(*v1.Endpoints)
+	if !ok {
+		return nil
+	}
+	for _, subset := range e.Subsets {
+		for _, address := range subset.Addresses {
+			if address.IP != record.Host {
+				continue
+			}
+			topology := &EndpointTopology{}
+			zone, hasZone := kd.endpointZone(namespace+"/"+name, address.IP)
+			topology.Zone = zone
+			if address.NodeName != nil {
+				topology.NodeName = *address.NodeName
+			}
+			if !hasZone && topology.NodeName != "" {
+				if obj, exists, err := kd.nodesStore.GetByKey(topology.NodeName); err == nil && exists {
+					if node, ok := obj.(*v1.Node); ok {
+						topology.Zone, _ = getNodeZoneAndRegion(node)
+					}
+				}
+			}
+			return topology
+		}
+	}
+	return nil
+}
+
+// Endpoint is an address and port an SRV record resolves to.
+type Endpoint struct {
+	// Target is the target of the SRV record.
+	Target string
+	IP     string
+	Port   int
+}
+
+// ResolveSRVTargets returns the addresses and ports the SRV records of the
+// given port of a service resolve to, following the target of each record
+// in the cache: the cluster IPs of a ClusterIP service, or the address of
+// each endpoint of a headless service.
+func (kd *KubeDNS) ResolveSRVTargets(namespace, service, portName, protocol string) ([]Endpoint, error) {
+	name := strings.Join([]string{
+		"_" + portName, "_" + strings.ToLower(protocol), service, namespace, serviceSubdomain, kd.domain}, ".")
+	srvRecords, err := kd.RecordsOfType(name, dns.TypeSRV, false)
+	if err != nil {
+		return nil, err
+	}
+	retval := []Endpoint{}
+	// Targets are resolved once, should several SRV records share one.
+	resolved := map[string]bool{}
+	for _, srvRecord := range srvRecords {
+		target := fmt.Sprintf("%s:%d", srvRecord.Host, srvRecord.Port)
+		if resolved[target] {
+			continue
+		}
+		resolved[target] = true
+		records, err := kd.Records(srvRecord.Host, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve SRV target %q: %v", srvRecord.Host, err)
+		}
+		for _, record := range records {
+			if net.ParseIP(record.Host) == nil {
+				continue
+			}
+			retval = append(retval, Endpoint{Target: srvRecord.Host, IP: record.Host, Port: srvRecord.Port})
+		}
+	}
+	return retval, nil
+}
+
+func recordIsOfType(record *skymsg.Service, qtype uint16) bool {
+	family, _ := util.IPFamily(record.Host)
+	switch qtype {
+	case dns.TypeA:
+		return family == v1.IPv4Protocol
+	case dns.TypeAAAA:
+		return family == v1.IPv6Protocol
+	case dns.TypeSRV:
+		return record.Port != 0
+	case dns.TypeCNAME:
+		return net.ParseIP(record.Host) == nil
+	default:
+		return true
+	}
+}
+
+// recordSource derives the object that produced the given record from the
+// key the record is stored under.
+func (kd *KubeDNS) recordSource(record *skymsg.Service) ObjectRef {
+	synthetic := ObjectRef{Kind: SyntheticObjectKind}
+
+	namespace, name, ok := kd.serviceForRecordKey(record.Key)
+	if !ok {
+		return synthetic
+	}
+	key := namespace + "/" + name
+	obj, exists, err := kd.servicesStore.GetByKey(key)
+	if err != nil || !exists {
+		return synthetic
+	}
+	svc, ok := assertIsService(obj)
+	if !ok {
+		return synthetic
+	}
+	if svc.Spec.Type == v1.ServiceTypeExternalName || util.IsServiceIPSet(svc) {
+		return ObjectRef{Kind: "Service", Namespace: svc.Namespace, Name: svc.Name, UID: svc.UID}
+	}
+	if obj, exists, err := kd.endpointsStore.GetByKey(key); err == nil && exists {
+		if e, ok := obj.(*v1.Endpoints); ok {
+			return ObjectRef{Kind: "Endpoints", Namespace: e.Namespace, Name: e.Name, UID: e.UID}
+		}
+	}
+	return synthetic
+}
+
+// serviceForRecordKey returns the namespace and name of the service owning
+// the record stored under the given skydns key, e.g.
+// /skydns/local/cluster/svc/default/kubernetes/1234.
+func (kd *KubeDNS) serviceForRecordKey(recordKey string) (string, string, bool) {
+	segments := strings.Split(strings.TrimPrefix(recordKey, "/"+skymsg.PathPrefix+"/"), "/")
+	if len(segments) < len(kd.domainPath)+3 {
+		return "", "", false
+	}
+	for i, label := range kd.domainPath {
+		if segments[i] != label {
+			return "", "", false
+		}
+	}
+	segments = segments[len(kd.domainPath):]
+	if segments[0] != serviceSubdomain {
+		return "", "", false
+	}
+	return segments[1], segments[2], true
+}
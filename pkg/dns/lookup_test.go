@@ -0,0 +1,434 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s.io/dns/pkg/dns/config"
+)
+
+func TestRecordsWithSource(t *testing.T) {
+	kd := newKubeDNS()
+
+	portal := newService(testNamespace, "portal", "1.2.3.4", "http", 80)
+	portal.UID = "portal-uid"
+	assert.NoError(t, kd.servicesStore.Add(portal))
+	kd.newService(portal)
+
+	external := newExternalNameService()
+	external.Name = "external"
+	external.UID = "external-uid"
+	assert.NoError(t, kd.servicesStore.Add(external))
+	kd.newService(external)
+
+	headless := newHeadlessService()
+	headless.Name = "headless"
+	headless.UID = "headless-uid"
+	assert.NoError(t, kd.servicesStore.Add(headless))
+	endpoints := newEndpoints(headless, newSubsetWithOnePort("http", 80, "10.0.0.1", "10.0.0.2"))
+	endpoints.UID = "endpoints-uid"
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(headless)
+
+	for _, tc := range []struct {
+		name     string
+		query    string
+		expected ObjectRef
+		count    int
+	}{
+		{
+			name:     "portal",
+			query:    "portal.default.svc.cluster.local.",
+			expected: ObjectRef{Kind: "Service", Namespace: testNamespace, Name: "portal", UID: "portal-uid"},
+			count:    1,
+		},
+		{
+			name:     "portal SRV",
+			query:    "_http._tcp.portal.default.svc.cluster.local.",
+			expected: ObjectRef{Kind: "Service", Namespace: testNamespace, Name: "portal", UID: "portal-uid"},
+			count:    1,
+		},
+		{
+			name:     "ExternalName",
+			query:    "external.default.svc.cluster.local.",
+			expected: ObjectRef{Kind: "Service", Namespace: testNamespace, Name: "external", UID: "external-uid"},
+			count:    1,
+		},
+		{
+			name:     "headless",
+			query:    "headless.default.svc.cluster.local.",
+			expected: ObjectRef{Kind: "Endpoints", Namespace: testNamespace, Name: "headless", UID: "endpoints-uid"},
+			count:    2,
+		},
+		{
+			name:     "pod",
+			query:    "10-0-0-1.default.pod.cluster.local.",
+			expected: ObjectRef{Kind: SyntheticObjectKind},
+			count:    1,
+		},
+	} {
+		records, err := kd.RecordsWithSource(tc.query, false)
+		require.NoError(t, err, tc.name)
+		assert.Equal(t, tc.count, len(records), tc.name)
+		for _, record := range records {
+			assert.Equal(t, tc.expected, record.Source, tc.name)
+		}
+	}
+
+	_, err := kd.RecordsWithSource("missing.default.svc.cluster.local.", false)
+	assert.Error(t, err)
+}
+
+func TestRecordsOfType(t *testing.T) {
+	kd := newKubeDNS()
+
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	s.Spec.ClusterIPs = []string{"1.2.3.4", "2001:db8::4"}
+	s.Spec.Ports = append(s.Spec.Ports, v1.ServicePort{Name: "https", Port: 443, Protocol: v1.ProtocolTCP})
+	kd.newService(s)
+	external := newExternalNameService()
+	external.Name = "external"
+	kd.newService(external)
+
+	name := testService + "." + testNamespace + ".svc." + testDomain
+	for _, tc := range []struct {
+		name          string
+		query         string
+		qtype         uint16
+		expectedHosts []string
+		expectedPorts []int
+	}{
+		{name: "A", query: name, qtype: dns.TypeA, expectedHosts: []string{"1.2.3.4"}, expectedPorts: []int{0}},
+		{name: "AAAA", query: name, qtype: dns.TypeAAAA, expectedHosts: []string{"2001:db8::4"}, expectedPorts: []int{0}},
+		{name: "SRV of the service name", query: name, qtype: dns.TypeSRV},
+		{
+			name: "SRV", query: "_https._tcp." + name, qtype: dns.TypeSRV,
+			expectedHosts: []string{name}, expectedPorts: []int{443},
+		},
+		{name: "A of an SRV name", query: "_https._tcp." + name, qtype: dns.TypeA},
+		{
+			name: "CNAME", query: "external." + testNamespace + ".svc." + testDomain, qtype: dns.TypeCNAME,
+			expectedHosts: []string{testExternalName}, expectedPorts: []int{0},
+		},
+		{name: "A of a CNAME", query: "external." + testNamespace + ".svc." + testDomain, qtype: dns.TypeA},
+	} {
+		records, err := kd.RecordsOfType(tc.query, tc.qtype, false)
+		require.NoError(t, err, tc.name)
+		hosts, ports := []string{}, []int{}
+		for _, record := range records {
+			hosts = append(hosts, record.Host)
+			ports = append(ports, record.Port)
+		}
+		if tc.expectedHosts == nil {
+			tc.expectedHosts, tc.expectedPorts = []string{}, []int{}
+		}
+		assert.Equal(t, tc.expectedHosts, hosts, tc.name)
+		assert.Equal(t, tc.expectedPorts, ports, tc.name)
+	}
+
+	_, err := kd.RecordsOfType("missing."+testNamespace+".svc."+testDomain, dns.TypeA, false)
+	assert.Error(t, err)
+}
+
+func TestRecordsWithTopology(t *testing.T) {
+	kd := newKubeDNS()
+
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:   "node-1",
+		Labels: map[string]string{v1.LabelTopologyZone: "zone-a"},
+	}}
+	assert.NoError(t, kd.nodesStore.Add(node))
+
+	headless := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(headless))
+	subset := newSubsetWithOnePort("http", 80, "10.0.0.1", "10.0.0.2", "10.0.0.3")
+	subset.Addresses[0].NodeName = &node.Name
+	unknownNode := "node-2"
+	subset.Addresses[1].NodeName = &unknownNode
+	assert.NoError(t, kd.endpointsStore.Add(newEndpoints(headless, subset)))
+	kd.newService(headless)
+
+	portal := newService(testNamespace, "portal", "1.2.3.4", "http", 80)
+	assert.NoError(t, kd.servicesStore.Add(portal))
+	kd.newService(portal)
+
+	records, err := kd.RecordsWithTopology(testService+"."+testNamespace+".svc."+testDomain, false)
+	require.NoError(t, err)
+	topologies := map[string]*EndpointTopology{}
+	for _, record := range records {
+		topologies[record.Host] = record.Topology
+	}
+	assert.Equal(t, map[string]*EndpointTopology{
+		"10.0.0.1": {NodeName: "node-1", Zone: "zone-a"},
+		"10.0.0.2": {NodeName: "node-2"},
+		"10.0.0.3": {},
+	}, topologies)
+
+	records, err = kd.RecordsWithTopology("portal."+testNamespace+".svc."+testDomain, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	assert.Nil(t, records[0].Topology)
+}
+
+func TestResolveSRVTargets(t *testing.T) {
+	kd := newKubeDNS()
+
+	portal := newService(testNamespace, "portal", "1.2.3.4", "http", 80)
+	portal.Spec.ClusterIPs = []string{"1.2.3.4", "2001:db8::4"}
+	assert.NoError(t, kd.servicesStore.Add(portal))
+	kd.newService(portal)
+
+	headless := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(headless))
+	endpoints := newEndpoints(headless,
+		newSubsetWithOnePortWithHostname("http", 8080, true, "10.0.0.1", "10.0.0.2"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(headless)
+
+	portalTarget := "portal." + testNamespace + ".svc." + testDomain
+	resolved, err := kd.ResolveSRVTargets(testNamespace, "portal", "http", "TCP")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []Endpoint{
+		{Target: portalTarget, IP: "1.2.3.4", Port: 80},
+		{Target: portalTarget, IP: "2001:db8::4", Port: 80},
+	}, resolved)
+
+	headlessTarget := "." + testService + "." + testNamespace + ".svc." + testDomain
+	resolved, err = kd.ResolveSRVTargets(testNamespace, testService, "http", "TCP")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []Endpoint{
+		{Target: "ep-0" + headlessTarget, IP: "10.0.0.1", Port: 8080},
+		{Target: "ep-1" + headlessTarget, IP: "10.0.0.2", Port: 8080},
+	}, resolved)
+
+	_, err = kd.ResolveSRVTargets(testNamespace, "portal", "https", "TCP")
+	assert.Error(t, err)
+}
+
+func TestRecordsForAny(t *testing.T) {
+	kd := newKubeDNS()
+
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	s.Spec.ClusterIPs = []string{"1.2.3.4", "2001:db8::4"}
+	kd.newService(s)
+	external := newExternalNameService()
+	external.Name = "external"
+	kd.newService(external)
+
+	rrTypes := func(answer []dns.RR) []uint16 {
+		types := []uint16{}
+		for _, rr := range answer {
+			types = append(types, rr.Header().Rrtype)
+		}
+		return types
+	}
+
+	name := testService + "." + testNamespace + ".svc." + testDomain
+	answer, err := kd.RecordsForAny(name)
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{dns.TypeA, dns.TypeAAAA}, rrTypes(answer))
+	assert.Equal(t, "1.2.3.4", answer[0].(*dns.A).A.String())
+	assert.Equal(t, "2001:db8::4", answer[1].(*dns.AAAA).AAAA.String())
+	for _, rr := range answer {
+		assert.Equal(t, name, rr.Header().Name)
+	}
+
+	answer, err = kd.RecordsForAny("_http._tcp." + name)
+	require.NoError(t, err)
+	require.Equal(t, []uint16{dns.TypeSRV}, rrTypes(answer))
+	assert.Equal(t, name, answer[0].(*dns.SRV).Target)
+	assert.Equal(t, uint16(80), answer[0].(*dns.SRV).Port)
+
+	answer, err = kd.RecordsForAny("external." + testNamespace + ".svc." + testDomain)
+	require.NoError(t, err)
+	require.Equal(t, []uint16{dns.TypeCNAME}, rrTypes(answer))
+	assert.Equal(t, testExternalName+".", answer[0].(*dns.CNAME).Target)
+
+	answer, err = kd.RecordsForAny("4.3.2.1.in-addr.arpa.")
+	require.NoError(t, err)
+	require.Equal(t, []uint16{dns.TypePTR}, rrTypes(answer))
+	assert.Equal(t, name, answer[0].(*dns.PTR).Ptr)
+
+	// The answer is bounded.
+	headless := newHeadlessService()
+	headless.Name = "headless"
+	ips := []string{}
+	for i := 0; i < 2*maxAnyRecords; i++ {
+		ips = append(ips, fmt.Sprintf("10.0.0.%d", i+1))
+	}
+	assert.NoError(t, kd.endpointsStore.Add(newEndpoints(headless, newSubsetWithOnePort("http", 80, ips...))))
+	kd.newService(headless)
+	answer, err = kd.RecordsForAny("headless." + testNamespace + ".svc." + testDomain)
+	require.NoError(t, err)
+	assert.Equal(t, maxAnyRecords, len(answer))
+
+	_, err = kd.RecordsForAny("missing." + testNamespace + ".svc." + testDomain)
+	assert.Error(t, err)
+}
+
+func TestReverseRecordErrors(t *testing.T) {
+	kd := newKubeDNS()
+	kd.newService(newService(testNamespace, testService, "1.2.3.4", "http", 80))
+
+	_, err := kd.ReverseRecord("4.3.2.1.in-addr.arpa.")
+	require.NoError(t, err)
+
+	_, err = kd.ReverseRecord("5.3.2.1.in-addr.arpa.")
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrReverseNotFound))
+	assert.False(t, errors.Is(err, ErrAmbiguousReverseRecord))
+	var reverseErr *ReverseRecordError
+	require.True(t, errors.As(err, &reverseErr))
+	assert.Equal(t, "1.2.3.5", reverseErr.IP)
+	assert.Equal(t, "no reverse record for 1.2.3.5", err.Error())
+
+	_, err = kd.RecordsForAny("5.3.2.1.in-addr.arpa.")
+	assert.True(t, errors.Is(err, ErrReverseNotFound))
+
+	// Names that are not reverse names are not misses.
+	_, err = kd.ReverseRecord("1.2.3.5.")
+	require.Error(t, err)
+	assert.False(t, errors.Is(err, ErrReverseNotFound))
+}
+
+func TestReverseRecordOutsideClusterCIDRs(t *testing.T) {
+	kd := newKubeDNS()
+	kd.config.ServiceCIDRs = []string{"1.2.3.0/24"}
+	kd.newService(newService(testNamespace, testService, "1.2.3.4", "http", 80))
+	const outOfRange = "4.3.2.10.in-addr.arpa."
+
+	// By default, the IP is denied a reverse record.
+	_, err := kd.ReverseRecord(outOfRange)
+	assert.True(t, errors.Is(err, ErrReverseNotFound))
+	response, err := kd.Resolve(ResolveRequest{Name: outOfRange, Qtype: dns.TypePTR})
+	require.NoError(t, err)
+	assert.Equal(t, ResolveNXDomain, response.Rcode)
+
+	kd.config.ForwardUnknownReverseQueries = true
+	_, err = kd.ReverseRecord(outOfRange)
+	assert.True(t, errors.Is(err, ErrReverseNotAuthoritative))
+	assert.False(t, errors.Is(err, ErrReverseNotFound))
+	_, err = kd.Resolve(ResolveRequest{Name: outOfRange, Qtype: dns.TypePTR})
+	assert.True(t, errors.Is(err, ErrReverseNotAuthoritative))
+
+	// IPs of the cluster ranges are still denied a reverse record.
+	_, err = kd.ReverseRecord("5.3.2.1.in-addr.arpa.")
+	assert.True(t, errors.Is(err, ErrReverseNotFound))
+	_, err = kd.ReverseRecord("4.3.2.1.in-addr.arpa.")
+	assert.NoError(t, err)
+}
+
+func TestRecordsFollowingCNAMEs(t *testing.T) {
+	kd := newKubeDNS()
+	kd.config = &config.Config{EndpointStabilityTTL: &config.StabilityTTL{
+		MinTTL: 300, MaxTTL: 600, RampPeriod: metav1.Duration{Duration: time.Hour}}}
+
+	headless := newHeadlessService()
+	headless.Name = "headless"
+	assert.NoError(t, kd.servicesStore.Add(headless))
+	assert.NoError(t, kd.endpointsStore.Add(newEndpoints(headless, newSubsetWithOnePort("http", 80, "10.0.0.1"))))
+	kd.newService(headless)
+	headlessName := "headless." + testNamespace + ".svc." + testDomain
+
+	external := newExternalNameService()
+	external.Name = "external"
+	external.Spec.ExternalName = headlessName
+	kd.newService(external)
+	externalName := "external." + testNamespace + ".svc." + testDomain
+
+	records, err := kd.Records(headlessName, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	assert.Equal(t, uint32(300), records[0].Ttl)
+
+	// The A record of the target is capped to the TTL of the CNAME.
+	records, err = kd.RecordsFollowingCNAMEs(externalName, false)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(records))
+	assert.Equal(t, headlessName, records[0].Host)
+	assert.Equal(t, uint32(30), records[0].Ttl)
+	assert.Equal(t, "10.0.0.1", records[1].Host)
+	assert.Equal(t, uint32(30), records[1].Ttl)
+
+	// Targets outside the cluster are left to the client.
+	outside := newExternalNameService()
+	outside.Name = "outside"
+	kd.newService(outside)
+	records, err = kd.RecordsFollowingCNAMEs("outside."+testNamespace+".svc."+testDomain, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	assert.Equal(t, testExternalName, records[0].Host)
+
+	// Loops end.
+	loop := newExternalNameService()
+	loop.Name = "loop"
+	loop.Spec.ExternalName = "loop." + testNamespace + ".svc." + testDomain
+	kd.newService(loop)
+	records, err = kd.RecordsFollowingCNAMEs(loop.Spec.ExternalName, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(records))
+
+	records, err = kd.RecordsFollowingCNAMEs(headlessName, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	assert.Equal(t, uint32(300), records[0].Ttl)
+}
+
+func TestCanonicalServiceFQDN(t *testing.T) {
+	kd := newKubeDNS()
+	kd.updateConfig(&config.Config{AdditionalDomains: []string{"cluster.example.com"}})
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	kd.newService(s)
+	external := newExternalNameService()
+	external.Name = "external"
+	kd.newService(external)
+
+	canonical := getServiceFQDN(kd.domain, s)
+	for _, name := range []string{
+		canonical,
+		"testservice.default.svc.cluster.example.com.",
+		"TestService.Default.svc.cluster.example.com",
+	} {
+		fqdn, ok := kd.CanonicalServiceFQDN(name)
+		assert.True(t, ok, name)
+		assert.Equal(t, canonical, fqdn, name)
+	}
+	fqdn, ok := kd.CanonicalServiceFQDN("external.default.svc.cluster.example.com.")
+	assert.True(t, ok)
+	assert.Equal(t, getServiceFQDN(kd.domain, external), fqdn)
+
+	for _, name := range []string{
+		"missing.default.svc.cluster.example.com.",
+		"testservice.other.svc.cluster.example.com.",
+		"testservice.default.svc.other.example.com.",
+		"_http._tcp.testservice.default.svc.cluster.example.com.",
+		"default.svc.cluster.example.com.",
+	} {
+		_, ok := kd.CanonicalServiceFQDN(name)
+		assert.False(t, ok, name)
+	}
+}
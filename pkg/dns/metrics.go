@@ -0,0 +1,417 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/prometheus/client_golang/prometheus"
+	skymsg "github.com/skynetservices/skydns/msg"
+	v1 "k8s.io/api/core/v1"
+
+	"k8s.io/dns/pkg/dns/util"
+)
+
+const (
+	metricsNamespace = "kubedns"
+
+	// Record types of the record age histogram.
+	serviceRecordType  = "service"
+	endpointRecordType = "endpoint"
+
+	// maxNamespaceRecordsLabels is the maximum number of namespaces the
+	// number of records is exported for. The records of the other
+	// namespaces are counted under otherNamespaceLabel.
+	maxNamespaceRecordsLabels = 100
+	otherNamespaceLabel       = "other"
+)
+
+// WithMetricsRegistry makes NewKubeDNS register the prometheus collectors of
+// KubeDNS with the given registry. They are not registered by default.
+func WithMetricsRegistry(registry prometheus.Registerer) Option {
+	return func(kd *KubeDNS) {
+		kd.metricsRegistry = registry
+	}
+}
+
+// WithCacheLockMetrics makes NewKubeDNS enable the cache lock metrics, see
+// EnableCacheLockMetrics, and register them with the other collectors.
+func WithCacheLockMetrics() Option {
+	return func(kd *KubeDNS) {
+		kd.cacheLockMetrics = true
+	}
+}
+
+// registerMetrics registers the prometheus collectors of kd with its
+// metricsRegistry.
+func (kd *KubeDNS) registerMetrics() {
+	collectors := []prometheus.Collector{
+		kd.RecordAgeCollector(),
+		kd.NodeListBreakerCollector(),
+		kd.FederationFallbackCollector(),
+		kd.IncompleteServicesCollector(),
+		kd.ReconcileCollector(),
+		kd.QueryCollector(),
+		kd.CacheLimitCollector(),
+	}
+	if kd.cacheLockMetrics {
+		collectors = append(collectors, kd.EnableCacheLockMetrics())
+	}
+	kd.metricsRegistry.MustRegister(collectors...)
+}
+
+// nopRegisterer is a prometheus.Registerer discarding the collectors.
+type nopRegisterer struct{}
+
+func (nopRegisterer) Register(prometheus.Collector) error { return nil }
+
+func (nopRegisterer) MustRegister(...prometheus.Collector) {}
+
+func (nopRegisterer) Unregister(prometheus.Collector) bool { return false }
+
+// queryType is the type of the records a query asks for, as far as KubeDNS
+// can tell from the name queried and the records answered.
+type queryType int
+
+const (
+	aQueryType queryType = iota
+	srvQueryType
+	ptrQueryType
+	cnameQueryType
+	numQueryTypes
+)
+
+func (t queryType) String() string {
+	switch t {
+	case aQueryType:
+		return "A"
+	case srvQueryType:
+		return "SRV"
+	case ptrQueryType:
+		return "PTR"
+	case cnameQueryType:
+		return "CNAME"
+	default:
+		return "unknown"
+	}
+}
+
+// recordAgeBuckets range from 1 second to about 3 days.
+var recordAgeBuckets = prometheus.ExponentialBuckets(1, 4, 10)
+
+var recordAgeDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(metricsNamespace, "", "record_age_seconds"),
+	"Time since the records of ClusterIP and ExternalName services (type=service) "+
+		"and of headless service endpoints (type=endpoint) were first seen.",
+	[]string{"type"}, nil)
+
+var incompleteServicesDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(metricsNamespace, "", "incomplete_services"),
+	"Number of ClusterIP services with neither ports nor endpoint addresses, "+
+		"which are likely misconfigured.",
+	nil, nil)
+
+var (
+	queriesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "queries_total"),
+		"Number of queries answered, by record type.",
+		[]string{"type"}, nil)
+	cacheHitsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "cache_hits_total"),
+		"Number of queries answered with records, by record type.",
+		[]string{"type"}, nil)
+	cacheMissesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "cache_misses_total"),
+		"Number of queries answered without record, by record type.",
+		[]string{"type"}, nil)
+	nxdomainsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "nxdomain_responses_total"),
+		"Number of queries for names that don't exist, by record type.",
+		[]string{"type"}, nil)
+	federationRedirectsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "federation_redirects_total"),
+		"Number of federation queries redirected to another cluster with a CNAME record.",
+		nil, nil)
+	cacheEntriesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "cache_entries"),
+		"Number of records held in the record cache.",
+		nil, nil)
+	reverseRecordsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "reverse_records"),
+		"Number of reverse (PTR) records held.",
+		nil, nil)
+	namespaceRecordsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "namespace_records"),
+		"Number of records held for the services of a namespace, including the "+
+			"reverse records pointing to the namespace. Past the namespaces with "+
+			"the most records, the records are counted under namespace=\"other\".",
+		[]string{"namespace"}, nil)
+)
+
+// queryCounters counts the queries answered by KubeDNS, by query type.
+// Access to the counters is atomic.
+type queryCounters struct {
+	queries             [numQueryTypes]uint64
+	hits                [numQueryTypes]uint64
+	misses              [numQueryTypes]uint64
+	nxdomains           [numQueryTypes]uint64
+	federationRedirects uint64
+}
+
+// observe counts a query of the given type, answered with records if
+// answered, or failed with err.
+func (c *queryCounters) observe(t queryType, answered bool, err error) {
+	atomic.AddUint64(&c.queries[t], 1)
+	if answered {
+		atomic.AddUint64(&c.hits[t], 1)
+		return
+	}
+	atomic.AddUint64(&c.misses[t], 1)
+	var etcdErr etcd.Error
+	if errors.As(err, &etcdErr) && etcdErr.Code == etcd.ErrorCodeKeyNotFound || errors.Is(err, ErrReverseNotFound) {
+		atomic.AddUint64(&c.nxdomains[t], 1)
+	}
+}
+
+// observeFederationRedirect counts a federation query redirected to another
+// cluster.
+func (c *queryCounters) observeFederationRedirect() {
+	atomic.AddUint64(&c.federationRedirects, 1)
+}
+
+// recordsQueryType returns the type of a query of Records for the given
+// name answered with the given records: CNAME if only CNAME records were
+// answered, SRV for names of SRV records, A otherwise.
+func recordsQueryType(name string, records []skymsg.Service) queryType {
+	if len(records) > 0 {
+		cnames := true
+		for i := range records {
+			if records[i].Port != 0 || net.ParseIP(records[i].Host) != nil {
+				cnames = false
+				break
+			}
+		}
+		if cnames {
+			return cnameQueryType
+		}
+	}
+	if strings.HasPrefix(name, "_") {
+		return srvQueryType
+	}
+	return aQueryType
+}
+
+type queryCollector struct {
+	kd *KubeDNS
+}
+
+// QueryCollector returns a prometheus.Collector exporting the number of
+// queries answered by kd, by record type, and the number of records it
+// holds.
+func (kd *KubeDNS) QueryCollector() prometheus.Collector {
+	return &queryCollector{kd: kd}
+}
+
+func (c *queryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queriesDesc
+	ch <- cacheHitsDesc
+	ch <- cacheMissesDesc
+	ch <- nxdomainsDesc
+	ch <- federationRedirectsDesc
+	ch <- cacheEntriesDesc
+	ch <- reverseRecordsDesc
+	ch <- namespaceRecordsDesc
+}
+
+func (c *queryCollector) Collect(ch chan<- prometheus.Metric) {
+	queries := &c.kd.queries
+	for t := queryType(0); t < numQueryTypes; t++ {
+		for desc, counter := range map[*prometheus.Desc]*uint64{
+			queriesDesc:     &queries.queries[t],
+			cacheHitsDesc:   &queries.hits[t],
+			cacheMissesDesc: &queries.misses[t],
+			nxdomainsDesc:   &queries.nxdomains[t],
+		} {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(atomic.LoadUint64(counter)), t.String())
+		}
+	}
+	redirects := atomic.LoadUint64(&queries.federationRedirects)
+	ch <- prometheus.MustNewConstMetric(federationRedirectsDesc, prometheus.CounterValue, float64(redirects))
+
+	c.kd.cacheLock.RLock()
+	entries := len(c.kd.cache.GetAllValues())
+	reverseRecords := len(c.kd.reverseRecordMap)
+	namespaceRecords := c.kd.namespaceRecordCounts()
+	c.kd.cacheLock.RUnlock()
+	ch <- prometheus.MustNewConstMetric(cacheEntriesDesc, prometheus.GaugeValue, float64(entries))
+	ch <- prometheus.MustNewConstMetric(reverseRecordsDesc, prometheus.GaugeValue, float64(reverseRecords))
+	for namespace, count := range capNamespaceLabels(namespaceRecords, maxNamespaceRecordsLabels) {
+		ch <- prometheus.MustNewConstMetric(namespaceRecordsDesc, prometheus.GaugeValue, float64(count), namespace)
+	}
+}
+
+// namespaceRecordCounts returns the number of records of the services of
+// each namespace, including the reverse records pointing to the namespace.
+// Important: Assumes that we already have the cacheLock.
+func (kd *KubeDNS) namespaceRecordCounts() map[string]int {
+	counts := map[string]int{}
+	servicePath := append(append([]string{}, kd.domainPath...), serviceSubdomain)
+	for _, namespace := range kd.cache.GetChildKeys(servicePath...) {
+		if records := len(kd.cache.GetAllValuesForPath(append(servicePath, namespace)...)); records > 0 {
+			counts[namespace] += records
+		}
+	}
+	for _, record := range kd.reverseRecordMap {
+		if namespace := kd.reverseRecordNamespace(record); namespace != "" {
+			counts[namespace]++
+		}
+	}
+	return counts
+}
+
+// capNamespaceLabels returns the given counts for at most max namespaces,
+// the ones with the highest counts, and the sum of the others under
+// otherNamespaceLabel. A namespace named like otherNamespaceLabel is
+// always counted under it.
+func capNamespaceLabels(counts map[string]int, max int) map[string]int {
+	namespaces := make([]string, 0, len(counts))
+	for namespace := range counts {
+		if namespace != otherNamespaceLabel {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	sort.Slice(namespaces, func(i, j int) bool {
+		ci, cj := counts[namespaces[i]], counts[namespaces[j]]
+		if ci != cj {
+			return ci > cj
+		}
+		return namespaces[i] < namespaces[j]
+	})
+	retval := make(map[string]int, max+1)
+	if other, ok := counts[otherNamespaceLabel]; ok {
+		retval[otherNamespaceLabel] = other
+	}
+	for i, namespace := range namespaces {
+		if i < max {
+			retval[namespace] = counts[namespace]
+		} else {
+			retval[otherNamespaceLabel] += counts[namespace]
+		}
+	}
+	return retval
+}
+
+// recordAgeCollector exports the age distribution of the records held by
+// KubeDNS. The distribution is computed when metrics are collected rather
+// than maintained as records change.
+type recordAgeCollector struct {
+	kd *KubeDNS
+}
+
+// RecordAgeCollector returns a prometheus.Collector exporting the age
+// distribution of the records served by kd.
+func (kd *KubeDNS) RecordAgeCollector() prometheus.Collector {
+	return &recordAgeCollector{kd: kd}
+}
+
+func (c *recordAgeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- recordAgeDesc
+}
+
+func (c *recordAgeCollector) Collect(ch chan<- prometheus.Metric) {
+	now := c.kd.clock.Now()
+	services := newAgeHistogram()
+	endpoints := newAgeHistogram()
+
+	c.kd.cacheLock.RLock()
+	for _, firstSeen := range c.kd.serviceFirstSeen {
+		services.observe(now.Sub(firstSeen))
+	}
+	for _, endpointFirstSeen := range c.kd.endpointFirstSeen {
+		for _, firstSeen := range endpointFirstSeen {
+			endpoints.observe(now.Sub(firstSeen))
+		}
+	}
+	c.kd.cacheLock.RUnlock()
+
+	ch <- services.metric(serviceRecordType)
+	ch <- endpoints.metric(endpointRecordType)
+}
+
+type ageHistogram struct {
+	count   uint64
+	sum     float64
+	buckets map[float64]uint64
+}
+
+func newAgeHistogram() *ageHistogram {
+	h := &ageHistogram{buckets: make(map[float64]uint64, len(recordAgeBuckets))}
+	for _, bound := range recordAgeBuckets {
+		h.buckets[bound] = 0
+	}
+	return h
+}
+
+func (h *ageHistogram) observe(age time.Duration) {
+	seconds := age.Seconds()
+	h.count++
+	h.sum += seconds
+	for _, bound := range recordAgeBuckets {
+		if seconds <= bound {
+			h.buckets[bound]++
+		}
+	}
+}
+
+func (h *ageHistogram) metric(recordType string) prometheus.Metric {
+	return prometheus.MustNewConstHistogram(recordAgeDesc, h.count, h.sum, h.buckets, recordType)
+}
+
+type incompleteServicesCollector struct {
+	kd *KubeDNS
+}
+
+// IncompleteServicesCollector returns a prometheus.Collector exporting the
+// number of ClusterIP services with neither ports nor endpoint addresses.
+func (kd *KubeDNS) IncompleteServicesCollector() prometheus.Collector {
+	return &incompleteServicesCollector{kd: kd}
+}
+
+func (c *incompleteServicesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- incompleteServicesDesc
+}
+
+func (c *incompleteServicesCollector) Collect(ch chan<- prometheus.Metric) {
+	incomplete := 0
+	for _, obj := range c.kd.servicesStore.List() {
+		service, ok := obj.(*v1.Service)
+		if !ok || !c.kd.servesNamespace(service.Namespace) ||
+			service.Spec.Type == v1.ServiceTypeExternalName || !util.IsServiceIPSet(service) {
+			continue
+		}
+		if c.kd.isIncompleteService(service) {
+			incomplete++
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(incompleteServicesDesc, prometheus.GaugeValue, float64(incomplete))
+}
@@ -0,0 +1,232 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"k8s.io/dns/pkg/dns/config"
+)
+
+// recordAgeSummary is the sample count, sum and cumulative bucket counts of
+// one type of the record age histogram.
+type recordAgeSummary struct {
+	count   uint64
+	sum     float64
+	buckets map[float64]uint64
+}
+
+func gatherRecordAges(t *testing.T, registry *prometheus.Registry) map[string]recordAgeSummary {
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	retval := map[string]recordAgeSummary{}
+	for _, family := range families {
+		require.Equal(t, "kubedns_record_age_seconds", family.GetName())
+		for _, metric := range family.GetMetric() {
+			h := metric.GetHistogram()
+			summary := recordAgeSummary{
+				count:   h.GetSampleCount(),
+				sum:     h.GetSampleSum(),
+				buckets: map[float64]uint64{},
+			}
+			for _, bucket := range h.GetBucket() {
+				summary.buckets[bucket.GetUpperBound()] = bucket.GetCumulativeCount()
+			}
+			retval[metric.GetLabel()[0].GetValue()] = summary
+		}
+	}
+	return retval
+}
+
+func TestRecordAgeCollector(t *testing.T) {
+	kd := newKubeDNS()
+	fakeClock := clock.NewFakeClock(time.Now())
+	kd.clock = fakeClock
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(kd.RecordAgeCollector()))
+
+	ages := gatherRecordAges(t, registry)
+	assert.Equal(t, uint64(0), ages[serviceRecordType].count)
+	assert.Equal(t, uint64(0), ages[endpointRecordType].count)
+
+	kd.newService(newService(testNamespace, "first", "1.2.3.4", "", 80))
+	headless := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(headless))
+	endpoints := newEndpoints(headless, newSubsetWithOnePort("", 80, "10.0.0.1", "10.0.0.2"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(headless)
+
+	fakeClock.Step(10 * time.Second)
+	kd.newService(newService(testNamespace, "second", "1.2.3.5", "", 80))
+
+	ages = gatherRecordAges(t, registry)
+	assert.Equal(t, recordAgeSummary{
+		count: 2,
+		sum:   10,
+		buckets: map[float64]uint64{
+			1: 1, 4: 1, 16: 2, 64: 2, 256: 2, 1024: 2, 4096: 2, 16384: 2, 65536: 2, 262144: 2,
+		},
+	}, ages[serviceRecordType])
+	assert.Equal(t, uint64(2), ages[endpointRecordType].count)
+	assert.Equal(t, uint64(0), ages[endpointRecordType].buckets[4])
+	assert.Equal(t, uint64(2), ages[endpointRecordType].buckets[16])
+
+	fakeClock.Step(time.Hour)
+	ages = gatherRecordAges(t, registry)
+	assert.Equal(t, uint64(2), ages[serviceRecordType].count)
+	assert.Equal(t, uint64(0), ages[serviceRecordType].buckets[1024])
+	assert.Equal(t, uint64(2), ages[serviceRecordType].buckets[4096])
+	assert.Equal(t, uint64(0), ages[endpointRecordType].buckets[1024])
+	assert.Equal(t, uint64(2), ages[endpointRecordType].buckets[4096])
+}
+
+// gatherQueryMetrics returns the values of the metrics of the query
+// collector, by metric name and type label.
+func gatherQueryMetrics(t *testing.T, registry *prometheus.Registry) map[string]map[string]float64 {
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	retval := map[string]map[string]float64{}
+	for _, family := range families {
+		values := map[string]float64{}
+		for _, metric := range family.GetMetric() {
+			label := ""
+			if len(metric.GetLabel()) > 0 {
+				label = metric.GetLabel()[0].GetValue()
+			}
+			if metric.GetCounter() != nil {
+				values[label] = metric.GetCounter().GetValue()
+			} else {
+				values[label] = metric.GetGauge().GetValue()
+			}
+		}
+		retval[family.GetName()] = values
+	}
+	return retval
+}
+
+func TestQueryCollector(t *testing.T) {
+	kd := newKubeDNS()
+	kd.kubeClient = fake.NewSimpleClientset(newNodes())
+	kd.config.Federations = map[string]string{"myfederation": "example.com"}
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(kd.QueryCollector()))
+
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	kd.newService(s)
+	externalName := newExternalNameService()
+	externalName.Name = "external"
+	kd.newService(externalName)
+
+	_, err := kd.Records(getServiceFQDN(kd.domain, s), false)
+	require.NoError(t, err)
+	_, err = kd.Records(getSRVFQDN(kd, s, "http"), false)
+	require.NoError(t, err)
+	_, err = kd.Records("missing.default.svc.cluster.local.", false)
+	require.Error(t, err)
+	_, err = kd.Records("_missing._tcp.missing.default.svc.cluster.local.", false)
+	require.Error(t, err)
+	_, err = kd.ReverseRecord("4.3.2.1.in-addr.arpa.")
+	require.NoError(t, err)
+	_, err = kd.ReverseRecord("5.3.2.1.in-addr.arpa.")
+	require.Error(t, err)
+	// The federation query is redirected, as the local service has no
+	// endpoints.
+	records, err := kd.Records("testservice.default.myfederation.svc.cluster.local.", false)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+
+	metrics := gatherQueryMetrics(t, registry)
+	assert.Equal(t, map[string]float64{"A": 2, "SRV": 2, "PTR": 2, "CNAME": 1}, metrics["kubedns_queries_total"])
+	assert.Equal(t, map[string]float64{"A": 1, "SRV": 1, "PTR": 1, "CNAME": 1}, metrics["kubedns_cache_hits_total"])
+	assert.Equal(t, map[string]float64{"A": 1, "SRV": 1, "PTR": 1, "CNAME": 0}, metrics["kubedns_cache_misses_total"])
+	assert.Equal(t, map[string]float64{"A": 1, "SRV": 1, "PTR": 1, "CNAME": 0}, metrics["kubedns_nxdomain_responses_total"])
+	assert.Equal(t, map[string]float64{"": 1}, metrics["kubedns_federation_redirects_total"])
+	// The A and SRV records of the service and the CNAME record of the
+	// ExternalName service.
+	assert.Equal(t, map[string]float64{"": 3}, metrics["kubedns_cache_entries"])
+	assert.Equal(t, map[string]float64{"": 1}, metrics["kubedns_reverse_records"])
+}
+
+func TestWithMetricsRegistry(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	kd := NewKubeDNS(fake.NewSimpleClientset(), testDomain, 0, config.NewNopSync(config.NewDefaultConfig()),
+		WithMetricsRegistry(registry), WithCacheLockMetrics())
+
+	// The collectors of kd are already registered.
+	for _, collector := range []prometheus.Collector{
+		kd.RecordAgeCollector(),
+		kd.NodeListBreakerCollector(),
+		kd.FederationFallbackCollector(),
+		kd.IncompleteServicesCollector(),
+		kd.ReconcileCollector(),
+		kd.QueryCollector(),
+		kd.CacheLimitCollector(),
+	} {
+		err := registry.Register(collector)
+		assert.IsType(t, prometheus.AlreadyRegisteredError{}, err)
+	}
+
+	kd.cacheLock.Lock()
+	kd.cacheLock.Unlock()
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	names := map[string]bool{}
+	for _, family := range families {
+		names[family.GetName()] = true
+	}
+	assert.True(t, names["kubedns_cache_lock_wait_seconds"])
+	assert.True(t, names["kubedns_queries_total"])
+}
+
+func TestNamespaceRecordsMetric(t *testing.T) {
+	kd := newKubeDNS()
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(kd.QueryCollector()))
+
+	// An A, an SRV and a reverse record per service.
+	kd.newService(newService("team-a", "svc1", "1.2.3.4", "http", 80))
+	kd.newService(newService("team-a", "svc2", "1.2.3.5", "http", 80))
+	kd.newService(newService("team-b", "svc1", "1.2.3.6", "http", 80))
+	// The CNAME record of the ExternalName service.
+	externalName := newExternalNameService()
+	externalName.Namespace = "team-c"
+	kd.newService(externalName)
+
+	metrics := gatherQueryMetrics(t, registry)
+	assert.Equal(t, map[string]float64{"team-a": 6, "team-b": 3, "team-c": 1}, metrics["kubedns_namespace_records"])
+
+	kd.removeService(newService("team-a", "svc2", "1.2.3.5", "http", 80))
+	metrics = gatherQueryMetrics(t, registry)
+	assert.Equal(t, map[string]float64{"team-a": 3, "team-b": 3, "team-c": 1}, metrics["kubedns_namespace_records"])
+}
+
+func TestCapNamespaceLabels(t *testing.T) {
+	counts := map[string]int{"a": 5, "b": 3, "c": 3, "d": 1}
+	assert.Equal(t, counts, capNamespaceLabels(counts, 4))
+	assert.Equal(t, map[string]int{"a": 5, "b": 3, "other": 4}, capNamespaceLabels(counts, 2))
+	assert.Equal(t, map[string]int{"other": 12}, capNamespaceLabels(counts, 0))
+	// A namespace named other is counted with the other namespaces.
+	assert.Equal(t, map[string]int{"a": 5, "other": 9}, capNamespaceLabels(map[string]int{"a": 5, "other": 2, "b": 3, "c": 4}, 1))
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"sync"
+	"time"
+)
+
+// maxNegativeCacheEntries is the number of names the negative cache
+// remembers at most.
+const maxNegativeCacheEntries = 10000
+
+// negativeCacheKey identifies a query of Records.
+type negativeCacheKey struct {
+	name  string
+	exact bool
+}
+
+// negativeCache remembers the queries recently found to have no record,
+// until they expire or the records change.
+type negativeCache struct {
+	lock sync.Mutex
+	// generation is incremented every time the records change, so that a
+	// query looked up before a change is not remembered after it.
+	generation uint64
+	// expiry maps the queries remembered to the time they expire at.
+	expiry map[negativeCacheKey]time.Time
+}
+
+// contains returns whether the given query is remembered to have no
+// record at the given time.
+func (c *negativeCache) contains(key negativeCacheKey, now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	expiry, ok := c.expiry[key]
+	if ok && !now.Before(expiry) {
+		delete(c.expiry, key)
+		return false
+	}
+	return ok
+}
+
+// currentGeneration returns the generation to pass to add for a query
+// about to be looked up.
+func (c *negativeCache) currentGeneration() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.generation
+}
+
+// add remembers that the given query, looked up at the given generation,
+// has no record until expiry, unless the records changed since. Expired
+// queries are forgotten when the cache is full; if it is still full, the
+// query is not remembered.
+func (c *negativeCache) add(key negativeCacheKey, generation uint64, now, expiry time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if c.expiry == nil {
+		c.expiry = make(map[negativeCacheKey]time.Time)
+	}
+	if len(c.expiry) >= maxNegativeCacheEntries {
+		for k, e := range c.expiry {
+			if !now.Before(e) {
+				delete(c.expiry, k)
+			}
+		}
+		if len(c.expiry) >= maxNegativeCacheEntries {
+			return
+		}
+	}
+	c.expiry[key] = expiry
+}
+
+// invalidate forgets the queries remembered whose name the given function
+// reports as affected by a change of the records, and all those being
+// looked up.
+func (c *negativeCache) invalidate(affected func(name string) bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generation++
+	for key := range c.expiry {
+		if affected(key.name) {
+			delete(c.expiry, key)
+		}
+	}
+}
+
+// clear forgets all the queries remembered, and those being looked up.
+func (c *negativeCache) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generation++
+	c.expiry = nil
+}
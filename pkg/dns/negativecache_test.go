@@ -0,0 +1,161 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+
+	"k8s.io/dns/pkg/dns/config"
+	"k8s.io/dns/pkg/dns/util"
+)
+
+func assertNotFound(t *testing.T, kd *KubeDNS, name string) {
+	t.Helper()
+	_, err := kd.Records(name, false)
+	require.Error(t, err)
+	assert.Equal(t, etcd.ErrorCodeKeyNotFound, err.(etcd.Error).Code)
+}
+
+func TestNegativeCache(t *testing.T) {
+	kd := newKubeDNS()
+	fakeClock := clock.NewFakeClock(time.Now())
+	kd.clock = fakeClock
+	kd.config = &config.Config{NegativeCacheTTL: metav1.Duration{Duration: 5 * time.Second}}
+
+	s := newService(testNamespace, testService, "1.2.3.4", "", 0)
+	fqdn := getServiceFQDN(kd.domain, s)
+	assertNotFound(t, kd, fqdn)
+
+	// A record added without going through recordsChanged is not seen
+	// until the miss expires.
+	record, label := util.GetSkyMsg("1.2.3.4", 0)
+	kd.cacheLock.Lock()
+	kd.cache.SetEntry(label, record, fqdn, append(append([]string{}, kd.domainPath...), serviceSubdomain, testNamespace, testService)...)
+	kd.cacheLock.Unlock()
+	assertNotFound(t, kd, fqdn)
+	fakeClock.Step(5 * time.Second)
+	records, err := kd.Records(fqdn, false)
+	require.NoError(t, err)
+	assert.Len(t, records, 1)
+
+	// Creating a service forgets the misses at once.
+	other := newService(testNamespace, "other", "1.2.3.5", "", 0)
+	otherFQDN := getServiceFQDN(kd.domain, other)
+	assertNotFound(t, kd, otherFQDN)
+	kd.newService(other)
+	records, err = kd.Records(otherFQDN, false)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "1.2.3.5", records[0].Host)
+}
+
+func TestNegativeCacheUnrelatedChange(t *testing.T) {
+	kd := newKubeDNS()
+	kd.config = &config.Config{NegativeCacheTTL: metav1.Duration{Duration: 5 * time.Second}}
+
+	missing := newService(testNamespace, "missing", "1.2.3.4", "", 0)
+	fqdn := getServiceFQDN(kd.domain, missing)
+	assertNotFound(t, kd, fqdn)
+	key := negativeCacheKey{name: fqdn, exact: false}
+
+	// Changing another service keeps the miss.
+	kd.newService(newService(testNamespace, "other", "1.2.3.5", "", 0))
+	kd.newService(newService("other-namespace", "missing", "1.2.3.6", "", 0))
+	assert.True(t, kd.negativeCache.contains(key, kd.clock.Now()))
+
+	// Changing the service forgets it.
+	kd.newService(missing)
+	assert.False(t, kd.negativeCache.contains(key, kd.clock.Now()))
+	records, err := kd.Records(fqdn, false)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "1.2.3.4", records[0].Host)
+}
+
+func TestMayNameService(t *testing.T) {
+	for _, tc := range []struct {
+		query     string
+		namespace string
+		name      string
+		expected  bool
+	}{
+		{"svc.ns.svc.cluster.local.", "ns", "svc", true},
+		{"SVC.NS.svc.cluster.local.", "ns", "svc", true},
+		{"_http._tcp.svc.ns.svc.cluster.local.", "ns", "svc", true},
+		{"host.svc.ns.svc.cluster.local.", "ns", "svc", true},
+		{"*.ns.svc.cluster.local.", "ns", "svc", true},
+		{"svc.*.svc.cluster.local.", "ns", "svc", true},
+		{"ns.svc.cluster.local.", "ns", "svc", true},
+		{"svc.ns.federation.svc.cluster.local.", "ns", "svc", true},
+		{"other.ns.svc.cluster.local.", "ns", "", true},
+		{"other.ns.svc.cluster.local.", "ns", "svc", false},
+		{"svc.other.svc.cluster.local.", "ns", "svc", false},
+		{"svc.cluster.local.", "ns", "svc", false},
+	} {
+		assert.Equal(t, tc.expected, mayNameService(tc.query, tc.namespace, tc.name),
+			"query %q for service %s/%s", tc.query, tc.namespace, tc.name)
+	}
+}
+
+func TestNegativeCacheDisabled(t *testing.T) {
+	kd := newKubeDNS()
+	s := newService(testNamespace, testService, "1.2.3.4", "", 0)
+	fqdn := getServiceFQDN(kd.domain, s)
+	assertNotFound(t, kd, fqdn)
+	assert.Empty(t, kd.negativeCache.expiry)
+}
+
+func TestNegativeCacheChangeDuringLookup(t *testing.T) {
+	var c negativeCache
+	key := negativeCacheKey{name: "missing.default.svc.cluster.local.", exact: false}
+	now := time.Now()
+
+	// The records changed after the miss was looked up.
+	generation := c.currentGeneration()
+	c.clear()
+	c.add(key, generation, now, now.Add(time.Minute))
+	assert.False(t, c.contains(key, now))
+
+	c.add(key, c.currentGeneration(), now, now.Add(time.Minute))
+	assert.True(t, c.contains(key, now))
+	assert.False(t, c.contains(key, now.Add(time.Minute)))
+}
+
+func TestNegativeCacheBounded(t *testing.T) {
+	var c negativeCache
+	now := time.Now()
+	for i := 0; i < maxNegativeCacheEntries; i++ {
+		c.add(negativeCacheKey{name: string(rune(i))}, 0, now, now.Add(time.Minute))
+	}
+	key := negativeCacheKey{name: "missing.default.svc.cluster.local."}
+	c.add(key, 0, now, now.Add(time.Minute))
+	assert.False(t, c.contains(key, now))
+	assert.Len(t, c.expiry, maxNegativeCacheEntries)
+
+	// Expired misses make room.
+	later := now.Add(time.Minute)
+	c.add(key, 0, later, later.Add(time.Minute))
+	assert.True(t, c.contains(key, later))
+	assert.Len(t, c.expiry, 1)
+}
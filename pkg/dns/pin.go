@@ -0,0 +1,78 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// PinService freezes the records of the given service: updates of the
+// service and of its endpoints are ignored until UnpinService is called, so
+// that churn doesn't make clients flap, e.g. during a migration. The
+// records of the service are still removed if it is deleted.
+func (kd *KubeDNS) PinService(namespace, name string) {
+	key := namespace + "/" + name
+	var endpoints *v1.Endpoints
+	if obj, exists, err := kd.endpointsStore.GetByKey(key); err == nil && exists {
+		endpoints, _ = obj.(*v1.Endpoints)
+	}
+
+	kd.pinnedServicesLock.Lock()
+	defer kd.pinnedServicesLock.Unlock()
+	if _, pinned := kd.pinnedServices[key]; pinned {
+		return
+	}
+	if kd.pinnedServices == nil {
+		kd.pinnedServices = make(map[string]*v1.Endpoints)
+	}
+	kd.pinnedServices[key] = endpoints
+	klog.Infof("Pinned the records of service %s", key)
+}
+
+// UnpinService resumes the updates of the records of the given service
+// pinned by PinService, and brings them up to date.
+func (kd *KubeDNS) UnpinService(namespace, name string) {
+	key := namespace + "/" + name
+	kd.pinnedServicesLock.Lock()
+	pinnedEndpoints, pinned := kd.pinnedServices[key]
+	delete(kd.pinnedServices, key)
+	kd.pinnedServicesLock.Unlock()
+	if !pinned {
+		return
+	}
+	klog.Infof("Unpinned the records of service %s", key)
+
+	obj, exists, err := kd.servicesStore.GetByKey(key)
+	if err != nil || !exists {
+		return
+	}
+	kd.newService(obj)
+	if obj, exists, err := kd.endpointsStore.GetByKey(key); err == nil && exists && pinnedEndpoints != nil {
+		// Remove the reverse records of the addresses gone while pinned.
+		kd.handleEndpointUpdate(pinnedEndpoints, obj)
+	}
+}
+
+// isPinned returns whether the records of the service with the given
+// namespace and name are pinned.
+func (kd *KubeDNS) isPinned(namespace, name string) bool {
+	kd.pinnedServicesLock.RLock()
+	defer kd.pinnedServicesLock.RUnlock()
+	_, pinned := kd.pinnedServices[namespace+"/"+name]
+	return pinned
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPinService(t *testing.T) {
+	kd := newKubeDNS()
+	s := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(s))
+	endpoints := newEndpoints(s, newSubsetWithOnePortWithHostname("http", 80, true, "10.0.0.1", "10.0.0.2"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(s)
+	assertDNSForHeadlessService(t, kd, endpoints)
+	assertReverseDNSForNamedHeadlessService(t, kd, endpoints)
+
+	kd.PinService(s.Namespace, s.Name)
+
+	// Churn of the endpoints is ignored.
+	churned := newEndpoints(s, newSubsetWithOnePortWithHostname("http", 80, true, "10.0.0.3"))
+	assert.NoError(t, kd.endpointsStore.Update(churned))
+	kd.handleEndpointUpdate(endpoints, churned)
+	kd.handleEndpointAdd(churned)
+	assertDNSForHeadlessService(t, kd, endpoints)
+	assertReverseDNSForNamedHeadlessService(t, kd, endpoints)
+
+	// So are the updates of the service.
+	updated := *s
+	updated.Spec.ClusterIP = "1.2.3.4"
+	kd.updateService(s, &updated)
+	assertDNSForHeadlessService(t, kd, endpoints)
+
+	// Other services keep updating.
+	other := newService(testNamespace, "other", "1.2.3.5", "http", 80)
+	assert.NoError(t, kd.servicesStore.Add(other))
+	kd.newService(other)
+	assertDNSForClusterIP(t, "other", kd, other, []string{"1.2.3.5"})
+
+	// Once unpinned, the records catch up.
+	kd.UnpinService(s.Namespace, s.Name)
+	assertDNSForHeadlessService(t, kd, churned)
+	assertReverseDNSForNamedHeadlessService(t, kd, churned)
+	_, err := kd.ReverseRecord("1.0.0.10.in-addr.arpa.")
+	assert.Error(t, err)
+	assert.False(t, kd.isPinned(s.Namespace, s.Name))
+}
+
+func TestPinServiceReconcile(t *testing.T) {
+	kd := newKubeDNS()
+	s := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(s))
+	endpoints := newEndpoints(s, newSubsetWithOnePortWithHostname("http", 80, true, "10.0.0.1"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(s)
+	kd.PinService(s.Namespace, s.Name)
+
+	churned := newEndpoints(s, newSubsetWithOnePortWithHostname("http", 80, true, "10.0.0.9"))
+	assert.NoError(t, kd.endpointsStore.Update(churned))
+	kd.handleEndpointUpdate(endpoints, churned)
+
+	// The reconciler neither reports nor repairs the pinned records.
+	assert.Empty(t, kd.reconcile(true))
+	assertDNSForHeadlessService(t, kd, endpoints)
+	assertReverseDNSForNamedHeadlessService(t, kd, endpoints)
+
+	kd.UnpinService(s.Namespace, s.Name)
+	assert.Empty(t, kd.reconcile(false))
+	assertDNSForHeadlessService(t, kd, churned)
+}
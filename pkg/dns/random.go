@@ -0,0 +1,99 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	skymsg "github.com/skynetservices/skydns/msg"
+
+	"k8s.io/dns/pkg/dns/config"
+)
+
+// lockedRand is a source of randomness safe for concurrent use. The zero
+// value is seeded with the current time on first use.
+type lockedRand struct {
+	lock sync.Mutex
+	rand *rand.Rand
+}
+
+func (r *lockedRand) setSource(source rand.Source) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.rand = rand.New(source)
+}
+
+// ensureRand must be called with the lock held.
+func (r *lockedRand) ensureRand() *rand.Rand {
+	if r.rand == nil {
+		r.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return r.rand
+}
+
+func (r *lockedRand) Shuffle(n int, swap func(i, j int)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.ensureRand().Shuffle(n, swap)
+}
+
+func (r *lockedRand) Int63n(n int64) int64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.ensureRand().Int63n(n)
+}
+
+// SetRandSource sets the source of randomness of every random choice made
+// when answering queries, e.g. the order of shuffled records, so that it can
+// be pinned for reproducible results. By default the source is seeded with
+// the time of the first random choice.
+func (kd *KubeDNS) SetRandSource(source rand.Source) {
+	kd.random.setSource(source)
+}
+
+// shuffleRecords shuffles the given records in place. The records are
+// sorted by key first, so that their order only depends on the source of
+// randomness and not on the order they were found in the cache.
+func (kd *KubeDNS) shuffleRecords(records []skymsg.Service) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Key != records[j].Key {
+			return records[i].Key < records[j].Key
+		}
+		return records[i].Host < records[j].Host
+	})
+	kd.random.Shuffle(len(records), func(i, j int) {
+		records[i], records[j] = records[j], records[i]
+	})
+}
+
+// applyTTLJitter randomly lengthens or shortens the TTL of the given records
+// by up to the TTLJitterPercent of the configuration.
+func (kd *KubeDNS) applyTTLJitter(records []skymsg.Service, currentConfig *config.Config) {
+	if currentConfig.TTLJitterPercent == 0 {
+		return
+	}
+	for i := range records {
+		jitter := int64(records[i].Ttl) * int64(currentConfig.TTLJitterPercent) / 100
+		if jitter == 0 {
+			continue
+		}
+		records[i].Ttl = uint32(int64(records[i].Ttl) + kd.random.Int63n(2*jitter+1) - jitter)
+	}
+}
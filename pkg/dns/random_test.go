@@ -0,0 +1,101 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/dns/pkg/dns/config"
+)
+
+func TestShuffleRecordsWithPinnedSeed(t *testing.T) {
+	ips := []string{}
+	for i := 1; i <= 10; i++ {
+		ips = append(ips, fmt.Sprintf("10.0.0.%d", i))
+	}
+	newShufflingKubeDNS := func() *KubeDNS {
+		kd := newKubeDNS()
+		kd.config = &config.Config{ShuffleRecords: true}
+		kd.SetRandSource(rand.NewSource(42))
+		s := newHeadlessService()
+		assert.NoError(t, kd.servicesStore.Add(s))
+		assert.NoError(t, kd.endpointsStore.Add(newEndpoints(s, newSubsetWithOnePort("", 80, ips...))))
+		kd.newService(s)
+		return kd
+	}
+	answers := func(kd *KubeDNS) []string {
+		records, err := kd.Records(testService+"."+testNamespace+".svc."+testDomain, false)
+		require.NoError(t, err)
+		hosts := []string{}
+		for _, record := range records {
+			hosts = append(hosts, record.Host)
+		}
+		return hosts
+	}
+
+	first, second := newShufflingKubeDNS(), newShufflingKubeDNS()
+	orders := map[string]bool{}
+	for i := 0; i < 5; i++ {
+		answer := answers(first)
+		assert.Equal(t, answer, answers(second))
+		assert.ElementsMatch(t, ips, answer)
+		orders[fmt.Sprint(answer)] = true
+	}
+	// Successive answers are shuffled differently.
+	assert.True(t, len(orders) > 1)
+}
+
+func TestTTLJitter(t *testing.T) {
+	kd := newKubeDNS()
+	kd.SetRandSource(rand.NewSource(42))
+	s := newService(testNamespace, testService, "1.2.3.4", "", 80)
+	kd.newService(s)
+	name := getServiceFQDN(kd.domain, s)
+
+	ttls := func() map[uint32]bool {
+		ttls := map[uint32]bool{}
+		for i := 0; i < 100; i++ {
+			records, err := kd.Records(name, false)
+			require.NoError(t, err)
+			require.Equal(t, 1, len(records))
+			ttls[records[0].Ttl] = true
+		}
+		return ttls
+	}
+
+	// No jitter by default.
+	assert.Equal(t, map[uint32]bool{30: true}, ttls())
+
+	// The default TTL of 30s varies by up to 3s.
+	kd.config = &config.Config{TTLJitterPercent: 10}
+	jittered := ttls()
+	assert.True(t, len(jittered) > 1, "TTLs don't vary: %v", jittered)
+	for ttl := range jittered {
+		assert.True(t, ttl >= 27 && ttl <= 33, "TTL %d out of the jitter band", ttl)
+	}
+
+	// The jittered TTLs are still bounded.
+	kd.config = &config.Config{TTLJitterPercent: 10, MinTTL: 29, MaxTTL: 31}
+	for ttl := range ttls() {
+		assert.True(t, ttl >= 29 && ttl <= 31, "TTL %d out of bounds", ttl)
+	}
+}
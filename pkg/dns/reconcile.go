@@ -0,0 +1,277 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	skymsg "github.com/skynetservices/skydns/msg"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/dns/pkg/dns/util"
+	"k8s.io/klog/v2"
+)
+
+// reconcileDisabledPollPeriod is how often the configuration is checked
+// while reconciliation is disabled.
+const reconcileDisabledPollPeriod = time.Minute
+
+var reconcileDriftDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(metricsNamespace, "", "reconcile_drifted_services_total"),
+	"Number of services whose records were found out of sync with the "+
+		"services and endpoints stores by the periodic reconciliation.",
+	nil, nil)
+
+// runReconciler periodically compares the records of the cache with the
+// services and endpoints stores while reconcileInterval is set, until
+// stopCh is closed.
+func (kd *KubeDNS) runReconciler(stopCh <-chan struct{}) {
+	for {
+		currentConfig := kd.currentConfig()
+		interval := currentConfig.ReconcileInterval.Duration
+		if interval <= 0 {
+			select {
+			case <-stopCh:
+				return
+			case <-kd.clock.After(reconcileDisabledPollPeriod):
+			}
+			continue
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-kd.clock.After(interval):
+			kd.reconcile(kd.currentConfig().ReconcileRepair)
+		}
+	}
+}
+
+// reconcile returns the keys of the services whose records are out of sync
+// with the services and endpoints stores, along with the keys of the
+// services records are served for that are not in the services store. The
+// records of these services are regenerated, or removed, if repair is set.
+// Pinned services are left out.
+// The stores are the only source of truth, no request is made to the
+// apiserver.
+func (kd *KubeDNS) reconcile(repair bool) []string {
+	currentConfig := kd.currentConfig()
+	drifted := []string{}
+	cached := kd.cachedServiceKeys()
+
+	for _, obj := range kd.servicesStore.List() {
+		service, ok := assertIsService(obj)
+		if !ok || !kd.servesNamespace(service.Namespace) {
+			continue
+		}
+		key := service.Namespace + "/" + service.Name
+		cached.Delete(key)
+		// The records of pinned services are out of sync on purpose.
+		if kd.isPinned(service.Namespace, service.Name) {
+			continue
+		}
+		if err := kd.checkServiceRecords(service); err != nil {
+			klog.Warningf("Records of service %s are out of sync: %v", key, err)
+			drifted = append(drifted, key)
+			if repair {
+				kd.repairServiceRecords(service)
+			}
+		}
+	}
+
+	// Records that are not generated from the services store.
+	kd.externalServicesLock.Lock()
+	for key := range kd.externalServices {
+		cached.Delete(key)
+	}
+	kd.externalServicesLock.Unlock()
+	kd.pendingRemovalsLock.Lock()
+	for key := range kd.pendingRemovals {
+		cached.Delete(key)
+	}
+	kd.pendingRemovalsLock.Unlock()
+	if currentConfig.KubernetesServiceIP != "" {
+		cached.Delete(metav1.NamespaceDefault + "/" + kubernetesServiceName)
+	}
+	if currentConfig.DNSServiceIP != "" {
+		cached.Delete(metav1.NamespaceSystem + "/" + dnsServiceName)
+	}
+
+	for _, key := range cached.List() {
+		klog.Warningf("Records of service %s are served but the service does not exist", key)
+		drifted = append(drifted, key)
+		if repair {
+			kd.removeStaleService(splitServiceKey(key))
+		}
+	}
+
+	sort.Strings(drifted)
+	atomic.AddUint64(&kd.reconcileDrifts, uint64(len(drifted)))
+	klog.V(2).Infof("Reconciled the records of the cache, %d services out of sync", len(drifted))
+	return drifted
+}
+
+// removeStaleService removes the records of a service that is not in the
+// services store, along with the reverse records pointing to them. As the
+// service object is gone, the cluster IPs and endpoints it owned are found
+// from the cluster IPs map and the reverse records rather than from the
+// service.
+func (kd *KubeDNS) removeStaleService(namespace, name string) {
+	service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+	fqdn := kd.fqdn(service)
+	kd.removeService(service)
+
+	kd.cacheLock.Lock()
+	defer kd.cacheLock.Unlock()
+	kd.recordsChanged(namespace, name)
+	owned := func(record *skymsg.Service) bool {
+		return record.Host == fqdn || strings.HasSuffix(record.Host, "."+fqdn)
+	}
+	for ip, record := range kd.shadowedReverseRecords {
+		if owned(record) {
+			delete(kd.shadowedReverseRecords, ip)
+		}
+	}
+	for ip, record := range kd.reverseRecordMap {
+		owner, ok := kd.clusterIPServiceMap[ip]
+		if ok && owner.Namespace == namespace && owner.Name == name {
+			kd.releaseClusterIP(ip)
+		} else if owned(record) {
+			delete(kd.reverseRecordMap, ip)
+			delete(kd.clusterIPServiceMap, ip)
+		}
+	}
+	// The cluster IPs in an excluded CIDR have no reverse record.
+	for ip, owner := range kd.clusterIPServiceMap {
+		if owner.Namespace == namespace && owner.Name == name {
+			kd.releaseClusterIP(ip)
+		}
+	}
+}
+
+// cachedServiceKeys returns the keys of the services records are cached
+// for.
+func (kd *KubeDNS) cachedServiceKeys() sets.String {
+	path := append(append([]string{}, kd.domainPath...), serviceSubdomain)
+	keys := sets.NewString()
+	kd.cacheLock.RLock()
+	defer kd.cacheLock.RUnlock()
+	for _, record := range kd.cache.GetAllValuesForPath(path...) {
+		if namespace, name, ok := kd.serviceForRecordKey(record.Key); ok {
+			keys.Insert(namespace + "/" + name)
+		}
+	}
+	return keys
+}
+
+// checkServiceRecords returns an error if the records cached for the given
+// service are not the ones generated from the stores.
+func (kd *KubeDNS) checkServiceRecords(service *v1.Service) error {
+	path := append(append([]string{}, kd.domainPath...), serviceSubdomain, service.Namespace)
+	expected := sets.NewString()
+	switch {
+	case service.Spec.Type == v1.ServiceTypeExternalName:
+		expected.Insert(service.Spec.ExternalName)
+	case util.IsServiceIPSet(service):
+		expected.Insert(util.GetClusterIPs(service)...)
+	default:
+		obj, exists, err := kd.endpointsStore.GetByKey(service.Namespace + "/" + service.Name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if e, ok := obj.(*v1.Endpoints); ok {
+				for i := range e.Subsets {
+					for _, address := range servedAddresses(&e.Subsets[i], service) {
+						expected.Insert(address.IP)
+					}
+				}
+			}
+		}
+	}
+
+	actual := sets.NewString()
+	kd.cacheLock.RLock()
+	if service.Spec.Type == v1.ServiceTypeExternalName {
+		if record, ok := kd.cache.GetEntry(service.Name, path...); ok {
+			actual.Insert(record.(*skymsg.Service).Host)
+		}
+	} else {
+		for _, record := range kd.cache.GetValuesForPathWithWildcards(append(path, service.Name)...) {
+			actual.Insert(record.Host)
+		}
+	}
+	kd.cacheLock.RUnlock()
+
+	// The addresses of headless services may be capped.
+	if maxAddresses := kd.currentConfig().MaxEndpointAddresses; !util.IsServiceIPSet(service) &&
+		service.Spec.Type != v1.ServiceTypeExternalName && maxAddresses > 0 && expected.Len() > maxAddresses {
+		if !expected.IsSuperset(actual) || actual.Len() != maxAddresses {
+			return fmt.Errorf("expected %d of %v, got %v", maxAddresses, expected.List(), actual.List())
+		}
+		return nil
+	}
+	if !expected.Equal(actual) {
+		return fmt.Errorf("expected %v, got %v", expected.List(), actual.List())
+	}
+	return nil
+}
+
+// repairServiceRecords regenerates the records of the given service.
+func (kd *KubeDNS) repairServiceRecords(service *v1.Service) {
+	if service.Spec.Type != v1.ServiceTypeExternalName && !util.IsServiceIPSet(service) {
+		// The records of headless services without endpoints are not
+		// regenerated, only removed.
+		if _, exists, err := kd.endpointsStore.GetByKey(service.Namespace + "/" + service.Name); err == nil && !exists {
+			kd.removeService(service)
+			return
+		}
+	}
+	kd.newService(service)
+}
+
+func splitServiceKey(key string) (string, string) {
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) != 2 {
+		return "", key
+	}
+	return parts[0], parts[1]
+}
+
+type reconcileCollector struct {
+	kd *KubeDNS
+}
+
+// ReconcileCollector returns a prometheus.Collector exporting the number of
+// services found out of sync by the periodic reconciliation.
+func (kd *KubeDNS) ReconcileCollector() prometheus.Collector {
+	return &reconcileCollector{kd: kd}
+}
+
+func (c *reconcileCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- reconcileDriftDesc
+}
+
+func (c *reconcileCollector) Collect(ch chan<- prometheus.Metric) {
+	drifts := atomic.LoadUint64(&c.kd.reconcileDrifts)
+	ch <- prometheus.MustNewConstMetric(reconcileDriftDesc, prometheus.CounterValue, float64(drifts))
+}
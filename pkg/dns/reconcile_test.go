@@ -0,0 +1,124 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+
+	"k8s.io/dns/pkg/dns/config"
+)
+
+func TestReconcile(t *testing.T) {
+	kd := newKubeDNS()
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(kd.ReconcileCollector()))
+
+	portal := newService(testNamespace, "portal", "1.2.3.4", "http", 80)
+	assert.NoError(t, kd.servicesStore.Add(portal))
+	kd.newService(portal)
+	headless := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(headless))
+	assert.NoError(t, kd.endpointsStore.Add(newEndpoints(headless, newSubsetWithOnePort("http", 80, "10.0.0.1"))))
+	kd.newService(headless)
+	external := newExternalNameService()
+	external.Name = "external"
+	assert.NoError(t, kd.servicesStore.Add(external))
+	kd.newService(external)
+
+	assert.Empty(t, kd.reconcile(false))
+
+	// Inject drift: updates the handlers missed and records without a
+	// service.
+	moved := newService(testNamespace, "portal", "1.2.3.5", "http", 80)
+	assert.NoError(t, kd.servicesStore.Update(moved))
+	assert.NoError(t, kd.endpointsStore.Update(newEndpoints(headless, newSubsetWithOnePort("http", 80, "10.0.0.1", "10.0.0.2"))))
+	kd.newService(newService("other", "stale", "1.2.3.6", "http", 80))
+
+	expected := []string{"default/portal", "default/testservice", "other/stale"}
+	assert.Equal(t, expected, kd.reconcile(false))
+	// Without repair, the records are left untouched.
+	assert.Equal(t, expected, kd.reconcile(false))
+	verifyRecord(t, "portal", getServiceFQDN(kd.domain, portal), "1.2.3.4", kd)
+
+	assert.Equal(t, expected, kd.reconcile(true))
+	assert.Empty(t, kd.reconcile(false))
+	verifyRecord(t, "portal", getServiceFQDN(kd.domain, moved), "1.2.3.5", kd)
+	records, err := kd.Records(getServiceFQDN(kd.domain, headless), false)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(records))
+	_, err = kd.Records("stale.other.svc."+testDomain, false)
+	assert.Error(t, err)
+	_, err = kd.ReverseRecord("6.3.2.1.in-addr.arpa.")
+	assert.Error(t, err)
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(families))
+	assert.Equal(t, 9.0, families[0].GetMetric()[0].GetCounter().GetValue())
+}
+
+func TestReconcilePublishedNotReadyAddresses(t *testing.T) {
+	kd := newKubeDNS()
+	s := newHeadlessService()
+	s.Spec.PublishNotReadyAddresses = true
+	assert.NoError(t, kd.servicesStore.Add(s))
+	subset := newSubsetWithOnePort("http", 80, "10.0.0.1")
+	subset.NotReadyAddresses = []v1.EndpointAddress{{IP: "10.0.0.2"}}
+	endpoints := newEndpoints(s, subset)
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(s)
+
+	// The published not-ready address is expected, not drift.
+	assert.Empty(t, kd.reconcile(false))
+}
+
+func TestReconcileIgnoresRecordsWithoutService(t *testing.T) {
+	kd := newKubeDNS()
+	kd.config = &config.Config{KubernetesServiceIP: "10.0.0.1"}
+	kd.seedService(metav1.NamespaceDefault, kubernetesServiceName, "10.0.0.1")
+	assert.NoError(t, kd.UpsertExternalService(ExternalServiceSpec{Namespace: testNamespace, Name: "crd", IPs: []string{"1.2.3.4"}}))
+	assert.Empty(t, kd.reconcile(false))
+}
+
+func TestRunReconciler(t *testing.T) {
+	kd := newKubeDNS()
+	fakeClock := clock.NewFakeClock(time.Now())
+	kd.clock = fakeClock
+	kd.config = &config.Config{
+		ReconcileInterval: metav1.Duration{Duration: time.Minute},
+		ReconcileRepair:   true,
+	}
+	kd.newService(newService(testNamespace, "stale", "1.2.3.4", "http", 80))
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go kd.runReconciler(stopCh)
+
+	require.Eventually(t, fakeClock.HasWaiters, time.Second, time.Millisecond)
+	fakeClock.Step(time.Minute)
+	assert.Eventually(t, func() bool {
+		_, err := kd.Records("stale."+testNamespace+".svc."+testDomain, false)
+		return err != nil
+	}, time.Second, time.Millisecond)
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/miekg/dns"
+	"k8s.io/dns/pkg/dns/util"
+)
+
+// ResolveRcode is the outcome of Resolve.
+type ResolveRcode int
+
+const (
+	// ResolveNoError means that records of the queried type were found.
+	ResolveNoError ResolveRcode = iota
+	// ResolveNXDomain means that the queried name doesn't exist.
+	ResolveNXDomain
+	// ResolveNoData means that the queried name exists, but has no record
+	// of the queried type.
+	ResolveNoData
+)
+
+func (rcode ResolveRcode) String() string {
+	switch rcode {
+	case ResolveNoError:
+		return "NOERROR"
+	case ResolveNXDomain:
+		return "NXDOMAIN"
+	case ResolveNoData:
+		return "NODATA"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// ResolveRequest is a question to Resolve.
+type ResolveRequest struct {
+	// Name is the queried name, e.g. "mysvc.myns.svc.cluster.local.".
+	Name string
+	// Qtype is the queried record type, e.g. dns.TypeA.
+	Qtype uint16
+	// Exact is whether the records of the names under Name are excluded,
+	// as in Records.
+	Exact bool
+	// ClientSubnet is the subnet of the client, if known, as in the EDNS0
+	// client subnet option. The answers of KubeDNS don't depend on the
+	// client for now, so it is ignored.
+	ClientSubnet *net.IPNet
+}
+
+// ResolveResponse is the answer of Resolve.
+type ResolveResponse struct {
+	Rcode ResolveRcode
+	// Records are the records answering the question, if Rcode is
+	// ResolveNoError.
+	Records []dns.RR
+}
+
+// Resolve answers the given question without the DNS wire protocol, for
+// users embedding KubeDNS. It answers SOA questions for the cluster domain
+// with SOA if the configuration enables it, PTR questions with
+// ReverseRecord, ANY questions with RecordsForAny and other questions with
+// Records, as the DNS server in front of KubeDNS would: A and AAAA questions
+// are answered with the CNAME records of a name without addresses. An error
+// is only returned if the lookup failed, not if the name doesn't exist.
+func (kd *KubeDNS) Resolve(req ResolveRequest) (ResolveResponse, error) {
+	name := dns.Fqdn(req.Name)
+	if kd.currentConfig().SOARecord && kd.isSOAQuestion(name, req.Qtype) {
+		return ResolveResponse{Rcode: ResolveNoError, Records: []dns.RR{kd.SOA()}}, nil
+	}
+	if lower := strings.ToLower(name); strings.HasSuffix(lower, util.ArpaSuffix) || strings.HasSuffix(lower, util.ArpaSuffixV6) {
+		return kd.resolveReverse(name, req.Qtype)
+	}
+
+	var answer []dns.RR
+	if req.Qtype == dns.TypeANY {
+		records, err := kd.RecordsForAny(name)
+		if err != nil {
+			return resolveError(err)
+		}
+		answer = records
+	} else {
+		records, err := kd.Records(name, req.Exact)
+		if err != nil {
+			return resolveError(err)
+		}
+		answer = []dns.RR{}
+		cnames := []dns.RR{}
+		for i := range records {
+			rr := anyRecord(name, &records[i])
+			switch rr.Header().Rrtype {
+			case req.Qtype:
+				answer = append(answer, rr)
+			case dns.TypeCNAME:
+				cnames = append(cnames, rr)
+			}
+		}
+		if len(answer) == 0 && (req.Qtype == dns.TypeA || req.Qtype == dns.TypeAAAA) {
+			answer = cnames
+		}
+	}
+
+	if len(answer) == 0 {
+		return ResolveResponse{Rcode: ResolveNoData}, nil
+	}
+	return ResolveResponse{Rcode: ResolveNoError, Records: answer}, nil
+}
+
+// resolveReverse answers the given question for a reverse name.
+func (kd *KubeDNS) resolveReverse(name string, qtype uint16) (ResolveResponse, error) {
+	if qtype == dns.TypeANY {
+		qtype = dns.TypePTR
+	}
+	record, err := kd.ReverseRecord(strings.ToLower(name))
+	if err != nil {
+		if errors.Is(err, ErrReverseNotFound) {
+			return ResolveResponse{Rcode: ResolveNXDomain}, nil
+		}
+		return ResolveResponse{}, err
+	}
+	if qtype != dns.TypePTR {
+		return ResolveResponse{Rcode: ResolveNoData}, nil
+	}
+	hdr := dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: record.Ttl}
+	return ResolveResponse{
+		Rcode:   ResolveNoError,
+		Records: []dns.RR{&dns.PTR{Hdr: hdr, Ptr: dns.Fqdn(record.Host)}},
+	}, nil
+}
+
+// resolveError converts the error of a lookup to the response of Resolve.
+func resolveError(err error) (ResolveResponse, error) {
+	if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeKeyNotFound {
+		return ResolveResponse{Rcode: ResolveNXDomain}, nil
+	}
+	return ResolveResponse{}, err
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolve(t *testing.T) {
+	kd := newKubeDNS()
+
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	kd.newService(s)
+	external := newExternalNameService()
+	external.Name = "external"
+	kd.newService(external)
+
+	resolve := func(name string, qtype uint16) ResolveResponse {
+		resp, err := kd.Resolve(ResolveRequest{Name: name, Qtype: qtype})
+		require.NoError(t, err)
+		return resp
+	}
+
+	name := testService + "." + testNamespace + ".svc." + testDomain
+	resp := resolve(name, dns.TypeA)
+	assert.Equal(t, ResolveNoError, resp.Rcode)
+	require.Equal(t, 1, len(resp.Records))
+	assert.Equal(t, "1.2.3.4", resp.Records[0].(*dns.A).A.String())
+	assert.Equal(t, name, resp.Records[0].Header().Name)
+
+	resp = resolve("_http._tcp."+name, dns.TypeSRV)
+	assert.Equal(t, ResolveNoError, resp.Rcode)
+	require.Equal(t, 1, len(resp.Records))
+	assert.Equal(t, uint16(80), resp.Records[0].(*dns.SRV).Port)
+
+	// A and AAAA questions for ExternalName services are answered with
+	// their CNAME record.
+	resp = resolve("external."+testNamespace+".svc."+testDomain, dns.TypeA)
+	assert.Equal(t, ResolveNoError, resp.Rcode)
+	require.Equal(t, 1, len(resp.Records))
+	assert.Equal(t, testExternalName+".", resp.Records[0].(*dns.CNAME).Target)
+
+	resp = resolve("4.3.2.1.in-addr.arpa.", dns.TypePTR)
+	assert.Equal(t, ResolveNoError, resp.Rcode)
+	require.Equal(t, 1, len(resp.Records))
+	assert.Equal(t, name, resp.Records[0].(*dns.PTR).Ptr)
+
+	assert.Equal(t, ResolveNoData, resolve(name, dns.TypeAAAA).Rcode)
+	assert.Equal(t, ResolveNoData, resolve(name, dns.TypeTXT).Rcode)
+	assert.Equal(t, ResolveNoData, resolve("4.3.2.1.in-addr.arpa.", dns.TypeA).Rcode)
+
+	assert.Equal(t, ResolveNXDomain, resolve("missing."+testNamespace+".svc."+testDomain, dns.TypeA).Rcode)
+	assert.Equal(t, ResolveNXDomain, resolve("5.3.2.1.in-addr.arpa.", dns.TypePTR).Rcode)
+	assert.Nil(t, resolve("missing."+testNamespace+".svc."+testDomain, dns.TypeA).Records)
+}
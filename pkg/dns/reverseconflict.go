@@ -0,0 +1,124 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"reflect"
+
+	skymsg "github.com/skynetservices/skydns/msg"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// An IP may be both the cluster IP of a service and the address of an
+// endpoint of a headless service. The reverse record of the cluster IP then
+// takes precedence, whatever the order the service and the endpoints are
+// seen in: the reverse record of the endpoint is set aside in
+// shadowedReverseRecords, and served again once the cluster IP is released.
+
+// claimClusterIP records that the given IP is a cluster IP of service,
+// setting aside the reverse record of the endpoint with the same IP, if any.
+// It returns whether the IP was not a cluster IP of service already.
+// Important: Assumes that we already have the cacheLock.
+func (kd *KubeDNS) claimClusterIP(ip string, service *v1.Service) bool {
+	owner, ok := kd.clusterIPServiceMap[ip]
+	if !ok {
+		if record, ok := kd.reverseRecordMap[ip]; ok {
+			klog.Warningf("Cluster IP %q of service %s/%s is also the address of an endpoint, "+
+				"its reverse record takes precedence over the one of the endpoint pointing to %q",
+				ip, service.Namespace, service.Name, record.Host)
+			kd.shadowReverseRecord(ip, record)
+		}
+	}
+	kd.clusterIPServiceMap[ip] = service
+	return !ok || owner.Namespace != service.Namespace || owner.Name != service.Name
+}
+
+// releaseClusterIP removes the reverse record of the given cluster IP, and
+// serves the reverse record of the endpoint with the same IP again, if any.
+// It returns whether the IP had a reverse record or was a cluster IP.
+// Important: Assumes that we already have the cacheLock.
+func (kd *KubeDNS) releaseClusterIP(ip string) bool {
+	_, changed := kd.clusterIPServiceMap[ip]
+	changed = kd.deleteReverseRecord(ip) || changed
+	delete(kd.clusterIPServiceMap, ip)
+	if record, ok := kd.shadowedReverseRecords[ip]; ok {
+		klog.V(2).Infof("Cluster IP %q released, serving the reverse record of the endpoint pointing to %q", ip, record.Host)
+		kd.reverseRecordMap[ip] = record
+		delete(kd.shadowedReverseRecords, ip)
+		changed = true
+	}
+	return changed
+}
+
+// setReverseRecord sets the reverse record of the given IP, and returns
+// whether it differs from the one it replaced, if any.
+// Important: Assumes that we already have the cacheLock.
+func (kd *KubeDNS) setReverseRecord(ip string, record *skymsg.Service) bool {
+	previous, ok := kd.reverseRecordMap[ip]
+	kd.reverseRecordMap[ip] = record
+	return !ok || !reflect.DeepEqual(previous, record)
+}
+
+// deleteReverseRecord removes the reverse record of the given IP, and
+// returns whether it had one.
+// Important: Assumes that we already have the cacheLock.
+func (kd *KubeDNS) deleteReverseRecord(ip string) bool {
+	_, ok := kd.reverseRecordMap[ip]
+	delete(kd.reverseRecordMap, ip)
+	return ok
+}
+
+// setEndpointReverseRecord sets the reverse record of the given endpoint
+// IP, unless it is a cluster IP, in which case the record is set aside. It
+// returns whether the reverse record of the IP changed.
+// Important: Assumes that we already have the cacheLock.
+func (kd *KubeDNS) setEndpointReverseRecord(ip string, record *skymsg.Service) bool {
+	if service, ok := kd.clusterIPServiceMap[ip]; ok {
+		if shadowed, ok := kd.shadowedReverseRecords[ip]; !ok || shadowed.Host != record.Host {
+			klog.Warningf("Endpoint IP %q is also a cluster IP of service %s/%s, "+
+				"its reverse record pointing to %q is not served while the cluster IP is",
+				ip, service.Namespace, service.Name, record.Host)
+		}
+		kd.shadowReverseRecord(ip, record)
+		return false
+	}
+	klog.V(4).Infof("Adding endpointIP %q to reverseRecord %+v", ip, record)
+	return kd.setReverseRecord(ip, record)
+}
+
+// removeEndpointReverseRecord removes the reverse record of the given
+// endpoint IP, leaving the one of the cluster IP with the same IP, if any.
+// It returns whether the reverse record of the IP changed.
+// Important: Assumes that we already have the cacheLock.
+func (kd *KubeDNS) removeEndpointReverseRecord(ip string) bool {
+	if _, ok := kd.clusterIPServiceMap[ip]; ok {
+		delete(kd.shadowedReverseRecords, ip)
+		return false
+	}
+	return kd.deleteReverseRecord(ip)
+}
+
+// shadowReverseRecord sets aside the given reverse record of an endpoint
+// whose IP is a cluster IP.
+// Important: Assumes that we already have the cacheLock.
+func (kd *KubeDNS) shadowReverseRecord(ip string, record *skymsg.Service) {
+	if kd.shadowedReverseRecords == nil {
+		kd.shadowedReverseRecords = make(map[string]*skymsg.Service)
+	}
+	kd.shadowedReverseRecords[ip] = record
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+	"k8s.io/dns/pkg/dns/util"
+)
+
+const (
+	// Refresh, retry and expire intervals of the SOA record of the cluster
+	// domain, in seconds.
+	soaRefresh = 60 * 60
+	soaRetry   = 10 * 60
+	soaExpire  = 7 * 24 * 60 * 60
+)
+
+// SOASerial returns the serial of the SOA record of the cluster domain. It
+// is incremented every time the records change, wrapping around as per RFC
+// 1982.
+func (kd *KubeDNS) SOASerial() uint32 {
+	kd.cacheLock.RLock()
+	defer kd.cacheLock.RUnlock()
+	return kd.soaSerial
+}
+
+// SOA returns the SOA record of the cluster domain, with the current
+// serial. Its TTL and minimum, the TTL of negative answers, are the default
+// TTL of the records.
+func (kd *KubeDNS) SOA() *dns.SOA {
+	return kd.soa(kd.SOASerial())
+}
+
+// soa returns the SOA record of the cluster domain with the given serial.
+func (kd *KubeDNS) soa(serial uint32) *dns.SOA {
+	domain := dns.Fqdn(kd.domain)
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   domain,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    util.DefaultTTL,
+		},
+		Ns:      "ns.dns." + domain,
+		Mbox:    "hostmaster." + domain,
+		Serial:  serial,
+		Refresh: soaRefresh,
+		Retry:   soaRetry,
+		Expire:  soaExpire,
+		Minttl:  util.DefaultTTL,
+	}
+}
+
+// isSOAQuestion returns whether the given name and type ask for the SOA
+// record of the cluster domain.
+func (kd *KubeDNS) isSOAQuestion(name string, qtype uint16) bool {
+	return qtype == dns.TypeSOA && strings.EqualFold(dns.Fqdn(name), dns.Fqdn(kd.domain))
+}
+
+// recordsChanged increments the serial of the SOA record and forgets the
+// misses of the negative cache that may name a record of the service with
+// the given namespace and name after a change of its records, or of any
+// service of the namespace if name is empty.
+// Important: Assumes that we already have the cacheLock.
+func (kd *KubeDNS) recordsChanged(namespace, name string) {
+	kd.soaSerial++
+	kd.negativeCache.invalidate(func(query string) bool {
+		return mayNameService(query, namespace, name)
+	})
+}
+
+// mayNameService returns whether the given name may name a record of the
+// service with the given namespace and name, or of any service of the
+// namespace if name is empty: whether it has labels matching the name and
+// the namespace in a row, or starts with a label matching the namespace,
+// as ExternalName services are entries of their namespace. A "*" label
+// matches any label.
+func mayNameService(query, namespace, name string) bool {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(query, ".")), ".")
+	matches := func(label, value string) bool {
+		return value == "" || label == value || label == "*"
+	}
+	if matches(labels[0], namespace) {
+		return true
+	}
+	for i := 0; i+1 < len(labels); i++ {
+		if matches(labels[i], name) && matches(labels[i+1], namespace) {
+			return true
+		}
+	}
+	return false
+}
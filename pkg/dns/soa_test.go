@@ -0,0 +1,129 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/dns/pkg/dns/config"
+)
+
+func TestSOASerial(t *testing.T) {
+	kd := newKubeDNS()
+	serial := kd.SOASerial()
+	assertAdvanced := func(change string) {
+		t.Helper()
+		next := kd.SOASerial()
+		assert.True(t, next > serial, "serial %d not advanced past %d after %s", next, serial, change)
+		serial = next
+	}
+
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	kd.newService(s)
+	assertAdvanced("adding a service")
+
+	s.Spec.ClusterIP = "1.2.3.5"
+	s.Spec.ClusterIPs = []string{"1.2.3.5"}
+	kd.newService(s)
+	assertAdvanced("updating a service")
+
+	headless := newHeadlessService()
+	headless.Name = "headless"
+	assert.NoError(t, kd.servicesStore.Add(headless))
+	endpoints := newEndpoints(headless, newSubsetWithOnePortWithHostname("http", 80, true, "10.0.0.1"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(headless)
+	assertAdvanced("adding a headless service")
+
+	kd.handleEndpointAdd(newEndpoints(headless, newSubsetWithOnePortWithHostname("http", 80, true, "10.0.0.2")))
+	assertAdvanced("updating endpoints")
+
+	kd.removeService(s)
+	assertAdvanced("removing a service")
+
+	// Reads leave the serial as is.
+	_, err := kd.Records(getServiceFQDN(kd.domain, headless), false)
+	require.NoError(t, err)
+	assert.Equal(t, serial, kd.SOASerial())
+}
+
+func TestSOASerialUnchangedRecords(t *testing.T) {
+	kd := newKubeDNS()
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	assert.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+	headless := newHeadlessService()
+	headless.Name = "headless"
+	assert.NoError(t, kd.servicesStore.Add(headless))
+	endpoints := newEndpoints(headless, newSubsetWithOnePortWithHostname("http", 80, true, "10.0.0.1"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(headless)
+	externalName := newExternalNameService()
+	externalName.Name = "external"
+	externalName.Annotations = map[string]string{ExternalNameTargetsAnnotation: "secondary.example.com"}
+	assert.NoError(t, kd.servicesStore.Add(externalName))
+	kd.newService(externalName)
+	kd.updateConfig(&config.Config{KubernetesServiceIP: "10.0.0.100"})
+	serial := kd.SOASerial()
+
+	// Resyncs and identical configuration updates regenerate the same
+	// records.
+	kd.updateService(s, s)
+	kd.updateService(headless, headless)
+	kd.handleEndpointUpdate(endpoints, endpoints)
+	kd.updateService(externalName, externalName)
+	kd.updateConfig(&config.Config{KubernetesServiceIP: "10.0.0.100"})
+	assert.Equal(t, serial, kd.SOASerial())
+
+	// Other updates regenerate different records.
+	updated := newService(testNamespace, testService, "1.2.3.5", "http", 80)
+	assert.NoError(t, kd.servicesStore.Update(updated))
+	kd.updateService(s, updated)
+	assert.True(t, kd.SOASerial() > serial)
+}
+
+func TestSOARecord(t *testing.T) {
+	kd := newKubeDNS()
+	kd.newService(newService(testNamespace, testService, "1.2.3.4", "http", 80))
+
+	// The SOA record is opt-in.
+	zone, err := kd.ExportZoneFile()
+	require.NoError(t, err)
+	assert.NotContains(t, zone, "SOA")
+
+	kd.config = &config.Config{SOARecord: true}
+	soa := kd.SOA()
+	assert.Equal(t, "cluster.local.", soa.Hdr.Name)
+	assert.Equal(t, kd.SOASerial(), soa.Serial)
+
+	response, err := kd.Resolve(ResolveRequest{Name: "Cluster.Local", Qtype: dns.TypeSOA})
+	require.NoError(t, err)
+	assert.Equal(t, ResolveNoError, response.Rcode)
+	require.Equal(t, 1, len(response.Records))
+	assert.Equal(t, soa.String(), response.Records[0].String())
+
+	zone, err = kd.ExportZoneFile()
+	require.NoError(t, err)
+	zp := dns.NewZoneParser(strings.NewReader(zone), "", "")
+	rr, ok := zp.Next()
+	require.True(t, ok, "empty zone file: %v", zp.Err())
+	assert.Equal(t, soa.String(), rr.String())
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	skymsg "github.com/skynetservices/skydns/msg"
+	"k8s.io/klog/v2"
+
+	"k8s.io/dns/pkg/dns/util"
+)
+
+// stubZonesSubdomain is the subdomain of the cluster domain the SkyDNS
+// server reads the nameservers of the stub domains from.
+const stubZonesSubdomain = "stub.dns"
+
+// stubDomainRecords returns the records of the nameservers of the stub
+// domains of the configuration, if name is the subdomain the SkyDNS server
+// reads them from. The key of each record is a placeholder label followed
+// by the stub domain under that subdomain, e.g.
+// ns0.acme.local.stub.dns.cluster.local., as SkyDNS derives the stub
+// domain from it. The nameservers given by name are skipped, as SkyDNS only
+// forwards to IPs.
+func (kd *KubeDNS) stubDomainRecords(name string) ([]skymsg.Service, bool) {
+	zone := stubZonesSubdomain + "." + dns.Fqdn(kd.domain)
+	if !strings.EqualFold(dns.Fqdn(name), zone) {
+		return nil, false
+	}
+	stubDomains := kd.currentConfig().StubDomains
+	domains := make([]string, 0, len(stubDomains))
+	for domain := range stubDomains {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	records := []skymsg.Service{}
+	for _, domain := range domains {
+		for i, nameServer := range stubDomains[domain] {
+			ip, port, err := util.ValidateNameserverIpAndPort(nameServer)
+			if err != nil {
+				klog.V(2).Infof("Not forwarding stub domain %q to nameserver %q, which is not an IP", domain, nameServer)
+				continue
+			}
+			portNumber, _ := strconv.Atoi(port)
+			records = append(records, skymsg.Service{
+				Host: ip,
+				Port: portNumber,
+				Ttl:  util.DefaultTTL,
+				Key:  skymsg.Path(fmt.Sprintf("ns%d.%s.%s", i, strings.TrimSuffix(domain, "."), zone)),
+			})
+		}
+	}
+	return records, true
+}
+
+// updateStubZones makes the SkyDNS server reload the nameservers of the
+// stub domains, if it is set.
+func (kd *KubeDNS) updateStubZones() {
+	if kd.UpdateStubZones != nil {
+		kd.UpdateStubZones()
+	}
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	skymsg "github.com/skynetservices/skydns/msg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/dns/pkg/dns/config"
+)
+
+func TestStubDomainRecords(t *testing.T) {
+	kd := newKubeDNS()
+	updates := 0
+	kd.UpdateStubZones = func() { updates++ }
+
+	// The nameservers of the stub domains, derived from the records as the
+	// skydns server does.
+	stubZones := func() map[string][]string {
+		records, err := kd.Records("stub.dns."+testDomain, false)
+		require.NoError(t, err)
+		stubZones := map[string][]string{}
+		for _, record := range records {
+			labels := dns.SplitDomainName(skymsg.Domain(record.Key))
+			domain := dns.Fqdn(strings.Join(labels[1:len(labels)-dns.CountLabel("local.dns."+testDomain)], "."))
+			stubZones[domain] = append(stubZones[domain], net.JoinHostPort(record.Host, strconv.Itoa(record.Port)))
+		}
+		return stubZones
+	}
+	assert.Empty(t, stubZones())
+
+	// Add.
+	kd.updateConfig(&config.Config{StubDomains: map[string][]string{
+		"acme.local":    {"1.2.3.4"},
+		"corp.internal": {"[2001:db8::1]:5353", "ns.corp.internal"},
+	}})
+	assert.Equal(t, 1, updates)
+	assert.Equal(t, map[string][]string{
+		"acme.local.":    {"1.2.3.4:53"},
+		"corp.internal.": {"[2001:db8::1]:5353"},
+	}, stubZones())
+
+	// Update.
+	kd.updateConfig(&config.Config{StubDomains: map[string][]string{
+		"acme.local":    {"1.2.3.5:5353", "1.2.3.6"},
+		"corp.internal": {"[2001:db8::1]:5353"},
+	}})
+	assert.Equal(t, 2, updates)
+	assert.Equal(t, map[string][]string{
+		"acme.local.":    {"1.2.3.5:5353", "1.2.3.6:53"},
+		"corp.internal.": {"[2001:db8::1]:5353"},
+	}, stubZones())
+
+	// Remove.
+	kd.updateConfig(&config.Config{StubDomains: map[string][]string{
+		"corp.internal": {"[2001:db8::1]:5353"},
+	}})
+	assert.Equal(t, 3, updates)
+	assert.Equal(t, map[string][]string{"corp.internal.": {"[2001:db8::1]:5353"}}, stubZones())
+
+	// An invalid configuration is not applied.
+	kd.updateConfig(&config.Config{StubDomains: map[string][]string{"$$$$": {"1.2.3.4"}}})
+	assert.Equal(t, 3, updates)
+	assert.Equal(t, map[string][]string{"corp.internal.": {"[2001:db8::1]:5353"}}, stubZones())
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/klog/v2"
+
+	"k8s.io/dns/pkg/dns/treecache"
+	"k8s.io/dns/pkg/dns/util"
+)
+
+// serviceTransition is the window during which a service that changed
+// between headless and ClusterIP is answered with the A records of both
+// forms: its cluster IPs and the addresses of its endpoints.
+type serviceTransition struct {
+	// clusterIPs are the cluster IPs of the service, before or after the
+	// change.
+	clusterIPs []string
+	timer      clock.Timer
+}
+
+// startServiceTransition starts the transition window of the given service
+// if it changes between headless and ClusterIP and the configuration sets
+// a window. At the end of the window, the records of the service are
+// generated again, without the form it left.
+func (kd *KubeDNS) startServiceTransition(old, new *v1.Service) {
+	window := kd.currentConfig().HeadlessTransitionWindow.Duration
+	if window <= 0 || old.Spec.Type == v1.ServiceTypeExternalName || new.Spec.Type == v1.ServiceTypeExternalName ||
+		util.IsServiceIPSet(old) == util.IsServiceIPSet(new) {
+		return
+	}
+	clusterIPs := util.GetClusterIPs(new)
+	if !util.IsServiceIPSet(new) {
+		clusterIPs = util.GetClusterIPs(old)
+	}
+
+	key := new.Namespace + "/" + new.Name
+	klog.V(2).Infof("Service %s changed between headless and ClusterIP, serving both forms for %v", key, window)
+	transition := &serviceTransition{clusterIPs: clusterIPs}
+	kd.serviceTransitionsLock.Lock()
+	defer kd.serviceTransitionsLock.Unlock()
+	if kd.serviceTransitions == nil {
+		kd.serviceTransitions = make(map[string]*serviceTransition)
+	}
+	if previous, ok := kd.serviceTransitions[key]; ok {
+		previous.timer.Stop()
+	}
+	transition.timer = kd.clock.AfterFunc(window, func() {
+		kd.serviceTransitionsLock.Lock()
+		current, ok := kd.serviceTransitions[key]
+		if ok && current == transition {
+			delete(kd.serviceTransitions, key)
+		}
+		kd.serviceTransitionsLock.Unlock()
+		if !ok || current != transition {
+			return
+		}
+		klog.V(2).Infof("Transition window of service %s ended", key)
+		if obj, exists, err := kd.servicesStore.GetByKey(key); err == nil && exists {
+			// The timer may fire with the lock of the clock held.
+			go kd.newService(obj)
+		}
+	})
+	kd.serviceTransitions[key] = transition
+}
+
+// serviceTransitionIPs returns the cluster IPs of the given service if it
+// is within its transition window.
+func (kd *KubeDNS) serviceTransitionIPs(service *v1.Service) ([]string, bool) {
+	kd.serviceTransitionsLock.Lock()
+	defer kd.serviceTransitionsLock.Unlock()
+	transition, ok := kd.serviceTransitions[service.Namespace+"/"+service.Name]
+	if !ok {
+		return nil, false
+	}
+	return transition.clusterIPs, true
+}
+
+// addTransitionRecords adds to the given subcache of a service within its
+// transition window the A records of the form it doesn't have: the cluster
+// IPs it had for a headless service, and the addresses of its endpoints for
+// a ClusterIP service.
+func (kd *KubeDNS) addTransitionRecords(subCache treecache.TreeCache, service *v1.Service) {
+	clusterIPs, ok := kd.serviceTransitionIPs(service)
+	if !ok {
+		return
+	}
+	if !util.IsServiceIPSet(service) {
+		for _, ip := range clusterIPs {
+			recordValue, recordLabel := kd.getServiceSkyMsg(service, ip, 0)
+			subCache.SetEntry(recordLabel, recordValue, kd.fqdn(service, recordLabel))
+		}
+		return
+	}
+	obj, exists, err := kd.endpointsStore.GetByKey(service.Namespace + "/" + service.Name)
+	if err != nil || !exists {
+		return
+	}
+	e, ok := obj.(*v1.Endpoints)
+	if !ok {
+		return
+	}
+	for idx := range e.Subsets {
+		for subIdx := range e.Subsets[idx].Addresses {
+			address := &e.Subsets[idx].Addresses[subIdx]
+			recordValue, endpointName := kd.getServiceSkyMsg(service, address.IP, 0)
+			if hostLabel, exists := getHostname(address); exists {
+				endpointName = hostLabel
+			}
+			subCache.SetEntry(endpointName, recordValue, kd.fqdn(service, endpointName))
+		}
+	}
+}
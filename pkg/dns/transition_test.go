@@ -0,0 +1,94 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"k8s.io/dns/pkg/dns/config"
+)
+
+func TestHeadlessTransitionWindow(t *testing.T) {
+	kd := newKubeDNS()
+	fakeClock := clock.NewFakeClock(time.Now())
+	kd.clock = fakeClock
+	kd.config = &config.Config{HeadlessTransitionWindow: metav1.Duration{Duration: time.Minute}}
+
+	headless := newHeadlessService()
+	require.NoError(t, kd.servicesStore.Add(headless))
+	endpoints := newEndpoints(headless, newSubsetWithOnePort("http", 80, "10.0.0.1", "10.0.0.2"))
+	require.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(headless)
+	fqdn := getServiceFQDN(kd.domain, headless)
+
+	hosts := func() []string {
+		records, err := kd.Records(fqdn, false)
+		require.NoError(t, err)
+		hosts := []string{}
+		for _, record := range records {
+			if record.Port == 0 {
+				hosts = append(hosts, record.Host)
+			}
+		}
+		sort.Strings(hosts)
+		return hosts
+	}
+	waitForHosts := func(expected ...string) {
+		t.Helper()
+		err := wait.PollImmediate(time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+			return assert.ObjectsAreEqual(expected, hosts()), nil
+		})
+		require.NoError(t, err, "expected %v, got %v", expected, hosts())
+	}
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, hosts())
+
+	// Headless to ClusterIP: both forms are served during the window.
+	clusterIP := headless.DeepCopy()
+	clusterIP.Spec.ClusterIP = "1.2.3.4"
+	clusterIP.Spec.ClusterIPs = []string{"1.2.3.4"}
+	require.NoError(t, kd.servicesStore.Update(clusterIP))
+	kd.updateService(headless, clusterIP)
+	assert.Equal(t, []string{"1.2.3.4", "10.0.0.1", "10.0.0.2"}, hosts())
+
+	fakeClock.Step(59 * time.Second)
+	assert.Equal(t, []string{"1.2.3.4", "10.0.0.1", "10.0.0.2"}, hosts())
+	fakeClock.Step(time.Second)
+	waitForHosts("1.2.3.4")
+
+	// And back: ClusterIP to headless.
+	require.NoError(t, kd.servicesStore.Update(headless))
+	kd.updateService(clusterIP, headless)
+	assert.Equal(t, []string{"1.2.3.4", "10.0.0.1", "10.0.0.2"}, hosts())
+	fakeClock.Step(time.Minute)
+	waitForHosts("10.0.0.1", "10.0.0.2")
+
+	// Without window, the new form replaces the other at once.
+	kd.config = &config.Config{}
+	require.NoError(t, kd.servicesStore.Update(clusterIP))
+	kd.updateService(headless, clusterIP)
+	assert.Equal(t, []string{"1.2.3.4"}, hosts())
+	_, ok := kd.serviceTransitionIPs(clusterIP)
+	assert.False(t, ok)
+}
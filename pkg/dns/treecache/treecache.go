@@ -18,9 +18,13 @@ package treecache
 
 import (
 	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
 	"strings"
 
 	skymsg "github.com/skynetservices/skydns/msg"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 )
 
 type TreeCache interface {
@@ -30,6 +34,19 @@ type TreeCache interface {
 	// Get a list of values including wildcards labels (e.g. "*").
 	GetValuesForPathWithWildcards(path ...string) []*skymsg.Service
 
+	// GetAllValues returns every entry stored in the cache, including the
+	// ones stored under "_" prefixed (SRV) subtrees.
+	GetAllValues() []*skymsg.Service
+
+	// GetAllValuesForPath returns every entry stored under the given
+	// path, including the ones stored under "_" prefixed (SRV) subtrees,
+	// which wildcards don't match.
+	GetAllValuesForPath(path ...string) []*skymsg.Service
+
+	// GetChildKeys returns the sorted names of the child nodes of the
+	// node at the given path.
+	GetChildKeys(path ...string) []string
+
 	// SetEntry creates the entire path if it doesn't already exist in
 	// the cache, then sets the given service record under the given
 	// key. The path this entry would have occupied in an etcd datastore
@@ -37,19 +54,38 @@ type TreeCache interface {
 	// skydns service; this is only required because skydns expects the
 	// service record to contain a key in a specific format (presumably
 	// for legacy compatibility). Note that the fqnd string typically
-	// contains both the key and all elements in the path.
-	SetEntry(key string, val *skymsg.Service, fqdn string, path ...string)
+	// contains both the key and all elements in the path. It returns
+	// whether the entry differs from the one it replaced, if any.
+	SetEntry(key string, val *skymsg.Service, fqdn string, path ...string) bool
 
 	// SetSubCache inserts the given subtree under the given
 	// path:key. Usually the key is the name of a Kubernetes Service,
 	// and the path maps to the cluster subdomains matching the Service.
-	SetSubCache(key string, subCache TreeCache, path ...string)
+	// Any subtree previously stored under path:key is replaced as a
+	// whole, so readers see either the old or the new subtree. It returns
+	// whether the subtree differs from the one it replaced, if any.
+	SetSubCache(key string, subCache TreeCache, path ...string) bool
 
 	// DeletePath removes all entries associated with a given path.
 	DeletePath(path ...string) bool
 
 	// Serialize dumps a JSON representation of the cache.
 	Serialize() (string, error)
+
+	// SerializeBestEffort dumps a JSON representation of the entries of
+	// the cache that can be serialized. The entries that cannot are
+	// skipped, and reported in the returned error along with their path.
+	SerializeBestEffort() (string, error)
+
+	// Copy returns a deep copy of the cache that shares no state with
+	// the original, so it can be used without holding the lock that
+	// guards the original.
+	Copy() TreeCache
+
+	// Compact removes the nodes holding neither entries nor, once
+	// compacted, child nodes, and returns the number of nodes removed.
+	// The entries of the cache are left untouched.
+	Compact() int
 }
 
 type treeCache struct {
@@ -64,6 +100,27 @@ func NewTreeCache() TreeCache {
 	}
 }
 
+// serviceJSON is the JSON representation of a service record, which always
+// includes its TTL, even if 0.
+type serviceJSON struct {
+	*skymsg.Service
+	Ttl uint32 `json:"ttl"`
+}
+
+func (cache *treeCache) MarshalJSON() ([]byte, error) {
+	entries := make(map[string]interface{}, len(cache.Entries))
+	for key, value := range cache.Entries {
+		if service, ok := value.(*skymsg.Service); ok {
+			value = serviceJSON{Service: service, Ttl: service.Ttl}
+		}
+		entries[key] = value
+	}
+	return json.Marshal(struct {
+		ChildNodes map[string]*treeCache
+		Entries    map[string]interface{}
+	}{cache.ChildNodes, entries})
+}
+
 func (cache *treeCache) Serialize() (string, error) {
 	prettyJSON, err := json.MarshalIndent(cache, "", "\t")
 	if err != nil {
@@ -72,7 +129,83 @@ func (cache *treeCache) Serialize() (string, error) {
 	return string(prettyJSON), nil
 }
 
-func (cache *treeCache) SetEntry(key string, val *skymsg.Service, fqdn string, path ...string) {
+func (cache *treeCache) SerializeBestEffort() (string, error) {
+	serializable, errs := cache.serializable(nil)
+	serialized, err := serializable.Serialize()
+	if err != nil {
+		return "", err
+	}
+	return serialized, utilerrors.NewAggregate(errs)
+}
+
+// serializable returns a shallow copy of the cache without the entries that
+// cannot be serialized, along with the errors serializing them.
+func (cache *treeCache) serializable(path []string) (*treeCache, []error) {
+	retval := &treeCache{
+		ChildNodes: make(map[string]*treeCache, len(cache.ChildNodes)),
+		Entries:    make(map[string]interface{}, len(cache.Entries)),
+	}
+	var errs []error
+	for _, key := range sortedKeys(cache.Entries) {
+		value := cache.Entries[key]
+		if _, err := json.Marshal(value); err != nil {
+			errs = append(errs, fmt.Errorf("skipped entry %q: %v", strings.Join(append(path, key), "/"), err))
+			continue
+		}
+		retval.Entries[key] = value
+	}
+	for key, node := range cache.ChildNodes {
+		child, childErrs := node.serializable(append(append([]string{}, path...), key))
+		retval.ChildNodes[key] = child
+		errs = append(errs, childErrs...)
+	}
+	return retval, errs
+}
+
+func sortedKeys(entries map[string]interface{}) []string {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (cache *treeCache) Copy() TreeCache {
+	return cache.copy()
+}
+
+func (cache *treeCache) copy() *treeCache {
+	retval := &treeCache{
+		ChildNodes: make(map[string]*treeCache, len(cache.ChildNodes)),
+		Entries:    make(map[string]interface{}, len(cache.Entries)),
+	}
+	for key, value := range cache.Entries {
+		if service, ok := value.(*skymsg.Service); ok {
+			serviceCopy := *service
+			value = &serviceCopy
+		}
+		retval.Entries[key] = value
+	}
+	for key, node := range cache.ChildNodes {
+		retval.ChildNodes[key] = node.copy()
+	}
+	return retval
+}
+
+func (cache *treeCache) Compact() int {
+	removed := 0
+	for key, node := range cache.ChildNodes {
+		removed += node.Compact()
+		if len(node.ChildNodes) == 0 && len(node.Entries) == 0 {
+			delete(cache.ChildNodes, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (cache *treeCache) SetEntry(key string, val *skymsg.Service, fqdn string, path ...string) bool {
 	// TODO: Consolidate setEntry and setSubCache into a single method with a
 	// type switch.
 	// TODO: Instead of passing the fqdn as an argument, we can reconstruct
@@ -89,7 +222,9 @@ func (cache *treeCache) SetEntry(key string, val *skymsg.Service, fqdn string, p
 	// hostname (as used by petset), this will end up being:
 	// /skydns/local/cluster/svc/svcNS/svcName/pod-hostname
 	val.Key = skymsg.Path(fqdn)
+	previous, ok := node.Entries[key]
 	node.Entries[key] = val
+	return !ok || !reflect.DeepEqual(previous, val)
 }
 
 func (cache *treeCache) getSubCache(path ...string) *treeCache {
@@ -103,9 +238,11 @@ func (cache *treeCache) getSubCache(path ...string) *treeCache {
 	return childCache
 }
 
-func (cache *treeCache) SetSubCache(key string, subCache TreeCache, path ...string) {
+func (cache *treeCache) SetSubCache(key string, subCache TreeCache, path ...string) bool {
 	node := cache.ensureChildNode(path...)
+	previous, ok := node.ChildNodes[key]
 	node.ChildNodes[key] = subCache.(*treeCache)
+	return !ok || !reflect.DeepEqual(previous, node.ChildNodes[key])
 }
 
 func (cache *treeCache) GetEntry(key string, path ...string) (interface{}, bool) {
@@ -169,6 +306,36 @@ func (cache *treeCache) GetValuesForPathWithWildcards(path ...string) []*skymsg.
 	return retval
 }
 
+func (cache *treeCache) GetAllValues() []*skymsg.Service {
+	ref := [][]interface{}{{}}
+	cache.appendValues(true, ref)
+
+	retval := make([]*skymsg.Service, 0, len(ref[0]))
+	for _, val := range ref[0] {
+		retval = append(retval, val.(*skymsg.Service))
+	}
+	return retval
+}
+
+func (cache *treeCache) GetAllValuesForPath(path ...string) []*skymsg.Service {
+	node := cache.getSubCache(path...)
+	if node == nil {
+		return []*skymsg.Service{}
+	}
+	return node.GetAllValues()
+}
+
+func (cache *treeCache) GetChildKeys(path ...string) []string {
+	keys := []string{}
+	if node := cache.getSubCache(path...); node != nil {
+		for key := range node.ChildNodes {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func (cache *treeCache) DeletePath(path ...string) bool {
 	if len(path) == 0 {
 		return false
@@ -17,6 +17,8 @@ limitations under the License.
 package treecache
 
 import (
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/skynetservices/skydns/msg"
@@ -130,6 +132,131 @@ func TestTreeCacheSetSubCache(t *testing.T) {
 	}
 }
 
+func TestTreeCacheSetChanged(t *testing.T) {
+	tc := NewTreeCache()
+	newBranch := func(host string) TreeCache {
+		branch := NewTreeCache()
+		branch.SetEntry("key1", &msg.Service{Host: host}, "key1.p1.p0.", "p2")
+		return branch
+	}
+
+	if !tc.SetSubCache("p1", newBranch("1.2.3.4"), "p0") {
+		t.Errorf("setting a new subtree should change the cache")
+	}
+	if tc.SetSubCache("p1", newBranch("1.2.3.4"), "p0") {
+		t.Errorf("setting an identical subtree should not change the cache")
+	}
+	if !tc.SetSubCache("p1", newBranch("1.2.3.5"), "p0") {
+		t.Errorf("setting a different subtree should change the cache")
+	}
+
+	if !tc.SetEntry("key2", &msg.Service{Host: "a"}, "key2.p0.", "p0") {
+		t.Errorf("setting a new entry should change the cache")
+	}
+	if tc.SetEntry("key2", &msg.Service{Host: "a"}, "key2.p0.", "p0") {
+		t.Errorf("setting an identical entry should not change the cache")
+	}
+	if !tc.SetEntry("key2", &msg.Service{Host: "b"}, "key2.p0.", "p0") {
+		t.Errorf("setting a different entry should change the cache")
+	}
+}
+
+func TestTreeCacheGetAllValues(t *testing.T) {
+	tc := NewTreeCache()
+	tc.SetEntry("key1", &msg.Service{}, "key1.p2.p1.", "p1", "p2")
+	tc.SetEntry("key2", &msg.Service{}, "key2.p3.p1.", "p1", "p3")
+	tc.SetEntry("key3", &msg.Service{}, "key3._p4.p3.p1.", "p1", "p3", "_p4")
+
+	if values := tc.GetAllValues(); len(values) != 3 {
+		t.Errorf("expected 3 values, got %v", len(values))
+	}
+	if values := NewTreeCache().GetAllValues(); len(values) != 0 {
+		t.Errorf("expected no values in an empty cache, got %v", len(values))
+	}
+}
+
+func TestTreeCacheGetAllValuesForPath(t *testing.T) {
+	tc := NewTreeCache()
+	tc.SetEntry("key1", &msg.Service{}, "key1.p2.p1.", "p1", "p2")
+	tc.SetEntry("key2", &msg.Service{}, "key2._p4.p3.p1.", "p1", "p3", "_p4")
+	tc.SetEntry("key3", &msg.Service{}, "key3._p5._p4.p3.p1.", "p1", "p3", "_p4", "_p5")
+
+	if values := tc.GetAllValuesForPath("p1", "p3"); len(values) != 2 {
+		t.Errorf("expected 2 values under p1.p3, got %v", len(values))
+	}
+	if values := tc.GetAllValuesForPath("p1"); len(values) != 3 {
+		t.Errorf("expected 3 values under p1, got %v", len(values))
+	}
+	if values := tc.GetAllValuesForPath("p1", "missing"); len(values) != 0 {
+		t.Errorf("expected no values under a missing path, got %v", len(values))
+	}
+}
+
+func TestTreeCacheGetChildKeys(t *testing.T) {
+	tc := NewTreeCache()
+	tc.SetEntry("key1", &msg.Service{}, "key1.p2.p1.", "p1", "p2")
+	tc.SetEntry("key2", &msg.Service{}, "key2.p0.p1.", "p1", "p0")
+	tc.SetEntry("key3", &msg.Service{}, "key3.p1.", "p1")
+
+	if keys := tc.GetChildKeys("p1"); !reflect.DeepEqual(keys, []string{"p0", "p2"}) {
+		t.Errorf("expected [p0 p2], got %v", keys)
+	}
+	if keys := tc.GetChildKeys("p1", "p2"); len(keys) != 0 {
+		t.Errorf("expected no child keys, got %v", keys)
+	}
+	if keys := tc.GetChildKeys("missing"); len(keys) != 0 {
+		t.Errorf("expected no child keys, got %v", keys)
+	}
+}
+
+func TestTreeCacheCopy(t *testing.T) {
+	tc := NewTreeCache()
+	m := &msg.Service{Host: "1.2.3.4"}
+	tc.SetEntry("key1", m, "key1.p2.p1.", "p1", "p2")
+
+	copied := tc.Copy()
+	m.Host = "5.6.7.8"
+	tc.SetEntry("key2", &msg.Service{}, "key2.p2.p1.", "p1", "p2")
+	tc.DeletePath("p1", "p2")
+
+	entry, ok := copied.GetEntry("key1", "p1", "p2")
+	if !ok {
+		t.Fatalf("should be able to get entry p1.p2.key1 from the copy")
+	}
+	if host := entry.(*msg.Service).Host; host != "1.2.3.4" {
+		t.Errorf("expected host 1.2.3.4, got %q", host)
+	}
+	if _, ok := copied.GetEntry("key2", "p1", "p2"); ok {
+		t.Errorf("entries added after the copy should not be visible in it")
+	}
+}
+
+func TestTreeCacheCompact(t *testing.T) {
+	tc := NewTreeCache()
+	tc.SetEntry("key1", &msg.Service{}, "key1.p2.p1.", "p1", "p2")
+	tc.SetEntry("key2", &msg.Service{}, "key2._p4.p3.p1.", "p1", "p3", "_p4")
+	tc.SetSubCache("p5", NewTreeCache(), "p1", "p3")
+	tc.DeletePath("p1", "p3", "_p4")
+
+	if removed := tc.Compact(); removed != 2 {
+		t.Errorf("expected 2 nodes to be removed, got %v", removed)
+	}
+	if _, ok := tc.GetEntry("key1", "p1", "p2"); !ok {
+		t.Errorf("should be able to get entry p1.p2.key1 after compaction")
+	}
+	if values := tc.GetValuesForPathWithWildcards("p1", "p3"); len(values) != 0 {
+		t.Errorf("expected no values under p1.p3, got %v", values)
+	}
+	if removed := tc.Compact(); removed != 0 {
+		t.Errorf("expected a compacted cache to be left untouched, got %v nodes removed", removed)
+	}
+
+	tc.DeletePath("p1", "p2")
+	if removed := tc.Compact(); removed != 1 {
+		t.Errorf("expected 1 node to be removed, got %v", removed)
+	}
+}
+
 func TestTreeCacheSerialize(t *testing.T) {
 	tc := NewTreeCache()
 	tc.SetEntry("key1", &msg.Service{}, "key1.p2.p1.", "p1", "p2")
@@ -141,7 +268,9 @@ func TestTreeCacheSerialize(t *testing.T) {
 				"p2": {
 					"ChildNodes": {},
 					"Entries": {
-						"key1": {}
+						"key1": {
+							"ttl": 0
+						}
 					}
 				}
 			},
@@ -159,3 +288,32 @@ func TestTreeCacheSerialize(t *testing.T) {
 		t.Errorf("expected %q, got %q", expected, actual)
 	}
 }
+
+func TestTreeCacheSerializeBestEffort(t *testing.T) {
+	tc := NewTreeCache()
+	tc.SetEntry("key1", &msg.Service{Host: "1.2.3.4"}, "key1.p2.p1.", "p1", "p2")
+	tc.SetEntry("key2", &msg.Service{Host: "1.2.3.5"}, "key2.p3.p1.", "p1", "p3")
+	// Entries set through SetEntry always serialize, corrupt one directly.
+	tc.(*treeCache).ChildNodes["p1"].ChildNodes["p3"].Entries["bad"] = make(chan int)
+
+	if _, err := tc.Serialize(); err == nil {
+		t.Fatalf("expected Serialize to fail")
+	}
+	actual, err := tc.SerializeBestEffort()
+	if err == nil || !strings.Contains(err.Error(), `"p1/p3/bad"`) {
+		t.Errorf("expected an error reporting p1/p3/bad, got %v", err)
+	}
+	for _, expected := range []string{`"key1"`, `"key2"`, `"1.2.3.4"`, `"1.2.3.5"`} {
+		if !strings.Contains(actual, expected) {
+			t.Errorf("expected %s in %q", expected, actual)
+		}
+	}
+	if strings.Contains(actual, `"bad"`) {
+		t.Errorf("expected the bad entry to be skipped, got %q", actual)
+	}
+
+	tc.DeletePath("p1", "p3")
+	if _, err := tc.SerializeBestEffort(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/miekg/dns"
 	"github.com/skynetservices/skydns/msg"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/klog/v2"
@@ -31,17 +32,23 @@ import (
 const (
 	// ArpaSuffix is the standard suffix for PTR IP reverse lookups.
 	ArpaSuffix = ".in-addr.arpa."
+	// ArpaSuffixV6 is the standard suffix for PTR IPv6 reverse lookups.
+	ArpaSuffixV6 = ".ip6.arpa."
 	// defaultPriority used for service records
 	defaultPriority = 10
 	// defaultWeight used for service records
 	defaultWeight = 10
-	// defaultTTL used for service records
-	defaultTTL = 30
+	// DefaultTTL used for service records
+	DefaultTTL = 30
 )
 
 // ExtractIP turns a standard PTR reverse record lookup name
-// into an IP address
+// into an IP address. IPv6 addresses are returned in canonical form, e.g.
+// 2001:db8::1.
 func ExtractIP(reverseName string) (string, bool) {
+	if strings.HasSuffix(reverseName, ArpaSuffixV6) {
+		return extractIPv6(strings.TrimSuffix(reverseName, ArpaSuffixV6))
+	}
 	if !strings.HasSuffix(reverseName, ArpaSuffix) {
 		return "", false
 	}
@@ -52,6 +59,30 @@ func ExtractIP(reverseName string) (string, bool) {
 	return strings.Join(segments, "."), true
 }
 
+// extractIPv6 turns the 32 nibbles of an ip6.arpa name, least significant
+// first, into an IPv6 address.
+func extractIPv6(nibbles string) (string, bool) {
+	segments := strings.Split(nibbles, ".")
+	if len(segments) != 2*net.IPv6len {
+		return "", false
+	}
+	ReverseArray(segments)
+	groups := make([]string, 0, net.IPv6len/2)
+	for i := 0; i < len(segments); i += 4 {
+		for _, nibble := range segments[i : i+4] {
+			if len(nibble) != 1 || !strings.Contains("0123456789abcdefABCDEF", nibble) {
+				return "", false
+			}
+		}
+		groups = append(groups, strings.Join(segments[i:i+4], ""))
+	}
+	ip := net.ParseIP(strings.Join(groups, ":"))
+	if ip == nil {
+		return "", false
+	}
+	return ip.String(), true
+}
+
 // ReverseArray reverses an array.
 func ReverseArray(arr []string) []string {
 	for i := 0; i < len(arr)/2; i++ {
@@ -61,6 +92,9 @@ func ReverseArray(arr []string) []string {
 	return arr
 }
 
+// HashFunc computes the label a DNS message is stored under.
+type HashFunc func(msg *msg.Service) string
+
 // Returns record in a format that SkyDNS understands.
 // Also return the hash of the record.
 func GetSkyMsg(ip string, port int) (*msg.Service, string) {
@@ -71,6 +105,15 @@ func GetSkyMsg(ip string, port int) (*msg.Service, string) {
 	return msg, fmt.Sprintf("%x", hash)
 }
 
+// GetSkyMsgWithTTL behaves like GetSkyMsg, but the record is served with
+// the given TTL. The hash is computed with the default TTL, so that the
+// label of a record doesn't change with its TTL.
+func GetSkyMsgWithTTL(ip string, port int, ttl uint32) (*msg.Service, string) {
+	msg, hash := GetSkyMsg(ip, port)
+	msg.Ttl = ttl
+	return msg, hash
+}
+
 // NewServiceRecord creates a new service DNS message.
 func NewServiceRecord(ip string, port int) *msg.Service {
 	return &msg.Service{
@@ -78,12 +121,12 @@ func NewServiceRecord(ip string, port int) *msg.Service {
 		Port:     port,
 		Priority: defaultPriority,
 		Weight:   defaultWeight,
-		Ttl:      defaultTTL,
+		Ttl:      DefaultTTL,
 	}
 }
 
 // HashServiceRecord hashes the string representation of a DNS
-// message.
+// message with FNV-32a.
 func HashServiceRecord(msg *msg.Service) string {
 	s := fmt.Sprintf("%v", msg)
 	h := fnv.New32a()
@@ -93,22 +136,49 @@ func HashServiceRecord(msg *msg.Service) string {
 
 // ValidateNameserverIpAndPort splits and validates ip and port for nameserver.
 // If there is no port in the given address, a default 53 port will be returned.
+// IPv6 addresses are accepted bare, e.g. "2001:db8::1", or in brackets, with
+// or without a port, e.g. "[2001:db8::1]:5353". The ip returned never has
+// brackets, so that it can be joined with the port by net.JoinHostPort.
 func ValidateNameserverIpAndPort(nameServer string) (string, string, error) {
 	if ip := net.ParseIP(nameServer); ip != nil {
 		return ip.String(), "53", nil
 	}
+	if strings.HasPrefix(nameServer, "[") && strings.HasSuffix(nameServer, "]") {
+		if ip := net.ParseIP(nameServer[1 : len(nameServer)-1]); ip != nil && ip.To4() == nil {
+			return ip.String(), "53", nil
+		}
+	}
 
 	host, port, err := net.SplitHostPort(nameServer)
 	if err != nil {
 		return "", "", err
 	}
-	if ip := net.ParseIP(host); ip == nil {
+	ip := net.ParseIP(host)
+	if ip == nil {
 		return "", "", fmt.Errorf("bad IP address: %q", host)
 	}
 	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
 		return "", "", fmt.Errorf("bad port number: %q", port)
 	}
-	return host, port, nil
+	return ip.String(), port, nil
+}
+
+// IPFamily returns the family of the given IP, which tells whether its
+// record answers A or AAAA questions. IPv4-mapped IPv6 addresses, e.g.
+// "::ffff:10.0.0.1", have no family, as they would be answered to A
+// questions although they are written as IPv6 addresses.
+func IPFamily(ip string) (corev1.IPFamily, bool) {
+	parsed := net.ParseIP(ip)
+	switch {
+	case parsed == nil:
+		return "", false
+	case !strings.Contains(ip, ":"):
+		return corev1.IPv4Protocol, true
+	case parsed.To4() == nil:
+		return corev1.IPv6Protocol, true
+	default:
+		return "", false
+	}
 }
 
 // IsServiceIPSet aims to check if the service's ClusterIP is set or not
@@ -124,3 +194,37 @@ func GetClusterIPs(service *corev1.Service) []string {
 	}
 	return []string{service.Spec.ClusterIP}
 }
+
+// ServiceRecordNames returns the names the records of the given service are
+// served under in the given cluster domain with the default configuration:
+// the name of the service, the names of the SRV records of its ports for
+// ClusterIP services, labeled after their number if they are unnamed, and
+// the reverse names of its IPv4 and IPv6 cluster IPs. The names of the
+// endpoints of headless services, and the ones depending on the
+// configuration or on annotations, are not included.
+func ServiceRecordNames(service *corev1.Service, domain string) []string {
+	serviceName := dns.Fqdn(strings.Join([]string{service.Name, service.Namespace, "svc", strings.TrimSuffix(domain, ".")}, "."))
+	names := []string{serviceName}
+	if service.Spec.Type == corev1.ServiceTypeExternalName || !IsServiceIPSet(service) {
+		return names
+	}
+	for _, port := range service.Spec.Ports {
+		switch port.Protocol {
+		case corev1.ProtocolTCP, corev1.ProtocolUDP, corev1.ProtocolSCTP:
+		default:
+			continue
+		}
+		portLabel := port.Name
+		if portLabel == "" {
+			portLabel = strconv.Itoa(int(port.Port))
+		}
+		names = append(names, "_"+portLabel+"._"+strings.ToLower(string(port.Protocol))+"."+serviceName)
+	}
+	for _, ip := range GetClusterIPs(service) {
+		if _, ok := IPFamily(ip); ok {
+			reverseName, _ := dns.ReverseAddr(ip)
+			names = append(names, reverseName)
+		}
+	}
+	return names
+}
@@ -17,7 +17,11 @@ limitations under the License.
 package util
 
 import (
+	"reflect"
 	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestValidateNameserverIpAndPort(t *testing.T) {
@@ -35,6 +39,15 @@ func TestValidateNameserverIpAndPort(t *testing.T) {
 		{wantErr: true, ns: "1.1.1.1:"},
 		{wantErr: true, ns: "invalidip"},
 		{wantErr: true, ns: "invalidip:80"},
+		{ns: "2001:4860:4860::8888", ip: "2001:4860:4860::8888", port: "53"},
+		{ns: "2001:DB8:0::1", ip: "2001:db8::1", port: "53"},
+		{ns: "[2001:db8::1]", ip: "2001:db8::1", port: "53"},
+		{ns: "[2001:db8::1]:5353", ip: "2001:db8::1", port: "5353"},
+		{wantErr: true, ns: "2001:db8::1:5353:"},
+		{wantErr: true, ns: "[2001:db8::1]:"},
+		{wantErr: true, ns: "[2001:db8::1]:abc"},
+		{wantErr: true, ns: "[2001:db8::zz]:53"},
+		{wantErr: true, ns: "[1.2.3.4]"},
 	} {
 		ip, port, err := ValidateNameserverIpAndPort(tc.ns)
 		gotErr := err != nil
@@ -46,3 +59,100 @@ func TestValidateNameserverIpAndPort(t *testing.T) {
 		}
 	}
 }
+
+func TestServiceRecordNames(t *testing.T) {
+	meta := metav1.ObjectMeta{Name: "mysvc", Namespace: "myns"}
+	for _, tc := range []struct {
+		name    string
+		service *corev1.Service
+		want    []string
+	}{
+		{
+			name: "cluster IP",
+			service: &corev1.Service{ObjectMeta: meta, Spec: corev1.ServiceSpec{
+				ClusterIP:  "10.0.0.1",
+				ClusterIPs: []string{"10.0.0.1", "fd00::1"},
+				Ports: []corev1.ServicePort{
+					{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80},
+					{Name: "dns", Protocol: corev1.ProtocolUDP, Port: 53},
+					{Protocol: corev1.ProtocolTCP, Port: 8080},
+				},
+			}},
+			want: []string{
+				"mysvc.myns.svc.cluster.local.",
+				"_http._tcp.mysvc.myns.svc.cluster.local.",
+				"_dns._udp.mysvc.myns.svc.cluster.local.",
+				"_8080._tcp.mysvc.myns.svc.cluster.local.",
+				"1.0.0.10.in-addr.arpa.",
+				"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.",
+			},
+		},
+		{
+			name: "headless",
+			service: &corev1.Service{ObjectMeta: meta, Spec: corev1.ServiceSpec{
+				ClusterIP: corev1.ClusterIPNone,
+				Ports:     []corev1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80}},
+			}},
+			want: []string{"mysvc.myns.svc.cluster.local."},
+		},
+		{
+			name: "ExternalName",
+			service: &corev1.Service{ObjectMeta: meta, Spec: corev1.ServiceSpec{
+				Type:         corev1.ServiceTypeExternalName,
+				ExternalName: "example.com",
+			}},
+			want: []string{"mysvc.myns.svc.cluster.local."},
+		},
+	} {
+		if got := ServiceRecordNames(tc.service, "cluster.local."); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: ServiceRecordNames() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestExtractIP(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ip   string
+		ok   bool
+	}{
+		{name: "4.3.2.1.in-addr.arpa.", ip: "1.2.3.4", ok: true},
+		{name: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", ip: "2001:db8::1", ok: true},
+		{name: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.", ip: "::1", ok: true},
+		{name: "0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.", ip: "::", ok: true},
+		{name: "f.f.f.f.f.f.f.f.f.f.f.f.f.f.f.f.f.f.f.f.f.f.f.f.f.f.f.f.f.f.f.f.ip6.arpa.", ip: "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", ok: true},
+		{name: "4.0.3.0.2.0.1.0.0.0.0.0.0.0.0.0.7.6.5.4.3.2.1.0.8.B.D.0.1.0.0.2.ip6.arpa.", ip: "2001:db8:123:4567::102:304", ok: true},
+		// IPv4-mapped addresses are returned as IPv4 addresses.
+		{name: "4.0.3.0.2.0.1.0.f.f.f.f.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.", ip: "1.2.3.4", ok: true},
+		{name: "8.b.d.0.1.0.0.2.ip6.arpa."},
+		{name: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.0.ip6.arpa."},
+		{name: "10.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."},
+		{name: "g.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."},
+		{name: "example.com."},
+	} {
+		ip, ok := ExtractIP(tc.name)
+		if ip != tc.ip || ok != tc.ok {
+			t.Errorf("ExtractIP(%q) = %q, %v, want %q, %v", tc.name, ip, ok, tc.ip, tc.ok)
+		}
+	}
+}
+
+func TestIPFamily(t *testing.T) {
+	for _, tc := range []struct {
+		ip     string
+		family corev1.IPFamily
+		ok     bool
+	}{
+		{ip: "10.0.0.1", family: corev1.IPv4Protocol, ok: true},
+		{ip: "2001:db8::1", family: corev1.IPv6Protocol, ok: true},
+		{ip: "::1", family: corev1.IPv6Protocol, ok: true},
+		{ip: "::ffff:10.0.0.1"},
+		{ip: "my.host.com"},
+		{ip: ""},
+	} {
+		family, ok := IPFamily(tc.ip)
+		if family != tc.family || ok != tc.ok {
+			t.Errorf("IPFamily(%q) = %q, %v, want %q, %v", tc.ip, family, ok, tc.family, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	skymsg "github.com/skynetservices/skydns/msg"
+)
+
+// reverseZoneOrigin is the $ORIGIN of the reverse section of the zone
+// file. It covers both the in-addr.arpa and ip6.arpa trees.
+const reverseZoneOrigin = "arpa."
+
+// ExportZoneFile renders the records held by KubeDNS in the BIND zone file
+// format. The forward records of the cluster domain are emitted first,
+// followed by the reverse (PTR) records, each section preceded by its own
+// $ORIGIN directive. The SOA record of the cluster domain comes first if
+// the configuration enables it. Owner names are always fully qualified and the records
+// of each section are sorted so that the output can be diffed.
+func (kd *KubeDNS) ExportZoneFile() (string, error) {
+	forward := map[string]bool{}
+	var reverse []string
+
+	kd.cacheLock.RLock()
+	serial := kd.soaSerial
+	for _, val := range kd.cache.GetAllValues() {
+		rrs, err := zoneFileRecords(val)
+		if err != nil {
+			kd.cacheLock.RUnlock()
+			return "", err
+		}
+		for _, rr := range rrs {
+			forward[rr.String()] = true
+		}
+	}
+	for ip, val := range kd.reverseRecordMap {
+		arpa, err := dns.ReverseAddr(ip)
+		if err != nil {
+			kd.cacheLock.RUnlock()
+			return "", fmt.Errorf("invalid reverse record IP %q: %v", ip, err)
+		}
+		reverse = append(reverse, val.NewPTR(arpa, val.Ttl).String())
+	}
+	kd.cacheLock.RUnlock()
+
+	sortedForward := make([]string, 0, len(forward))
+	for rr := range forward {
+		sortedForward = append(sortedForward, rr)
+	}
+	sort.Strings(sortedForward)
+	sort.Strings(reverse)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "$ORIGIN %s\n", dns.Fqdn(kd.domain))
+	if kd.currentConfig().SOARecord {
+		fmt.Fprintln(&b, kd.soa(serial))
+	}
+	for _, rr := range sortedForward {
+		fmt.Fprintln(&b, rr)
+	}
+	fmt.Fprintf(&b, "\n$ORIGIN %s\n", reverseZoneOrigin)
+	for _, rr := range reverse {
+		fmt.Fprintln(&b, rr)
+	}
+	return b.String(), nil
+}
+
+// zoneFileRecords converts a cache entry to the resource records it is
+// served as. Entries with a port are SRV records owned by the entry's parent
+// name (the entry itself is keyed by its target label). Entries holding an
+// IP are A or AAAA records, served both under their own label (the target
+// of SRV records) and under the parent service name. Any other entry is the
+// CNAME of an ExternalName service.
+func zoneFileRecords(val *skymsg.Service) ([]dns.RR, error) {
+	name := skymsg.Domain(val.Key)
+	labels := dns.SplitDomainName(name)
+	if len(labels) < 2 {
+		return nil, fmt.Errorf("invalid record name %q", name)
+	}
+	parent := dns.Fqdn(strings.Join(labels[1:], "."))
+	if val.Port != 0 {
+		return []dns.RR{val.NewSRV(parent, uint16(val.Weight))}, nil
+	}
+
+	ip := net.ParseIP(val.Host)
+	switch {
+	case ip == nil:
+		return []dns.RR{val.NewCNAME(name, dns.Fqdn(val.Host))}, nil
+	case ip.To4() != nil:
+		return []dns.RR{val.NewA(name, ip.To4()), val.NewA(parent, ip.To4())}, nil
+	default:
+		return []dns.RR{val.NewAAAA(name, ip), val.NewAAAA(parent, ip)}, nil
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportZoneFile(t *testing.T) {
+	kd := newKubeDNS()
+
+	portal := newService(testNamespace, "portal", "1.2.3.4", "http", 80)
+	kd.newService(portal)
+
+	dualStack := newService(testNamespace, "dualstack", "1.2.3.5", "", 80)
+	dualStack.Spec.ClusterIPs = []string{"1.2.3.5", "2001:db8::5"}
+	kd.newService(dualStack)
+
+	external := newExternalNameService()
+	kd.newService(external)
+
+	headless := newHeadlessService()
+	headless.Name = "headless"
+	assert.NoError(t, kd.servicesStore.Add(headless))
+	endpoints := newEndpoints(headless, newSubsetWithOnePortWithHostname("https", 443, true, "10.0.0.1"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(headless)
+
+	zone, err := kd.ExportZoneFile()
+	require.NoError(t, err)
+	t.Logf("zone file:\n%s", zone)
+
+	got := map[string]bool{}
+	zp := dns.NewZoneParser(strings.NewReader(zone), "", "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		got[rr.String()] = true
+	}
+	require.NoError(t, zp.Err())
+
+	for _, expected := range []string{
+		"portal.default.svc.cluster.local.\t30\tIN\tA\t1.2.3.4",
+		"_http._tcp.portal.default.svc.cluster.local.\t30\tIN\tSRV\t10 10 80 portal.default.svc.cluster.local.",
+		"4.3.2.1.in-addr.arpa.\t30\tIN\tPTR\tportal.default.svc.cluster.local.",
+		"dualstack.default.svc.cluster.local.\t30\tIN\tA\t1.2.3.5",
+		"dualstack.default.svc.cluster.local.\t30\tIN\tAAAA\t2001:db8::5",
+		"_80._tcp.dualstack.default.svc.cluster.local.\t30\tIN\tSRV\t10 10 80 dualstack.default.svc.cluster.local.",
+		"testservice.default.svc.cluster.local.\t30\tIN\tCNAME\t" + testExternalName + ".",
+		"ep-0.headless.default.svc.cluster.local.\t30\tIN\tA\t10.0.0.1",
+		"_https._tcp.headless.default.svc.cluster.local.\t30\tIN\tSRV\t10 10 443 ep-0.headless.default.svc.cluster.local.",
+		"1.0.0.10.in-addr.arpa.\t30\tIN\tPTR\tep-0.headless.default.svc.cluster.local.",
+	} {
+		assert.True(t, got[expected], "expected %q in zone file", expected)
+	}
+	// Every A/AAAA record is also exported under its own record label.
+	assert.Equal(t, 16, len(got))
+}
+
+func TestExportZoneFileEmpty(t *testing.T) {
+	kd := newKubeDNS()
+
+	zone, err := kd.ExportZoneFile()
+	require.NoError(t, err)
+	assert.Equal(t, "$ORIGIN cluster.local.\n\n$ORIGIN arpa.\n", zone)
+}